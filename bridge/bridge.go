@@ -12,6 +12,7 @@ Package bridge 实现服务端与客户端之间的“桥接”层。
 package bridge
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -20,6 +21,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"ehang.io/nps-mux"
@@ -52,6 +54,10 @@ type Client struct {
 	Version string
 	// 心跳重试计数
 	retryTime int // it will be add 1 when ping not ok until to 3 will close the client
+	// 信令写锁，保证 flag 与其后的内容作为整体写出
+	signalLock sync.Mutex
+	// 客户端是否支持扩展信令（链路探测、管理命令），收到 ping 后置 1，以 atomic 读写
+	signalExt int32
 }
 
 // NewClient 创建一个 Client 聚合对象。
@@ -65,6 +71,26 @@ func NewClient(t, f *nps_mux.Mux, s *conn.Conn, vs string) *Client {
 	}
 }
 
+// writeSignal 向客户端信令连接写入一个 flag 及若干长度前缀的内容。
+// 整条消息先拼装再加锁一次写出，避免多个 goroutine 同时下发时消息交错。
+func (s *Client) writeSignal(flag string, contents ...[]byte) error {
+	raw := bytes.NewBuffer([]byte(flag))
+	for _, c := range contents {
+		b, err := conn.GetLenBytes(c)
+		if err != nil {
+			return err
+		}
+		raw.Write(b)
+	}
+	s.signalLock.Lock()
+	defer s.signalLock.Unlock()
+	if s.signal == nil {
+		return errors.New("the client signal is not connect")
+	}
+	_, err := s.signal.Write(raw.Bytes())
+	return err
+}
+
 // Bridge 是服务端桥接核心对象，负责管理所有客户端的连接与任务。
 // 字段说明：
 // - TunnelPort: 监听的桥接端口（仅用于日志显示，实际端口取自配置）
@@ -77,6 +103,12 @@ func NewClient(t, f *nps_mux.Mux, s *conn.Conn, vs string) *Client {
 // - ipVerify: 是否启用来源 IP 验证
 // - runList: 正在运行的任务列表（通过 sync.Map 共享）
 // - disconnectTime: 复用连接的闲置断开时间，传递给 nps-mux
+// - telemetry: 各客户端上报的链路质量历史，key 为客户端 ID
+// - commands/commandWait: 各客户端的管理命令记录，以及等待结果的命令（key 为请求 ID）
+// - targetDeny: 各客户端因本地目标白名单拒绝的连接统计
+// - outliers: 被动健康检查中各客户端各目标的连续失败与摘除状态
+// - healthStats: 各客户端各目标最近一次主动健康检查的结果
+// - Relay: 集群模式下经其他节点连接客户端的转发函数
 type Bridge struct {
 	TunnelPort     int // 通信隧道端口（日志显示）
 	Client         sync.Map
@@ -89,6 +121,15 @@ type Bridge struct {
 	ipVerify       bool
 	runList        sync.Map // map[int]interface{}
 	disconnectTime int
+	telemetry      sync.Map   // map[int]*telemetryHistory
+	commands       sync.Map   // map[int]*commandHistory
+	commandWait    sync.Map   // map[string]chan *conn.CommandResult
+	targetDeny     sync.Map   // map[int]*TargetDeny
+	outliers       sync.Map   // map[targetKey]*outlier
+	outlierPrune   pruneState // 上次清理被动健康检查状态的时间
+	healthStats    sync.Map   // map[healthKey]*file.HealthStat
+	// Relay 集群模式下，为未连接到本节点的客户端经其他节点建立连接
+	Relay func(clientId int, link *conn.Link, t *file.Tunnel) (net.Conn, error)
 }
 
 // NewTunnel 创建 Bridge，并初始化内部通道与参数。
@@ -136,24 +177,34 @@ func (s *Bridge) StartTunnel() error {
 // GetHealthFromClient 持续读取客户端的健康上报信息，并动态维护后端目标可用性。
 // - 当 status=false 时，表示目标探测失败：从 TargetArr 中移除，并记录到 HealthRemoveArr。
 // - 当 status=true 时，表示目标恢复可用：从 HealthRemoveArr 移除并重新加入 TargetArr。
+// - 当 info 为 MSG_PING/MSG_TELEMETRY 时，为链路探测与遥测消息，分别回写 pong 与记录历史。
+// - 当 info 为 MSG_CMD_RESULT 时，为管理命令的执行结果。
+// - 当 info 为 MSG_TARGET_DENY 时，为客户端本地目标白名单拒绝的连接。
+// - 当 info 为 MSG_TARGET_DIAL 时，为客户端拨号目标的结果，用于被动健康检查。
+// - 当 info 为 MSG_HEALTH_RESULT 时，为客户端对目标主动健康检查的结果。
 // - 该方法在连接终止后会调用 DelClient 进行清理。
 func (s *Bridge) GetHealthFromClient(id int, c *conn.Conn) {
 	for {
-		if info, status, err := c.GetHealthInfo(); err != nil {
+		if info, status, payload, err := c.GetSignalInfo(); err != nil {
 			break
+		} else if info == common.MSG_PING {
+			s.pong(id, payload)
+		} else if info == common.MSG_TELEMETRY {
+			s.dealTelemetry(id, payload)
+		} else if info == common.MSG_CMD_RESULT {
+			s.dealCommandResult(id, payload)
+		} else if info == common.MSG_TARGET_DENY {
+			s.dealTargetDeny(id, payload)
+		} else if info == common.MSG_TARGET_DIAL {
+			s.dealTargetDial(id, payload)
+		} else if info == common.MSG_HEALTH_RESULT {
+			s.dealHealthResult(id, payload)
 		} else if !status { //the status is true , return target to the targetArr
 			file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
 				v := value.(*file.Tunnel)
 				if v.Client.Id == id && v.Mode == "tcp" && strings.Contains(v.Target.TargetStr, info) {
 					v.Lock()
-					if v.Target.TargetArr == nil || (len(v.Target.TargetArr) == 0 && len(v.HealthRemoveArr) == 0) {
-						v.Target.TargetArr = common.TrimArr(strings.Split(v.Target.TargetStr, "\n"))
-					}
-					v.Target.TargetArr = common.RemoveArrVal(v.Target.TargetArr, info)
-					if v.HealthRemoveArr == nil {
-						v.HealthRemoveArr = make([]string, 0)
-					}
-					v.HealthRemoveArr = append(v.HealthRemoveArr, info)
+					v.HealthRemove(v.Target, info)
 					v.Unlock()
 				}
 				return true
@@ -162,14 +213,7 @@ func (s *Bridge) GetHealthFromClient(id int, c *conn.Conn) {
 				v := value.(*file.Host)
 				if v.Client.Id == id && strings.Contains(v.Target.TargetStr, info) {
 					v.Lock()
-					if v.Target.TargetArr == nil || (len(v.Target.TargetArr) == 0 && len(v.HealthRemoveArr) == 0) {
-						v.Target.TargetArr = common.TrimArr(strings.Split(v.Target.TargetStr, "\n"))
-					}
-					v.Target.TargetArr = common.RemoveArrVal(v.Target.TargetArr, info)
-					if v.HealthRemoveArr == nil {
-						v.HealthRemoveArr = make([]string, 0)
-					}
-					v.HealthRemoveArr = append(v.HealthRemoveArr, info)
+					v.HealthRemove(v.Target, info)
 					v.Unlock()
 				}
 				return true
@@ -177,10 +221,9 @@ func (s *Bridge) GetHealthFromClient(id int, c *conn.Conn) {
 		} else { //the status is false,remove target from the targetArr
 			file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
 				v := value.(*file.Tunnel)
-				if v.Client.Id == id && v.Mode == "tcp" && common.IsArrContains(v.HealthRemoveArr, info) && !common.IsArrContains(v.Target.TargetArr, info) {
+				if v.Client.Id == id && v.Mode == "tcp" {
 					v.Lock()
-					v.Target.TargetArr = append(v.Target.TargetArr, info)
-					v.HealthRemoveArr = common.RemoveArrVal(v.HealthRemoveArr, info)
+					v.HealthRestore(v.Target, info)
 					v.Unlock()
 				}
 				return true
@@ -188,10 +231,9 @@ func (s *Bridge) GetHealthFromClient(id int, c *conn.Conn) {
 
 			file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
 				v := value.(*file.Host)
-				if v.Client.Id == id && common.IsArrContains(v.HealthRemoveArr, info) && !common.IsArrContains(v.Target.TargetArr, info) {
+				if v.Client.Id == id {
 					v.Lock()
-					v.Target.TargetArr = append(v.Target.TargetArr, info)
-					v.HealthRemoveArr = common.RemoveArrVal(v.HealthRemoveArr, info)
+					v.HealthRestore(v.Target, info)
 					v.Unlock()
 				}
 				return true
@@ -302,18 +344,17 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 			c.Close()
 			return
 		}
-		tcpConn, ok := c.Conn.(*net.TCPConn)
-		if ok {
-			// add tcp keep alive option for signal connection
-			_ = tcpConn.SetKeepAlive(true)
-			_ = tcpConn.SetKeepAlivePeriod(5 * time.Second)
-		}
+		// add tcp keep alive option for signal connection, also behind a trusted load balancer
+		c.SetKeepAlive(5 * time.Second)
 		//the vKey connect by another ,close the client of before
 		if v, ok := s.Client.LoadOrStore(id, NewClient(nil, nil, c, vs)); ok {
+			v.(*Client).signalLock.Lock()
 			if v.(*Client).signal != nil {
 				v.(*Client).signal.WriteClose()
 			}
 			v.(*Client).signal = c
+			atomic.StoreInt32(&v.(*Client).signalExt, 0)
+			v.(*Client).signalLock.Unlock()
 			v.(*Client).Version = vs
 		}
 		go s.GetHealthFromClient(id, c)
@@ -355,14 +396,11 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 				return
 			} else {
 				//向密钥对应的客户端发送与服务端udp建立连接信息，地址，密钥
-				v.(*Client).signal.Write([]byte(common.NEW_UDP_CONN))
 				svrAddr := beego.AppConfig.String("p2p_ip") + ":" + beego.AppConfig.String("p2p_port")
-				if err != nil {
-					logs.Warn("get local udp addr error")
+				if err := v.(*Client).writeSignal(common.NEW_UDP_CONN, []byte(svrAddr), b); err != nil {
+					logs.Warn("send p2p info to client error", err.Error())
 					return
 				}
-				v.(*Client).signal.WriteLenContent([]byte(svrAddr))
-				v.(*Client).signal.WriteLenContent(b)
 				//向该请求者发送建立连接请求,服务器地址
 				c.WriteLenContent([]byte(svrAddr))
 			}
@@ -386,11 +424,27 @@ func (s *Bridge) register(c *conn.Conn) {
 // - 若 link.LocalProxy=true，直接在本地拨号到 link.Host；
 // - 否则通过对应客户端的复用隧道建立一条新连接，并发送 Link 元信息；
 // - 当 t.Mode=="file" 时，禁用加密与压缩，以优化文件传输；
-// - 如启用了 IP 白名单验证，将校验请求来源的 RemoteAddr 是否在有效期内。
+// - 如启用了 IP 白名单验证，将校验请求来源的 RemoteAddr 是否在有效期内；
+// - 客户端未连接到本节点且设置了 Relay 时，交由 Relay 经集群中持有该客户端的节点建立连接。
 func (s *Bridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (target net.Conn, err error) {
+	if _, ok := s.Client.Load(clientId); !ok && !link.LocalProxy && s.Relay != nil {
+		return s.Relay(clientId, link, t)
+	}
+	return s.SendLocalLinkInfo(clientId, link, t)
+}
+
+// SendLocalLinkInfo 与 SendLinkInfo 相同，但只使用连接到本节点的客户端，用于处理其他集群节点转发来的连接。
+func (s *Bridge) SendLocalLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (target net.Conn, err error) {
 	//if the proxy type is local
 	if link.LocalProxy {
-		target, err = net.Dial("tcp", link.Host)
+		addr := link.Host
+		if link.Option.DialAddr != "" {
+			addr = link.Option.DialAddr
+		}
+		target, err = net.Dial("tcp", addr)
+		if link.Option.FixedTarget {
+			s.targetDialed(clientId, link.Host, err)
+		}
 		return
 	}
 	if v, ok := s.Client.Load(clientId); ok {
@@ -537,6 +591,41 @@ loop:
 			if h.Location == "" {
 				h.Location = "/"
 			}
+			// 认证用户的明文密码以 bcrypt 哈希保存
+			if err := h.SetAuth(h.AuthUsers, h.AuthTokens, h.AuthBypass, h.AuthCookieHours); err != nil {
+				logs.Warn("client %d host %s, %s", client.Id, h.Host, err.Error())
+				fail = true
+				c.WriteAddFail()
+				break loop
+			}
+			if h.IpAcl != nil {
+				if h.IpAcl, err = file.NewIpAcl(h.IpAcl.Allow, h.IpAcl.Deny); err != nil {
+					logs.Warn("client %d host %s, %s", client.Id, h.Host, err.Error())
+					fail = true
+					c.WriteAddFail()
+					break loop
+				}
+			}
+			if h.RateLimit != nil {
+				if h.RateLimit, err = file.NewRateLimit(h.RateLimit.Rate, h.RateLimit.Burst, h.RateLimit.BanSeconds); err != nil {
+					logs.Warn("client %d host %s, %s", client.Id, h.Host, err.Error())
+					fail = true
+					c.WriteAddFail()
+					break loop
+				}
+			}
+			if err := file.CheckForwardAuth(h.ForwardAuth, h.AuthRespHeaders, beego.AppConfig.String("forward_auth_allow"), false); err != nil {
+				logs.Warn("client %d host %s, %s", client.Id, h.Host, err.Error())
+				fail = true
+				c.WriteAddFail()
+				break loop
+			}
+			if err := conn.CheckProxyProtocol(h.ProxyProtocol); err != nil {
+				logs.Warn("client %d host %s, %s", client.Id, h.Host, err.Error())
+				fail = true
+				c.WriteAddFail()
+				break loop
+			}
 			if !client.HasHost(h) {
 				if file.GetDb().IsHostExist(h) {
 					fail = true
@@ -569,6 +658,32 @@ loop:
 					c.WriteAddFail()
 					break loop
 				}
+				var allow, deny string
+				if t.IpAcl != nil {
+					allow, deny = t.IpAcl.Allow, t.IpAcl.Deny
+				}
+				if _, err := file.NewIpAcl(allow, deny); err != nil {
+					logs.Warn("client %d task %s, %s", client.Id, t.Remark, err.Error())
+					fail = true
+					c.WriteAddFail()
+					break loop
+				}
+				limit := new(file.RateLimit)
+				if t.RateLimit != nil {
+					limit = t.RateLimit
+				}
+				if _, err := file.NewRateLimit(limit.Rate, limit.Burst, limit.BanSeconds); err != nil {
+					logs.Warn("client %d task %s, %s", client.Id, t.Remark, err.Error())
+					fail = true
+					c.WriteAddFail()
+					break loop
+				}
+				if err := conn.CheckProxyProtocol(t.ProxyProtocol); err != nil {
+					logs.Warn("client %d task %s, %s", client.Id, t.Remark, err.Error())
+					fail = true
+					c.WriteAddFail()
+					break loop
+				}
 				for i := 0; i < len(ports); i++ {
 					tl := new(file.Tunnel)
 					tl.Mode = t.Mode
@@ -594,7 +709,11 @@ loop:
 					tl.Password = t.Password
 					tl.LocalPath = t.LocalPath
 					tl.StripPre = t.StripPre
+					tl.SniHost = t.SniHost
 					tl.MultiAccount = t.MultiAccount
+					tl.IpAcl, _ = file.NewIpAcl(allow, deny) // 每个隧道单独计数
+					tl.RateLimit, _ = file.NewRateLimit(limit.Rate, limit.Burst, limit.BanSeconds)
+					tl.ProxyProtocol = t.ProxyProtocol
 					if !client.HasTunnel(tl) {
 						if err := file.GetDb().NewTask(tl); err != nil {
 							logs.Notice("Add task error ", err.Error())
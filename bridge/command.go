@@ -0,0 +1,142 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+// 每个客户端保留的命令记录条数
+const commandHistoryLen = 50
+
+// CommandRecord 记录一条下发给客户端的管理命令及其执行结果。
+// Status 取值：pending（等待结果）、success、fail、timeout。
+type CommandRecord struct {
+	Id        string
+	ClientId  int
+	Name      string
+	Args      string
+	Status    string
+	Result    string
+	StartTime int64
+	EndTime   int64
+}
+
+// commandHistory 保存单个客户端最近的命令记录。
+type commandHistory struct {
+	records []*CommandRecord
+	sync.RWMutex
+}
+
+// SendCommand 通过信令连接向客户端下发一条管理命令，并阻塞等待结果直至超时。
+// 命令使用客户端验证密钥签名，仅支持扩展信令（已上报链路探测）的客户端。
+// 返回的记录同时保存在该客户端的命令历史中。
+func (s *Bridge) SendCommand(clientId int, name, args string, timeout int) (*CommandRecord, error) {
+	v, ok := s.Client.Load(clientId)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("the client %d is not connect", clientId))
+	}
+	if atomic.LoadInt32(&v.(*Client).signalExt) == 0 {
+		return nil, errors.New("the client does not support remote command or is not ready")
+	}
+	client, err := file.GetDb().GetClient(clientId)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = 10
+	}
+	cmd := conn.NewCommand(name, args, timeout, client.VerifyKey)
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	record := &CommandRecord{
+		Id:        cmd.Id,
+		ClientId:  clientId,
+		Name:      name,
+		Args:      args,
+		Status:    "pending",
+		StartTime: time.Now().Unix(),
+	}
+	s.addCommandRecord(clientId, record)
+	ch := make(chan *conn.CommandResult, 1)
+	s.commandWait.Store(cmd.Id, ch)
+	defer s.commandWait.Delete(cmd.Id)
+	if err = v.(*Client).writeSignal(common.NEW_COMMAND, b); err != nil {
+		s.finishCommand(record, "fail", err.Error())
+		return record, nil
+	}
+	select {
+	case res := <-ch:
+		if res.Success {
+			s.finishCommand(record, "success", res.Result)
+		} else {
+			s.finishCommand(record, "fail", res.Result)
+		}
+	case <-time.After(time.Duration(timeout) * time.Second):
+		s.finishCommand(record, "timeout", "")
+	}
+	return record, nil
+}
+
+// dealCommandResult 将客户端回传的命令结果交给等待中的 SendCommand。
+func (s *Bridge) dealCommandResult(id int, payload []byte) {
+	res := new(conn.CommandResult)
+	if err := json.Unmarshal(payload, res); err != nil {
+		logs.Warn("clientId %d command result error %s", id, err.Error())
+		return
+	}
+	if v, ok := s.commandWait.Load(res.Id); ok {
+		select {
+		case v.(chan *conn.CommandResult) <- res:
+		default:
+		}
+	}
+}
+
+// finishCommand 在记录所属客户端的锁保护下写入命令的最终状态。
+func (s *Bridge) finishCommand(record *CommandRecord, status, result string) {
+	if v, ok := s.commands.Load(record.ClientId); ok {
+		h := v.(*commandHistory)
+		h.Lock()
+		defer h.Unlock()
+	}
+	record.Status = status
+	record.Result = result
+	record.EndTime = time.Now().Unix()
+}
+
+// addCommandRecord 追加一条命令记录，超出长度的旧记录会被丢弃。
+func (s *Bridge) addCommandRecord(clientId int, record *CommandRecord) {
+	v, _ := s.commands.LoadOrStore(clientId, new(commandHistory))
+	h := v.(*commandHistory)
+	h.Lock()
+	h.records = append(h.records, record)
+	if len(h.records) > commandHistoryLen {
+		h.records = h.records[len(h.records)-commandHistoryLen:]
+	}
+	h.Unlock()
+}
+
+// GetCommands 返回指定客户端的命令记录（按下发先后排列）的副本。
+func (s *Bridge) GetCommands(clientId int) []CommandRecord {
+	list := make([]CommandRecord, 0)
+	if v, ok := s.commands.Load(clientId); ok {
+		h := v.(*commandHistory)
+		h.RLock()
+		defer h.RUnlock()
+		for _, r := range h.records {
+			list = append(list, *r)
+		}
+	}
+	return list
+}
@@ -0,0 +1,43 @@
+package bridge
+
+import (
+	"encoding/json"
+	"sync"
+
+	"ehang.io/nps/lib/conn"
+	"github.com/astaxie/beego/logs"
+)
+
+// TargetDeny 统计单个客户端因本地目标白名单拒绝的连接
+type TargetDeny struct {
+	Num  int64         // 累计拒绝次数
+	Last conn.LinkDeny // 最近一次拒绝
+	sync.RWMutex
+}
+
+// dealTargetDeny 记录客户端上报的目标拒绝事件，与普通的拨号失败区分开
+func (s *Bridge) dealTargetDeny(id int, payload []byte) {
+	d := new(conn.LinkDeny)
+	if err := json.Unmarshal(payload, d); err != nil {
+		logs.Warn("clientId %d target deny data error %s", id, err.Error())
+		return
+	}
+	logs.Warn("clientId %d rejected %s connection to %s from %s, %s", id, d.ConnType, d.Host, d.RemoteAddr, d.Reason)
+	v, _ := s.targetDeny.LoadOrStore(id, new(TargetDeny))
+	t := v.(*TargetDeny)
+	t.Lock()
+	t.Num++
+	t.Last = *d
+	t.Unlock()
+}
+
+// GetTargetDeny 返回指定客户端的目标拒绝次数与最近一次拒绝，未发生时 ok 为 false
+func (s *Bridge) GetTargetDeny(id int) (num int64, last conn.LinkDeny, ok bool) {
+	if v, exist := s.targetDeny.Load(id); exist {
+		t := v.(*TargetDeny)
+		t.RLock()
+		defer t.RUnlock()
+		return t.Num, t.Last, true
+	}
+	return
+}
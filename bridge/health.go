@@ -0,0 +1,38 @@
+package bridge
+
+import (
+	"encoding/json"
+
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+// dealHealthResult 记录客户端上报的目标主动健康检查结果
+func (s *Bridge) dealHealthResult(id int, payload []byte) {
+	h := new(file.HealthStat)
+	if err := json.Unmarshal(payload, h); err != nil {
+		logs.Warn("clientId %d health check result data error %s", id, err.Error())
+		return
+	}
+	s.SetHealthStat(id, "", h)
+}
+
+// healthKey 一个目标主动健康检查结果的 key，owner 为 nps 检查本地代理目标时所属的隧道或域名解析，
+// 指向同一目标的隧道与域名解析的结果互不覆盖，npc 上报的结果 owner 为空
+type healthKey struct {
+	targetKey
+	owner string
+}
+
+// SetHealthStat 记录客户端的目标最近一次主动健康检查的结果，也用于 nps 对本地代理目标的检查
+func (s *Bridge) SetHealthStat(id int, owner string, h *file.HealthStat) {
+	s.healthStats.Store(healthKey{targetKey{id, h.Target}, owner}, h)
+}
+
+// GetHealthStat 返回指定客户端的目标最近一次主动健康检查的结果，未检查时返回 nil
+func (s *Bridge) GetHealthStat(id int, owner, addr string) *file.HealthStat {
+	if v, ok := s.healthStats.Load(healthKey{targetKey{id, addr}, owner}); ok {
+		return v.(*file.HealthStat)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package bridge
+
+import (
+	"testing"
+
+	"ehang.io/nps/lib/file"
+)
+
+// TestHealthStat 测试指向同一目标的隧道、域名解析与 npc 上报的检查结果互不覆盖
+func TestHealthStat(t *testing.T) {
+	s := new(Bridge)
+	s.dealHealthResult(1, []byte(`{"Target":"10.0.0.1:80","Ok":true}`))
+	s.SetHealthStat(1, "tunnel:1", &file.HealthStat{Target: "10.0.0.1:80", Error: "tunnel"})
+	s.SetHealthStat(1, "host:1", &file.HealthStat{Target: "10.0.0.1:80", Error: "host"})
+	if h := s.GetHealthStat(1, "", "10.0.0.1:80"); h == nil || !h.Ok {
+		t.Fatalf("result reported by npc is overwritten, got %v", h)
+	}
+	for _, owner := range []string{"tunnel", "host"} {
+		if h := s.GetHealthStat(1, owner+":1", "10.0.0.1:80"); h == nil || h.Error != owner {
+			t.Fatalf("result of the %s is overwritten, got %v", owner, h)
+		}
+	}
+	if s.GetHealthStat(2, "", "10.0.0.1:80") != nil || s.GetHealthStat(1, "tunnel:2", "10.0.0.1:80") != nil {
+		t.Fatal("result of another client or tunnel is returned")
+	}
+}
@@ -0,0 +1,170 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// 被动健康检查：根据实际转发中拨号目标的结果（npc 以 MSG_TARGET_DIAL 上报，本地代理时为 nps 自己拨号的结果），
+// 同一客户端的同一目标连续失败 outlier_fail_num 次后，从该客户端使用此目标的隧道与域名解析中摘除，
+// outlier_eject_time 秒后放回重试；放回后再次被摘除时摘除时间加倍，最长 outlier_max_eject_time 秒，拨号成功后清零。
+// 目标是唯一可用的目标时不摘除；已被主动健康检查移除的目标到期后不放回，由主动健康检查恢复。
+// 未处于摘除中且超过 outlierIdle 没有拨号结果的状态会被清理，避免已删除的目标或客户端的状态一直保留。
+
+// maxEjectShift 摘除时间加倍的次数上限，避免移位溢出
+const maxEjectShift = 16
+
+// outlierIdle 被动健康检查状态的闲置清理时间，清理最多每 outlierIdle 执行一次
+const outlierIdle = 10 * time.Minute
+
+// outlier 一个客户端的一个目标的被动健康检查状态
+type outlier struct {
+	fails   int       // 连续失败次数
+	ejects  int       // 连续被摘除的次数，决定摘除时间
+	ejected bool      // 是否处于摘除中
+	last    time.Time // 最近一次拨号结果的时间
+	sync.Mutex
+}
+
+// pruneState 上次清理被动健康检查状态的时间
+type pruneState struct {
+	last time.Time
+	sync.Mutex
+}
+
+// targetKey 一个客户端的一个目标，用作被动健康检查状态与主动健康检查结果的 key
+type targetKey struct {
+	clientId int
+	addr     string
+}
+
+// outlierConfig 读取被动健康检查的配置，failNum 不大于 0 时不启用
+func outlierConfig() (failNum int, ejectTime, maxEjectTime time.Duration) {
+	failNum = beego.AppConfig.DefaultInt("outlier_fail_num", 3)
+	ejectTime = time.Duration(beego.AppConfig.DefaultInt("outlier_eject_time", 30)) * time.Second
+	maxEjectTime = time.Duration(beego.AppConfig.DefaultInt("outlier_max_eject_time", 300)) * time.Second
+	return
+}
+
+// dealTargetDial 处理客户端上报的拨号结果
+func (s *Bridge) dealTargetDial(id int, payload []byte) {
+	d := new(conn.LinkDial)
+	if err := json.Unmarshal(payload, d); err != nil {
+		logs.Warn("clientId %d dial result data error %s", id, err.Error())
+		return
+	}
+	if d.Ok {
+		s.targetDialed(id, d.Host, nil)
+	} else {
+		s.targetDialed(id, d.Host, errors.New(d.Reason))
+	}
+}
+
+// targetDialed 记录一次拨号目标的结果，err 为 nil 表示成功，连续失败达到次数时摘除目标
+func (s *Bridge) targetDialed(id int, addr string, err error) {
+	failNum, ejectTime, maxEjectTime := outlierConfig()
+	if failNum <= 0 {
+		return
+	}
+	now := time.Now()
+	s.pruneOutliers(now)
+	key := targetKey{id, addr}
+	if err == nil {
+		if v, ok := s.outliers.Load(key); ok {
+			o := v.(*outlier)
+			o.Lock()
+			o.fails, o.ejects, o.last = 0, 0, now
+			o.Unlock()
+		}
+		return
+	}
+	v, _ := s.outliers.LoadOrStore(key, new(outlier))
+	o := v.(*outlier)
+	o.Lock()
+	defer o.Unlock()
+	o.last = now
+	if o.fails++; o.ejected || o.fails < failNum {
+		return
+	}
+	//the only available target is kept, try again on the next failure
+	if !s.setTargetOnline(id, addr, false) {
+		return
+	}
+	d := ejectTime << uint(o.ejects)
+	if d > maxEjectTime {
+		d = maxEjectTime
+	}
+	if o.ejects < maxEjectShift {
+		o.ejects++
+	}
+	o.fails, o.ejected = 0, true
+	logs.Warn("clientId %d target %s is ejected for %s after %d consecutive dial failures, last error %s", id, addr, d, failNum, err.Error())
+	time.AfterFunc(d, func() {
+		o.Lock()
+		o.ejected = false
+		o.Unlock()
+		if s.setTargetOnline(id, addr, true) {
+			logs.Info("clientId %d target %s is returned after ejection", id, addr)
+		}
+	})
+}
+
+// pruneOutliers 清理未处于摘除中且闲置超过 outlierIdle 的状态，距上次清理不足 outlierIdle 时直接返回
+func (s *Bridge) pruneOutliers(now time.Time) {
+	s.outlierPrune.Lock()
+	if now.Sub(s.outlierPrune.last) < outlierIdle {
+		s.outlierPrune.Unlock()
+		return
+	}
+	s.outlierPrune.last = now
+	s.outlierPrune.Unlock()
+	s.outliers.Range(func(key, value interface{}) bool {
+		o := value.(*outlier)
+		o.Lock()
+		if !o.ejected && now.Sub(o.last) > outlierIdle {
+			s.outliers.Delete(key)
+		}
+		o.Unlock()
+		return true
+	})
+}
+
+// setTargetOnline 在客户端使用该目标的隧道与域名解析中摘除或放回目标，返回是否有变化
+func (s *Bridge) setTargetOnline(id int, addr string, online bool) (changed bool) {
+	change := func(t *file.Target, healthRemoved bool) {
+		if online && !healthRemoved && t.RestoreTarget(addr) {
+			changed = true
+		} else if !online && t.EjectTarget(addr) {
+			changed = true
+		}
+	}
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.Client != nil && v.Client.Id == id && v.Target != nil {
+			v.RLock()
+			removed := common.IsArrContains(v.HealthRemoveArr, addr)
+			v.RUnlock()
+			change(v.Target, removed)
+		}
+		return true
+	})
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		v := value.(*file.Host)
+		if v.Client != nil && v.Client.Id == id && v.Target != nil {
+			v.RLock()
+			removed := common.IsArrContains(v.HealthRemoveArr, addr)
+			v.RUnlock()
+			change(v.Target, removed)
+		}
+		return true
+	})
+	return
+}
@@ -0,0 +1,122 @@
+package bridge
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+)
+
+// newOutlierTask 在内存中添加一个客户端为 id、目标为 targets 的隧道
+func newOutlierTask(t *testing.T, id int, targets string) *file.Tunnel {
+	dir := filepath.Join(common.GetRunPath(), "conf")
+	os.MkdirAll(dir, 0755)
+	for _, name := range []string{"clients.json", "tasks.json", "hosts.json"} {
+		if p := filepath.Join(dir, name); !common.FileExists(p) {
+			if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	task := &file.Tunnel{
+		Id:     id,
+		Client: &file.Client{Id: id, Cnf: new(file.Config), Flow: new(file.Flow)},
+		Flow:   new(file.Flow),
+		Target: &file.Target{TargetStr: targets},
+	}
+	file.GetDb().JsonDb.Tasks.Store(id, task)
+	t.Cleanup(func() { file.GetDb().JsonDb.Tasks.Delete(id) })
+	return task
+}
+
+// online 返回目标 addr 是否在当前可用的目标中
+func online(task *file.Tunnel, addr string) bool {
+	for _, v := range task.Target.Stats() {
+		if v.Addr == addr {
+			return v.Online
+		}
+	}
+	return false
+}
+
+// TestTargetDialed 测试被动健康检查：连续失败后摘除、到期放回、只记录固定目标，以及闲置状态的清理
+func TestTargetDialed(t *testing.T) {
+	beego.AppConfig.Set("outlier_fail_num", "2")
+	beego.AppConfig.Set("outlier_eject_time", "1")
+	t.Cleanup(func() {
+		beego.AppConfig.Set("outlier_fail_num", "3")
+		beego.AppConfig.Set("outlier_eject_time", "30")
+	})
+	const id = 1 << 30
+	task := newOutlierTask(t, id, "127.0.0.1:1\n127.0.0.1:2")
+	s := new(Bridge)
+	fail := errors.New("connection refused")
+
+	s.targetDialed(id, "127.0.0.1:1", fail)
+	s.targetDialed(id, "127.0.0.1:1", nil)
+	s.targetDialed(id, "127.0.0.1:1", fail)
+	if !online(task, "127.0.0.1:1") {
+		t.Fatal("target ejected although the failures were not consecutive")
+	}
+	s.targetDialed(id, "127.0.0.1:1", fail)
+	if online(task, "127.0.0.1:1") {
+		t.Fatal("target not ejected after consecutive failures")
+	}
+	//the only available target is kept
+	s.targetDialed(id, "127.0.0.1:2", fail)
+	s.targetDialed(id, "127.0.0.1:2", fail)
+	if !online(task, "127.0.0.1:2") {
+		t.Fatal("the only available target is ejected")
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for !online(task, "127.0.0.1:1") {
+		if time.Now().After(deadline) {
+			t.Fatal("target not returned after the eject time")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	//visitor-chosen targets such as socks5 destinations are not recorded
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	s = new(Bridge)
+	if _, err = s.SendLocalLinkInfo(id, conn.NewLink(common.CONN_TCP, addr, false, false, "", true), nil); err == nil {
+		t.Fatal("dial to a closed port succeeded")
+	}
+	if _, ok := s.outliers.Load(targetKey{id, addr}); ok {
+		t.Fatal("dial to a visitor-chosen target is recorded")
+	}
+	s.SendLocalLinkInfo(id, conn.NewLink(common.CONN_TCP, addr, false, false, "", true, conn.LinkFixedTarget()), nil)
+	if _, ok := s.outliers.Load(targetKey{id, addr}); !ok {
+		t.Fatal("dial to a fixed target is not recorded")
+	}
+
+	//idle state is pruned, ejected state is kept
+	ejected := &outlier{ejected: true}
+	s.outliers.Store(targetKey{id, "ejected"}, ejected)
+	s.outlierPrune.last = time.Time{}
+	s.pruneOutliers(time.Now().Add(outlierIdle / 2))
+	if _, ok := s.outliers.Load(targetKey{id, addr}); !ok {
+		t.Fatal("state pruned before it is idle")
+	}
+	s.outlierPrune.last = time.Time{}
+	s.pruneOutliers(time.Now().Add(outlierIdle + time.Second))
+	if _, ok := s.outliers.Load(targetKey{id, addr}); ok {
+		t.Fatal("idle state is not pruned")
+	}
+	if _, ok := s.outliers.Load(targetKey{id, "ejected"}); !ok {
+		t.Fatal("ejected state is pruned")
+	}
+}
@@ -0,0 +1,106 @@
+package bridge
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// telemetryHistory 保存单个客户端的遥测滚动历史，客户端重连后历史仍保留，
+// 便于在掉线前后对比链路质量。
+type telemetryHistory struct {
+	samples []*file.Telemetry
+	sync.RWMutex
+}
+
+const (
+	telemetryMaxStr   = 256 // 客户端上报的版本、系统、架构及每个隧道名称的最大长度
+	telemetryMaxTasks = 256 // 客户端上报的隧道与域名解析的最大数量
+)
+
+// historyLen 返回每个客户端保留的遥测样本数量，可通过 nps.conf 的 telemetry_history_length 配置。
+func historyLen() int {
+	if n := beego.AppConfig.DefaultInt("telemetry_history_length", 120); n > 0 {
+		return n
+	}
+	return 120
+}
+
+// dealTelemetry 解析客户端上报的遥测数据并追加到该客户端的历史中，超出长度的旧样本会被丢弃。
+func (s *Bridge) dealTelemetry(id int, payload []byte) {
+	t := new(file.Telemetry)
+	if err := json.Unmarshal(payload, t); err != nil {
+		logs.Warn("clientId %d telemetry data error %s", id, err.Error())
+		return
+	}
+	//the strings are reported by the client, limit them so the history of each client stays small
+	t.Os, t.Arch, t.Version = limitStr(t.Os), limitStr(t.Arch), limitStr(t.Version)
+	if len(t.Tasks) > telemetryMaxTasks {
+		t.Tasks = t.Tasks[:telemetryMaxTasks]
+	}
+	for i, v := range t.Tasks {
+		t.Tasks[i] = limitStr(v)
+	}
+	v, _ := s.telemetry.LoadOrStore(id, new(telemetryHistory))
+	h := v.(*telemetryHistory)
+	h.Lock()
+	h.samples = append(h.samples, t)
+	if l := historyLen(); len(h.samples) > l {
+		h.samples = h.samples[len(h.samples)-l:]
+	}
+	h.Unlock()
+}
+
+// limitStr 截断超过 telemetryMaxStr 的字符串，并去掉截断产生的不完整字符
+func limitStr(s string) string {
+	if len(s) <= telemetryMaxStr {
+		return s
+	}
+	return strings.ToValidUTF8(s[:telemetryMaxStr], "")
+}
+
+// pong 原样回写客户端 ping 的负载，客户端据此计算往返时延与丢包率。
+// 收到 ping 即说明客户端支持扩展信令，可以向其下发管理命令。
+func (s *Bridge) pong(id int, payload []byte) {
+	if v, ok := s.Client.Load(id); ok {
+		atomic.StoreInt32(&v.(*Client).signalExt, 1)
+		if err := v.(*Client).writeSignal(common.RES_PONG, payload); err != nil {
+			logs.Trace("clientId %d write pong error %s", id, err.Error())
+		}
+	}
+}
+
+// DelTelemetry 删除指定客户端的遥测历史，在客户端被删除时调用；断线时保留历史。
+func (s *Bridge) DelTelemetry(id int) {
+	s.telemetry.Delete(id)
+}
+
+// GetTelemetry 返回指定客户端的遥测历史（按时间先后排列）的副本。
+func (s *Bridge) GetTelemetry(id int) []*file.Telemetry {
+	if v, ok := s.telemetry.Load(id); ok {
+		h := v.(*telemetryHistory)
+		h.RLock()
+		defer h.RUnlock()
+		return append([]*file.Telemetry{}, h.samples...)
+	}
+	return nil
+}
+
+// GetLastTelemetry 返回指定客户端最近一次上报的遥测数据，未上报时返回 nil。
+func (s *Bridge) GetLastTelemetry(id int) *file.Telemetry {
+	if v, ok := s.telemetry.Load(id); ok {
+		h := v.(*telemetryHistory)
+		h.RLock()
+		defer h.RUnlock()
+		if len(h.samples) > 0 {
+			return h.samples[len(h.samples)-1]
+		}
+	}
+	return nil
+}
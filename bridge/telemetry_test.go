@@ -0,0 +1,45 @@
+package bridge
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"ehang.io/nps/lib/file"
+)
+
+// TestDealTelemetry 测试客户端上报的字符串与隧道数量被截断，历史只保留最近的样本
+func TestDealTelemetry(t *testing.T) {
+	s := new(Bridge)
+	tasks := make([]string, telemetryMaxTasks+10)
+	for i := range tasks {
+		tasks[i] = "task"
+	}
+	tasks[0] = strings.Repeat("隧", telemetryMaxStr)
+	b, err := json.Marshal(&file.Telemetry{Time: 1, Os: strings.Repeat("x", 1<<20), Arch: "amd64", Version: "0.26", Tasks: tasks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dealTelemetry(1, b)
+	last := s.GetLastTelemetry(1)
+	if last == nil || len(last.Os) != telemetryMaxStr || last.Arch != "amd64" || last.Version != "0.26" {
+		t.Fatalf("telemetry strings are not limited, got %v", last)
+	}
+	if len(last.Tasks) != telemetryMaxTasks || len(last.Tasks[0]) > telemetryMaxStr || !strings.HasPrefix(last.Tasks[0], "隧") || last.Tasks[1] != "task" {
+		t.Fatalf("telemetry tasks are not limited, got %d tasks", len(last.Tasks))
+	}
+	if !strings.HasSuffix(last.Tasks[0], "隧") {
+		t.Fatal("truncated task name ends with a partial character")
+	}
+
+	for i := 0; i < historyLen()+5; i++ {
+		s.dealTelemetry(1, []byte(`{"Time":2}`))
+	}
+	if h := s.GetTelemetry(1); len(h) != historyLen() || h[0].Time != 2 {
+		t.Fatalf("expects %d samples, got %d", historyLen(), len(h))
+	}
+	s.dealTelemetry(1, []byte("not json"))
+	if len(s.GetTelemetry(1)) != historyLen() {
+		t.Fatal("invalid telemetry is stored")
+	}
+}
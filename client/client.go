@@ -9,10 +9,12 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"net"
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"ehang.io/nps-mux"
@@ -38,7 +40,8 @@ import (
 // - ticker: 心跳检测定时器；
 // - cnf: 客户端配置，包含健康检查项等；
 // - disconnectTime: 复用隧道的空闲断连时间（秒）；
-// - once: 保证 Close/closing 只执行一次。
+// - once: 保证 Close/closing 只执行一次；
+// - probe: 链路探测统计，用于计算上报的 RTT 与丢包率。
 type TRPClient struct {
 	svrAddr        string
 	bridgeConnType string
@@ -51,6 +54,8 @@ type TRPClient struct {
 	cnf            *config.Config
 	disconnectTime int
 	once           sync.Once
+	probe          linkProbe
+	dialFails      sync.Map // 上报过拨号失败的固定目标，key 为目标地址
 }
 
 // NewRPClient 创建并返回一个 TRPClient。
@@ -90,7 +95,8 @@ var CloseClient bool
 // 2) 并发启动 ping() 监控复用隧道状态；
 // 3) 并发建立数据复用通道 newChan()（WORK_CHAN）；
 // 4) 若配置中开启健康检查，则启动 heathCheck；
-// 5) 进入 handleMain() 循环处理来自服务端的控制消息（如 NEW_UDP_CONN）。
+// 5) 启动链路探测与遥测上报 telemetry；
+// 6) 进入 handleMain() 循环处理来自服务端的控制消息（如 NEW_UDP_CONN）。
 // 发生错误时会等待 5 秒重试，直到 CloseClient 被置为 true。
 // 注意：该方法会阻塞在 handleMain()，需要在独立 goroutine 中调用或在主线程按需处理。
 // 线程安全：内部使用 once 确保 Close 仅执行一次。
@@ -114,6 +120,7 @@ retry:
 		goto retry
 	}
 	logs.Info("Successful connection with server %s", s.svrAddr)
+	atomic.AddInt32(&connectTimes, 1)
 	//monitor the connection
 	go s.ping()
 	s.signal = c
@@ -123,13 +130,17 @@ retry:
 	if s.cnf != nil && len(s.cnf.Healths) > 0 {
 		go heathCheck(s.cnf.Healths, s.signal)
 	}
+	//report link quality telemetry
+	go s.telemetry(s.signal)
 	NowStatus = 1
 	//msg connection, eg udp
 	s.handleMain()
 }
 
 // handleMain 处理来自服务端控制连接（signal）的消息。
-// 目前主要处理 NEW_UDP_CONN，用于触发 P2P UDP 打洞：
+// RES_PONG 为服务端对链路探测的回应，用于计算往返时延；
+// NEW_COMMAND 为服务端下发的管理命令，异步执行后回传结果；
+// NEW_UDP_CONN 用于触发 P2P UDP 打洞：
 // - 读取服务端下发的远端 UDP 地址与口令；
 // - 以时间片为单位复用本地端口（降低 NAT 映射变化带来的失败率）；
 // - 异步调用 newUdpConn 发起打洞与后续的 KCP+Mux 建链。
@@ -141,6 +152,23 @@ func (s *TRPClient) handleMain() {
 			break
 		}
 		switch flags {
+		case common.RES_PONG:
+			if b, err := s.signal.GetShortLenContent(); err != nil {
+				logs.Warn(err)
+				return
+			} else {
+				s.probe.onPong(b)
+			}
+		case common.NEW_COMMAND:
+			cmd := new(conn.Command)
+			if b, err := s.signal.GetShortLenContent(); err != nil {
+				logs.Warn(err)
+				return
+			} else if err := json.Unmarshal(b, cmd); err != nil {
+				logs.Warn("remote command format error", err.Error())
+			} else {
+				go s.dealCommand(s.signal, cmd)
+			}
 		case common.NEW_UDP_CONN:
 			//read server udp addr and password
 			if lAddr, err := s.signal.GetShortLenContent(); err != nil {
@@ -233,10 +261,17 @@ func (s *TRPClient) newChan() {
 // handleChan 处理一条由隧道接入的新逻辑连接：
 // - 首先从连接中读取 LinkInfo（目标地址、连接类型、编解码选项等）；
 // - 对 HTTP 连接做特殊处理：日志记录请求行，并将请求转发至目标；
+// - 拨号前按本地目标白名单校验，被拒绝的连接会上报服务端并关闭；
 // - 对 UDP5（ Socks5-UDP 拓展协议）连接交由 handleUdp 处理；
 // - 对 TCP/UDP 连接，直连目标并做双向拷贝，支持加密/压缩；
-// - 发生错误或目标不可达时，及时关闭源连接并记录日志。
+// - 发生错误或目标不可达时，及时关闭源连接并记录日志；
+// - 拨号结果以 MSG_TARGET_DIAL 上报服务端，用于被动健康检查。
+// 每条逻辑连接都会计入遥测上报的活动/累计复用流数量，读写的字节数计入复用吞吐。
 func (s *TRPClient) handleChan(src net.Conn) {
+	src = &streamConn{Conn: src}
+	atomic.AddInt32(&activeStreams, 1)
+	atomic.AddInt64(&totalStreams, 1)
+	defer atomic.AddInt32(&activeStreams, -1)
 	lk, err := conn.NewConn(src).GetLinkInfo()
 	if err != nil || lk == nil {
 		src.Close()
@@ -245,9 +280,21 @@ func (s *TRPClient) handleChan(src net.Conn) {
 	}
 	//host for target processing
 	lk.Host = common.FormatAddress(lk.Host)
+	//check the target with the local allow-list before dialing, and dial the checked address
+	dialAddr, err := s.checkLink(lk)
+	if err != nil {
+		s.denyTarget(lk.ConnType, lk.Host, lk.RemoteAddr, err)
+		src.Close()
+		return
+	}
 	//if Conn type is http, read the request and log
 	if lk.ConnType == "http" {
-		if targetConn, err := net.DialTimeout(common.CONN_TCP, lk.Host, lk.Option.Timeout); err != nil {
+		targetConn, err := net.DialTimeout(common.CONN_TCP, dialAddr, lk.Option.Timeout)
+		s.reportDial(lk, err)
+		if err == nil {
+			targetConn, err = writeProxyHeader(targetConn, lk)
+		}
+		if err != nil {
 			logs.Warn("connect to %s error %s", lk.Host, err.Error())
 			src.Close()
 		} else {
@@ -272,10 +319,16 @@ func (s *TRPClient) handleChan(src net.Conn) {
 	}
 	if lk.ConnType == "udp5" {
 		logs.Trace("new %s connection with the goal of %s, remote address:%s", lk.ConnType, lk.Host, lk.RemoteAddr)
-		s.handleUdp(src)
+		s.handleUdp(src, lk.RemoteAddr)
+		return
 	}
 	//connect to target if conn type is tcp or udp
-	if targetConn, err := net.DialTimeout(lk.ConnType, lk.Host, lk.Option.Timeout); err != nil {
+	targetConn, err := net.DialTimeout(lk.ConnType, dialAddr, lk.Option.Timeout)
+	s.reportDial(lk, err)
+	if err == nil {
+		targetConn, err = writeProxyHeader(targetConn, lk)
+	}
+	if err != nil {
 		logs.Warn("connect to %s error %s", lk.Host, err.Error())
 		src.Close()
 	} else {
@@ -284,12 +337,39 @@ func (s *TRPClient) handleChan(src net.Conn) {
 	}
 }
 
+// writeProxyHeader 服务端要求时向目标发送访问者地址的 PROXY protocol 头
+// tcp 连接建立后先写出一次；udp 只支持 v2，返回的连接在每个数据包之前附加头
+// 写出失败时关闭目标连接并返回错误
+func writeProxyHeader(target net.Conn, lk *conn.Link) (net.Conn, error) {
+	if lk.Option.ProxyProtocol <= 0 {
+		return target, nil
+	}
+	network, version := common.CONN_TCP, lk.Option.ProxyProtocol
+	if lk.ConnType == common.CONN_UDP {
+		network, version = common.CONN_UDP, 2
+	}
+	header, err := conn.ProxyHeader(version, network, lk.RemoteAddr, lk.Option.LocalAddr)
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+	if network == common.CONN_UDP {
+		return conn.NewProxyPacketConn(target, header), nil
+	}
+	if _, err := target.Write(header); err != nil {
+		target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
 // handleUdp 实现 UDP Relay：
 // - 在本地绑定一个临时 UDP 端口，供上游应用发送流量；
 // - 从本地 UDP 读取数据 -> 打包为自定义 UDPDatagram -> 通过 serverConn 发送至服务端；
 // - 从 serverConn 读取数据 -> 解包 UDPDatagram -> 写回本地 UDP；
+// - 目的地址未通过本地目标白名单的数据包会被丢弃，同一目标的校验结果缓存一分钟，期间只上报一次；
 // - 发生任何读写错误时，及时关闭相关连接。
-func (s *TRPClient) handleUdp(serverConn net.Conn) {
+func (s *TRPClient) handleUdp(serverConn net.Conn, remoteAddr string) {
 	// bind a local udp port
 	local, err := net.ListenUDP("udp", nil)
 	defer serverConn.Close()
@@ -323,6 +403,8 @@ func (s *TRPClient) handleUdp(serverConn net.Conn) {
 	}()
 	b := common.BufPoolUdp.Get().([]byte)
 	defer common.BufPoolUdp.Put(b)
+	// allow-list results of the targets in this session, the checked address to send to or empty when rejected
+	checked := common.NewVerdictCache()
 	for {
 		n, err := serverConn.Read(b)
 		if err != nil {
@@ -335,7 +417,18 @@ func (s *TRPClient) handleUdp(serverConn net.Conn) {
 			logs.Error("unpack data error", err.Error())
 			return
 		}
-		raddr, err := net.ResolveUDPAddr("udp", udpData.Header.Addr.String())
+		dst := udpData.Header.Addr.String()
+		allow, ok := checked.Get(dst, time.Now())
+		if !ok {
+			if allow, err = s.targetPolicy().AllowAddr(dst); err != nil {
+				s.denyTarget("udp5", dst, remoteAddr, err)
+			}
+			checked.Set(dst, allow, time.Now())
+		}
+		if allow == "" {
+			continue // drop the datagram to the rejected target
+		}
+		raddr, err := net.ResolveUDPAddr("udp", allow)
 		if err != nil {
 			logs.Error("build remote addr err", err.Error())
 			continue // drop silently
@@ -0,0 +1,231 @@
+// Package client 中的 command.go 负责执行服务端通过信令连接下发的管理命令。
+//
+// 设计要点：
+//  1. 命令由服务端使用客户端验证密钥签名，签名校验失败的命令不会执行；
+//     下发时间与本地时间相差超过 CommandMaxSkew 秒或请求 ID 已执行过的命令视为重放，同样拒绝；
+//  2. 配置文件中 disable_remote_command=true 时拒绝所有命令；
+//  3. 每条命令在独立 goroutine 中执行，超过命令携带的超时时间即返回超时；
+//  4. 结果以 MSG_CMD_RESULT 消息按请求 ID 回传，restart/reload 在结果回传后再执行。
+package client
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/version"
+	"github.com/astaxie/beego/logs"
+)
+
+// 回传结果的最大长度，避免超出服务端信令读取缓冲
+const maxCommandResultLen = 32 << 10
+
+// reloadConfig 置位后，StartFromFile 在下一次重连前会重新读取配置文件。
+var reloadConfig int32
+
+// commandSeen 记录有效期内已接受的命令请求 ID 及其下发时间，用于拒绝重放
+var commandSeen = struct {
+	ids map[string]int64
+	sync.Mutex
+}{ids: make(map[string]int64)}
+
+// checkCommandReplay 拒绝过期或重复的命令，通过时记录其请求 ID
+func checkCommandReplay(cmd *conn.Command, now time.Time) error {
+	if d := now.Unix() - cmd.Time; d > conn.CommandMaxSkew || d < -conn.CommandMaxSkew {
+		return errors.New("command is expired, check the clock of the client and the server")
+	}
+	commandSeen.Lock()
+	defer commandSeen.Unlock()
+	for id, t := range commandSeen.ids {
+		if now.Unix()-t > 2*conn.CommandMaxSkew {
+			delete(commandSeen.ids, id)
+		}
+	}
+	if _, ok := commandSeen.ids[cmd.Id]; ok {
+		return errors.New("command is replayed")
+	}
+	commandSeen.ids[cmd.Id] = cmd.Time
+	return nil
+}
+
+// dealCommand 校验并执行一条管理命令，然后将结果回传服务端。
+func (s *TRPClient) dealCommand(c *conn.Conn, cmd *conn.Command) {
+	res := &conn.CommandResult{Id: cmd.Id}
+	var after func()
+	if !hmac.Equal([]byte(cmd.Sign), []byte(cmd.GetSign(s.vKey))) {
+		logs.Warn("remote command %s sign error", cmd.Name)
+		res.Result = "sign error"
+	} else if err := checkCommandReplay(cmd, time.Now()); err != nil {
+		logs.Warn("remote command %s %s", cmd.Name, err.Error())
+		res.Result = err.Error()
+	} else if s.cnf != nil && s.cnf.CommonConfig != nil && s.cnf.CommonConfig.DisableRemoteCommand {
+		res.Result = "remote command is disabled"
+	} else {
+		logs.Info("receive remote command %s %s", cmd.Name, cmd.Args)
+		timeout := cmd.Timeout
+		if timeout <= 0 {
+			timeout = 10
+		}
+		done := make(chan *conn.CommandResult, 1)
+		var doneAfter func()
+		go func() {
+			r := &conn.CommandResult{Id: cmd.Id}
+			var err error
+			if r.Result, doneAfter, err = s.runCommand(cmd, time.Duration(timeout)*time.Second); err != nil {
+				r.Result = err.Error()
+			} else {
+				r.Success = true
+			}
+			done <- r
+		}()
+		select {
+		case res = <-done:
+			after = doneAfter
+		case <-time.After(time.Duration(timeout) * time.Second):
+			res.Result = "command timeout"
+		}
+	}
+	if len(res.Result) > maxCommandResultLen {
+		res.Result = res.Result[len(res.Result)-maxCommandResultLen:]
+	}
+	if b, err := json.Marshal(res); err == nil {
+		if _, err := c.SendSignalInfo(common.MSG_CMD_RESULT, b); err != nil {
+			logs.Warn("send command result error", err.Error())
+		}
+	}
+	if after != nil {
+		time.Sleep(time.Second)
+		after()
+	}
+}
+
+// runCommand 执行具体命令，返回输出、需要在结果回传后执行的动作及错误。
+func (s *TRPClient) runCommand(cmd *conn.Command, timeout time.Duration) (string, func(), error) {
+	switch cmd.Name {
+	case conn.COMMAND_VERSION:
+		return fmt.Sprintf("version: %s, core version: %s, os: %s, arch: %s", version.VERSION, version.GetVersion(), runtime.GOOS, runtime.GOARCH), nil, nil
+	case conn.COMMAND_CONFIG:
+		var b []byte
+		var err error
+		if s.cnf != nil {
+			b, err = redactConfig(s.cnf)
+		} else {
+			b, err = redactConfig(map[string]interface{}{"Server": s.svrAddr, "Tp": s.bridgeConnType, "ProxyUrl": s.proxyUrl})
+		}
+		return string(b), nil, err
+	case conn.COMMAND_LOG:
+		n := common.GetIntNoErrByStr(cmd.Args)
+		if n <= 0 {
+			n = 50
+		}
+		lines := common.TrimArr(strings.Split(common.GetLogMsg(), "\r\n"))
+		if len(lines) > n {
+			lines = lines[len(lines)-n:]
+		}
+		return strings.Join(lines, "\n"), nil, nil
+	case conn.COMMAND_RESTART:
+		return "restarting", func() {
+			if err := restartProcess(); err != nil {
+				logs.Error("restart error", err.Error())
+			}
+		}, nil
+	case conn.COMMAND_RELOAD:
+		if s.cnf == nil {
+			return "", nil, errors.New("reload is only supported when started with a config file")
+		}
+		return "reloading", func() {
+			atomic.StoreInt32(&reloadConfig, 1)
+			s.Close()
+		}, nil
+	case conn.COMMAND_TEST:
+		return testTarget(cmd.Args, timeout)
+	}
+	return "", nil, errors.New("unknown command " + cmd.Name)
+}
+
+// testTarget 测试客户端到目标的连通性，target 为 host:port 或 http(s) URL。
+func testTarget(target string, timeout time.Duration) (string, func(), error) {
+	if target == "" {
+		return "", nil, errors.New("target is empty")
+	}
+	start := time.Now()
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		client := &http.Client{Timeout: timeout}
+		rs, err := client.Get(target)
+		if err != nil {
+			return "", nil, err
+		}
+		rs.Body.Close()
+		return fmt.Sprintf("%s %s, cost %sms", target, rs.Status, strconv.FormatInt(time.Since(start).Milliseconds(), 10)), nil, nil
+	}
+	c, err := net.DialTimeout(common.CONN_TCP, common.FormatAddress(target), timeout)
+	if err != nil {
+		return "", nil, err
+	}
+	c.Close()
+	return fmt.Sprintf("connect to %s success, cost %sms", target, strconv.FormatInt(time.Since(start).Milliseconds(), 10)), nil, nil
+}
+
+// redactKeys 返回的配置中需隐藏的字段：验证密钥、认证用户名与密码、隧道与私密代理密码、私钥与认证令牌
+var redactKeys = map[string]bool{
+	"VKey":        true,
+	"VerifyKey":   true,
+	"U":           true,
+	"P":           true,
+	"Password":    true,
+	"WebPassword": true,
+	"KeyContent":  true,
+	"AuthUsers":   true,
+	"AuthTokens":  true,
+}
+
+// redactConfig 序列化配置并隐藏其中的敏感字段，结果会保存在服务端的命令历史中并在 web 显示
+func redactConfig(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	redact(m)
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// redact 递归替换 redactKeys 中非空的字段，并隐藏代理地址中的密码
+func redact(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			s, ok := e.(string)
+			switch {
+			case !ok:
+				redact(e)
+			case s != "" && redactKeys[k]:
+				v[k] = "******"
+			case k == "ProxyUrl":
+				if u, err := url.Parse(s); err == nil && u.User != nil {
+					u.User = url.User(u.User.Username())
+					v[k] = u.String()
+				}
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			redact(e)
+		}
+	}
+}
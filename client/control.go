@@ -27,6 +27,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"ehang.io/nps/lib/common"
@@ -141,8 +142,18 @@ func StartFromFile(path string) {
 	logs.Info("Loading configuration file %s successfully", path)
 
 re:
+	// 收到服务端的 reload 命令时，重新读取配置文件后重连（不受 AutoReconnection 限制）
+	reload := atomic.CompareAndSwapInt32(&reloadConfig, 1, 0)
+	if reload {
+		if newCnf, err := config.NewConfig(path); err != nil || newCnf.CommonConfig == nil {
+			logs.Error("Config file %s reloading error, keep the current configuration", path)
+		} else {
+			cnf = newCnf
+			logs.Info("Reloading configuration file %s successfully", path)
+		}
+	}
 	// 根据 AutoReconnection 决定是否继续重连；非首次进入时等待 5 秒
-	if first || cnf.CommonConfig.AutoReconnection {
+	if first || reload || cnf.CommonConfig.AutoReconnection {
 		if !first {
 			logs.Info("Reconnecting...")
 			time.Sleep(time.Second * 5)
@@ -1,7 +1,8 @@
 // Package client 中的 health.go 负责客户端侧的健康检查调度与上报。
 //
 // 设计要点（重要）：
-//  1. 支持多目标的 TCP/HTTP 健康检查，目标以逗号分隔存放于 HealthCheckTarget 中。
+//  1. 支持多目标的 tcp/http/https/udp/dns 健康检查，目标以逗号分隔存放于 HealthCheckTarget 中，
+//     各类型的探测由 lib/health 实现。
 //  2. 使用一个最小堆（sheap.IntHeap）按“下一次检查时间”的时间戳进行调度，
 //     每到期一次就触发相应 Health 的检查，并计算下次时间后重新入堆。
 //  3. 对每个目标维护失败计数 HealthMap[v]：
@@ -9,24 +10,24 @@
 //     - 当检查成功且此前计数已达到阈值（HealthMaxFail）时，认为从失败恢复，向服务端上报恢复（"1"），并清零计数；
 //     - 当失败计数累加到阈值的整数倍（即每达到 HealthMaxFail 次失败），认为处于/仍处于失败状态，向服务端上报失败（"0"）。
 //  4. 通过 serverConn.SendHealthInfo(target, flag) 与服务端通信：flag="0" 表示失败（移除），flag="1" 表示恢复（添加）。
-//  5. 为避免并发竞争，对单个 Health 的 HealthMap 访问需加锁（t.Lock()/Unlock()）。
-//  6. 仅在 HealthMaxFail、HealthCheckTimeout、HealthCheckInterval 都为正时，才会调度该 Health。
-//
-// 注意：本文件仅新增了详细注释，不改变任何原有逻辑。
+//  5. 每次检查后以 MSG_HEALTH_RESULT 上报该目标的状态、耗时、最近一次失败原因与进入当前状态的时间，供 web 管理显示。
+//  6. 为避免并发竞争，对单个 Health 的 HealthMap 与检查结果的访问需加锁（t.Lock()/Unlock()）。
+//  7. 仅在 HealthMaxFail、HealthCheckTimeout、HealthCheckInterval 都为正时，才会调度该 Health。
 package client
 
 import (
 	"container/heap"
-	"net"
-	"net/http"
+	"encoding/json"
 	"strings"
+	"sync"
 	"time"
 
+	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/health"
 	"ehang.io/nps/lib/sheap"
 	"github.com/astaxie/beego/logs"
-	"github.com/pkg/errors"
 )
 
 // isStart 表示健康检查调度是否已经初始化启动。
@@ -118,51 +119,35 @@ func session(healths []*file.Health, h *sheap.IntHeap) {
 	}
 }
 
+// healthStats 各 Health 中每个目标最近一次的检查结果，key 为 *file.Health，值由 Health 的锁保护
+var healthStats sync.Map
+
 // check 对单个 Health 配置执行一次健康检查。
 //
 // 适用场景：单一端口、多目标（HealthCheckTarget 以逗号分隔）。
 // 行为：
-//   - 当 HealthCheckType=="tcp" 时，尝试以超时时间发起 TCP 连接；成功即认为健康。
-//   - 否则按 HTTP 方式：GET http://{target}{HttpHealthUrl}，要求返回码为 200 才视为健康。
+//   - 按 HealthCheckType 以 lib/health 探测每个目标。
 //   - 根据结果更新失败计数 HealthMap[target]，并在阈值到达或恢复时通过 serverConn 上报。
+//   - 更新并上报该目标的检查结果。
 func check(t *file.Health) {
-	arr := strings.Split(t.HealthCheckTarget, ",")
-	var err error
-	var rs *http.Response
-	for _, v := range arr {
-		if t.HealthCheckType == "tcp" {
-			// TCP 健康检查：在指定超时时间内建立连接。
-			var c net.Conn
-			c, err = net.DialTimeout("tcp", v, time.Duration(t.HealthCheckTimeout)*time.Second)
-			if err == nil {
-				c.Close()
-			}
-		} else {
-			// HTTP 健康检查：要求返回 200。
-			client := &http.Client{}
-			client.Timeout = time.Duration(t.HealthCheckTimeout) * time.Second
-			rs, err = client.Get("http://" + v + t.HttpHealthUrl)
-			if err == nil && rs.StatusCode != 200 {
-				err = errors.New("status code is not match")
-			}
-		}
+	v, _ := healthStats.LoadOrStore(t, make(map[string]*file.HealthStat))
+	stats := v.(map[string]*file.HealthStat)
+	for _, v := range strings.Split(t.HealthCheckTarget, ",") {
+		latency, err := health.Probe(t, v)
 
-		// 下面更新失败计数与上报，需加锁保护。
+		// 下面更新失败计数、检查结果与上报，需加锁保护。
+		// 失败次数达到阈值的整数倍（例如阈值=3，累计失败 3、6、9... 次）时上报失败（"0"），
+		// 此前已达到阈值后检查成功时上报恢复（"1"）。
 		t.Lock()
-		if err != nil {
-			// 本次检查失败：计数 +1。
-			t.HealthMap[v] += 1
-		} else if t.HealthMap[v] >= t.HealthMaxFail {
-			// 本次检查成功且此前失败计数已经达到阈值：认为从失败恢复，通知服务端恢复（"1"），并清零计数。
-			serverConn.SendHealthInfo(v, "1")
-			t.HealthMap[v] = 0
-		}
-
-		// 当失败计数达到阈值的整数倍（例如阈值=3，累计失败 3、6、9... 次）：
-		// 向服务端上报失败（"0"）。
-		if t.HealthMap[v] > 0 && t.HealthMap[v]%t.HealthMaxFail == 0 {
-			serverConn.SendHealthInfo(v, "0")
+		change, stat := health.Update(t, v, stats[v], latency, err)
+		stats[v] = stat
+		if change != health.ChangeNone {
+			serverConn.SendHealthInfo(v, change)
 		}
+		b, _ := json.Marshal(stat)
 		t.Unlock()
+		if _, err = serverConn.SendSignalInfo(common.MSG_HEALTH_RESULT, b); err != nil {
+			logs.Trace("report health check result error %s", err.Error())
+		}
 	}
 }
@@ -0,0 +1,39 @@
+// Package client 中的 outlier.go 负责上报实际转发中拨号目标的结果。
+//
+// 设计要点：
+//  1. 服务端据此做被动健康检查，同一目标连续失败达到次数后暂时摘除；
+//  2. 失败时每次都上报，成功时只在该目标此前上报过失败时上报一次，避免每条连接都产生信令消息；
+//  3. 只上报隧道与域名解析配置的固定目标，socks5、http 代理由访问者指定的目标不上报。
+package client
+
+import (
+	"encoding/json"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"github.com/astaxie/beego/logs"
+)
+
+// reportDial 上报一次拨号目标的结果，err 为 nil 表示成功
+func (s *TRPClient) reportDial(lk *conn.Link, err error) {
+	if s.signal == nil || !lk.Option.FixedTarget {
+		return
+	}
+	d := &conn.LinkDial{ConnType: lk.ConnType, Host: lk.Host, Ok: err == nil}
+	if err == nil {
+		if _, ok := s.dialFails.Load(lk.Host); !ok {
+			return
+		}
+		s.dialFails.Delete(lk.Host)
+	} else {
+		d.Reason = err.Error()
+		s.dialFails.Store(lk.Host, true)
+	}
+	b, e := json.Marshal(d)
+	if e != nil {
+		return
+	}
+	if _, e = s.signal.SendSignalInfo(common.MSG_TARGET_DIAL, b); e != nil {
+		logs.Trace("report dial result error %s", e.Error())
+	}
+}
@@ -0,0 +1,70 @@
+// Package client 中的 policy.go 负责在拨号前执行 npc 本地的目标白名单。
+//
+// 设计要点：
+//  1. 白名单来自 npc.conf [common] 段的 allow_target_cidr、allow_target_host、
+//     allow_target_port 与 allow_conn_type，未配置时不做任何限制；
+//  2. handleChan 在拨号前校验连接类型与目标地址，handleUdp 对每个 UDP 数据包的目的地址校验；
+//  3. 被拒绝的连接记录警告日志，并以 MSG_TARGET_DENY 消息上报服务端，
+//     与普通的拨号失败相区分。
+package client
+
+import (
+	"encoding/json"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/config"
+	"ehang.io/nps/lib/conn"
+	"github.com/astaxie/beego/logs"
+)
+
+// targetPolicy 返回配置文件中的目标白名单，未配置时返回 nil
+func (s *TRPClient) targetPolicy() *config.TargetPolicy {
+	if s.cnf == nil || s.cnf.CommonConfig == nil {
+		return nil
+	}
+	return s.cnf.CommonConfig.TargetPolicy
+}
+
+// checkLink 校验服务端下发的连接是否被本地白名单允许，返回拨号时应使用的地址。
+// udp5 连接的目标由每个数据包携带，此处只校验连接类型。
+// 服务端已按校验过的 IP 下发拨号地址时拨号该地址，不再重新解析域名。
+func (s *TRPClient) checkLink(lk *conn.Link) (string, error) {
+	p := s.targetPolicy()
+	if err := p.AllowType(lk.ConnType); err != nil {
+		return "", err
+	}
+	if lk.ConnType == "udp5" {
+		return lk.Host, nil
+	}
+	dialAddr, err := p.AllowAddr(lk.Host)
+	if err != nil || lk.Option.DialAddr == "" || lk.Option.DialAddr == lk.Host {
+		return dialAddr, err
+	}
+	if dialAddr == lk.Host {
+		return lk.Option.DialAddr, nil
+	}
+	//the local policy checked the ips resolved by npc, the ip checked by the server must be allowed as well
+	return p.AllowAddr(lk.Option.DialAddr)
+}
+
+// denyTarget 记录被拒绝的目标并上报服务端
+func (s *TRPClient) denyTarget(connType, host, remoteAddr string, err error) {
+	logs.Warn("%s connection to %s from %s is rejected, %s", connType, host, remoteAddr, err.Error())
+	if s.signal == nil {
+		return
+	}
+	b, e := json.Marshal(&conn.LinkDeny{
+		ConnType:   connType,
+		Host:       host,
+		RemoteAddr: remoteAddr,
+		Reason:     err.Error(),
+		Time:       time.Now().Unix(),
+	})
+	if e != nil {
+		return
+	}
+	if _, e = s.signal.SendSignalInfo(common.MSG_TARGET_DENY, b); e != nil {
+		logs.Trace("report rejected target error %s", e.Error())
+	}
+}
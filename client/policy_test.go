@@ -0,0 +1,32 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"ehang.io/nps/lib/config"
+	"ehang.io/nps/lib/conn"
+)
+
+// TestCheckLink 测试服务端下发校验过的拨号地址时 npc 拨号该地址，且该地址仍需通过本地白名单
+func TestCheckLink(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("127.0.0.0/8")
+	for _, c := range []struct {
+		policy               *config.TargetPolicy
+		host, dialAddr, want string // want 为空时期望被拒绝
+	}{
+		{nil, "localhost:80", "", "localhost:80"},
+		{nil, "example.com:80", "10.0.0.1:80", "10.0.0.1:80"},
+		{&config.TargetPolicy{Hosts: []string{"*.lan"}}, "a.lan:80", "10.0.0.1:80", "10.0.0.1:80"},
+		{&config.TargetPolicy{Hosts: []string{"*.lan"}}, "b.com:80", "10.0.0.1:80", ""},
+		{&config.TargetPolicy{Cidrs: []*net.IPNet{lan}}, "localhost:80", "127.0.0.2:80", "127.0.0.2:80"},
+		{&config.TargetPolicy{Cidrs: []*net.IPNet{lan}}, "localhost:80", "10.0.0.1:80", ""},
+		{&config.TargetPolicy{Cidrs: []*net.IPNet{lan}}, "127.0.0.1:80", "127.0.0.1:80", "127.0.0.1:80"},
+	} {
+		s := &TRPClient{cnf: &config.Config{CommonConfig: &config.CommonConfig{TargetPolicy: c.policy}}}
+		got, err := s.checkLink(conn.NewLink("tcp", c.host, false, false, "", false, conn.LinkDialAddr(c.dialAddr)))
+		if (c.want == "") != (err != nil) || got != c.want {
+			t.Errorf("%s pinned to %q expects %q, got %q %v", c.host, c.dialAddr, c.want, got, err)
+		}
+	}
+}
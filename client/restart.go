@@ -0,0 +1,17 @@
+// +build !windows
+
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartProcess 以相同的参数与环境变量替换当前进程映像，实现原地重启（进程 PID 不变）。
+func restartProcess() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
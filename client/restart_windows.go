@@ -0,0 +1,25 @@
+// +build windows
+
+package client
+
+import (
+	"os"
+	"os/exec"
+)
+
+// restartProcess 以相同的参数启动一个新进程后退出当前进程。
+// 以 Windows 服务方式运行时，由服务管理器的恢复策略负责重新拉起。
+func restartProcess() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
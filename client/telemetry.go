@@ -0,0 +1,179 @@
+// Package client 中的 telemetry.go 负责链路质量探测与遥测上报。
+//
+// 设计要点：
+//  1. 客户端每 5 秒通过信令连接发送一次 MSG_PING，负载为发送时刻的纳秒时间戳；
+//     服务端原样以 RES_PONG 回写，handleMain 收到后计算往返时延。
+//  2. 每个上报周期内统计 ping 的发送数与响应数，得到平均 RTT 与丢包率。
+//  3. 每隔 telemetry_interval 秒（默认 30 秒）将 RTT、丢包率、复用流数量与吞吐、复用窗口、重连次数、
+//     CPU/内存使用率、系统信息及配置的隧道列表以 JSON 形式通过 MSG_TELEMETRY 上报。
+//  4. 信令连接写入失败即视为连接已断开，上报循环随之退出，重连后由 Start 重新启动。
+//  5. nps-mux 不导出实际的接收窗口，复用窗口按本周期复用流的吞吐与 RTT 估算为带宽时延积，
+//     与 nps-mux 计算接收窗口的方式一致。
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/version"
+	"github.com/astaxie/beego/logs"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// activeStreams/totalStreams 为当前活动与累计建立的复用流数量，由 handleChan 维护。
+var activeStreams int32
+var totalStreams int64
+
+// connectTimes 为与服务端成功建立信令连接的次数，减一即为重连次数。
+var connectTimes int32
+
+// streamBytes 为上次上报以来复用流上读写的字节数，streamSince 为上次上报的时刻（Unix 纳秒）。
+var streamBytes int64
+var streamSince = time.Now().UnixNano()
+
+// streamConn 统计复用流上读写的字节数，用于估算复用吞吐与窗口。
+type streamConn struct {
+	net.Conn
+}
+
+// Read 读取并计入字节数。
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&streamBytes, int64(n))
+	return n, err
+}
+
+// Write 写入并计入字节数。
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&streamBytes, int64(n))
+	return n, err
+}
+
+// streamThroughput 返回上次调用以来复用流的平均吞吐（字节/秒），并开始下一周期。
+func streamThroughput() float64 {
+	now := time.Now().UnixNano()
+	since := atomic.SwapInt64(&streamSince, now)
+	n := atomic.SwapInt64(&streamBytes, 0)
+	if now <= since {
+		return 0
+	}
+	return float64(n) / (float64(now-since) / float64(time.Second))
+}
+
+// pingInterval 为链路探测的发送间隔。
+const pingInterval = time.Second * 5
+
+// linkProbe 统计一个上报周期内 ping 的发送、响应与往返时延。
+type linkProbe struct {
+	sent   int
+	recv   int
+	rttSum time.Duration
+	sync.Mutex
+}
+
+// onPing 记录一次 ping 的发送。
+func (p *linkProbe) onPing() {
+	p.Lock()
+	p.sent++
+	p.Unlock()
+}
+
+// onPong 根据服务端回写的时间戳计算本次往返时延。
+func (p *linkProbe) onPong(payload []byte) {
+	ts, err := strconv.ParseInt(string(payload), 10, 64)
+	if err != nil {
+		return
+	}
+	p.Lock()
+	p.recv++
+	p.rttSum += time.Since(time.Unix(0, ts))
+	p.Unlock()
+}
+
+// reset 返回本周期的平均 RTT（毫秒）与丢包率（百分比），并清零计数开始下一周期。
+func (p *linkProbe) reset() (rtt, loss float64) {
+	p.Lock()
+	defer p.Unlock()
+	if p.recv > 0 {
+		rtt = float64(p.rttSum) / float64(p.recv) / float64(time.Millisecond)
+	}
+	if p.sent > 0 && p.recv < p.sent {
+		loss = float64(p.sent-p.recv) * 100 / float64(p.sent)
+	}
+	p.sent, p.recv, p.rttSum = 0, 0, 0
+	return
+}
+
+// telemetry 在信令连接 c 上周期发送 ping 与遥测数据，写入失败时退出。
+func (s *TRPClient) telemetry(c *conn.Conn) {
+	interval := 30
+	if s.cnf != nil && s.cnf.CommonConfig != nil && s.cnf.CommonConfig.TelemetryInterval > 0 {
+		interval = s.cnf.CommonConfig.TelemetryInterval
+	}
+	pingTicker := time.NewTicker(pingInterval)
+	reportTicker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer pingTicker.Stop()
+	defer reportTicker.Stop()
+	for {
+		select {
+		case <-pingTicker.C:
+			s.probe.onPing()
+			if _, err := c.SendSignalInfo(common.MSG_PING, []byte(strconv.FormatInt(time.Now().UnixNano(), 10))); err != nil {
+				return
+			}
+		case <-reportTicker.C:
+			b, err := json.Marshal(s.collectTelemetry())
+			if err != nil {
+				logs.Warn("marshal telemetry error", err.Error())
+				continue
+			}
+			if _, err := c.SendSignalInfo(common.MSG_TELEMETRY, b); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// collectTelemetry 采集一次遥测样本。
+func (s *TRPClient) collectTelemetry() *file.Telemetry {
+	t := &file.Telemetry{
+		Time:          time.Now().Unix(),
+		ActiveStreams: atomic.LoadInt32(&activeStreams),
+		TotalStreams:  atomic.LoadInt64(&totalStreams),
+		Os:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		Version:       version.VERSION,
+	}
+	t.Rtt, t.Loss = s.probe.reset()
+	t.MuxThroughput = streamThroughput()
+	t.MuxWindow = int64(t.MuxThroughput * t.Rtt / 1000)
+	if n := atomic.LoadInt32(&connectTimes); n > 1 {
+		t.Reconnects = n - 1
+	}
+	if percents, err := cpu.Percent(0, false); err == nil && len(percents) > 0 {
+		t.CpuPercent = percents[0]
+	}
+	if m, err := mem.VirtualMemory(); err == nil {
+		t.MemPercent = m.UsedPercent
+	}
+	if s.cnf != nil {
+		for _, v := range s.cnf.Tasks {
+			t.Tasks = append(t.Tasks, fmt.Sprintf("%s(%s:%s)", v.Remark, v.Mode, v.Ports))
+		}
+		for _, v := range s.cnf.Hosts {
+			t.Tasks = append(t.Tasks, fmt.Sprintf("%s(host:%s%s)", v.Remark, v.Host, v.Location))
+		}
+	}
+	return t
+}
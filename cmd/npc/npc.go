@@ -100,6 +100,8 @@ func main() {
 	} else {
 		logs.SetLogger(logs.AdapterFile, `{"level":`+*logLevel+`,"filename":"`+*logPath+`","daily":false,"maxlines":100000,"color":true}`)
 	}
+	// 同时保留最近的日志在内存中，供服务端通过管理命令获取
+	_ = logs.SetLogger("store")
 
 	// 初始化系统服务配置（支持 Windows Service、systemd、SysV）
 	options := make(service.KeyValue)
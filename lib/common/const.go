@@ -18,9 +18,19 @@ const (
 	WORK_P2P_END      = "p2pe"
 	WORK_P2P_LAST     = "p2pl"
 	WORK_STATUS       = "stus"
+	CLUSTER_SYNC      = "csyn" //config sync stream between cluster nodes
+	CLUSTER_RELAY     = "crly" //visitor connection relayed between cluster nodes
 	RES_MSG           = "msg0"
 	RES_CLOSE         = "clse"
 	NEW_UDP_CONN      = "udpc" //p2p udp conn
+	RES_PONG          = "pong" //reply of the signal ping
+	MSG_PING          = "ping" //signal ping from client, used to measure rtt and loss
+	MSG_TELEMETRY     = "tele" //link quality telemetry from client
+	NEW_COMMAND       = "cmdq" //management command from server
+	MSG_CMD_RESULT    = "cmdr" //result of the management command
+	MSG_TARGET_DENY   = "deny" //target rejected by the client side allow-list
+	MSG_TARGET_DIAL   = "dial" //result of dialing the target, used by the passive health check
+	MSG_HEALTH_RESULT = "hlth" //result of the active health check of a target
 	NEW_TASK          = "task"
 	NEW_CONF          = "conf"
 	NEW_HOST          = "host"
@@ -35,4 +45,8 @@ WWW-Authenticate: Basic realm="easyProxy"
 	ConnectionFailBytes = `HTTP/1.1 404 Not Found
 
 `
+	ForbiddenBytes = `HTTP/1.1 403 Forbidden
+Content-Type: text/plain; charset=utf-8
+
+403 Forbidden`
 )
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseCIDRs 解析逗号或换行分隔的 CIDR 列表，单个 IP 视为 /32（IPv6 为 /128）。
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var list []*net.IPNet
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, errors.New("invalid ip " + v)
+			}
+			if ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+// IsIpInCIDRs 判断 ip 是否属于列表中的任一网段
+func IsIpInCIDRs(ip net.IP, list []*net.IPNet) bool {
+	for _, n := range list {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchHostPattern 判断主机名是否匹配模式，不区分大小写。
+// 模式支持精确匹配、"*" 匹配全部以及 "*.example.com" 匹配 example.com 的任意子域名。
+func MatchHostPattern(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern == "" {
+		return false
+	}
+	if pattern == "*" || pattern == host {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return false
+}
+
+// MatchDomainSuffix 判断主机名是否等于 suffix 或为其子域名，suffix 可带前导 "."
+func MatchDomainSuffix(suffix, host string) bool {
+	suffix = strings.ToLower(strings.Trim(strings.TrimSpace(suffix), "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if suffix == "" {
+		return false
+	}
+	return host == suffix || strings.HasSuffix(host, "."+suffix)
+}
+
+// IsPortInRanges 判断端口是否在形如 "80,443,8000-9000" 的端口范围内
+func IsPortInRanges(ranges string, port int) bool {
+	for _, v := range strings.Split(ranges, ",") {
+		v = strings.TrimSpace(v)
+		if fw := strings.Split(v, "-"); len(fw) == 2 {
+			start, err1 := strconv.Atoi(strings.TrimSpace(fw[0]))
+			end, err2 := strconv.Atoi(strings.TrimSpace(fw[1]))
+			if err1 == nil && err2 == nil && port >= start && port <= end {
+				return true
+			}
+		} else if p, err := strconv.Atoi(v); err == nil && p == port {
+			return true
+		}
+	}
+	return false
+}
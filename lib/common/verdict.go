@@ -0,0 +1,42 @@
+package common
+
+import "time"
+
+const (
+	verdictCacheMax = 256         // 缓存的目的地址数上限，超过时清空
+	verdictCacheTTL = time.Minute // 校验结果的有效期，过期后重新校验，域名的解析结果随之更新
+)
+
+// VerdictCache 缓存一次 UDP 会话中各目的地址的校验结果，即校验后的发送地址，为空表示被拒绝。
+// 地址数超过上限时清空，避免向大量不同目的地址发送的会话占用的内存无限增长。
+// 只在转发数据包的 goroutine 中使用，不加锁。
+type VerdictCache struct {
+	m map[string]verdict
+}
+
+type verdict struct {
+	addr    string
+	expires time.Time
+}
+
+// NewVerdictCache 创建一个空的校验结果缓存
+func NewVerdictCache() *VerdictCache {
+	return &VerdictCache{m: make(map[string]verdict)}
+}
+
+// Get 返回目的地址未过期的校验结果
+func (c *VerdictCache) Get(dst string, now time.Time) (string, bool) {
+	v, ok := c.m[dst]
+	if !ok || now.After(v.expires) {
+		return "", false
+	}
+	return v.addr, true
+}
+
+// Set 保存目的地址的校验结果
+func (c *VerdictCache) Set(dst, addr string, now time.Time) {
+	if _, ok := c.m[dst]; !ok && len(c.m) >= verdictCacheMax {
+		c.m = make(map[string]verdict)
+	}
+	c.m[dst] = verdict{addr: addr, expires: now.Add(verdictCacheTTL)}
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestVerdictCache 测试校验结果过期后需重新校验，地址数超过上限时清空
+func TestVerdictCache(t *testing.T) {
+	c := NewVerdictCache()
+	now := time.Unix(1700000000, 0)
+	c.Set("a.lan:53", "10.0.0.1:53", now)
+	c.Set("b.lan:53", "", now)
+	if v, ok := c.Get("a.lan:53", now.Add(verdictCacheTTL)); !ok || v != "10.0.0.1:53" {
+		t.Fatalf("expects the cached address, got %q %v", v, ok)
+	}
+	if v, ok := c.Get("b.lan:53", now); !ok || v != "" {
+		t.Fatalf("expects the cached rejection, got %q %v", v, ok)
+	}
+	if _, ok := c.Get("a.lan:53", now.Add(verdictCacheTTL+time.Second)); ok {
+		t.Fatal("expired verdict is returned")
+	}
+	if _, ok := c.Get("c.lan:53", now); ok {
+		t.Fatal("unknown address is cached")
+	}
+
+	for i := 0; i < verdictCacheMax*3; i++ {
+		dst := "10.0.0.1:" + strconv.Itoa(i)
+		c.Set(dst, dst, now)
+		if len(c.m) > verdictCacheMax {
+			t.Fatalf("cache grows to %d addresses", len(c.m))
+		}
+	}
+	// 已缓存的地址更新结果时不清空
+	n := len(c.m)
+	c.Set("10.0.0.1:767", "", now)
+	if len(c.m) != n {
+		t.Fatal("updating a cached address clears the cache")
+	}
+}
@@ -11,13 +11,16 @@ import (
 )
 
 type CommonConfig struct {
-	Server           string
-	VKey             string
-	Tp               string //bridgeType kcp or tcp
-	AutoReconnection bool
-	ProxyUrl         string
-	Client           *file.Client
-	DisconnectTime   int
+	Server               string
+	VKey                 string
+	Tp                   string //bridgeType kcp or tcp
+	AutoReconnection     bool
+	ProxyUrl             string
+	Client               *file.Client
+	DisconnectTime       int
+	TelemetryInterval    int           // 链路质量遥测上报间隔（秒）
+	DisableRemoteCommand bool          // 是否拒绝服务端下发的管理命令
+	TargetPolicy         *TargetPolicy // 目标白名单，未配置时为 nil
 }
 
 type LocalServer struct {
@@ -44,7 +47,9 @@ type Config struct {
 // 支持以下段落与键：
 // - [common]：server_addr、vkey、conn_type、auto_reconnection、basic_username、basic_password、
 //   web_username、web_password、compress、crypt、proxy_url、rate_limit、flow_limit、max_conn、
-//   remark、pprof_addr、disconnect_timeout 等
+//   remark、pprof_addr、disconnect_timeout、telemetry_interval、
+//   disable_remote_command、allow_target_cidr、allow_target_host、allow_target_port、
+//   allow_conn_type 等
 // - 其他段：如果包含 host 相关键解析为 Host，反之解析为 Tunnel
 // - [secret*]/[p2p*] 且无 mode：解析为本地服务 LocalServer
 // - [health*]：解析为健康检查配置
@@ -94,6 +99,9 @@ func NewConfig(path string) (c *Config, err error) {
 			switch c.title[i] {
 			case "[common]":
 				c.CommonConfig = dealCommon(nowContent)
+				if p := c.CommonConfig.TargetPolicy; p != nil && p.err != nil {
+					return nil, p.err
+				}
 			default:
 				if strings.Index(nowContent, "host") > -1 {
 					h := dealHost(nowContent)
@@ -121,6 +129,7 @@ func getTitleContent(s string) string {
 // dealCommon 解析 [common] 段
 // 将分行的 key=value 文本转换为 CommonConfig，并填充嵌套的 file.Client 参数。
 // 会将字符串转换为布尔值/整数等类型；支持 pprof 初始化与断连超时设置。
+// allow_target_* 与 allow_conn_type 键构成 TargetPolicy 目标白名单。
 // 未识别或缺失的键保持零值。
 func dealCommon(s string) *CommonConfig {
 	c := &CommonConfig{}
@@ -168,15 +177,30 @@ func dealCommon(s string) *CommonConfig {
 			common.InitPProfFromArg(item[1])
 		case "disconnect_timeout":
 			c.DisconnectTime = common.GetIntNoErrByStr(item[1])
+		case "telemetry_interval":
+			c.TelemetryInterval = common.GetIntNoErrByStr(item[1])
+		case "disable_remote_command":
+			c.DisableRemoteCommand = common.GetBoolByStr(item[1])
+		case "allow_target_cidr":
+			c.getTargetPolicy().setCidrs(item[1])
+		case "allow_target_host":
+			c.getTargetPolicy().Hosts = splitList(item[1])
+		case "allow_target_port":
+			c.getTargetPolicy().Ports = item[1]
+		case "allow_conn_type":
+			c.getTargetPolicy().ConnTypes = splitList(item[1])
 		}
 	}
 	return c
 }
 
 // dealHost 解析 Host 段
-// 根据 host、target_addr、host_change、scheme、location 及 header_ 前缀键构造 *file.Host。
-// target_addr 支持逗号分隔，自动转换为换行分隔。
+// 根据 host、target_addr、lb_strategy、host_change、scheme、location、http2、h2c_target、auto_cert、cache、http_compress、maintenance、rule 及 header_ 前缀键构造 *file.Host。
+// target_addr 支持逗号分隔，自动转换为换行分隔，每个目标后可带 weight=N。
 // header_* 键会被聚合到 HeaderChange（形如 key:value 的多行字符串）。
+// rule 键可出现多次，按出现的顺序聚合到 Rules，值中可以包含 =。
+// response_header_* 键按出现的顺序聚合到 RespHeaderChange：名称以 @ 开头为预设（值为参数），
+// 以 + 开头为添加，以 - 开头或值为空为删除，其余为设置。
 func dealHost(s string) *file.Host {
 	h := &file.Host{}
 	h.Target = new(file.Target)
@@ -193,15 +217,72 @@ func dealHost(s string) *file.Host {
 		case "host":
 			h.Host = item[1]
 		case "target_addr":
-			h.Target.TargetStr = strings.Replace(item[1], ",", "\n", -1)
+			h.Target.TargetStr = strings.Replace(strings.SplitN(v, "=", 2)[1], ",", "\n", -1)
+		case "lb_strategy":
+			h.Target.LbStrategy = item[1]
 		case "host_change":
 			h.HostChange = item[1]
 		case "scheme":
 			h.Scheme = item[1]
 		case "location":
 			h.Location = item[1]
+		case "http2":
+			h.Http2 = common.GetBoolByStr(item[1])
+		case "h2c_target":
+			h.H2cTarget = common.GetBoolByStr(item[1])
+		case "auto_cert":
+			h.AutoCert = common.GetBoolByStr(item[1])
+		case "cache":
+			h.Cache = common.GetBoolByStr(item[1])
+		case "http_compress":
+			h.HttpCompress = common.GetBoolByStr(item[1])
+		case "maintenance":
+			h.Maintenance = common.GetBoolByStr(item[1])
+		case "rule":
+			h.Rules += strings.TrimSpace(strings.SplitN(v, "=", 2)[1]) + "\n"
+		case "auth_user":
+			h.AuthUsers += strings.TrimSpace(strings.SplitN(v, "=", 2)[1]) + "\n"
+		case "auth_token":
+			h.AuthTokens += strings.TrimSpace(strings.SplitN(v, "=", 2)[1]) + "\n"
+		case "auth_bypass":
+			h.AuthBypass = item[1]
+		case "auth_cookie_hours":
+			h.AuthCookieHours = common.GetIntNoErrByStr(item[1])
+		case "forward_auth":
+			h.ForwardAuth = strings.TrimSpace(strings.SplitN(v, "=", 2)[1])
+		case "auth_resp_headers":
+			h.AuthRespHeaders = item[1]
+		case "ip_allow":
+			if h.IpAcl == nil {
+				h.IpAcl = new(file.IpAcl)
+			}
+			h.IpAcl.Allow = item[1]
+		case "ip_deny":
+			if h.IpAcl == nil {
+				h.IpAcl = new(file.IpAcl)
+			}
+			h.IpAcl.Deny = item[1]
+		case "ip_rate":
+			if h.RateLimit == nil {
+				h.RateLimit = new(file.RateLimit)
+			}
+			h.RateLimit.Rate = common.GetIntNoErrByStr(item[1])
+		case "ip_burst":
+			if h.RateLimit == nil {
+				h.RateLimit = new(file.RateLimit)
+			}
+			h.RateLimit.Burst = common.GetIntNoErrByStr(item[1])
+		case "ip_ban":
+			if h.RateLimit == nil {
+				h.RateLimit = new(file.RateLimit)
+			}
+			h.RateLimit.BanSeconds = common.GetIntNoErrByStr(item[1])
+		case "proxy_protocol":
+			h.ProxyProtocol = common.GetIntNoErrByStr(item[1])
 		default:
-			if strings.Contains(item[0], "header") {
+			if strings.HasPrefix(item[0], "response_header_") {
+				h.RespHeaderChange += respHeaderLine(strings.TrimPrefix(item[0], "response_header_"), strings.TrimSpace(strings.SplitN(v, "=", 2)[1])) + "\n"
+			} else if strings.Contains(item[0], "header") {
 				headerChange += strings.Replace(item[0], "header_", "", -1) + ":" + item[1] + "\n"
 			}
 			h.HeaderChange = headerChange
@@ -210,13 +291,28 @@ func dealHost(s string) *file.Host {
 	return h
 }
 
+// respHeaderLine 将 response_header_ 键转换为一行响应头规则
+func respHeaderLine(name, value string) string {
+	switch {
+	case strings.HasPrefix(name, "@"):
+		return strings.TrimSpace(name + " " + value)
+	case strings.HasPrefix(name, "-"):
+		return name
+	case value == "":
+		return "-" + name
+	}
+	return name + ": " + value
+}
+
 // dealHealth 解析健康检查段
 // 支持键：health_check_timeout、health_check_max_failed、health_check_interval、
-// health_http_url、health_check_type、health_check_target。
+// health_http_url、health_check_type、health_check_target、health_check_status、
+// health_check_header（可以写多行，每行一个请求头）、health_check_body、health_check_body_regex、
+// health_check_skip_verify、health_check_sni、health_check_send、health_check_dns_name。
 func dealHealth(s string) *file.Health {
 	h := &file.Health{}
 	for _, v := range splitStr(s) {
-		item := strings.Split(v, "=")
+		item := strings.SplitN(v, "=", 2)
 		if len(item) == 0 {
 			continue
 		} else if len(item) == 1 {
@@ -235,13 +331,32 @@ func dealHealth(s string) *file.Health {
 			h.HealthCheckType = item[1]
 		case "health_check_target":
 			h.HealthCheckTarget = item[1]
+		case "health_check_status":
+			h.HealthCheckStatus = item[1]
+		case "health_check_header":
+			if h.HealthCheckHeader != "" {
+				h.HealthCheckHeader += "\n"
+			}
+			h.HealthCheckHeader += item[1]
+		case "health_check_body":
+			h.HealthCheckBody = item[1]
+		case "health_check_body_regex":
+			h.HealthCheckBodyRegex = item[1]
+		case "health_check_skip_verify":
+			h.HealthCheckSkipVerify = common.GetBoolByStr(item[1])
+		case "health_check_sni":
+			h.HealthCheckSni = item[1]
+		case "health_check_send":
+			h.HealthCheckSend = item[1]
+		case "health_check_dns_name":
+			h.HealthCheckDnsName = item[1]
 		}
 	}
 	return h
 }
 
 // dealTunnel 解析隧道段
-// 根据 server_port/server_ip/mode/target_addr/target_port/target_ip/password/local_path/strip_pre 等键
+// 根据 server_port/server_ip/mode/target_addr/lb_strategy/target_port/target_ip/password/local_path/strip_pre/sni_host 等键
 // 构造 *file.Tunnel。若设置 multi_account 为文件路径，将读取并解析为多账号映射。
 func dealTunnel(s string) *file.Tunnel {
 	t := &file.Tunnel{}
@@ -261,7 +376,9 @@ func dealTunnel(s string) *file.Tunnel {
 		case "mode":
 			t.Mode = item[1]
 		case "target_addr":
-			t.Target.TargetStr = strings.Replace(item[1], ",", "\n", -1)
+			t.Target.TargetStr = strings.Replace(strings.SplitN(v, "=", 2)[1], ",", "\n", -1)
+		case "lb_strategy":
+			t.Target.LbStrategy = item[1]
 		case "target_port":
 			t.Target.TargetStr = item[1]
 		case "target_ip":
@@ -272,6 +389,35 @@ func dealTunnel(s string) *file.Tunnel {
 			t.LocalPath = item[1]
 		case "strip_pre":
 			t.StripPre = item[1]
+		case "sni_host":
+			t.SniHost = item[1]
+		case "ip_allow":
+			if t.IpAcl == nil {
+				t.IpAcl = new(file.IpAcl)
+			}
+			t.IpAcl.Allow = item[1]
+		case "ip_deny":
+			if t.IpAcl == nil {
+				t.IpAcl = new(file.IpAcl)
+			}
+			t.IpAcl.Deny = item[1]
+		case "ip_rate":
+			if t.RateLimit == nil {
+				t.RateLimit = new(file.RateLimit)
+			}
+			t.RateLimit.Rate = common.GetIntNoErrByStr(item[1])
+		case "ip_burst":
+			if t.RateLimit == nil {
+				t.RateLimit = new(file.RateLimit)
+			}
+			t.RateLimit.Burst = common.GetIntNoErrByStr(item[1])
+		case "ip_ban":
+			if t.RateLimit == nil {
+				t.RateLimit = new(file.RateLimit)
+			}
+			t.RateLimit.BanSeconds = common.GetIntNoErrByStr(item[1])
+		case "proxy_protocol":
+			t.ProxyProtocol = common.GetIntNoErrByStr(item[1])
 		case "multi_account":
 			t.MultiAccount = &file.MultiAccount{}
 			if common.FileExists(item[1]) {
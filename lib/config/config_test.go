@@ -2,6 +2,7 @@ package config
 
 import (
 	"log"
+	"net"
 	"regexp"
 	"testing"
 )
@@ -67,3 +68,37 @@ func TestGetTitleContent(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestTargetPolicy(t *testing.T) {
+	s := `allow_target_cidr=192.168.1.0/24,10.0.0.1
+allow_target_host=*.lan
+allow_target_port=22,8000-9000
+allow_conn_type=tcp,udp5`
+	p := dealCommon(s).TargetPolicy
+	for _, v := range []string{"192.168.1.5:22", "10.0.0.1:8500", "nas.lan:22"} {
+		if _, err := p.AllowAddr(v); err != nil {
+			t.Errorf("%s should be allowed, %s", v, err)
+		}
+	}
+	for _, v := range []string{"192.168.2.1:22", "192.168.1.5:80", "10.0.0.2:22"} {
+		if _, err := p.AllowAddr(v); err == nil {
+			t.Errorf("%s should be denied", v)
+		}
+	}
+	if p.AllowType("tcp") != nil || p.AllowType("http") == nil {
+		t.Fail()
+	}
+	if _, err := dealCommon("allow_target_cidr=bad").TargetPolicy.AllowAddr("192.168.1.5:22"); err == nil {
+		t.Fail()
+	}
+	// 按 IP 校验的域名返回校验过的 IP，匹配主机名模式时原样返回
+	p = dealCommon("allow_target_cidr=127.0.0.0/8,::1/128\nallow_target_host=*.lan").TargetPolicy
+	if addr, err := p.AllowAddr("localhost:22"); err != nil {
+		t.Error(err)
+	} else if host, _, _ := net.SplitHostPort(addr); net.ParseIP(host) == nil {
+		t.Errorf("expects an ip address to dial, got %s", addr)
+	}
+	if addr, err := p.AllowAddr("nas.lan:22"); err != nil || addr != "nas.lan:22" {
+		t.Errorf("expects nas.lan:22, got %s %v", addr, err)
+	}
+}
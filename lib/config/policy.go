@@ -0,0 +1,111 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"ehang.io/nps/lib/common"
+)
+
+// TargetPolicy 是 npc 侧的目标白名单，handleChan/handleUdp 在拨号前据此校验服务端下发的目标，
+// 防止被篡改或配置错误的服务端把客户端当作进入内网的跳板。
+// 各项为空表示不限制；Cidrs 与 Hosts 同时为空时不限制目标主机。
+type TargetPolicy struct {
+	Cidrs     []*net.IPNet // allow_target_cidr，允许的目标网段
+	Hosts     []string     // allow_target_host，允许的主机名模式，如 *.lan
+	Ports     string       // allow_target_port，允许的端口范围，如 22,80,8000-9000
+	ConnTypes []string     // allow_conn_type，允许的连接类型：tcp、udp、http、udp5
+	err       error        // 解析错误，存在时拒绝所有目标
+}
+
+// ErrTargetDenied 表示目标被本地白名单拒绝
+var ErrTargetDenied = errors.New("target denied by local policy")
+
+// AllowType 校验连接类型是否被允许，policy 为 nil 时全部放行
+func (p *TargetPolicy) AllowType(connType string) error {
+	if p == nil {
+		return nil
+	}
+	if p.err != nil {
+		return p.err
+	}
+	if len(p.ConnTypes) == 0 || common.InStrArr(p.ConnTypes, connType) {
+		return nil
+	}
+	return errors.New(ErrTargetDenied.Error() + ": conn type " + connType + " is not allowed")
+}
+
+// AllowAddr 校验目标地址 host:port 是否被允许，返回拨号时应使用的地址。
+// 主机名匹配 Hosts 中任一模式即放行，否则解析后的所有 IP 均需落在 Cidrs 中；
+// 按 IP 校验时返回校验过的 IP 与端口，拨号时不再重新解析，避免校验之后域名被重新绑定到其他地址。
+func (p *TargetPolicy) AllowAddr(addr string) (string, error) {
+	if p == nil {
+		return addr, nil
+	}
+	if p.err != nil {
+		return "", p.err
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errors.New(ErrTargetDenied.Error() + ": invalid address " + addr)
+	}
+	if p.Ports != "" {
+		if pi, err := strconv.Atoi(port); err != nil || !common.IsPortInRanges(p.Ports, pi) {
+			return "", errors.New(ErrTargetDenied.Error() + ": port " + port + " is not allowed")
+		}
+	}
+	if len(p.Cidrs) == 0 && len(p.Hosts) == 0 {
+		return addr, nil
+	}
+	for _, v := range p.Hosts {
+		if common.MatchHostPattern(v, host) {
+			return addr, nil
+		}
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else if len(p.Cidrs) > 0 {
+		if ips, err = net.LookupIP(host); err != nil {
+			return "", errors.New(ErrTargetDenied.Error() + ": resolve " + host + " error " + err.Error())
+		}
+	}
+	if len(ips) == 0 {
+		return "", errors.New(ErrTargetDenied.Error() + ": host " + host + " is not allowed")
+	}
+	for _, ip := range ips {
+		if !common.IsIpInCIDRs(ip, p.Cidrs) {
+			return "", errors.New(ErrTargetDenied.Error() + ": " + ip.String() + " is not allowed")
+		}
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// getTargetPolicy 返回 CommonConfig 上的目标白名单，不存在时创建
+func (c *CommonConfig) getTargetPolicy() *TargetPolicy {
+	if c.TargetPolicy == nil {
+		c.TargetPolicy = new(TargetPolicy)
+	}
+	return c.TargetPolicy
+}
+
+// setCidrs 解析 allow_target_cidr，格式错误时记录错误，使白名单拒绝所有目标
+func (p *TargetPolicy) setCidrs(s string) {
+	var err error
+	if p.Cidrs, err = common.ParseCIDRs(s); err != nil {
+		p.err = errors.New("allow_target_cidr error: " + err.Error())
+	}
+}
+
+// splitList 按逗号拆分并去除空白项
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,66 @@
+package conn
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"ehang.io/nps/lib/crypt"
+)
+
+// CommandMaxSkew 客户端接受的命令下发时间与本地时间的最大偏差（秒），超出的命令视为过期
+const CommandMaxSkew = 60
+
+// 服务端可下发给客户端的管理命令
+const (
+	COMMAND_VERSION = "version" // 返回客户端版本与运行环境
+	COMMAND_CONFIG  = "config"  // 返回客户端当前配置
+	COMMAND_LOG     = "log"     // 返回最近 N 行日志，Args 为行数
+	COMMAND_RESTART = "restart" // 重启客户端进程
+	COMMAND_RELOAD  = "reload"  // 重新加载配置文件并重连
+	COMMAND_TEST    = "test"    // 从客户端测试到目标的连通性，Args 为 host:port 或 http(s) URL
+)
+
+// Command 表示服务端通过信令连接下发给客户端的一条管理命令。
+// Sign 为使用客户端验证密钥计算的签名，客户端校验通过后才会执行。
+// Id 同时作为随机数，客户端拒绝过期或重复的命令，防止截获的命令被重放。
+type Command struct {
+	Id      string // 请求 ID，结果按此 ID 回传
+	Name    string // 命令名称
+	Args    string // 命令参数
+	Timeout int    // 执行超时（秒）
+	Time    int64  // 下发时间（Unix 秒）
+	Sign    string // 签名
+}
+
+// CommandResult 表示客户端对一条命令的执行结果。
+type CommandResult struct {
+	Id      string // 对应 Command.Id
+	Success bool   // 是否执行成功
+	Result  string // 执行输出或错误信息
+}
+
+// NewCommand 创建一条管理命令并使用客户端验证密钥 vKey 签名。
+func NewCommand(name, args string, timeout int, vKey string) *Command {
+	c := &Command{
+		Id:      crypt.GetRandomString(16),
+		Name:    name,
+		Args:    args,
+		Timeout: timeout,
+		Time:    time.Now().Unix(),
+	}
+	c.Sign = c.GetSign(vKey)
+	return c
+}
+
+// GetSign 计算命令签名：以 vKey 为密钥，对 Id、Name、Args、Timeout、Time 计算 HMAC-SHA256。
+// 各字段以长度为前缀，字段之间的内容无法互相挪动而保持签名不变。
+func (s *Command) GetSign(vKey string) string {
+	h := hmac.New(sha256.New, []byte(vKey))
+	for _, v := range []string{s.Id, s.Name, s.Args, strconv.Itoa(s.Timeout), strconv.FormatInt(s.Time, 10)} {
+		h.Write([]byte(strconv.Itoa(len(v)) + ":" + v))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -182,6 +182,21 @@ func (s *Conn) SetAlive(tp string) {
 		//conn.SetKeepAlivePeriod(time.Duration(2 * time.Second))
 	case *pmux.PortConn:
 		s.Conn.(*pmux.PortConn).SetReadDeadline(time.Time{})
+	case *proxyProtoConn:
+		s.Conn.(*proxyProtoConn).SetReadDeadline(time.Time{})
+	}
+}
+
+// SetKeepAlive 为底层 TCP 连接开启 TCP keepalive，period 为探测间隔。
+// 经 PROXY protocol 包装的连接同样作用于其中的 TCP 连接，其他类型的连接不处理。
+func (s *Conn) SetKeepAlive(period time.Duration) {
+	c := s.Conn
+	if p, ok := c.(*proxyProtoConn); ok {
+		c = p.Conn
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(period)
 	}
 }
 
@@ -195,6 +210,8 @@ func (s *Conn) SetReadDeadlineBySecond(t time.Duration) {
 		s.Conn.(*net.TCPConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
 	case *pmux.PortConn:
 		s.Conn.(*pmux.PortConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
+	case *proxyProtoConn:
+		s.Conn.(*proxyProtoConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
 	}
 }
 
@@ -218,6 +235,22 @@ func (s *Conn) SendHealthInfo(info, status string) (int, error) {
 // 过程：先读长度，再读内容，随后按 common.CONN_DATA_SEQ 拆分为 info 和 status。
 // 返回：info 字符串、status 布尔值与可能的错误。
 func (s *Conn) GetHealthInfo() (info string, status bool, err error) {
+	info, status, _, err = s.GetSignalInfo()
+	return
+}
+
+// SendSignalInfo 通过信令连接发送一条带负载的消息（如 ping、遥测数据）。
+// 格式与健康检查信息一致："kind*#*1*#*payload"，status 固定为 1，
+// 旧版本服务端按健康信息处理时不会误摘除任何目标。
+func (s *Conn) SendSignalInfo(kind string, payload []byte) (int, error) {
+	raw := bytes.NewBuffer([]byte{})
+	common.BinaryWrite(raw, kind, "1", string(payload))
+	return s.Write(raw.Bytes())
+}
+
+// GetSignalInfo 读取一条信令消息，兼容健康检查信息与带负载的扩展消息。
+// 返回：info（健康检查目标或消息类型）、status、可选负载与错误。
+func (s *Conn) GetSignalInfo() (info string, status bool, payload []byte, err error) {
 	var l int
 	buf := common.BufPoolMax.Get().([]byte)
 	defer common.PutBufPoolMax(buf)
@@ -226,12 +259,15 @@ func (s *Conn) GetHealthInfo() (info string, status bool, err error) {
 	} else if _, err = s.ReadLen(l, buf); err != nil {
 		return
 	} else {
-		arr := strings.Split(string(buf[:l]), common.CONN_DATA_SEQ)
+		arr := strings.SplitN(string(buf[:l]), common.CONN_DATA_SEQ, 3)
 		if len(arr) >= 2 {
-			return arr[0], common.GetBoolByStr(arr[1]), nil
+			if len(arr) == 3 {
+				payload = []byte(strings.TrimSuffix(arr[2], common.CONN_DATA_SEQ))
+			}
+			return arr[0], common.GetBoolByStr(arr[1]), payload, nil
 		}
 	}
-	return "", false, errors.New("receive health info error")
+	return "", false, nil, errors.New("receive health info error")
 }
 
 // GetHostInfo 读取主机（Host）配置信息并做必要的默认项填充：
@@ -40,9 +40,13 @@ type Link struct {
 type Option func(*Options)
 
 // Options 包含连接的可选配置参数。
-// 目前主要包含超时时间设置，未来可扩展其他选项。
+// 包含超时时间设置，以及 npc 连接目标后发送的 PROXY protocol 头。
 type Options struct {
-	Timeout time.Duration // 连接超时时间
+	Timeout       time.Duration // 连接超时时间
+	ProxyProtocol int           // 连接目标后发送的 PROXY protocol 版本（1 或 2），0 为不发送
+	LocalAddr     string        // 访问者连接的 nps 地址，作为 PROXY protocol 头中的目标地址
+	FixedTarget   bool          // 目标来自隧道或域名解析配置的目标，拨号结果用于被动健康检查
+	DialAddr      string        // 服务端按目标访问控制规则校验过的地址，与 Host 不同时 npc 拨号此地址而不再解析 Host
 }
 
 // defaultTimeOut 定义默认的连接超时时间为 5 秒。
@@ -97,3 +101,52 @@ func LinkTimeout(t time.Duration) Option {
 		opt.Timeout = t
 	}
 }
+
+// LinkProxyProtocol 返回一个设置 PROXY protocol 的选项函数。
+// 参数:
+//   - version: PROXY protocol 版本，0 为不发送
+//   - localAddr: 访问者连接的 nps 地址
+// 返回值: 配置 PROXY protocol 的选项函数
+func LinkProxyProtocol(version int, localAddr string) Option {
+	return func(opt *Options) {
+		opt.ProxyProtocol = version
+		opt.LocalAddr = localAddr
+	}
+}
+
+// LinkFixedTarget 返回一个标记目标来自隧道或域名解析配置的选项函数。
+// socks5、http 代理等由访问者指定的目标不设置，其拨号结果不用于被动健康检查。
+// 返回值: 设置固定目标标记的选项函数
+func LinkFixedTarget() Option {
+	return func(opt *Options) {
+		opt.FixedTarget = true
+	}
+}
+
+// LinkDialAddr 返回一个设置拨号地址的选项函数。
+// 服务端按 cidr 规则校验域名目标时使用自己的解析结果，npc 拨号同一地址，避免借助 DNS 重绑定绕过规则。
+// 参数:
+//   - addr: 校验过的目标地址（ip:port）
+// 返回值: 配置拨号地址的选项函数
+func LinkDialAddr(addr string) Option {
+	return func(opt *Options) {
+		opt.DialAddr = addr
+	}
+}
+
+// LinkDeny 描述一次被 npc 本地目标白名单拒绝的连接，通过信令连接上报服务端。
+type LinkDeny struct {
+	ConnType   string // 连接类型
+	Host       string // 被拒绝的目标地址
+	RemoteAddr string // 访问者地址
+	Reason     string // 拒绝原因
+	Time       int64  // 拒绝时间（Unix 秒）
+}
+
+// LinkDial 描述 npc 拨号目标的结果，通过信令连接上报服务端，用于被动健康检查。
+type LinkDial struct {
+	ConnType string // 连接类型
+	Host     string // 目标地址
+	Ok       bool   // 是否拨号成功
+	Reason   string // 失败原因
+}
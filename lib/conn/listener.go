@@ -14,6 +14,7 @@ import (
 // NewTcpListenerAndProcess 创建一个 TCP 监听器并开始处理连接。
 // 该函数会在指定地址上创建 TCP 监听器，然后调用 Accept 函数持续接受新连接。
 // 每个新连接都会在独立的 goroutine 中通过提供的处理函数进行处理。
+// 设置了 PROXY protocol 受信任来源时，监听器由 NewProxyListener 包装。
 //
 // 参数:
 //   - addr: 监听地址，格式为 "host:port"（如 ":8080" 或 "127.0.0.1:8080"）
@@ -25,11 +26,11 @@ import (
 //
 // 注意: 此函数会阻塞执行，持续接受新连接直到监听器被关闭
 func NewTcpListenerAndProcess(addr string, f func(c net.Conn), listener *net.Listener) error {
-	var err error
-	*listener, err = net.Listen("tcp", addr)
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
+	*listener = NewProxyListener(l)
 	Accept(*listener, f)
 	return nil
 }
@@ -0,0 +1,329 @@
+package conn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"github.com/astaxie/beego/logs"
+)
+
+// PROXY protocol：npc 连接目标后先发送访问者的真实地址，供 nginx、HAProxy、Postfix 等识别访问者 IP。
+// v1 为文本格式，只用于 TCP；v2 为二进制格式，UDP 时附加在每个数据包之前。
+// nps 位于负载均衡之后时，也可以解析受信任来源发送的 PROXY protocol 头，取得真实的访问者地址。
+
+const (
+	proxyReadTimeout = 10 * time.Second // 读取 PROXY protocol 头的超时时间
+	proxyV1MaxLen    = 107              // v1 头的最大长度，包括结尾的 \r\n
+)
+
+// proxyV2Sig PROXY protocol v2 头的签名
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// CheckProxyProtocol 检查 PROXY protocol 的版本，0 为不发送
+func CheckProxyProtocol(version int) error {
+	if version < 0 || version > 2 {
+		return errors.New("proxy protocol version must be 0, 1 or 2")
+	}
+	return nil
+}
+
+// ProxyHeader 生成 PROXY protocol 头
+// version: 1 或 2，udp 只支持 2
+// network: tcp 或 udp
+// src: 访问者地址（ip:port）
+// dst: 访问者连接的地址（ip:port），无法解析时以与 src 同族的未指定地址代替
+// 返回: src 无法解析时 v1 为 PROXY UNKNOWN，v2 为 LOCAL 命令
+func ProxyHeader(version int, network, src, dst string) ([]byte, error) {
+	srcIp, srcPort := splitProxyAddr(src)
+	dstIp, dstPort := splitProxyAddr(dst)
+	if srcIp != nil && dstIp == nil {
+		dstIp, dstPort = net.IPv4zero, 0
+		if srcIp.To4() == nil {
+			dstIp = net.IPv6unspecified
+		}
+	}
+	v4 := srcIp != nil && srcIp.To4() != nil && dstIp.To4() != nil
+	switch version {
+	case 1:
+		if network != "tcp" {
+			return nil, errors.New("proxy protocol v1 only supports tcp")
+		}
+		if srcIp == nil {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto, srcStr, dstStr := "TCP4", srcIp.String(), dstIp.String()
+		if !v4 {
+			proto, srcStr, dstStr = "TCP6", proxyV6String(srcIp), proxyV6String(dstIp)
+		}
+		return []byte("PROXY " + proto + " " + srcStr + " " + dstStr + " " +
+			strconv.Itoa(srcPort) + " " + strconv.Itoa(dstPort) + "\r\n"), nil
+	case 2:
+		var b bytes.Buffer
+		b.Write(proxyV2Sig)
+		if srcIp == nil {
+			b.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return b.Bytes(), nil
+		}
+		fam := byte(0x20)
+		addr := append(append([]byte{}, srcIp.To16()...), dstIp.To16()...)
+		if v4 {
+			fam = 0x10
+			addr = append(append([]byte{}, srcIp.To4()...), dstIp.To4()...)
+		}
+		if network == "udp" {
+			fam |= 0x02
+		} else {
+			fam |= 0x01
+		}
+		b.Write([]byte{0x21, fam})
+		binary.Write(&b, binary.BigEndian, uint16(len(addr)+4))
+		b.Write(addr)
+		binary.Write(&b, binary.BigEndian, uint16(srcPort))
+		binary.Write(&b, binary.BigEndian, uint16(dstPort))
+		return b.Bytes(), nil
+	}
+	return nil, errors.New("unsupported proxy protocol version " + strconv.Itoa(version))
+}
+
+// splitProxyAddr 解析 ip:port，无法解析时返回 nil
+func splitProxyAddr(addr string) (net.IP, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, 0
+	}
+	return net.ParseIP(host), p
+}
+
+// proxyV6String 返回 TCP6 头中的地址，ipv4 地址以 ipv4 映射的 ipv6 形式表示
+func proxyV6String(ip net.IP) string {
+	if ip.To4() != nil {
+		return "::ffff:" + ip.String()
+	}
+	return ip.String()
+}
+
+// proxyPacketConn 在每个写出的 UDP 数据包之前附加 PROXY protocol v2 头
+type proxyPacketConn struct {
+	net.Conn
+	header []byte
+}
+
+// NewProxyPacketConn 返回在每个数据包之前附加 header 的 UDP 连接
+func NewProxyPacketConn(c net.Conn, header []byte) net.Conn {
+	return &proxyPacketConn{Conn: c, header: header}
+}
+
+// Write 将 header 与数据作为一个数据包写出，返回的长度不含 header
+func (s *proxyPacketConn) Write(b []byte) (int, error) {
+	n, err := s.Conn.Write(append(append(make([]byte, 0, len(s.header)+len(b)), s.header...), b...))
+	if n -= len(s.header); n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// proxyTrusted 允许发送 PROXY protocol 头的来源（[]*net.IPNet），为空时不解析
+var proxyTrusted atomic.Value
+
+// SetProxyTrusted 设置允许发送 PROXY protocol 头的来源 IP 或 CIDR，以逗号或换行分隔，为空时不解析
+func SetProxyTrusted(list string) error {
+	nets, err := common.ParseCIDRs(list)
+	if err != nil {
+		return errors.New("invalid proxy protocol trusted address, " + err.Error())
+	}
+	proxyTrusted.Store(nets)
+	return nil
+}
+
+// isProxyTrusted 判断连接的来源是否允许发送 PROXY protocol 头
+func isProxyTrusted(addr net.Addr) bool {
+	ip, _ := splitProxyAddr(addr.String())
+	if ip == nil {
+		return false
+	}
+	nets, _ := proxyTrusted.Load().([]*net.IPNet)
+	return common.IsIpInCIDRs(ip, nets)
+}
+
+// proxyListener 受信任来源的连接在首次读取或取地址时解析 PROXY protocol 头
+type proxyListener struct {
+	net.Listener
+}
+
+// NewProxyListener 包装监听器，使受信任来源的连接的 RemoteAddr 返回 PROXY protocol 头中的访问者地址
+// 未设置受信任来源时原样返回 l，因此需要在创建监听器之前调用 SetProxyTrusted
+func NewProxyListener(l net.Listener) net.Listener {
+	if nets, _ := proxyTrusted.Load().([]*net.IPNet); len(nets) == 0 {
+		return l
+	}
+	return &proxyListener{Listener: l}
+}
+
+// Accept 不在此处读取头，避免阻塞接受循环
+func (s *proxyListener) Accept() (net.Conn, error) {
+	c, err := s.Listener.Accept()
+	if err != nil || !isProxyTrusted(c.RemoteAddr()) {
+		return c, err
+	}
+	return &proxyProtoConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyProtoConn 解析 PROXY protocol 头之后的连接，没有头时按原地址处理
+type proxyProtoConn struct {
+	net.Conn
+	r        *bufio.Reader
+	once     sync.Once
+	remote   net.Addr
+	err      error
+	lock     sync.Mutex
+	deadline time.Time // 上层设置的读超时，读取头之后恢复
+}
+
+// readHeader 读取 PROXY protocol 头，只执行一次
+func (s *proxyProtoConn) readHeader() {
+	s.once.Do(func() {
+		s.lock.Lock()
+		deadline := s.deadline
+		s.lock.Unlock()
+		if t := time.Now().Add(proxyReadTimeout); deadline.IsZero() || t.Before(deadline) {
+			s.Conn.SetReadDeadline(t)
+		} else {
+			s.Conn.SetReadDeadline(deadline)
+		}
+		s.remote, s.err = ReadProxyHeader(s.r)
+		s.Conn.SetReadDeadline(deadline)
+		if s.err != nil {
+			logs.Warn("read proxy protocol header from %s error %s", s.Conn.RemoteAddr().String(), s.err.Error())
+		}
+	})
+}
+
+// Read 先读取头，头无效时返回错误
+func (s *proxyProtoConn) Read(b []byte) (int, error) {
+	s.readHeader()
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.r.Read(b)
+}
+
+// RemoteAddr 返回头中的访问者地址，没有头或头为 LOCAL、UNKNOWN 时返回原地址
+func (s *proxyProtoConn) RemoteAddr() net.Addr {
+	s.readHeader()
+	if s.remote != nil {
+		return s.remote
+	}
+	return s.Conn.RemoteAddr()
+}
+
+// SetDeadline 记录读超时，供读取头之后恢复
+func (s *proxyProtoConn) SetDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.deadline = t
+	s.lock.Unlock()
+	return s.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline 记录读超时，供读取头之后恢复
+func (s *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.deadline = t
+	s.lock.Unlock()
+	return s.Conn.SetReadDeadline(t)
+}
+
+// ReadProxyHeader 读取 PROXY protocol v1 或 v2 头，返回其中的访问者地址
+// 数据不以头的签名开始时不读取任何数据，返回 nil；LOCAL 命令、UNKNOWN 及非 TCP/UDP 地址也返回 nil
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		if b, err = r.Peek(6); err != nil || string(b) != "PROXY " {
+			return nil, nil
+		}
+		return readProxyV1(r)
+	case proxyV2Sig[0]:
+		if b, err = r.Peek(len(proxyV2Sig)); err != nil || !bytes.Equal(b, proxyV2Sig) {
+			return nil, nil
+		}
+		return readProxyV2(r)
+	}
+	return nil, nil
+}
+
+// readProxyV1 读取文本格式的头：PROXY TCP4|TCP6|UNKNOWN 源地址 目的地址 源端口 目的端口\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid proxy protocol v1 header")
+	}
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, errors.New("invalid proxy protocol v1 header")
+	}
+	ip, port := splitProxyAddr(net.JoinHostPort(f[2], f[4]))
+	if ip == nil || (f[1] == "TCP4") == strings.Contains(f[2], ":") {
+		return nil, errors.New("invalid proxy protocol v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 读取二进制格式的头：签名、版本与命令、地址族与协议、地址长度、地址及 TLV
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, errors.New("invalid proxy protocol v2 version")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch head[12] & 0x0f {
+	case 0x00: // LOCAL，负载均衡自身的连接，例如健康检查
+		return nil, nil
+	case 0x01: // PROXY
+	default:
+		return nil, errors.New("invalid proxy protocol v2 command")
+	}
+	var ip net.IP
+	var port int
+	switch head[13] >> 4 {
+	case 0x1:
+		if len(body) < 12 {
+			return nil, errors.New("invalid proxy protocol v2 address length")
+		}
+		ip, port = net.IP(body[0:4]), int(binary.BigEndian.Uint16(body[8:10]))
+	case 0x2:
+		if len(body) < 36 {
+			return nil, errors.New("invalid proxy protocol v2 address length")
+		}
+		ip, port = net.IP(body[0:16]), int(binary.BigEndian.Uint16(body[32:34]))
+	default: // AF_UNSPEC、AF_UNIX
+		return nil, nil
+	}
+	// 头来自 TCP 连接，地址统一按 TCP 返回，上层可能断言为 *net.TCPAddr
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
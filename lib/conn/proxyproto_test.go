@@ -0,0 +1,186 @@
+package conn
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProxyHeader 测试 PROXY protocol v1/v2 头的生成，以及生成的头能被 ReadProxyHeader 读回访问者地址
+func TestProxyHeader(t *testing.T) {
+	const (
+		sig     = "\r\n\r\n\x00\r\nQUIT\n"
+		v4Addrs = "\x01\x02\x03\x04\x0a\x00\x00\x01"
+		v6Src   = "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+		v6Dst   = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x0a\x00\x00\x01"
+		ports   = "\x16\x2e\x00\x50"
+	)
+	for _, c := range []struct {
+		version         int
+		network         string
+		src, dst        string
+		header, visitor string // 期望的头与读回的访问者地址，header 为空时期望错误
+	}{
+		{1, "tcp", "1.2.3.4:5678", "10.0.0.1:80", "PROXY TCP4 1.2.3.4 10.0.0.1 5678 80\r\n", "1.2.3.4:5678"},
+		{1, "tcp", "[2001:db8::1]:5678", "10.0.0.1:80", "PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 5678 80\r\n", "[2001:db8::1]:5678"},
+		{1, "tcp", "1.2.3.4:5678", "", "PROXY TCP4 1.2.3.4 0.0.0.0 5678 0\r\n", "1.2.3.4:5678"},
+		{1, "tcp", "[2001:db8::1]:5678", "bad", "PROXY TCP6 2001:db8::1 :: 5678 0\r\n", "[2001:db8::1]:5678"},
+		{1, "tcp", "pipe", "10.0.0.1:80", "PROXY UNKNOWN\r\n", ""},
+		{1, "udp", "1.2.3.4:5678", "10.0.0.1:80", "", ""},
+		{2, "tcp", "1.2.3.4:5678", "10.0.0.1:80", sig + "\x21\x11\x00\x0c" + v4Addrs + ports, "1.2.3.4:5678"},
+		{2, "udp", "1.2.3.4:5678", "10.0.0.1:80", sig + "\x21\x12\x00\x0c" + v4Addrs + ports, "1.2.3.4:5678"},
+		{2, "tcp", "[2001:db8::1]:5678", "10.0.0.1:80", sig + "\x21\x21\x00\x24" + v6Src + v6Dst + ports, "[2001:db8::1]:5678"},
+		{2, "tcp", "1.2.3.4:99999", "10.0.0.1:80", sig + "\x20\x00\x00\x00", ""},
+		{3, "tcp", "1.2.3.4:5678", "10.0.0.1:80", "", ""},
+	} {
+		h, err := ProxyHeader(c.version, c.network, c.src, c.dst)
+		if c.header == "" {
+			if err == nil {
+				t.Errorf("v%d %s %s expects an error", c.version, c.network, c.src)
+			}
+			continue
+		}
+		if err != nil || string(h) != c.header {
+			t.Errorf("v%d %s %s %s expects %q, got %q %v", c.version, c.network, c.src, c.dst, c.header, h, err)
+			continue
+		}
+		r := bufio.NewReader(strings.NewReader(string(h) + "data"))
+		addr, err := ReadProxyHeader(r)
+		if err != nil {
+			t.Errorf("read %q error %v", h, err)
+			continue
+		}
+		if (addr == nil && c.visitor != "") || (addr != nil && addr.String() != c.visitor) {
+			t.Errorf("read %q expects %q, got %v", h, c.visitor, addr)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "data" {
+			t.Errorf("read %q leaves %q", h, rest)
+		}
+	}
+
+	if addr, err := ReadProxyHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))); addr != nil || err != nil {
+		t.Fatalf("data without a header expects nil, got %v %v", addr, err)
+	}
+	for _, v := range []string{"PROXY TCP4 1.2.3.4 10.0.0.1 5678\r\n", "PROXY TCP4 2001:db8::1 10.0.0.1 5678 80\r\n", "PROXY TCP4 1.2.3.4 10.0.0.1 5678 80\n", sig + "\x11\x11\x00\x00"} {
+		if _, err := ReadProxyHeader(bufio.NewReader(strings.NewReader(v))); err == nil {
+			t.Errorf("invalid header %q is accepted", v)
+		}
+	}
+}
+
+// TestProxyPacketConn 测试 UDP 时每个数据包之前附加 v2 头，返回的长度不含头
+func TestProxyPacketConn(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	header, err := ProxyHeader(2, "udp", "1.2.3.4:5678", "10.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := NewProxyPacketConn(c, header)
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	for _, payload := range []string{"first", "second packet"} {
+		if n, err := pc.Write([]byte(payload)); err != nil || n != len(payload) {
+			t.Fatalf("write %q returns %d %v", payload, n, err)
+		}
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], append(append([]byte{}, header...), payload...)) {
+			t.Fatalf("packet expects the header and %q, got %q", payload, buf[:n])
+		}
+		addr, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || addr == nil || addr.String() != "1.2.3.4:5678" {
+			t.Fatalf("packet header expects 1.2.3.4:5678, got %v %v", addr, err)
+		}
+	}
+}
+
+// TestProxyListener 测试只解析受信任来源发送的 PROXY protocol 头，访问者地址由 RemoteAddr 返回，头之后的数据不受影响
+func TestProxyListener(t *testing.T) {
+	if err := SetProxyTrusted("127.0.0.1,10.0.0.300"); err == nil {
+		t.Fatal("expects an error for the invalid trusted address")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err = SetProxyTrusted(""); err != nil || NewProxyListener(l) != l {
+		t.Fatal("listener is wrapped without trusted sources")
+	}
+	if err = SetProxyTrusted("127.0.0.1\n::1"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetProxyTrusted("") })
+	pl := NewProxyListener(l)
+
+	accept := func(header []byte) (remote, data string, err error) {
+		t.Helper()
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write(append(header, "hello"...))
+		c.Close()
+		sc, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sc.Close()
+		sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, err := ioutil.ReadAll(sc)
+		return sc.RemoteAddr().String(), string(b), err
+	}
+	header := func(version int, src string) []byte {
+		t.Helper()
+		b, err := ProxyHeader(version, "tcp", src, "192.0.2.1:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	for _, c := range []struct {
+		header []byte
+		remote string // 期望的访问者地址，为空时为原地址
+	}{
+		{nil, ""},
+		{header(1, "10.1.2.3:5000"), "10.1.2.3:5000"},
+		{header(2, "10.1.2.3:5000"), "10.1.2.3:5000"},
+		{header(2, "[2001:db8::1]:5000"), "[2001:db8::1]:5000"},
+		// LOCAL 命令与 UNKNOWN 按原地址处理
+		{header(2, ""), ""},
+		{header(1, ""), ""},
+	} {
+		remote, data, err := accept(c.header)
+		if err != nil || data != "hello" {
+			t.Fatalf("header %q expects hello, got %q %v", c.header, data, err)
+		}
+		if ip, _, _ := net.SplitHostPort(remote); (c.remote == "" && ip != "127.0.0.1") || (c.remote != "" && remote != c.remote) {
+			t.Fatalf("header %q expects remote %q, got %s", c.header, c.remote, remote)
+		}
+	}
+	if _, data, err := accept([]byte("PROXY TCP4 10.1.2.3\r\n")); err == nil || data != "" {
+		t.Fatalf("expects the invalid header to be rejected, got %q %v", data, err)
+	}
+	// 不受信任的来源发送的头不被解析
+	SetProxyTrusted("192.0.2.0/24")
+	remote, data, err := accept(header(1, "10.1.2.3:5000"))
+	if err != nil || remote == "10.1.2.3:5000" || !strings.HasPrefix(data, "PROXY TCP4") {
+		t.Fatalf("expects the header from an untrusted source to be ignored, got %s %q %v", remote, data, err)
+	}
+}
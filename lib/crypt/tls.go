@@ -44,6 +44,11 @@ func InitTls() {
 	}
 }
 
+// GetCert 返回InitTls()生成的自签名证书
+func GetCert() tls.Certificate {
+	return cert
+}
+
 // NewTlsServerConn 创建TLS服务端连接
 // 将普通的网络连接包装成TLS加密连接，用于服务端
 // 使用全局变量cert作为服务端证书
@@ -0,0 +1,192 @@
+package file
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"ehang.io/nps/lib/common"
+	"github.com/pkg/errors"
+)
+
+// DestAcl 隧道的目标访问控制规则，用于 socks5 与 httpProxy 模式在服务端校验访问者请求的目标。
+// Rules 每行一条规则，格式为 "allow|deny cidr|domain|port 值"，按顺序匹配，第一条命中的规则生效：
+//   - cidr：目标 IP 所在网段，单个 IP 视为 /32；目标为域名时按服务端解析结果匹配，无法解析时视为命中拒绝规则
+//   - domain：域名后缀，example.com 匹配其自身及所有子域名
+//   - port：目标端口，支持 80,443,8000-9000 形式
+//
+// 未命中任何规则时按 Default 处理。
+type DestAcl struct {
+	Rules       string  // 规则文本
+	Default     string  // 默认策略：allow 或 deny
+	Hits        []int64 // 每条规则的命中次数
+	DefaultHits int64   // 按默认策略处理的次数
+	rules       []*aclRule
+	sync.RWMutex
+}
+
+// aclRule 解析后的一条规则
+type aclRule struct {
+	allow bool
+	kind  string
+	value string
+	cidrs []*net.IPNet
+}
+
+const (
+	AclAllow = "allow"
+	AclDeny  = "deny"
+)
+
+// NewDestAcl 解析规则文本并创建 DestAcl，规则格式错误时返回错误
+func NewDestAcl(rules, def string) (*DestAcl, error) {
+	a := &DestAcl{Rules: strings.TrimSpace(rules), Default: def}
+	if a.Default != AclDeny {
+		a.Default = AclAllow
+	}
+	if err := a.compile(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetDefault 修改默认策略，保留已有的规则与命中计数
+func (s *DestAcl) SetDefault(def string) {
+	if def != AclDeny {
+		def = AclAllow
+	}
+	s.Lock()
+	s.Default = def
+	s.Unlock()
+}
+
+// MarshalJSON 在锁内以原子方式读取命中计数后序列化，避免与 Allow 并发读写
+func (s *DestAcl) MarshalJSON() ([]byte, error) {
+	s.RLock()
+	hits := make([]int64, len(s.Hits))
+	for i := range s.Hits {
+		hits[i] = atomic.LoadInt64(&s.Hits[i])
+	}
+	v := struct {
+		Rules       string
+		Default     string
+		Hits        []int64
+		DefaultHits int64
+	}{s.Rules, s.Default, hits, atomic.LoadInt64(&s.DefaultHits)}
+	s.RUnlock()
+	return json.Marshal(v)
+}
+
+// compile 解析 Rules，并在规则条数变化时重置命中计数
+func (s *DestAcl) compile() error {
+	var list []*aclRule
+	for i, line := range strings.Split(s.Rules, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 3 || (f[0] != AclAllow && f[0] != AclDeny) {
+			return errors.New("acl rule line " + strconv.Itoa(i+1) + " error, the format is allow|deny cidr|domain|port value")
+		}
+		r := &aclRule{allow: f[0] == AclAllow, kind: f[1], value: f[2]}
+		switch r.kind {
+		case "cidr":
+			var err error
+			if r.cidrs, err = common.ParseCIDRs(r.value); err != nil {
+				return errors.New("acl rule line " + strconv.Itoa(i+1) + " error, " + err.Error())
+			}
+		case "domain", "port":
+		default:
+			return errors.New("acl rule line " + strconv.Itoa(i+1) + " error, unknown type " + r.kind)
+		}
+		list = append(list, r)
+	}
+	s.rules = list
+	if len(s.Hits) != len(list) {
+		s.Hits = make([]int64, len(list))
+	}
+	return nil
+}
+
+// Allow 校验目标地址 host:port 是否允许访问，并累计命中的规则或默认策略的计数。
+// 返回是否允许、命中的规则序号（从 0 开始，按默认策略处理时为 -1）及拨号时应使用的地址：
+// 域名按 cidr 规则校验过时为校验过的 IP，避免客户端重新解析得到不同的结果绕过规则，否则为 addr。
+func (s *DestAcl) Allow(addr string) (bool, int, string) {
+	s.Lock()
+	if s.rules == nil && s.Rules != "" {
+		if err := s.compile(); err != nil {
+			s.Unlock()
+			return false, -1, addr
+		}
+	}
+	rules, def := s.rules, s.Default
+	s.Unlock()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, -1, addr
+	}
+	pi, _ := strconv.Atoi(port)
+	var ips []net.IP
+	resolved := false
+	for i, r := range rules {
+		var match bool
+		switch r.kind {
+		case "cidr":
+			if !resolved {
+				ips, resolved = resolveHost(host), true
+			}
+			match = matchCidrs(r.cidrs, ips, r.allow)
+		case "domain":
+			match = net.ParseIP(host) == nil && common.MatchDomainSuffix(r.value, host)
+		case "port":
+			match = common.IsPortInRanges(r.value, pi)
+		}
+		if match {
+			s.RLock()
+			if i < len(s.Hits) {
+				atomic.AddInt64(&s.Hits[i], 1)
+			}
+			s.RUnlock()
+			return r.allow, i, dialAddr(addr, host, port, ips)
+		}
+	}
+	atomic.AddInt64(&s.DefaultHits, 1)
+	return def != AclDeny, -1, dialAddr(addr, host, port, ips)
+}
+
+// dialAddr 返回拨号时应使用的地址，目标为域名且已解析时为第一个解析结果
+func dialAddr(addr, host, port string, ips []net.IP) string {
+	if len(ips) == 0 || net.ParseIP(host) != nil {
+		return addr
+	}
+	return net.JoinHostPort(ips[0].String(), port)
+}
+
+// resolveHost 返回目标主机对应的 IP，域名解析失败时返回空
+func resolveHost(host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	ips, _ := net.LookupIP(host)
+	return ips
+}
+
+// matchCidrs 判断目标 IP 是否命中网段。
+// 允许规则要求所有 IP 都在网段内，拒绝规则只要任一 IP 在网段内即命中，避免借助域名绕过拒绝规则；
+// 域名无法解析时无从判断，拒绝规则视为命中。
+func matchCidrs(cidrs []*net.IPNet, ips []net.IP, all bool) bool {
+	if len(ips) == 0 {
+		return !all
+	}
+	for _, ip := range ips {
+		if in := common.IsIpInCIDRs(ip, cidrs); all && !in {
+			return false
+		} else if !all && in {
+			return true
+		}
+	}
+	return all
+}
@@ -0,0 +1,58 @@
+package file
+
+import (
+	"net"
+	"testing"
+)
+
+// TestDestAcl 测试目标访问控制按顺序匹配规则，域名无法解析时视为命中拒绝规则，以及返回校验过的拨号地址
+func TestDestAcl(t *testing.T) {
+	for _, c := range []struct {
+		rules, def, addr string
+		ok               bool
+		rule             int
+	}{
+		{"allow cidr 127.0.0.1\ndeny domain nps.test", AclDeny, "127.0.0.1:80", true, 0},
+		{"allow cidr 127.0.0.1\ndeny domain nps.test", AclAllow, "www.nps.test:80", false, 1},
+		{"allow cidr 127.0.0.1\ndeny domain nps.test", AclDeny, "192.0.2.1:80", false, -1},
+		{"deny port 22\nallow cidr 10.0.0.0/8", AclDeny, "10.0.0.1:22", false, 0},
+		{"deny cidr 10.0.0.0/8", AclAllow, "[2001:db8::1]:443", true, -1},
+		// 域名无法解析时拒绝规则视为命中，允许规则视为未命中
+		{"deny cidr 10.0.0.0/8", AclAllow, "nps.invalid:80", false, 0},
+		{"allow cidr 10.0.0.0/8", AclAllow, "nps.invalid:80", true, -1},
+		{"allow cidr 10.0.0.0/8", AclDeny, "nps.invalid:80", false, -1},
+		{"deny cidr 127.0.0.1", AclAllow, "localhost:80", false, 0},
+		{"", AclAllow, "bad address", false, -1},
+	} {
+		a, err := NewDestAcl(c.rules, c.def)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, i, _ := a.Allow(c.addr); ok != c.ok || i != c.rule {
+			t.Errorf("rules %q check %s expects %v %d, got %v %d", c.rules, c.addr, c.ok, c.rule, ok, i)
+		}
+	}
+	if _, err := NewDestAcl("allow cidr 10.0.0.300", AclAllow); err == nil {
+		t.Fatal("expects an error for the invalid cidr")
+	}
+
+	//names checked by cidr rules are pinned to the checked ip, other targets are dialed as they are
+	a, err := NewDestAcl("deny cidr 192.0.2.0/24", AclAllow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, _, dial := a.Allow("localhost:80")
+	host, port, _ := net.SplitHostPort(dial)
+	if ip := net.ParseIP(host); !ok || ip == nil || !ip.IsLoopback() || port != "80" {
+		t.Fatalf("localhost expects to be dialed by its loopback ip, got %v %s", ok, dial)
+	}
+	if _, _, dial = a.Allow("127.0.0.1:80"); dial != "127.0.0.1:80" {
+		t.Fatalf("ip target expects to be dialed as it is, got %s", dial)
+	}
+	if a, err = NewDestAcl("allow domain localhost", AclDeny); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, dial = a.Allow("localhost:80"); dial != "localhost:80" {
+		t.Fatalf("name not checked by cidr rules expects to be dialed as it is, got %s", dial)
+	}
+}
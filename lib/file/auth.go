@@ -0,0 +1,78 @@
+package file
+
+import (
+	"fmt"
+	"strings"
+
+	"ehang.io/nps/lib/common"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 域名解析的认证：设置了认证用户或 Bearer 令牌时由服务端校验访问者，不再使用客户端的 Basic 认证。
+// AuthUsers 每行一个 用户名:密码，保存时明文密码以 bcrypt 哈希代替，已是哈希的保持不变；
+// AuthTokens 每行一个令牌，访问者以 Authorization: Bearer <令牌> 访问；
+// AuthBypass 中的访问者 IP 免认证；AuthCookieHours 大于 0 时认证通过后下发登录 Cookie，有效期内不再要求认证。
+
+// isBcryptHash 判断密码是否已是 bcrypt 哈希
+func isBcryptHash(s string) bool {
+	return len(s) == 60 && (strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$"))
+}
+
+// HashAuthUsers 检查认证用户的写法，并将明文密码替换为 bcrypt 哈希，返回每行一个 用户名:哈希 的文本
+func HashAuthUsers(s string) (string, error) {
+	lines := make([]string, 0)
+	names := make(map[string]bool)
+	for i, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return "", fmt.Errorf("auth user line %d is not in user:password form", i+1)
+		}
+		if names[kv[0]] {
+			return "", fmt.Errorf("auth user %s is duplicated", kv[0])
+		}
+		names[kv[0]] = true
+		if !isBcryptHash(kv[1]) {
+			b, err := bcrypt.GenerateFromPassword([]byte(kv[1]), bcrypt.DefaultCost)
+			if err != nil {
+				return "", err
+			}
+			kv[1] = string(b)
+		}
+		lines = append(lines, kv[0]+":"+kv[1])
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// CheckAuthBypass 检查免认证的 IP 或 CIDR
+func CheckAuthBypass(s string) error {
+	_, err := common.ParseCIDRs(s)
+	return err
+}
+
+// SetAuth 设置域名解析的认证配置，明文密码以 bcrypt 哈希保存
+func (s *Host) SetAuth(users, tokens, bypass string, cookieHours int) error {
+	users, err := HashAuthUsers(users)
+	if err != nil {
+		return err
+	}
+	if err := CheckAuthBypass(bypass); err != nil {
+		return err
+	}
+	if cookieHours < 0 {
+		return errors.New("auth cookie hours can not be negative")
+	}
+	s.AuthUsers = users
+	s.AuthTokens = strings.Join(strings.Fields(tokens), "\n")
+	s.AuthBypass = strings.TrimSpace(bypass)
+	s.AuthCookieHours = cookieHours
+	return nil
+}
+
+// HasAuth 判断域名解析是否设置了自己的认证
+func (s *Host) HasAuth() bool {
+	return s.AuthUsers != "" || s.AuthTokens != ""
+}
@@ -38,6 +38,8 @@ func GetDb() *DbUtils {
 		jsonDb.LoadTaskFromJsonFile()
 		// 从文件加载主机数据
 		jsonDb.LoadHostFromJsonFile()
+		// 从文件加载全局配置
+		jsonDb.LoadGlobalFromJsonFile()
 		// 初始化数据库工具实例
 		Db = &DbUtils{JsonDb: jsonDb}
 	})
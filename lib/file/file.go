@@ -10,7 +10,6 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
-	"sync/atomic"
 
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/rate"
@@ -27,23 +26,29 @@ func NewJsonDb(runPath string) *JsonDb {
 		TaskFilePath:   filepath.Join(runPath, "conf", "tasks.json"),
 		HostFilePath:   filepath.Join(runPath, "conf", "hosts.json"),
 		ClientFilePath: filepath.Join(runPath, "conf", "clients.json"),
+		GlobalFilePath: filepath.Join(runPath, "conf", "global.json"),
 	}
 }
 
 // JsonDb JSON文件数据库结构体
 // 使用sync.Map提供线程安全的内存存储，并支持持久化到JSON文件
 type JsonDb struct {
-	Tasks            sync.Map // 隧道任务存储，key为任务ID，value为*Tunnel
-	Hosts            sync.Map // 主机配置存储，key为主机ID，value为*Host
-	HostsTmp         sync.Map // 临时主机配置存储
-	Clients          sync.Map // 客户端存储，key为客户端ID，value为*Client
-	RunPath          string   // 程序运行路径
-	ClientIncreaseId int32    // 客户端自增ID计数器
-	TaskIncreaseId   int32    // 任务自增ID计数器
-	HostIncreaseId   int32    // 主机自增ID计数器
-	TaskFilePath     string   // 任务配置文件路径
-	HostFilePath     string   // 主机配置文件路径
-	ClientFilePath   string   // 客户端配置文件路径
+	Tasks            sync.Map  // 隧道任务存储，key为任务ID，value为*Tunnel
+	Hosts            sync.Map  // 主机配置存储，key为主机ID，value为*Host
+	HostsTmp         sync.Map  // 临时主机配置存储
+	Clients          sync.Map  // 客户端存储，key为客户端ID，value为*Client
+	RunPath          string    // 程序运行路径
+	ClientIncreaseId int32     // 客户端自增ID计数器
+	TaskIncreaseId   int32     // 任务自增ID计数器
+	HostIncreaseId   int32     // 主机自增ID计数器
+	TaskFilePath     string    // 任务配置文件路径
+	HostFilePath     string    // 主机配置文件路径
+	ClientFilePath   string    // 客户端配置文件路径
+	GlobalFilePath   string    // 全局配置文件路径
+	Global           *Glob     // 全局配置
+	idStep           int32     // 集群模式下自增ID的步长
+	idOffset         int32     // 集群模式下本节点ID的偏移
+	syncer           syncState // 集群同步状态
 }
 
 // LoadTaskFromJsonFile 从JSON文件加载隧道任务配置
@@ -60,6 +65,8 @@ func (s *JsonDb) LoadTaskFromJsonFile() {
 		if post.Client, err = s.GetClient(post.Client.Id); err != nil {
 			return
 		}
+		// 健康检查移除的目标在重启后由健康检查重新判断
+		post.ResetHealth(post.Target)
 		// 存储任务到内存
 		s.Tasks.Store(post.Id, post)
 		// 更新任务ID计数器，确保新任务ID不重复
@@ -113,6 +120,8 @@ func (s *JsonDb) LoadHostFromJsonFile() {
 		if post.Client, err = s.GetClient(post.Client.Id); err != nil {
 			return
 		}
+		// 健康检查移除的目标在重启后由健康检查重新判断
+		post.ResetHealth(post.Target)
 		// 存储主机配置到内存
 		s.Hosts.Store(post.Id, post)
 		// 更新主机ID计数器，确保新主机ID不重复
@@ -142,10 +151,11 @@ func (s *JsonDb) GetClient(id int) (c *Client, err error) {
 var hostLock sync.Mutex
 
 // StoreHostToJsonFile 将主机配置持久化到JSON文件
-// 使用互斥锁确保文件写入的原子性
+// 使用互斥锁确保文件写入的原子性，开启集群同步时通知有变化的对象
 func (s *JsonDb) StoreHostToJsonFile() {
 	hostLock.Lock()
 	storeSyncMapToFile(s.Hosts, s.HostFilePath)
+	s.diffSync(SyncHost, &s.Hosts)
 	hostLock.Unlock()
 }
 
@@ -153,10 +163,11 @@ func (s *JsonDb) StoreHostToJsonFile() {
 var taskLock sync.Mutex
 
 // StoreTasksToJsonFile 将任务配置持久化到JSON文件
-// 使用互斥锁确保文件写入的原子性
+// 使用互斥锁确保文件写入的原子性，开启集群同步时通知有变化的对象
 func (s *JsonDb) StoreTasksToJsonFile() {
 	taskLock.Lock()
 	storeSyncMapToFile(s.Tasks, s.TaskFilePath)
+	s.diffSync(SyncTask, &s.Tasks)
 	taskLock.Unlock()
 }
 
@@ -164,35 +175,36 @@ func (s *JsonDb) StoreTasksToJsonFile() {
 var clientLock sync.Mutex
 
 // StoreClientsToJsonFile 将客户端配置持久化到JSON文件
-// 使用互斥锁确保文件写入的原子性
+// 使用互斥锁确保文件写入的原子性，开启集群同步时通知有变化的对象
 func (s *JsonDb) StoreClientsToJsonFile() {
 	clientLock.Lock()
 	storeSyncMapToFile(s.Clients, s.ClientFilePath)
+	s.diffSync(SyncClient, &s.Clients)
 	clientLock.Unlock()
 }
 
 // GetClientId 获取下一个可用的客户端ID
-// 使用原子操作确保ID的唯一性和线程安全
+// 使用原子操作确保ID的唯一性和线程安全，集群模式下按节点步长分配
 // 返回值:
 //   int32 - 新的客户端ID
 func (s *JsonDb) GetClientId() int32 {
-	return atomic.AddInt32(&s.ClientIncreaseId, 1)
+	return s.nextId(&s.ClientIncreaseId)
 }
 
 // GetTaskId 获取下一个可用的任务ID
-// 使用原子操作确保ID的唯一性和线程安全
+// 使用原子操作确保ID的唯一性和线程安全，集群模式下按节点步长分配
 // 返回值:
 //   int32 - 新的任务ID
 func (s *JsonDb) GetTaskId() int32 {
-	return atomic.AddInt32(&s.TaskIncreaseId, 1)
+	return s.nextId(&s.TaskIncreaseId)
 }
 
 // GetHostId 获取下一个可用的主机ID
-// 使用原子操作确保ID的唯一性和线程安全
+// 使用原子操作确保ID的唯一性和线程安全，集群模式下按节点步长分配
 // 返回值:
 //   int32 - 新的主机ID
 func (s *JsonDb) GetHostId() int32 {
-	return atomic.AddInt32(&s.HostIncreaseId, 1)
+	return s.nextId(&s.HostIncreaseId)
 }
 
 // loadSyncMapFromFile 从文件加载数据到sync.Map
@@ -0,0 +1,37 @@
+package file
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CheckForwardAuth 检查域名解析的外部认证服务地址与复制的响应头。
+// 认证服务的子请求由 nps 发出，非 2xx 的应答原样返回访问者，因此非管理员（admin 为 false，包括 npc 配置文件）
+// 设置的地址必须在 allow（nps.conf 中的 forward_auth_allow）中，否则可以借 nps 访问只有 nps 能访问的地址。
+// allow 以逗号分隔，每项为 host 或 host:port，只写 host 时允许任意端口；为空时只有管理员可以设置外部认证。
+func CheckForwardAuth(authUrl, headers, allow string, admin bool) error {
+	if authUrl == "" {
+		if headers != "" {
+			return errors.New("forward auth headers require a forward auth url")
+		}
+		return nil
+	}
+	u, err := url.Parse(authUrl)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("forward auth url must be an absolute http or https url")
+	}
+	if admin {
+		return nil
+	}
+	for _, v := range strings.Split(allow, ",") {
+		if v = strings.TrimSpace(v); v != "" && (strings.EqualFold(v, u.Host) || strings.EqualFold(v, u.Hostname())) {
+			return nil
+		}
+	}
+	return errors.New("forward auth url " + u.Host + " is not in forward_auth_allow of nps.conf")
+}
@@ -0,0 +1,27 @@
+package file
+
+import "testing"
+
+// TestCheckForwardAuth 测试外部认证服务地址的校验：地址格式，以及非管理员设置的地址需在 forward_auth_allow 中
+func TestCheckForwardAuth(t *testing.T) {
+	allow := "auth.example.com, 127.0.0.1:4181"
+	for _, c := range []struct {
+		url, headers, allow string
+		admin, ok           bool
+	}{
+		{"", "", "", false, true},
+		{"", "X-User", "", true, false},
+		{"ftp://auth.example.com/", "", allow, true, false},
+		{"/auth", "", allow, true, false},
+		{"http://127.0.0.1:8080/", "", "", true, true},
+		{"http://127.0.0.1:8080/", "", "", false, false},
+		{"http://127.0.0.1:8080/", "", allow, false, false},
+		{"http://127.0.0.1:4181/auth", "X-User", allow, false, true},
+		{"https://AUTH.example.com:8443/auth", "", allow, false, true},
+		{"http://auth.example.com.evil.com/", "", allow, false, false},
+	} {
+		if err := CheckForwardAuth(c.url, c.headers, c.allow, c.admin); (err == nil) != c.ok {
+			t.Errorf("CheckForwardAuth(%q, %q, %q, %v) = %v, want ok %v", c.url, c.headers, c.allow, c.admin, err, c.ok)
+		}
+	}
+}
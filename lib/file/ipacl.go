@@ -0,0 +1,163 @@
+package file
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"ehang.io/nps/lib/common"
+	"github.com/astaxie/beego/logs"
+	"github.com/pkg/errors"
+)
+
+// IpAcl 访问者来源 IP 的访问控制，用于隧道与域名解析，在接受连接或请求时校验。
+// Deny 中的访问者拒绝访问；Allow 不为空时只允许其中的访问者。同时命中时拒绝优先。
+// 与 ip_limit 不同，列表是静态配置的，不需要访问者先通过 npc register 登记。
+type IpAcl struct {
+	Allow    string // 允许的 IP 或 CIDR，逗号或换行分隔，为空时不限制
+	Deny     string // 拒绝的 IP 或 CIDR，逗号或换行分隔
+	DenyHits int64  // 拒绝的次数
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	err      error // 解析列表的错误，不为 nil 时拒绝所有访问者
+	compiled bool
+	sync.Mutex
+}
+
+// NewIpAcl 解析允许与拒绝的列表并创建 IpAcl，两者都为空时返回 nil
+func NewIpAcl(allow, deny string) (*IpAcl, error) {
+	a := &IpAcl{Allow: strings.TrimSpace(allow), Deny: strings.TrimSpace(deny)}
+	if a.Allow == "" && a.Deny == "" {
+		return nil, nil
+	}
+	if err := a.compile(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// compile 解析 Allow 与 Deny，解析结果与错误都会保留，不再重复解析，调用时需持有锁
+func (s *IpAcl) compile() error {
+	s.compiled = true
+	var err error
+	if s.allow, err = common.ParseCIDRs(s.Allow); err != nil {
+		s.err = errors.New("allow list error, " + err.Error())
+	} else if s.deny, err = common.ParseCIDRs(s.Deny); err != nil {
+		s.err = errors.New("deny list error, " + err.Error())
+	}
+	return s.err
+}
+
+// Check 校验访问者地址（ip 或 ip:port）是否允许访问，拒绝时累计计数
+// 列表有误（如手工修改了配置文件）时拒绝所有访问者，错误只在第一次校验时记录
+func (s *IpAcl) Check(addr string) bool {
+	if s == nil {
+		return true
+	}
+	s.Lock()
+	if !s.compiled {
+		if err := s.compile(); err != nil {
+			logs.Warn("ip acl error %s, all visitors are denied", err.Error())
+		}
+	}
+	allow, deny, err := s.allow, s.deny, s.err
+	s.Unlock()
+	ip := parseAddrIp(addr)
+	if ip == nil || err != nil || common.IsIpInCIDRs(ip, deny) || (s.Allow != "" && !common.IsIpInCIDRs(ip, allow)) {
+		atomic.AddInt64(&s.DenyHits, 1)
+		return false
+	}
+	return true
+}
+
+// parseAddrIp 从 ip 或 ip:port 形式的地址中取得 IP
+func parseAddrIp(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// Glob 全局配置，保存在 conf/global.json
+type Glob struct {
+	BlockList string // 全局黑名单，访问者 IP 或 CIDR，逗号或换行分隔，对所有隧道与域名解析生效
+	acl       *IpAcl
+	sync.RWMutex
+}
+
+// SetBlockList 设置全局黑名单，列表有误时返回错误，拒绝计数在列表变化时清零
+func (s *Glob) SetBlockList(list string) error {
+	acl, err := NewIpAcl("", list)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if acl == nil || s.acl == nil || acl.Deny != s.acl.Deny {
+		s.acl = acl
+	}
+	s.BlockList = strings.TrimSpace(list)
+	return nil
+}
+
+// Check 校验访问者地址是否不在全局黑名单中
+func (s *Glob) Check(addr string) bool {
+	if s == nil {
+		return true
+	}
+	s.RLock()
+	acl := s.acl
+	s.RUnlock()
+	return acl.Check(addr)
+}
+
+// DenyHits 返回全局黑名单拒绝的次数
+func (s *Glob) DenyHits() int64 {
+	s.RLock()
+	defer s.RUnlock()
+	if s.acl == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.acl.DenyHits)
+}
+
+// LoadGlobalFromJsonFile 从JSON文件加载全局配置，文件不存在时使用空配置
+func (s *JsonDb) LoadGlobalFromJsonFile() {
+	s.Global = new(Glob)
+	if !common.FileExists(s.GlobalFilePath) {
+		return
+	}
+	b, err := common.ReadAllFromFile(s.GlobalFilePath)
+	if err != nil {
+		panic(err)
+	}
+	g := new(Glob)
+	if json.Unmarshal(b, g) != nil {
+		return
+	}
+	if err := s.Global.SetBlockList(g.BlockList); err != nil {
+		logs.Warn("global blocklist is ignored, %s", err.Error())
+	}
+}
+
+// StoreGlobalToJsonFile 将全局配置保存到JSON文件，先写入临时文件再替换
+func (s *JsonDb) StoreGlobalToJsonFile() {
+	s.Global.RLock()
+	b, err := json.Marshal(s.Global)
+	s.Global.RUnlock()
+	if err != nil {
+		logs.Error(err)
+		return
+	}
+	if err := ioutil.WriteFile(s.GlobalFilePath+".tmp", b, 0644); err != nil {
+		logs.Error(err)
+		return
+	}
+	if err := os.Rename(s.GlobalFilePath+".tmp", s.GlobalFilePath); err != nil {
+		logs.Error(err)
+	}
+}
@@ -0,0 +1,86 @@
+package file
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestIpAcl 测试来源 IP 访问控制：白名单、黑名单优先、拒绝计数、列表有误时拒绝所有访问者，以及全局黑名单
+func TestIpAcl(t *testing.T) {
+	var nilAcl *IpAcl
+	if !nilAcl.Check("127.0.0.1:80") {
+		t.Fatal("nil acl denies the visitor")
+	}
+	if a, err := NewIpAcl(" ", "\n"); a != nil || err != nil {
+		t.Fatalf("empty lists expect a nil acl, got %v %v", a, err)
+	}
+	for _, c := range []struct {
+		allow, deny, addr string
+		ok                bool
+	}{
+		{"10.0.0.0/8", "", "127.0.0.1:1234", false},
+		{"10.0.0.0/8,127.0.0.1", "", "127.0.0.1:1234", true},
+		{"10.0.0.0/8\n127.0.0.1", "", "127.0.0.1", true},
+		{"127.0.0.1", "127.0.0.0/8", "127.0.0.1:1234", false},
+		{"", "192.168.0.0/16", "127.0.0.1:1234", true},
+		{"", "192.168.0.0/16", "192.168.1.1:1234", false},
+		{"2001:db8::/32", "", "[2001:db8::1]:443", true},
+		{"2001:db8::/32", "", "[2001:db9::1]:443", false},
+		{"", "10.0.0.0/8", "not an ip", false},
+	} {
+		a, err := NewIpAcl(c.allow, c.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Check(c.addr) != c.ok {
+			t.Errorf("allow %q deny %q check %s expects %v", c.allow, c.deny, c.addr, c.ok)
+		}
+	}
+
+	a, err := NewIpAcl("127.0.0.1", "127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Check("127.0.0.1")
+	a.Check("127.0.0.1")
+	if a.DenyHits != 2 {
+		t.Fatalf("expects 2 denials, got %d", a.DenyHits)
+	}
+	if _, err = NewIpAcl("", "127.0.0.300"); err == nil {
+		t.Fatal("expects an error for the invalid ip")
+	}
+
+	//lists loaded from a hand-edited config file are compiled on the first check, errors deny everyone
+	for _, v := range []string{`{"Allow":"10.0.0.0/33"}`, `{"Deny":"127.0.0.300"}`, `{"Allow":"127.0.0.1","Deny":"bad"}`} {
+		a = new(IpAcl)
+		if err = json.Unmarshal([]byte(v), a); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if a.Check("127.0.0.1:1234") || a.Check("10.0.0.1:1234") {
+				t.Fatalf("malformed acl %s allows the visitor", v)
+			}
+		}
+		if !a.compiled || a.err == nil {
+			t.Fatalf("compile error of %s is not kept", v)
+		}
+	}
+
+	g := new(Glob)
+	if !g.Check("127.0.0.1:1234") {
+		t.Fatal("empty blocklist denies the visitor")
+	}
+	if err = g.SetBlockList("192.168.0.0/16\n127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if g.Check("127.0.0.1:1234") || g.DenyHits() != 1 {
+		t.Fatalf("expects 1 global denial, got %d", g.DenyHits())
+	}
+	if err = g.SetBlockList("10.0.0.300"); err == nil {
+		t.Fatal("expects an error for the invalid blocklist")
+	}
+	g.SetBlockList("192.168.0.0/16")
+	if !g.Check("127.0.0.1:1234") || g.DenyHits() != 0 {
+		t.Fatal("changed blocklist still denies the visitor")
+	}
+}
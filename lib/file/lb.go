@@ -0,0 +1,321 @@
+package file
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"github.com/pkg/errors"
+)
+
+// 负载均衡：目标字符串每行一个目标，地址后可以用空格分隔写参数，目前支持 weight=N（1-100，默认 1），例如
+//   10.0.0.1:80 weight=3
+//   10.0.0.2:80
+// 策略按隧道或域名解析设置：
+//   round_robin 平滑加权轮询（默认，权重都为 1 时即普通轮询）
+//   least_conn  选择活动连接数与权重之比最小的目标
+//   ip_hash     按访问者 IP 的哈希与权重选择目标，同一访问者固定访问同一目标
+//   cookie      以 Cookie 保持会话，仅对域名解析有效，首次访问按加权轮询选择
+
+// 负载均衡策略
+const (
+	LbRoundRobin = "round_robin"
+	LbLeastConn  = "least_conn"
+	LbIpHash     = "ip_hash"
+	LbCookie     = "cookie"
+)
+
+// maxTargetWeight 目标权重的上限
+const maxTargetWeight = 100
+
+// lbState 负载均衡的运行时状态，由 Target 的锁保护
+type lbState struct {
+	targetStr string           // 解析权重时的目标字符串，变化后重新解析
+	weights   map[string]int   // 目标地址的权重
+	current   map[string]int   // 平滑加权轮询的当前权重
+	conns     map[string]int64 // 目标地址的活动连接数
+}
+
+// TargetStat 一个目标的负载均衡状态，用于 web 管理显示
+type TargetStat struct {
+	Addr   string      // 目标地址
+	Weight int         // 权重
+	Conn   int64       // 活动连接数
+	Online bool        // 是否在当前可用的目标中（未被健康检查移除）
+	Health *HealthStat `json:",omitempty"` // 最近一次主动健康检查的结果，未检查时为空
+}
+
+// CheckLbStrategy 检查负载均衡策略，为空时使用默认的加权轮询
+func CheckLbStrategy(s string) error {
+	switch s {
+	case "", LbRoundRobin, LbLeastConn, LbIpHash, LbCookie:
+		return nil
+	}
+	return errors.New("unknown load balancing strategy " + s)
+}
+
+// ParseTargetLine 解析一行目标，返回目标地址与权重
+func ParseTargetLine(line string) (string, int, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", 0, errors.New("target is empty")
+	}
+	weight := 1
+	for _, v := range fields[1:] {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] != "weight" {
+			return "", 0, errors.New("unknown target option " + v)
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n < 1 || n > maxTargetWeight {
+			return "", 0, fmt.Errorf("weight must be between 1 and %d", maxTargetWeight)
+		}
+		weight = n
+	}
+	return fields[0], weight, nil
+}
+
+// CheckTargetStr 检查目标字符串中每一行的写法
+func CheckTargetStr(s string) error {
+	for _, line := range strings.Split(s, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if _, _, err := ParseTargetLine(line); err != nil {
+			return fmt.Errorf("target %s: %s", strings.TrimSpace(line), err.Error())
+		}
+	}
+	return nil
+}
+
+// TargetAddrs 返回目标字符串中的全部目标地址，忽略空行与权重等参数
+func TargetAddrs(s string) []string {
+	arr := make([]string, 0)
+	for _, line := range strings.Split(s, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			arr = append(arr, fields[0])
+		}
+	}
+	return arr
+}
+
+// StickyId 目标地址在会话保持 Cookie 中的标识，避免暴露内网地址
+func StickyId(addr string) string {
+	h := fnv.New32a()
+	h.Write([]byte(addr))
+	return strconv.FormatUint(uint64(h.Sum32()), 16)
+}
+
+// SelectTarget 按负载均衡策略从当前可用的目标中选择一个
+// clientIp 为访问者的 IP，用于 ip_hash；sticky 为访问者 Cookie 中保存的目标标识，用于 cookie，
+// 为空或对应的目标已不可用时按加权轮询选择
+func (s *Target) SelectTarget(clientIp, sticky string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.TargetArr == nil {
+		s.TargetArr = TargetAddrs(s.TargetStr)
+	}
+	switch len(s.TargetArr) {
+	case 0:
+		return "", errors.New("all inward-bending targets are offline")
+	case 1:
+		return s.TargetArr[0], nil
+	}
+	s.loadWeights()
+	switch s.LbStrategy {
+	case LbLeastConn:
+		return s.leastConn(), nil
+	case LbIpHash:
+		if clientIp != "" {
+			return s.ipHash(clientIp), nil
+		}
+	case LbCookie:
+		if sticky != "" {
+			for _, v := range s.TargetArr {
+				if StickyId(v) == sticky {
+					return v, nil
+				}
+			}
+		}
+	}
+	return s.roundRobin(), nil
+}
+
+// loadWeights 目标字符串变化后重新解析权重，调用时需持有锁
+func (s *Target) loadWeights() {
+	if s.lb == nil {
+		s.lb = &lbState{conns: make(map[string]int64)}
+	}
+	if s.lb.weights != nil && s.lb.targetStr == s.TargetStr {
+		return
+	}
+	s.lb.targetStr = s.TargetStr
+	s.lb.weights = make(map[string]int)
+	s.lb.current = make(map[string]int)
+	for _, line := range strings.Split(s.TargetStr, "\n") {
+		if addr, weight, err := ParseTargetLine(line); err == nil {
+			s.lb.weights[addr] = weight
+		}
+	}
+}
+
+// weight 返回目标的权重，不在目标字符串中的目标（如旧版本保存的）权重为 1
+func (s *Target) weight(addr string) int {
+	if w, ok := s.lb.weights[addr]; ok {
+		return w
+	}
+	return 1
+}
+
+// roundRobin 平滑加权轮询：每次各目标的当前权重加上自身权重，选出最大的一个后减去总权重
+func (s *Target) roundRobin() string {
+	total, best := 0, ""
+	for _, v := range s.TargetArr {
+		w := s.weight(v)
+		s.lb.current[v] += w
+		total += w
+		if best == "" || s.lb.current[v] > s.lb.current[best] {
+			best = v
+		}
+	}
+	s.lb.current[best] -= total
+	return best
+}
+
+// leastConn 选择活动连接数与权重之比最小的目标，相同时轮流选择
+func (s *Target) leastConn() string {
+	n := len(s.TargetArr)
+	s.nowIndex = (s.nowIndex + 1) % n
+	best := ""
+	for i := 0; i < n; i++ {
+		v := s.TargetArr[(s.nowIndex+i)%n]
+		if best == "" || s.lb.conns[v]*int64(s.weight(best)) < s.lb.conns[best]*int64(s.weight(v)) {
+			best = v
+		}
+	}
+	return best
+}
+
+// ipHash 按访问者 IP 的哈希在各目标的权重区间中选择
+func (s *Target) ipHash(clientIp string) string {
+	total := 0
+	for _, v := range s.TargetArr {
+		total += s.weight(v)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(clientIp))
+	n := int(h.Sum32() % uint32(total))
+	for _, v := range s.TargetArr {
+		if n -= s.weight(v); n < 0 {
+			return v
+		}
+	}
+	return s.TargetArr[0]
+}
+
+// ConnOpen 记录到目标的连接建立，连接结束时需调用 ConnClose
+func (s *Target) ConnOpen(addr string) {
+	s.Lock()
+	s.loadWeights()
+	s.lb.conns[addr]++
+	s.Unlock()
+}
+
+// ConnClose 记录到目标的连接结束
+func (s *Target) ConnClose(addr string) {
+	s.Lock()
+	if s.lb != nil {
+		if s.lb.conns[addr]--; s.lb.conns[addr] <= 0 {
+			delete(s.lb.conns, addr)
+		}
+	}
+	s.Unlock()
+}
+
+// Stats 返回目标字符串中每个目标的权重、活动连接数与可用状态
+func (s *Target) Stats() []TargetStat {
+	s.Lock()
+	defer s.Unlock()
+	s.loadWeights()
+	stats := make([]TargetStat, 0)
+	for _, v := range TargetAddrs(s.TargetStr) {
+		stats = append(stats, TargetStat{
+			Addr:   v,
+			Weight: s.weight(v),
+			Conn:   s.lb.conns[v],
+			Online: s.TargetArr == nil || common.IsArrContains(s.TargetArr, v),
+		})
+	}
+	return stats
+}
+
+// EjectTarget 从当前可用的目标中暂时摘除地址，用于被动健康检查，返回是否摘除
+// 地址是唯一可用的目标时不摘除，以免全部目标都不可用
+func (s *Target) EjectTarget(addr string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.TargetArr == nil {
+		s.TargetArr = TargetAddrs(s.TargetStr)
+	}
+	if len(s.TargetArr) < 2 || !common.IsArrContains(s.TargetArr, addr) {
+		return false
+	}
+	s.TargetArr = common.RemoveArrVal(s.TargetArr, addr)
+	return true
+}
+
+// RestoreTarget 将摘除的地址放回当前可用的目标，地址已不在目标字符串中时不放回，返回是否放回
+func (s *Target) RestoreTarget(addr string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.TargetArr == nil || common.IsArrContains(s.TargetArr, addr) || !common.IsArrContains(TargetAddrs(s.TargetStr), addr) {
+		return false
+	}
+	s.TargetArr = append(s.TargetArr, addr)
+	return true
+}
+
+// HealthRemove 将健康检查失败的目标从当前可用的目标中移除，并记入 HealthRemoveArr，
+// 调用时需持有隧道或域名解析的锁，TargetArr 在 Target 的锁下修改
+func (s *Health) HealthRemove(t *Target, addr string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.TargetArr == nil || (len(t.TargetArr) == 0 && len(s.HealthRemoveArr) == 0) {
+		t.TargetArr = TargetAddrs(t.TargetStr)
+	}
+	t.TargetArr = common.RemoveArrVal(t.TargetArr, addr)
+	if s.HealthRemoveArr == nil {
+		s.HealthRemoveArr = make([]string, 0)
+	}
+	if !common.IsArrContains(s.HealthRemoveArr, addr) {
+		s.HealthRemoveArr = append(s.HealthRemoveArr, addr)
+	}
+}
+
+// HealthRestore 将健康检查恢复的目标放回当前可用的目标，目标不是由健康检查移除的时不处理，
+// 返回是否放回，调用时需持有隧道或域名解析的锁，TargetArr 在 Target 的锁下修改
+func (s *Health) HealthRestore(t *Target, addr string) bool {
+	t.Lock()
+	defer t.Unlock()
+	if !common.IsArrContains(s.HealthRemoveArr, addr) || common.IsArrContains(t.TargetArr, addr) {
+		return false
+	}
+	t.TargetArr = append(t.TargetArr, addr)
+	s.HealthRemoveArr = common.RemoveArrVal(s.HealthRemoveArr, addr)
+	return true
+}
+
+// ResetHealth 清除健康检查的运行时状态，已移除的目标全部恢复，用于加载或修改配置时，修改时需持有 Health 的锁
+func (s *Health) ResetHealth(t *Target) {
+	s.HealthMap = nil
+	s.HealthRemoveArr = nil
+	s.HealthNextTime = time.Time{}
+	if t != nil {
+		t.Lock()
+		t.TargetArr = nil
+		t.Unlock()
+	}
+}
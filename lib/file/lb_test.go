@@ -0,0 +1,118 @@
+package file
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestHealthRemoveRestore 测试健康检查移除与恢复目标，并与负载均衡选择目标并发执行（配合 -race 检查数据竞争）
+func TestHealthRemoveRestore(t *testing.T) {
+	target := &Target{TargetStr: "a:1\nb:2"}
+	h := new(Health)
+	var owner sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if _, err := target.SelectTarget("", ""); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			owner.Lock()
+			h.HealthRemove(target, "a:1")
+			h.HealthRestore(target, "a:1")
+			owner.Unlock()
+		}
+	}()
+	wg.Wait()
+
+	h.HealthRemove(target, "a:1")
+	if addr, _ := target.SelectTarget("", ""); addr != "b:2" {
+		t.Fatalf("removed target is selected: %s", addr)
+	}
+	if h.HealthRestore(target, "b:2") {
+		t.Fatal("target not removed by the health check is restored")
+	}
+	if !h.HealthRestore(target, "a:1") || len(h.HealthRemoveArr) != 0 {
+		t.Fatal("removed target is not restored")
+	}
+	h.HealthRemove(target, "a:1")
+	h.ResetHealth(target)
+	if len(h.HealthRemoveArr) != 0 || !target.Stats()[0].Online {
+		t.Fatal("ResetHealth does not restore the targets")
+	}
+}
+
+// TestLeastConn 测试 least_conn 按活动连接数与权重之比选择目标，相同时轮流选择，连接结束后释放计数
+func TestLeastConn(t *testing.T) {
+	for _, c := range []struct {
+		targets string
+		conns   map[string]int // 预先建立的连接数
+		want    []string       // 连续选择目标数次后期望选中的目标，多个时为相同比值轮流选中
+	}{
+		{"a:1\nb:1\nc:1", nil, []string{"a:1", "b:1", "c:1"}},
+		{"a:1\nb:1", map[string]int{"a:1": 1}, []string{"b:1"}},
+		{"a:1\nb:1\nc:1", map[string]int{"a:1": 2, "b:1": 1, "c:1": 1}, []string{"b:1", "c:1"}},
+		{"a:1 weight=3\nb:1", map[string]int{"a:1": 2, "b:1": 1}, []string{"a:1"}},
+		{"a:1 weight=2\nb:1", map[string]int{"a:1": 2, "b:1": 1}, []string{"a:1", "b:1"}},
+		{"a:1 weight=2\nb:1", map[string]int{"a:1": 3, "b:1": 1}, []string{"b:1"}},
+	} {
+		target := &Target{TargetStr: c.targets, LbStrategy: LbLeastConn}
+		for addr, n := range c.conns {
+			for i := 0; i < n; i++ {
+				target.ConnOpen(addr)
+			}
+		}
+		picked := make(map[string]bool)
+		for i := 0; i < len(TargetAddrs(c.targets)); i++ {
+			addr, err := target.SelectTarget("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			picked[addr] = true
+		}
+		ok := len(picked) == len(c.want)
+		for _, v := range c.want {
+			ok = ok && picked[v]
+		}
+		if !ok {
+			t.Errorf("targets %q with connections %v expect %v, got %v", c.targets, c.conns, c.want, picked)
+		}
+	}
+
+	target := &Target{TargetStr: "a:1\nb:1", LbStrategy: LbLeastConn}
+	selectTarget := func(want string) {
+		t.Helper()
+		if addr, _ := target.SelectTarget("", ""); addr != want {
+			t.Fatalf("expects %s, got %s", want, addr)
+		}
+	}
+	target.ConnOpen("a:1")
+	target.ConnOpen("a:1")
+	selectTarget("b:1")
+	for i := 0; i < 3; i++ {
+		target.ConnOpen("b:1")
+	}
+	selectTarget("a:1")
+	for i := 0; i < 3; i++ {
+		target.ConnClose("b:1")
+	}
+	selectTarget("b:1")
+	target.ConnClose("a:1")
+	target.ConnClose("a:1")
+	target.ConnClose("a:1")
+	for _, v := range target.Stats() {
+		if v.Conn != 0 {
+			t.Fatalf("connections to %s are not released, %d left", v.Addr, v.Conn)
+		}
+	}
+	if len(target.lb.conns) != 0 {
+		t.Fatalf("released targets are kept, %v", target.lb.conns)
+	}
+}
@@ -3,13 +3,12 @@
 package file
 
 import (
-	"strings"
+	"encoding/json"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"ehang.io/nps/lib/rate"
-	"github.com/pkg/errors"
 )
 
 // Flow 流量统计结构体，用于记录和控制数据流量
@@ -59,6 +58,10 @@ type Client struct {
 	ConfigConnAllow bool       // 是否允许通过配置文件连接
 	MaxTunnelNum    int        // 最大隧道数量
 	Version         string     // 客户端版本
+	Telemetry       *Telemetry // 客户端最近一次上报的链路质量数据
+	TargetDenyNum   int64      // 被客户端本地目标白名单拒绝的连接数
+	TargetDenyLast  string     // 最近一次被拒绝的目标及原因
+	ClusterNode     int        // 集群模式下客户端所连接的其他节点，0 表示未连接到其他节点
 	sync.RWMutex               // 读写锁，保证并发安全
 }
 
@@ -110,7 +113,8 @@ func (s *Client) GetConn() bool {
 func (s *Client) HasTunnel(t *Tunnel) (exist bool) {
 	GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
 		v := value.(*Tunnel)
-		if v.Client.Id == s.Id && v.Port == t.Port && t.Port != 0 {
+		// 同一端口上的 tls-sni 隧道按域名规则区分
+		if v.Client.Id == s.Id && v.Port == t.Port && t.Port != 0 && !(v.Mode == "tls-sni" && t.Mode == "tls-sni" && v.SniHost != t.SniHost) {
 			exist = true
 			return false
 		}
@@ -147,70 +151,158 @@ func (s *Client) HasHost(h *Host) bool {
 	return has
 }
 
+// Telemetry 客户端通过信令通道周期上报的链路质量与运行环境数据
+type Telemetry struct {
+	Time          int64    // 采样时间（Unix 秒）
+	Rtt           float64  // 采样周期内到服务端的平均往返时延（毫秒）
+	Loss          float64  // 采样周期内 ping 未得到响应的比例（百分比）
+	ActiveStreams int32    // 当前活动的复用流数量
+	TotalStreams  int64    // 累计建立的复用流数量
+	MuxThroughput float64  // 采样周期内复用流的平均吞吐（字节/秒）
+	MuxWindow     int64    // 按吞吐与 RTT 估算的复用窗口（带宽时延积，字节）
+	Reconnects    int32    // 客户端启动以来的重连次数
+	CpuPercent    float64  // 客户端所在主机 CPU 使用率
+	MemPercent    float64  // 客户端所在主机内存使用率
+	Os            string   // 客户端操作系统
+	Arch          string   // 客户端 CPU 架构
+	Version       string   // 客户端版本
+	Tasks         []string // 客户端配置文件中的隧道与域名解析
+}
+
 // Tunnel 隧道结构体，表示一个网络隧道配置
 type Tunnel struct {
-	Id           int           // 隧道唯一标识ID
-	Port         int           // 服务器端口
-	ServerIp     string        // 服务器IP地址
-	Mode         string        // 隧道模式（tcp、udp、http等）
-	Status       bool          // 隧道状态（启用/禁用）
-	RunStatus    bool          // 运行状态
-	Client       *Client       // 关联的客户端
-	Ports        string        // 端口范围或多端口配置
-	Flow         *Flow         // 流量统计
-	Password     string        // 隧道密码
-	Remark       string        // 备注信息
-	TargetAddr   string        // 目标地址
-	NoStore      bool          // 是否不存储到文件
-	LocalPath    string        // 本地路径（用于文件服务）
-	StripPre     string        // URL前缀剥离
-	Target       *Target       // 目标配置
-	MultiAccount *MultiAccount // 多账户配置
-	Health                     // 健康检查配置
-	sync.RWMutex              // 读写锁，保证并发安全
+	Id            int           // 隧道唯一标识ID
+	Port          int           // 服务器端口
+	ServerIp      string        // 服务器IP地址
+	Mode          string        // 隧道模式（tcp、udp、http等）
+	Status        bool          // 隧道状态（启用/禁用）
+	RunStatus     bool          // 运行状态
+	Client        *Client       // 关联的客户端
+	Ports         string        // 端口范围或多端口配置
+	Flow          *Flow         // 流量统计
+	Password      string        // 隧道密码
+	Remark        string        // 备注信息
+	TargetAddr    string        // 目标地址
+	NoStore       bool          // 是否不存储到文件
+	LocalPath     string        // 本地路径（用于文件服务）
+	StripPre      string        // URL前缀剥离
+	Target        *Target       // 目标配置
+	MultiAccount  *MultiAccount // 多账户配置
+	DestAcl       *DestAcl      // 目标访问控制规则（socks5、httpProxy 模式）
+	IpAcl         *IpAcl        // 访问者来源 IP 的允许与拒绝列表
+	RateLimit     *RateLimit    // 按访问者 IP 的新建连接速率限制
+	ProxyProtocol int           // npc 连接目标后发送的 PROXY protocol 版本（1 或 2），0 为不发送
+	SniHost       string        // tls-sni 模式按 SNI 匹配的域名规则，多个以逗号分隔，支持 *.example.com
+	Health                      // 健康检查配置
+	sync.RWMutex                // 读写锁，保证并发安全
 }
 
 // Health 健康检查结构体，用于监控隧道或服务的健康状态
 type Health struct {
-	HealthCheckTimeout  int           // 健康检查超时时间（秒）
-	HealthMaxFail       int           // 最大失败次数
-	HealthCheckInterval int           // 健康检查间隔（秒）
-	HealthNextTime      time.Time     // 下次检查时间
-	HealthMap           map[string]int // 健康状态映射
-	HttpHealthUrl       string        // HTTP健康检查URL
-	HealthRemoveArr     []string      // 需要移除的不健康目标
-	HealthCheckType     string        // 健康检查类型
-	HealthCheckTarget   string        // 健康检查目标
-	sync.RWMutex                      // 读写锁，保证并发安全
+	HealthCheckTimeout    int            // 健康检查超时时间（秒）
+	HealthMaxFail         int            // 最大失败次数
+	HealthCheckInterval   int            // 健康检查间隔（秒）
+	HealthNextTime        time.Time      // 下次检查时间
+	HealthMap             map[string]int // 健康状态映射
+	HttpHealthUrl         string         // HTTP健康检查URL
+	HealthRemoveArr       []string       // 需要移除的不健康目标
+	HealthCheckType       string         // 健康检查类型
+	HealthCheckTarget     string         // 健康检查目标
+	HealthCheckStatus     string         // http/https 检查期望的状态码范围，如 200-299,301，为空时为 200
+	HealthCheckHeader     string         // http/https 检查的请求头，每行一个 Name: value
+	HealthCheckBody       string         // 响应体需包含的内容（http/https/udp）
+	HealthCheckBodyRegex  string         // 响应体需匹配的正则（http/https/udp）
+	HealthCheckSkipVerify bool           // https 检查不校验证书
+	HealthCheckSni        string         // https 检查使用的 SNI
+	HealthCheckSend       string         // udp 检查发送的内容
+	HealthCheckDnsName    string         // dns 检查查询的域名，为空时查询根域名
+	sync.RWMutex                         // 读写锁，保证并发安全
+}
+
+// HealthStat 一个目标最近一次主动健康检查的结果，npc 检查后上报服务端，用于 web 管理显示
+type HealthStat struct {
+	Target  string  // 目标地址
+	Type    string  // 检查类型
+	Ok      bool    // 是否健康，连续失败未达到允许次数时仍为健康
+	Fails   int     // 累计的失败次数，恢复后清零
+	Latency float64 // 最近一次检查的耗时（毫秒）
+	Error   string  // 最近一次失败的原因
+	Since   int64   // 进入当前状态的时间（Unix 秒）
+	Time    int64   // 最近一次检查的时间（Unix 秒）
 }
 
 // Host 主机结构体，表示HTTP/HTTPS代理的主机配置
 type Host struct {
-	Id           int     // 主机配置唯一标识ID
-	Host         string  // 主机名或域名
-	HeaderChange string  // 请求头修改规则
-	HostChange   string  // 主机名修改规则
-	Location     string  // URL路由路径
-	Remark       string  // 备注信息
-	Scheme       string  // 协议类型（http、https、all）
-	CertFilePath string  // SSL证书文件路径
-	KeyFilePath  string  // SSL私钥文件路径
-	NoStore      bool    // 是否不存储到文件
-	IsClose      bool    // 是否关闭
-	Flow         *Flow   // 流量统计
-	Client       *Client // 关联的客户端
-	Target       *Target // 目标配置
-	Health       `json:"-"` // 健康检查配置（JSON序列化时忽略）
-	sync.RWMutex            // 读写锁，保证并发安全
+	Id               int        // 主机配置唯一标识ID
+	Host             string     // 主机名或域名
+	HeaderChange     string     // 请求头修改规则
+	RespHeaderChange string     // 响应头修改规则，每行一条（设置、添加、删除及 @hsts 等预设）
+	HostChange       string     // 主机名修改规则
+	Location         string     // URL路由路径
+	Remark           string     // 备注信息
+	Scheme           string     // 协议类型（http、https、all）
+	CertFilePath     string     // SSL证书文件路径
+	KeyFilePath      string     // SSL私钥文件路径
+	CertContent      string     // 粘贴的 PEM 证书，优先于证书文件
+	KeyContent       string     // 粘贴的 PEM 私钥
+	NoStore          bool       // 是否不存储到文件
+	IsClose          bool       // 是否关闭
+	Flow             *Flow      // 流量统计
+	Client           *Client    // 关联的客户端
+	Target           *Target    // 目标配置
+	Http2            bool       // TLS 终止时是否与访问者协商 HTTP/2
+	H2cTarget        bool       // 是否以 h2c（HTTP/2 明文）连接后端，适用于 gRPC
+	AutoCert         bool       // 是否通过 ACME 自动申请与续期证书
+	CertStatus       string     // 自动证书的状态（运行时）
+	Cache            bool       // 是否缓存后端响应（需开启 http_cache）
+	HttpCompress     bool       // 是否按访问者的 Accept-Encoding 以 gzip/brotli 压缩响应
+	Rules            string     // 路由规则，每行一条，按顺序匹配（重写、重定向、指定目标、固定应答）
+	Maintenance      bool       // 是否处于维护状态，维护时直接返回维护页面
+	ErrorPage        string     // 自定义错误页面（HTML 模板），为空时使用全局模板
+	AuthUsers        string     // 认证用户，每行一个 用户名:bcrypt 哈希
+	AuthTokens       string     // Bearer 认证令牌，每行一个
+	AuthBypass       string     // 免认证的访问者 IP 或 CIDR，逗号或换行分隔
+	AuthCookieHours  int        // 认证通过后下发的登录 Cookie 的有效小时数，为 0 时不下发
+	ForwardAuth      string     // 外部认证服务的地址，为空时不使用外部认证
+	AuthRespHeaders  string     // 外部认证通过时从认证服务的响应复制到请求的头，逗号分隔
+	IpAcl            *IpAcl     // 访问者来源 IP 的允许与拒绝列表
+	RateLimit        *RateLimit // 按访问者 IP 的请求速率限制
+	ProxyProtocol    int        // npc 连接目标后发送的 PROXY protocol 版本（1 或 2），0 为不发送
+	Health                      // 健康检查配置（本地代理时由 nps 检查）
+	sync.RWMutex                // 读写锁，保证并发安全
+}
+
+// SetCertStatus 记录自动证书的状态，由后台检查证书时调用
+func (s *Host) SetCertStatus(status string) {
+	s.Lock()
+	s.CertStatus = status
+	s.Unlock()
+}
+
+// GetCertStatus 返回自动证书的状态
+func (s *Host) GetCertStatus() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.CertStatus
+}
+
+// MarshalJSON 在锁内序列化，避免与后台更新的运行时字段（如 CertStatus）并发读写
+func (s *Host) MarshalJSON() ([]byte, error) {
+	type host Host
+	s.RLock()
+	defer s.RUnlock()
+	return json.Marshal((*host)(s))
 }
 
 // Target 目标结构体，用于负载均衡和目标选择
 type Target struct {
-	nowIndex   int      // 当前选择的目标索引
-	TargetStr  string   // 目标字符串（多个目标用换行分隔）
-	TargetArr  []string // 目标数组
-	LocalProxy bool     // 是否为本地代理
-	sync.RWMutex        // 读写锁，保证并发安全
+	nowIndex     int      // 当前选择的目标索引
+	TargetStr    string   // 目标字符串（多个目标用换行分隔，地址后可带 weight=N）
+	TargetArr    []string // 当前可用的目标地址（不含权重）
+	LocalProxy   bool     // 是否为本地代理
+	LbStrategy   string   // 负载均衡策略（round_robin、least_conn、ip_hash、cookie），为空时为加权轮询
+	lb           *lbState // 负载均衡的运行时状态
+	sync.RWMutex          // 读写锁，保证并发安全
 }
 
 // MultiAccount 多账户结构体，用于支持多用户认证
@@ -218,27 +310,23 @@ type MultiAccount struct {
 	AccountMap map[string]string // 账户映射表（用户名->密码）
 }
 
-// GetRandomTarget 获取随机目标地址，实现简单的负载均衡
+// GetRandomTarget 按负载均衡策略获取目标地址，不区分访问者（ip_hash、cookie 时按加权轮询）
 // 返回目标地址和可能的错误
 func (s *Target) GetRandomTarget() (string, error) {
-	// 如果目标数组为空，则解析目标字符串
-	if s.TargetArr == nil {
-		s.TargetArr = strings.Split(s.TargetStr, "\n")
-	}
-	// 如果只有一个目标，直接返回
-	if len(s.TargetArr) == 1 {
-		return s.TargetArr[0], nil
-	}
-	// 如果没有可用目标，返回错误
-	if len(s.TargetArr) == 0 {
-		return "", errors.New("all inward-bending targets are offline")
-	}
-	// 使用轮询方式选择目标
+	return s.SelectTarget("", "")
+}
+
+// HasTarget 判断目标地址是否在当前可用的目标中
+func (s *Target) HasTarget(addr string) bool {
 	s.Lock()
 	defer s.Unlock()
-	if s.nowIndex >= len(s.TargetArr)-1 {
-		s.nowIndex = -1
+	if s.TargetArr == nil {
+		s.TargetArr = TargetAddrs(s.TargetStr)
 	}
-	s.nowIndex++
-	return s.TargetArr[s.nowIndex], nil
+	for _, v := range s.TargetArr {
+		if v == addr {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,216 @@
+package file
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	rateBanWindow   = 10 * time.Second // 统计访问者被限制次数的时间窗口
+	rateIdleTimeout = time.Minute      // 访问者的令牌桶空闲多久后被清理
+)
+
+// RateLimit 按访问者来源 IP 的速率限制，域名解析按请求数计，隧道按新建连接数计。
+// 每个访问者一个令牌桶，每秒补充 Rate 个，最多积累 Burst 个；
+// BanSeconds 大于 0 时，访问者在 10 秒内被限制的次数达到 Rate 的 10 倍（即持续以两倍以上的速率访问）将被封禁。
+type RateLimit struct {
+	Rate       int   // 每个访问者 IP 每秒允许的请求或连接数
+	Burst      int   // 允许的突发数，为 0 时与 Rate 相同
+	BanSeconds int   // 封禁的秒数，为 0 时不封禁
+	Limited    int64 // 被限制的次数（包括封禁期间的拒绝）
+	Banned     int64 // 封禁的次数
+	visitors   map[string]*rateVisitor
+	lastSweep  time.Time
+	now        func() time.Time // 当前时间，为 nil 时为 time.Now，测试时替换
+	sync.Mutex
+}
+
+// rateVisitor 一个访问者的令牌桶与封禁状态
+type rateVisitor struct {
+	tokens      float64
+	last        time.Time
+	rejected    int       // 当前窗口内被限制的次数
+	windowStart time.Time // 当前窗口的开始时间
+	bannedUntil time.Time
+}
+
+// BannedVisitor 被封禁的访问者
+type BannedVisitor struct {
+	Ip    string
+	Until time.Time
+}
+
+// NewRateLimit 检查并创建速率限制，rate 为 0 时返回 nil
+func NewRateLimit(rate, burst, banSeconds int) (*RateLimit, error) {
+	if rate < 0 || burst < 0 || banSeconds < 0 {
+		return nil, errors.New("rate limit can not be negative")
+	}
+	if rate == 0 {
+		if burst != 0 || banSeconds != 0 {
+			return nil, errors.New("rate limit burst and ban require a rate")
+		}
+		return nil, nil
+	}
+	return &RateLimit{Rate: rate, Burst: burst, BanSeconds: banSeconds}, nil
+}
+
+// Same 判断配置是否与 rate、burst、banSeconds 相同
+func (s *RateLimit) Same(rate, burst, banSeconds int) bool {
+	return s != nil && s.Rate == rate && s.Burst == burst && s.BanSeconds == banSeconds
+}
+
+// clock 返回当前时间
+func (s *RateLimit) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// Allow 校验访问者地址（ip 或 ip:port）的一次请求或连接，超出限制或处于封禁期间时返回false并累计计数
+func (s *RateLimit) Allow(addr string) bool {
+	if s == nil || s.Rate <= 0 {
+		return true
+	}
+	ip := addr
+	if p := parseAddrIp(addr); p != nil {
+		ip = p.String()
+	}
+	now := s.clock()
+	burst := float64(s.Burst)
+	if burst <= 0 {
+		burst = float64(s.Rate)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.visitors == nil {
+		s.visitors = make(map[string]*rateVisitor)
+	}
+	s.sweep(now)
+	v, ok := s.visitors[ip]
+	if !ok {
+		v = &rateVisitor{tokens: burst, last: now, windowStart: now}
+		s.visitors[ip] = v
+	}
+	if now.Before(v.bannedUntil) {
+		atomic.AddInt64(&s.Limited, 1)
+		return false
+	}
+	v.tokens += now.Sub(v.last).Seconds() * float64(s.Rate)
+	if v.tokens > burst {
+		v.tokens = burst
+	}
+	v.last = now
+	if v.tokens >= 1 {
+		v.tokens--
+		return true
+	}
+	atomic.AddInt64(&s.Limited, 1)
+	if s.BanSeconds > 0 {
+		if now.Sub(v.windowStart) > rateBanWindow {
+			v.windowStart, v.rejected = now, 0
+		}
+		if v.rejected++; v.rejected >= s.Rate*int(rateBanWindow/time.Second) {
+			v.bannedUntil = now.Add(time.Duration(s.BanSeconds) * time.Second)
+			v.windowStart, v.rejected = now, 0
+			atomic.AddInt64(&s.Banned, 1)
+		}
+	}
+	return false
+}
+
+// sweep 清理空闲且未被封禁的访问者，每分钟最多执行一次，调用时需持有锁
+func (s *RateLimit) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < rateIdleTimeout {
+		return
+	}
+	s.lastSweep = now
+	for ip, v := range s.visitors {
+		if now.Sub(v.last) > rateIdleTimeout && now.After(v.bannedUntil) {
+			delete(s.visitors, ip)
+		}
+	}
+}
+
+// BannedList 返回封禁中的访问者，按 IP 排序
+func (s *RateLimit) BannedList() []BannedVisitor {
+	list := make([]BannedVisitor, 0)
+	if s == nil {
+		return list
+	}
+	now := s.clock()
+	s.Lock()
+	for ip, v := range s.visitors {
+		if now.Before(v.bannedUntil) {
+			list = append(list, BannedVisitor{Ip: ip, Until: v.bannedUntil})
+		}
+	}
+	s.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Ip < list[j].Ip })
+	return list
+}
+
+// Unban 解除访问者的封禁，ip 为空时解除全部，返回解除的数量
+func (s *RateLimit) Unban(ip string) int {
+	if s == nil {
+		return 0
+	}
+	now := s.clock()
+	n := 0
+	s.Lock()
+	for k, v := range s.visitors {
+		if (ip == "" || k == ip) && now.Before(v.bannedUntil) {
+			v.bannedUntil = time.Time{}
+			v.windowStart, v.rejected = now, 0
+			n++
+		}
+	}
+	s.Unlock()
+	return n
+}
+
+// BannedEntry 被隧道或域名解析封禁的访问者
+type BannedEntry struct {
+	Kind   string // task 或 host
+	Id     int    // 隧道或域名解析的 id
+	Remark string // 隧道的备注或域名解析的域名
+	BannedVisitor
+}
+
+// GetBannedList 返回所有隧道与域名解析中封禁中的访问者
+func (s *DbUtils) GetBannedList() []*BannedEntry {
+	list := make([]*BannedEntry, 0)
+	s.JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		t := value.(*Tunnel)
+		for _, v := range t.RateLimit.BannedList() {
+			list = append(list, &BannedEntry{Kind: "task", Id: t.Id, Remark: t.Remark, BannedVisitor: v})
+		}
+		return true
+	})
+	s.JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		h := value.(*Host)
+		for _, v := range h.RateLimit.BannedList() {
+			list = append(list, &BannedEntry{Kind: "host", Id: h.Id, Remark: h.Host, BannedVisitor: v})
+		}
+		return true
+	})
+	return list
+}
+
+// Unban 在所有隧道与域名解析中解除访问者的封禁，ip 为空时解除全部，返回解除的数量
+func (s *DbUtils) Unban(ip string) int {
+	n := 0
+	s.JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		n += value.(*Tunnel).RateLimit.Unban(ip)
+		return true
+	})
+	s.JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		n += value.(*Host).RateLimit.Unban(ip)
+		return true
+	})
+	return n
+}
@@ -0,0 +1,93 @@
+package file
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRateLimit 测试按访问者 IP 的令牌桶限速、突发、封禁与解除封禁，以及空闲访问者的清理，时间由替换的时钟控制
+func TestRateLimit(t *testing.T) {
+	var nilLimit *RateLimit
+	if !nilLimit.Allow("127.0.0.1:1234") || len(nilLimit.BannedList()) != 0 || nilLimit.Unban("") != 0 {
+		t.Fatal("nil rate limit limits the visitor")
+	}
+	for _, c := range [][3]int{{-1, 0, 0}, {0, 5, 0}, {0, 0, 60}} {
+		if _, err := NewRateLimit(c[0], c[1], c[2]); err == nil {
+			t.Fatalf("expects an error for %v", c)
+		}
+	}
+	if r, err := NewRateLimit(0, 0, 0); r != nil || err != nil {
+		t.Fatalf("zero rate expects a nil rate limit, got %v %v", r, err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	newLimit := func(rate, burst, ban int) *RateLimit {
+		r, err := NewRateLimit(rate, burst, ban)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.now = func() time.Time { return now }
+		return r
+	}
+	allow := func(r *RateLimit, addr string, want ...bool) {
+		t.Helper()
+		for i, w := range want {
+			if got := r.Allow(addr); got != w {
+				t.Fatalf("request %d of %s expects %v, got %v", i, addr, w, got)
+			}
+		}
+	}
+
+	r := newLimit(2, 0, 0)
+	allow(r, "127.0.0.1:1", true, true, false)
+	//visitors are counted by ip, not by port
+	allow(r, "127.0.0.1:2", false)
+	allow(r, "127.0.0.2:1", true)
+	now = now.Add(500 * time.Millisecond)
+	allow(r, "127.0.0.1:1", true, false)
+	if r.Limited != 3 {
+		t.Fatalf("expects 3 limited requests, got %d", r.Limited)
+	}
+
+	r = newLimit(1, 3, 0)
+	allow(r, "127.0.0.1", true, true, true, false)
+	now = now.Add(10 * time.Second)
+	allow(r, "127.0.0.1", true, true, true, false)
+
+	//banned after being limited rate*10 times in 10 seconds
+	r = newLimit(1, 0, 60)
+	allow(r, "127.0.0.1", true)
+	for i := 0; i < 9; i++ {
+		allow(r, "127.0.0.1", false)
+	}
+	if r.Banned != 0 || len(r.BannedList()) != 0 {
+		t.Fatal("visitor banned before reaching the limit")
+	}
+	allow(r, "127.0.0.1", false)
+	if list := r.BannedList(); r.Banned != 1 || len(list) != 1 || list[0].Ip != "127.0.0.1" || !list[0].Until.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expects 127.0.0.1 to be banned for a minute, got %d %v", r.Banned, list)
+	}
+	now = now.Add(30 * time.Second)
+	allow(r, "127.0.0.1", false)
+	if r.Unban("127.0.0.2") != 0 || r.Unban("127.0.0.1") != 1 {
+		t.Fatal("expects 1 visitor to be unbanned")
+	}
+	allow(r, "127.0.0.1", true)
+	for i := 0; i < 10; i++ {
+		r.Allow("127.0.0.1")
+	}
+	now = now.Add(time.Minute + time.Second)
+	if len(r.BannedList()) != 0 {
+		t.Fatal("ban does not expire")
+	}
+	allow(r, "127.0.0.1", true)
+
+	//idle visitors are swept
+	r = newLimit(1, 0, 0)
+	allow(r, "127.0.0.1", true)
+	now = now.Add(2 * rateIdleTimeout)
+	allow(r, "127.0.0.2", true)
+	if _, ok := r.visitors["127.0.0.1"]; ok || len(r.visitors) != 1 {
+		t.Fatalf("idle visitor is not swept, %d visitors", len(r.visitors))
+	}
+}
@@ -0,0 +1,235 @@
+package file
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 集群同步的对象类型
+const (
+	SyncClient = "client"
+	SyncTask   = "task"
+	SyncHost   = "host"
+)
+
+// SyncEvent 集群节点之间同步的一次配置变更。
+// 各节点对同一对象以变更时间较新者为准，删除以墓碑记录，避免节点重连后恢复已删除的对象。
+type SyncEvent struct {
+	Kind string          // 对象类型：client、task、host
+	Id   int             // 对象ID
+	Time int64           // 变更时间（UnixNano），从文件加载的对象为 0
+	Del  bool            // 是否为删除
+	Data json.RawMessage // 去除运行时字段后的对象JSON，删除时为空
+}
+
+// runtimeFields 各类对象中只属于本节点、不参与集群同步的运行时字段
+var runtimeFields = map[string][]string{
+	SyncClient: {"Addr", "IsConnect", "NowConn", "Version", "Rate", "Flow.ExportFlow", "Flow.InletFlow",
+		"Telemetry", "TargetDenyNum", "TargetDenyLast", "ClusterNode"},
+	SyncTask: {"RunStatus", "Flow.ExportFlow", "Flow.InletFlow", "Target.TargetArr",
+		"HealthMap", "HealthRemoveArr", "HealthNextTime", "DestAcl.Hits", "DestAcl.DefaultHits",
+		"IpAcl.DenyHits", "RateLimit.Limited", "RateLimit.Banned"},
+	SyncHost: {"Flow.ExportFlow", "Flow.InletFlow", "Target.TargetArr", "CertStatus", "IpAcl.DenyHits",
+		"RateLimit.Limited", "RateLimit.Banned"},
+}
+
+// syncState 集群同步状态：各对象最近一次同步的内容与正在应用远端变更的对象
+type syncState struct {
+	onSync func(e *SyncEvent)
+	synced sync.Map // map[string]*SyncEvent，key 为 kind-id
+	muted  sync.Map // map[string]struct{}
+}
+
+// syncKey 返回对象在同步状态中的key
+func syncKey(kind string, id int) string {
+	return kind + "-" + strconv.Itoa(id)
+}
+
+// SyncData 返回对象用于集群同步的JSON：去除运行时字段，关联的客户端只保留ID
+func SyncData(kind string, v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	for _, f := range runtimeFields[kind] {
+		delField(m, strings.Split(f, "."))
+	}
+	if c, ok := m["Client"].(map[string]interface{}); ok {
+		m["Client"] = map[string]interface{}{"Id": c["Id"]}
+	}
+	return json.Marshal(m)
+}
+
+// delField 按路径删除嵌套map中的字段
+func delField(m map[string]interface{}, path []string) {
+	if len(path) == 1 {
+		delete(m, path[0])
+		return
+	}
+	if sub, ok := m[path[0]].(map[string]interface{}); ok {
+		delField(sub, path[1:])
+	}
+}
+
+// isNoStore 判断对象是否为不存储（本节点临时）的对象
+func isNoStore(v interface{}) bool {
+	switch t := v.(type) {
+	case *Client:
+		return t.NoStore
+	case *Tunnel:
+		return t.NoStore
+	case *Host:
+		return t.NoStore
+	}
+	return true
+}
+
+// EnableSync 开启集群同步，记录当前所有对象的内容，之后每次持久化时将有变化的对象通过 f 通知。
+// f 在持久化的锁内调用，不应阻塞。
+func (s *JsonDb) EnableSync(f func(e *SyncEvent)) {
+	for kind, m := range map[string]*sync.Map{SyncClient: &s.Clients, SyncTask: &s.Tasks, SyncHost: &s.Hosts} {
+		m.Range(func(key, value interface{}) bool {
+			if !isNoStore(value) {
+				if b, err := SyncData(kind, value); err == nil {
+					s.syncer.synced.Store(syncKey(kind, key.(int)), &SyncEvent{Kind: kind, Id: key.(int), Data: b})
+				}
+			}
+			return true
+		})
+	}
+	s.syncer.onSync = f
+}
+
+// diffSync 比较对象与上次同步的内容，对新增、修改与删除的对象发出同步事件
+func (s *JsonDb) diffSync(kind string, m *sync.Map) {
+	if s.syncer.onSync == nil {
+		return
+	}
+	exist := make(map[int]bool)
+	m.Range(func(key, value interface{}) bool {
+		if isNoStore(value) {
+			return true
+		}
+		id := key.(int)
+		exist[id] = true
+		k := syncKey(kind, id)
+		if _, ok := s.syncer.muted.Load(k); ok {
+			return true
+		}
+		b, err := SyncData(kind, value)
+		if err != nil {
+			return true
+		}
+		if old, ok := s.syncer.synced.Load(k); !ok || old.(*SyncEvent).Del || string(old.(*SyncEvent).Data) != string(b) {
+			e := &SyncEvent{Kind: kind, Id: id, Time: time.Now().UnixNano(), Data: b}
+			s.syncer.synced.Store(k, e)
+			s.syncer.onSync(e)
+		}
+		return true
+	})
+	s.syncer.synced.Range(func(key, value interface{}) bool {
+		e := value.(*SyncEvent)
+		if e.Kind != kind || e.Del || exist[e.Id] {
+			return true
+		}
+		if _, ok := s.syncer.muted.Load(key); !ok {
+			d := &SyncEvent{Kind: kind, Id: e.Id, Time: time.Now().UnixNano(), Del: true}
+			s.syncer.synced.Store(key, d)
+			s.syncer.onSync(d)
+		}
+		return true
+	})
+}
+
+// IsSyncNewer 判断远端的变更是否比本节点记录的更新，只有更新的变更才需要应用
+func (s *JsonDb) IsSyncNewer(e *SyncEvent) bool {
+	if v, ok := s.syncer.synced.Load(syncKey(e.Kind, e.Id)); ok {
+		old := v.(*SyncEvent)
+		return e.Time > old.Time && (e.Del != old.Del || string(e.Data) != string(old.Data))
+	}
+	return !e.Del
+}
+
+// ApplySync 应用远端变更：执行 f 期间屏蔽该对象的同步事件，成功后记录远端的变更时间与对象的最新内容
+func (s *JsonDb) ApplySync(e *SyncEvent, f func() error) error {
+	k := syncKey(e.Kind, e.Id)
+	s.syncer.muted.Store(k, struct{}{})
+	defer s.syncer.muted.Delete(k)
+	if err := f(); err != nil {
+		return err
+	}
+	var m *sync.Map
+	switch e.Kind {
+	case SyncClient:
+		m = &s.Clients
+		s.raiseId(&s.ClientIncreaseId, e.Id)
+	case SyncTask:
+		m = &s.Tasks
+		s.raiseId(&s.TaskIncreaseId, e.Id)
+	case SyncHost:
+		m = &s.Hosts
+		s.raiseId(&s.HostIncreaseId, e.Id)
+	default:
+		return nil
+	}
+	r := &SyncEvent{Kind: e.Kind, Id: e.Id, Time: e.Time, Del: true}
+	if v, ok := m.Load(e.Id); ok && !isNoStore(v) {
+		if b, err := SyncData(e.Kind, v); err == nil {
+			r.Del, r.Data = false, b
+		}
+	}
+	s.syncer.synced.Store(k, r)
+	return nil
+}
+
+// SyncSnapshot 返回本节点记录的所有对象（含已删除对象的墓碑），用于节点重连后的全量同步。
+// 按客户端、隧道、域名解析的顺序排列，保证对端应用隧道与域名解析时所属客户端已存在。
+func (s *JsonDb) SyncSnapshot() []*SyncEvent {
+	order := map[string]int{SyncClient: 0, SyncTask: 1, SyncHost: 2}
+	list := make([]*SyncEvent, 0)
+	s.syncer.synced.Range(func(key, value interface{}) bool {
+		list = append(list, value.(*SyncEvent))
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return order[list[i].Kind] < order[list[j].Kind]
+		}
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+// SetIdStep 设置自增ID的步长与偏移，集群中各节点分配的ID互不冲突
+func (s *JsonDb) SetIdStep(step, offset int32) {
+	s.idStep, s.idOffset = step, offset
+}
+
+// nextId 分配下一个自增ID，集群模式下只分配属于本节点的ID
+func (s *JsonDb) nextId(p *int32) int32 {
+	for {
+		id := atomic.AddInt32(p, 1)
+		if s.idStep <= 1 || id%s.idStep == s.idOffset {
+			return id
+		}
+	}
+}
+
+// raiseId 确保自增ID计数器不小于 id
+func (s *JsonDb) raiseId(p *int32, id int) {
+	for {
+		old := atomic.LoadInt32(p)
+		if int32(id) <= old || atomic.CompareAndSwapInt32(p, old, int32(id)) {
+			return
+		}
+	}
+}
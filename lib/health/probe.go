@@ -0,0 +1,233 @@
+// Package health 实现健康检查的各类探测，npc 的主动健康检查与 nps 对本地代理目标的健康检查共用。
+//
+// 检查类型（HealthCheckType）：
+//
+//	tcp   能在超时时间内建立 TCP 连接即为健康
+//	http  GET http://目标+HttpHealthUrl，状态码在 HealthCheckStatus 中（默认 200），跟随重定向
+//	https 同 http，可以不校验证书（HealthCheckSkipVerify）并指定 SNI（HealthCheckSni）
+//	udp   发送 HealthCheckSend 的内容，超时时间内收到应答即为健康
+//	dns   查询 HealthCheckDnsName（默认 .）的 A 记录，应答码为 NOERROR 或 NXDOMAIN 即为健康
+//
+// http、https 与 udp 可以要求响应体包含 HealthCheckBody 或匹配正则 HealthCheckBodyRegex。
+// 未知的类型按 http 检查。
+package health
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"ehang.io/nps/lib/file"
+	"github.com/pkg/errors"
+)
+
+// maxBodySize 匹配响应体时最多读取的字节数
+const maxBodySize = 64 << 10
+
+// Probe 按健康检查配置探测一个目标，返回耗时与失败原因
+// 调用时不能持有 h 的锁，配置在锁内复制后使用
+func Probe(h *file.Health, target string) (time.Duration, error) {
+	h = probeConfig(h)
+	start := time.Now()
+	timeout := time.Duration(h.HealthCheckTimeout) * time.Second
+	var err error
+	switch h.HealthCheckType {
+	case "tcp":
+		var c net.Conn
+		if c, err = net.DialTimeout("tcp", target, timeout); err == nil {
+			c.Close()
+		}
+	case "udp":
+		err = probeUdp(h, target, timeout)
+	case "dns":
+		err = probeDns(h, target, timeout)
+	case "https":
+		err = probeHttp(h, "https://"+target+h.HttpHealthUrl)
+	default:
+		err = probeHttp(h, "http://"+target+h.HttpHealthUrl)
+	}
+	return time.Since(start), err
+}
+
+// probeConfig 在锁内复制探测使用的配置，web 中修改配置时在锁内原地更新
+func probeConfig(h *file.Health) *file.Health {
+	h.RLock()
+	defer h.RUnlock()
+	return &file.Health{
+		HealthCheckTimeout:    h.HealthCheckTimeout,
+		HealthCheckType:       h.HealthCheckType,
+		HttpHealthUrl:         h.HttpHealthUrl,
+		HealthCheckStatus:     h.HealthCheckStatus,
+		HealthCheckHeader:     h.HealthCheckHeader,
+		HealthCheckBody:       h.HealthCheckBody,
+		HealthCheckBodyRegex:  h.HealthCheckBodyRegex,
+		HealthCheckSkipVerify: h.HealthCheckSkipVerify,
+		HealthCheckSni:        h.HealthCheckSni,
+		HealthCheckSend:       h.HealthCheckSend,
+		HealthCheckDnsName:    h.HealthCheckDnsName,
+	}
+}
+
+// httpClient 按健康检查当前的配置创建 HTTP 客户端，不保持连接，配置在 web 或 npc 配置中修改后下次检查即生效
+func httpClient(h *file.Health) *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(h.HealthCheckTimeout) * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: h.HealthCheckSkipVerify, ServerName: h.HealthCheckSni},
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// probeHttp 以 GET 请求检查目标的状态码与响应体
+func probeHttp(h *file.Health, url string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(h.HealthCheckHeader, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			continue
+		}
+		if name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]); strings.EqualFold(name, "host") {
+			req.Host = value
+		} else {
+			req.Header.Set(name, value)
+		}
+	}
+	rs, err := httpClient(h).Do(req)
+	if err != nil {
+		return err
+	}
+	defer rs.Body.Close()
+	if ok, err := MatchStatus(h.HealthCheckStatus, rs.StatusCode); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("status code %d is not expected", rs.StatusCode)
+	}
+	if h.HealthCheckBody == "" && h.HealthCheckBodyRegex == "" {
+		return nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(rs.Body, maxBodySize))
+	if err != nil {
+		return err
+	}
+	return matchBody(h, b)
+}
+
+// MatchStatus 判断状态码是否在期望的范围中，范围如 200-299,301，为空时只有 200 符合
+func MatchStatus(s string, code int) (bool, error) {
+	if s == "" {
+		return code == http.StatusOK, nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(v), "-", 2)
+		min, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return false, errors.New("invalid status code range " + v)
+		}
+		max := min
+		if len(bounds) == 2 {
+			if max, err = strconv.Atoi(bounds[1]); err != nil {
+				return false, errors.New("invalid status code range " + v)
+			}
+		}
+		if code >= min && code <= max {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchBody 检查响应体是否包含要求的内容并匹配正则
+func matchBody(h *file.Health, b []byte) error {
+	if h.HealthCheckBody != "" && !bytes.Contains(b, []byte(h.HealthCheckBody)) {
+		return errors.New("response body does not contain " + h.HealthCheckBody)
+	}
+	if h.HealthCheckBodyRegex != "" {
+		re, err := regexp.Compile(h.HealthCheckBodyRegex)
+		if err != nil {
+			return err
+		}
+		if !re.Match(b) {
+			return errors.New("response body does not match " + h.HealthCheckBodyRegex)
+		}
+	}
+	return nil
+}
+
+// probeUdp 发送探测内容并等待应答
+func probeUdp(h *file.Health, target string, timeout time.Duration) error {
+	c, err := net.DialTimeout("udp", target, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err = c.Write([]byte(h.HealthCheckSend)); err != nil {
+		return err
+	}
+	b := make([]byte, 65535)
+	n, err := c.Read(b)
+	if err != nil {
+		return err
+	}
+	return matchBody(h, b[:n])
+}
+
+// probeDns 向目标发送 DNS 查询并检查应答码
+func probeDns(h *file.Health, target string, timeout time.Duration) error {
+	c, err := net.DialTimeout("udp", target, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	id := uint16(rand.Intn(1 << 16))
+	if _, err = c.Write(dnsQuery(id, h.HealthCheckDnsName)); err != nil {
+		return err
+	}
+	b := make([]byte, 1500)
+	for {
+		n, err := c.Read(b)
+		if err != nil {
+			return err
+		}
+		//ignore the responses of other queries
+		if n < 12 || binary.BigEndian.Uint16(b) != id || b[2]&0x80 == 0 {
+			continue
+		}
+		switch rcode := b[3] & 0x0f; rcode {
+		case 0, 3:
+			return nil
+		default:
+			return fmt.Errorf("dns response code %d", rcode)
+		}
+	}
+}
+
+// dnsQuery 构造查询 A 记录的 DNS 请求，域名为空时查询根域名
+func dnsQuery(id uint16, name string) []byte {
+	b := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(b, id)
+	b[2] = 1 //recursion desired
+	b[5] = 1 //one question
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		if label != "" && len(label) < 64 {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0, 0, 1, 0, 1) //type A, class IN
+}
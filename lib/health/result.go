@@ -0,0 +1,69 @@
+package health
+
+import (
+	"regexp"
+	"time"
+
+	"ehang.io/nps/lib/file"
+	"github.com/pkg/errors"
+)
+
+// 检查结果引起的目标状态变化，与 npc 通过 SendHealthInfo 上报的标志相同
+const (
+	ChangeNone    = ""
+	ChangeRemove  = "0" // 失败次数达到允许次数（的整数倍），应移除目标
+	ChangeRestore = "1" // 此前已移除的目标检查成功，应恢复目标
+)
+
+// CheckHealth 检查健康检查配置中的类型、状态码范围与正则
+func CheckHealth(h *file.Health) error {
+	switch h.HealthCheckType {
+	case "", "tcp", "http", "https", "udp", "dns":
+	default:
+		return errors.New("unknown health check type " + h.HealthCheckType)
+	}
+	if _, err := MatchStatus(h.HealthCheckStatus, 0); err != nil {
+		return err
+	}
+	if h.HealthCheckBodyRegex != "" {
+		if _, err := regexp.Compile(h.HealthCheckBodyRegex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update 按一次检查的结果更新目标的失败计数 HealthMap，返回目标状态的变化与新的检查结果，调用时需持有 Health 的锁
+// last 为该目标上一次的检查结果，没有时为 nil；返回的检查结果是新的副本，不会修改 last
+func Update(h *file.Health, target string, last *file.HealthStat, latency time.Duration, err error) (string, *file.HealthStat) {
+	if h.HealthMap == nil {
+		h.HealthMap = make(map[string]int)
+	}
+	change := ChangeNone
+	if err != nil {
+		h.HealthMap[target] += 1
+		if h.HealthMap[target]%h.HealthMaxFail == 0 {
+			change = ChangeRemove
+		}
+	} else if h.HealthMap[target] >= h.HealthMaxFail {
+		h.HealthMap[target] = 0
+		change = ChangeRestore
+	}
+
+	now := time.Now().Unix()
+	stat := &file.HealthStat{Target: target, Ok: true, Since: now}
+	if last != nil {
+		*stat = *last
+	}
+	stat.Type = h.HealthCheckType
+	stat.Fails = h.HealthMap[target]
+	stat.Latency = float64(latency.Microseconds()) / 1000
+	stat.Time = now
+	if err != nil {
+		stat.Error = err.Error()
+	}
+	if healthy := h.HealthMap[target] < h.HealthMaxFail; healthy != stat.Ok {
+		stat.Ok, stat.Since = healthy, now
+	}
+	return change, stat
+}
@@ -43,14 +43,17 @@ type PortMux struct {
 	httpConn    chan *PortConn      // HTTP连接通道
 	httpsConn   chan *PortConn      // HTTPS连接通道
 	managerConn chan *PortConn      // 管理器连接通道
+	wrap        []func(net.Listener) net.Listener // 包装底层监听器，例如解析 PROXY protocol 头
 }
 
 // NewPortMux 创建新的端口复用器
 // port: 要监听的端口号
 // managerHost: 管理器主机地址，用于区分管理连接和普通HTTP连接
+// wrap: 可选，包装底层监听器，在协议识别之前生效
 // 返回: 初始化后的PortMux实例
-func NewPortMux(port int, managerHost string) *PortMux {
+func NewPortMux(port int, managerHost string, wrap ...func(net.Listener) net.Listener) *PortMux {
 	pMux := &PortMux{
+		wrap:        wrap,
 		managerHost: managerHost,
 		port:        port,
 		clientConn:  make(chan *PortConn),
@@ -76,6 +79,9 @@ func (pMux *PortMux) Start() error {
 		logs.Error(err)
 		os.Exit(0)
 	}
+	for _, w := range pMux.wrap {
+		pMux.Listener = w(pMux.Listener)
+	}
 	// 启动接受连接的协程
 	go func() {
 		for {
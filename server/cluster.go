@@ -0,0 +1,525 @@
+// Package server 中的 cluster.go 实现多个 nps 节点组成的双活集群。
+//
+// 设计要点：
+//  1. 各节点在 nps.conf 中配置相同的 cluster_nodes 与 cluster_secret，以及各自的 cluster_node_id；
+//  2. 节点之间通过 TLS 长连接同步客户端、隧道与域名解析的配置变更，对同一对象以变更时间较新者为准；
+//  3. 各节点定时向其他节点发送连接到本节点的客户端列表，形成客户端所在节点的注册表；
+//  4. 访问者连接到达的节点未持有目标客户端的 bridge 会话时，经持有该客户端的节点中转；
+//  5. 自增 ID 按节点数量分段分配，不同节点新增的对象 ID 不会冲突；
+//  6. 节点之间的认证签名绑定 TLS 会话导出的密钥材料，被中间人转发的签名无法在另一个会话中使用，
+//     配置 cluster_ca_file 时还按集群 CA 双向校验节点证书。
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	clusterHeartbeat = time.Second * 3  // 心跳间隔，同时携带本节点的客户端列表
+	clusterExpire    = time.Second * 10 // 注册表中客户端所在节点的有效期
+	clusterRetry     = time.Second * 5  // 与其他节点断开后的重连间隔
+	clusterMaxMsg    = 1 << 20          // 单条消息的最大长度
+)
+
+// Cluster 集群状态，未开启集群模式时为 nil
+var Cluster *cluster
+
+// clusterNode 集群中的一个节点
+type clusterNode struct {
+	Id   int
+	Addr string
+	msgs chan *file.SyncEvent // 等待发送给该节点的配置变更
+}
+
+// clusterAuth 节点之间建立连接时的认证信息，发起方发送后由接受方以相同的 Nonce 应答
+type clusterAuth struct {
+	Node  int    // 发送认证信息的节点
+	Nonce string // 发起方生成的随机数
+	Sign  string // HMAC-SHA256(cluster_secret, 角色 + Node + Nonce + TLS 会话导出的密钥材料)
+}
+
+// clusterMsg 同步连接上的一条消息，Event 为空时是心跳
+type clusterMsg struct {
+	Clients []int           // 连接到发送节点的客户端
+	Event   *file.SyncEvent // 配置变更
+}
+
+// clusterRelay 中转连接的请求与应答
+type clusterRelay struct {
+	ClientId int
+	Mode     string     // 隧道模式，file 模式不加密压缩
+	Link     *conn.Link // 请求时为访问者的链路信息，应答时为持有节点实际使用的链路信息
+	Err      string     // 应答时的错误信息
+}
+
+// clusterOwner 注册表中客户端所在的节点
+type clusterOwner struct {
+	node   int
+	expire time.Time
+}
+
+// cluster 集群模式的运行状态
+type cluster struct {
+	self      int
+	secret    string
+	nodes     map[int]*clusterNode
+	owners    sync.Map    // map[int]*clusterOwner，key 为客户端ID
+	serverTls *tls.Config // 接受其他节点连接时的 TLS 配置
+	clientTls *tls.Config // 连接其他节点时的 TLS 配置
+}
+
+// newCluster 解析 cluster_node_id、cluster_nodes 与 cluster_secret，未配置 cluster_nodes 时返回 nil
+func newCluster() (*cluster, error) {
+	list := beego.AppConfig.String("cluster_nodes")
+	if list == "" {
+		return nil, nil
+	}
+	s := &cluster{secret: beego.AppConfig.String("cluster_secret"), nodes: make(map[int]*clusterNode)}
+	var err error
+	if s.self, err = beego.AppConfig.Int("cluster_node_id"); err != nil {
+		return nil, errors.New("cluster_node_id error")
+	}
+	if s.secret == "" {
+		return nil, errors.New("cluster_secret is required in cluster mode")
+	}
+	for _, v := range strings.Split(list, ",") {
+		arr := strings.SplitN(strings.TrimSpace(v), "@", 2)
+		if len(arr) != 2 {
+			return nil, errors.New("cluster_nodes format error, such as 1@10.0.0.1:8100,2@10.0.0.2:8100")
+		}
+		id, err := strconv.Atoi(arr[0])
+		if err != nil || id <= 0 {
+			return nil, errors.New("cluster node id error " + arr[0])
+		}
+		if _, ok := s.nodes[id]; ok {
+			return nil, errors.New("cluster node id duplicate " + arr[0])
+		}
+		s.nodes[id] = &clusterNode{Id: id, Addr: arr[1], msgs: make(chan *file.SyncEvent, 1024)}
+	}
+	if _, ok := s.nodes[s.self]; !ok {
+		return nil, errors.New("cluster_node_id " + strconv.Itoa(s.self) + " is not in cluster_nodes")
+	}
+	if s.serverTls, s.clientTls, err = clusterTlsConfig(beego.AppConfig.String("cluster_ca_file"),
+		beego.AppConfig.String("cluster_cert_file"), beego.AppConfig.String("cluster_key_file")); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// clusterTlsConfig 创建节点之间连接的 TLS 配置。
+// 未配置 CA 时使用服务端的自签名证书且不校验对方证书，由绑定会话的认证签名防止中间人；
+// 配置 CA 时双方都必须出示由该 CA 签发的证书，不校验证书中的主机名。
+func clusterTlsConfig(caFile, certFile, keyFile string) (*tls.Config, *tls.Config, error) {
+	if caFile == "" {
+		return &tls.Config{Certificates: []tls.Certificate{crypt.GetCert()}}, &tls.Config{InsecureSkipVerify: true}, nil
+	}
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, nil, errors.New("read cluster_ca_file error " + err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, nil, errors.New("cluster_ca_file contains no certificate")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, errors.New("load cluster_cert_file and cluster_key_file error " + err.Error())
+	}
+	verify := func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("cluster node certificate is required")
+		}
+		opts := x509.VerifyOptions{Roots: pool, Intermediates: x509.NewCertPool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+		for _, c := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+	server := &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAnyClientCert, VerifyConnection: verify}
+	client := &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true, VerifyConnection: verify}
+	return server, client, nil
+}
+
+// StartCluster 按配置开启集群模式，需在创建 Bridge 之后、启动任务之前调用
+func StartCluster() {
+	c, err := newCluster()
+	if err != nil {
+		logs.Error("start cluster error %s", err.Error())
+		return
+	}
+	if c == nil {
+		return
+	}
+	ids := make([]int, 0)
+	for id := range c.nodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for i, id := range ids {
+		if id == c.self {
+			file.GetDb().JsonDb.SetIdStep(int32(len(ids)), int32(i))
+		}
+	}
+	l, err := net.Listen("tcp", c.nodes[c.self].Addr)
+	if err != nil {
+		logs.Error("cluster listen %s error %s", c.nodes[c.self].Addr, err.Error())
+		return
+	}
+	Cluster = c
+	Bridge.Relay = c.relay
+	file.GetDb().JsonDb.EnableSync(c.broadcast)
+	go c.accept(l)
+	for _, n := range c.nodes {
+		if n.Id != c.self {
+			go c.keepNode(n)
+		}
+	}
+	logs.Info("cluster node %d started at %s, %d nodes", c.self, c.nodes[c.self].Addr, len(c.nodes))
+}
+
+// broadcast 将配置变更放入各节点的发送队列，队列已满时丢弃，待重连后由全量同步补齐
+func (s *cluster) broadcast(e *file.SyncEvent) {
+	for _, n := range s.nodes {
+		if n.Id == s.self {
+			continue
+		}
+		select {
+		case n.msgs <- e:
+		default:
+			logs.Warn("cluster node %d send queue is full, the change of %s %d will be synced after reconnecting", n.Id, e.Kind, e.Id)
+		}
+	}
+}
+
+// sign 计算认证签名，role 区分发起方与接受方，binding 为 TLS 会话导出的密钥材料
+func (s *cluster) sign(role string, node int, nonce string, binding []byte) string {
+	h := hmac.New(sha256.New, []byte(s.secret))
+	h.Write([]byte(role + "|" + strconv.Itoa(node) + "|" + nonce + "|"))
+	h.Write(binding)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verify 校验认证签名
+func (s *cluster) verify(role string, auth *clusterAuth, binding []byte) bool {
+	return auth.Nonce != "" && hmac.Equal([]byte(auth.Sign), []byte(s.sign(role, auth.Node, auth.Nonce, binding)))
+}
+
+// tlsBinding 完成 TLS 握手，返回本次会话导出的密钥材料，用于将认证签名绑定到该会话
+func tlsBinding(c *tls.Conn) ([]byte, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	st := c.ConnectionState()
+	return st.ExportKeyingMaterial("nps cluster auth", nil, 32)
+}
+
+// dial 连接到指定节点，发送连接用途与认证信息，并校验对方节点的应答
+func (s *cluster) dial(n *clusterNode, flag string) (*conn.Conn, error) {
+	raw, err := net.DialTimeout("tcp", n.Addr, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(raw, s.clientTls)
+	c := conn.NewConn(tc)
+	c.SetDeadline(time.Now().Add(time.Second * 10))
+	if err = s.dialAuth(n, c, tc, flag); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// dialAuth 发起方的认证过程
+func (s *cluster) dialAuth(n *clusterNode, c *conn.Conn, tc *tls.Conn, flag string) error {
+	binding, err := tlsBinding(tc)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	auth := &clusterAuth{Node: s.self, Nonce: hex.EncodeToString(nonce)}
+	auth.Sign = s.sign("dial", s.self, auth.Nonce, binding)
+	if _, err = c.Write([]byte(flag)); err != nil {
+		return err
+	}
+	if err = s.writeMsg(c, auth); err != nil {
+		return err
+	}
+	res := new(clusterAuth)
+	if err = s.readMsg(c, res); err != nil {
+		return err
+	}
+	if res.Node != n.Id || res.Nonce != auth.Nonce || !s.verify("reply", res, binding) {
+		return errors.New("cluster node " + strconv.Itoa(n.Id) + " verify failed")
+	}
+	return nil
+}
+
+// readMsg 读取一条长度前缀的消息
+func (s *cluster) readMsg(c *conn.Conn, v interface{}) error {
+	l, err := c.GetLen()
+	if err != nil {
+		return err
+	}
+	if l < 0 || l > clusterMaxMsg {
+		return errors.New("cluster message length error " + strconv.Itoa(l))
+	}
+	b, err := c.GetShortContent(l)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeMsg 写入一条长度前缀的消息
+func (s *cluster) writeMsg(c *conn.Conn, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteLenContent(b)
+}
+
+// accept 接受其他节点的连接
+func (s *cluster) accept(l net.Listener) {
+	for {
+		raw, err := l.Accept()
+		if err != nil {
+			logs.Error("cluster accept error %s", err.Error())
+			return
+		}
+		go s.handle(tls.Server(raw, s.serverTls))
+	}
+}
+
+// handle 校验连接的节点身份并应答，然后按用途分别处理
+func (s *cluster) handle(tc *tls.Conn) {
+	c := conn.NewConn(tc)
+	c.SetDeadline(time.Now().Add(time.Second * 10))
+	binding, err := tlsBinding(tc)
+	if err != nil {
+		logs.Warn("cluster connection from %s error %s", c.RemoteAddr().String(), err.Error())
+		c.Close()
+		return
+	}
+	flag, err := c.ReadFlag()
+	if err != nil {
+		c.Close()
+		return
+	}
+	auth := new(clusterAuth)
+	if err = s.readMsg(c, auth); err != nil {
+		logs.Warn("cluster connection from %s error %s", c.RemoteAddr().String(), err.Error())
+		c.Close()
+		return
+	}
+	if _, ok := s.nodes[auth.Node]; !ok || auth.Node == s.self || !s.verify("dial", auth, binding) {
+		logs.Warn("cluster connection from %s verify failed", c.RemoteAddr().String())
+		c.Close()
+		return
+	}
+	res := &clusterAuth{Node: s.self, Nonce: auth.Nonce}
+	res.Sign = s.sign("reply", s.self, res.Nonce, binding)
+	if err = s.writeMsg(c, res); err != nil {
+		c.Close()
+		return
+	}
+	c.SetWriteDeadline(time.Time{})
+	switch flag {
+	case common.CLUSTER_SYNC:
+		s.handleSync(auth.Node, c)
+	case common.CLUSTER_RELAY:
+		s.handleRelay(auth.Node, c)
+	default:
+		c.Close()
+	}
+}
+
+// keepNode 维持到指定节点的同步连接，断开后自动重连
+func (s *cluster) keepNode(n *clusterNode) {
+	for {
+		c, err := s.dial(n, common.CLUSTER_SYNC)
+		if err != nil {
+			logs.Trace("cluster node %d connect error %s", n.Id, err.Error())
+			time.Sleep(clusterRetry)
+			continue
+		}
+		logs.Info("cluster node %d connected", n.Id)
+		err = s.pushNode(n, c)
+		c.Close()
+		logs.Warn("cluster node %d disconnected, %s", n.Id, err.Error())
+		time.Sleep(clusterRetry)
+	}
+}
+
+// pushNode 先发送全量配置，再持续发送配置变更与心跳，直到连接出错
+func (s *cluster) pushNode(n *clusterNode, c *conn.Conn) error {
+	for len(n.msgs) > 0 {
+		<-n.msgs
+	}
+	for _, e := range file.GetDb().JsonDb.SyncSnapshot() {
+		if err := s.writeMsg(c, &clusterMsg{Event: e}); err != nil {
+			return err
+		}
+	}
+	ticker := time.NewTicker(clusterHeartbeat)
+	defer ticker.Stop()
+	for {
+		if err := s.writeMsg(c, &clusterMsg{Clients: s.localClients()}); err != nil {
+			return err
+		}
+	loop:
+		for {
+			select {
+			case e := <-n.msgs:
+				if err := s.writeMsg(c, &clusterMsg{Event: e}); err != nil {
+					return err
+				}
+			case <-ticker.C:
+				break loop
+			}
+		}
+	}
+}
+
+// localClients 返回连接到本节点的客户端
+func (s *cluster) localClients() []int {
+	ids := make([]int, 0)
+	Bridge.Client.Range(func(key, value interface{}) bool {
+		ids = append(ids, key.(int))
+		return true
+	})
+	return ids
+}
+
+// handleSync 接收其他节点的配置变更与心跳
+func (s *cluster) handleSync(node int, c *conn.Conn) {
+	defer c.Close()
+	for {
+		c.SetReadDeadline(time.Now().Add(clusterExpire))
+		msg := new(clusterMsg)
+		if err := s.readMsg(c, msg); err != nil {
+			logs.Warn("cluster node %d sync error %s", node, err.Error())
+			return
+		}
+		if msg.Event != nil {
+			applySyncEvent(node, msg.Event)
+		} else {
+			s.setOwners(node, msg.Clients)
+		}
+	}
+}
+
+// setOwners 更新注册表中连接到指定节点的客户端
+func (s *cluster) setOwners(node int, ids []int) {
+	expire := time.Now().Add(clusterExpire)
+	exist := make(map[int]bool)
+	for _, id := range ids {
+		exist[id] = true
+		s.owners.Store(id, &clusterOwner{node: node, expire: expire})
+	}
+	s.owners.Range(func(key, value interface{}) bool {
+		if o := value.(*clusterOwner); o.node == node && !exist[key.(int)] {
+			s.owners.Delete(key)
+		}
+		return true
+	})
+}
+
+// Owner 返回持有指定客户端 bridge 会话的其他节点，不存在时返回 0
+func (s *cluster) Owner(clientId int) int {
+	if v, ok := s.owners.Load(clientId); ok {
+		if o := v.(*clusterOwner); o.expire.After(time.Now()) {
+			return o.node
+		}
+	}
+	return 0
+}
+
+// relay 经持有客户端的节点建立到客户端的连接，作为 Bridge.Relay 使用。
+// 加密、压缩、限速与流量统计仍由本节点完成，持有节点只做原样转发。
+func (s *cluster) relay(clientId int, link *conn.Link, t *file.Tunnel) (net.Conn, error) {
+	n, ok := s.nodes[s.Owner(clientId)]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("the client %d is not connect", clientId))
+	}
+	c, err := s.dial(n, common.CLUSTER_RELAY)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("connect cluster node %d error %s", n.Id, err.Error()))
+	}
+	req := &clusterRelay{ClientId: clientId, Link: link}
+	if t != nil {
+		req.Mode = t.Mode
+	}
+	res := new(clusterRelay)
+	c.SetReadDeadlineBySecond(10)
+	if err = s.writeMsg(c, req); err == nil {
+		err = s.readMsg(c, res)
+	}
+	if err == nil && res.Err != "" {
+		err = errors.New(res.Err)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetReadDeadline(time.Time{})
+	if res.Link != nil {
+		link.Crypt, link.Compress = res.Link.Crypt, res.Link.Compress
+	}
+	return c, nil
+}
+
+// handleRelay 处理其他节点转发来的连接：经本节点的 bridge 会话连接客户端后原样转发
+func (s *cluster) handleRelay(node int, c *conn.Conn) {
+	req := new(clusterRelay)
+	if err := s.readMsg(c, req); err != nil || req.Link == nil {
+		c.Close()
+		return
+	}
+	var t *file.Tunnel
+	if req.Mode != "" {
+		t = &file.Tunnel{Mode: req.Mode}
+	}
+	target, err := Bridge.SendLocalLinkInfo(req.ClientId, req.Link, t)
+	res := &clusterRelay{ClientId: req.ClientId, Link: req.Link}
+	if err != nil {
+		res.Err = err.Error()
+	}
+	if e := s.writeMsg(c, res); e != nil || err != nil {
+		if target != nil {
+			target.Close()
+		}
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	logs.Trace("relay %s connection to client %d from cluster node %d", req.Link.ConnType, req.ClientId, node)
+	conn.CopyWaitGroup(target, c, false, false, nil, nil, false, nil)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/rate"
+	"ehang.io/nps/server/proxy"
+	"github.com/astaxie/beego/logs"
+)
+
+// applySyncEvent 应用其他节点的配置变更，只处理比本节点记录更新的变更
+func applySyncEvent(node int, e *file.SyncEvent) {
+	db := file.GetDb().JsonDb
+	if !db.IsSyncNewer(e) {
+		return
+	}
+	err := db.ApplySync(e, func() error {
+		switch e.Kind {
+		case file.SyncClient:
+			return syncClient(e)
+		case file.SyncTask:
+			return syncTask(e)
+		case file.SyncHost:
+			return syncHost(e)
+		}
+		return errors.New("unknown kind " + e.Kind)
+	})
+	if err != nil {
+		logs.Warn("apply %s %d from cluster node %d error %s", e.Kind, e.Id, node, err.Error())
+	}
+}
+
+// syncClient 应用客户端的变更：已存在的客户端只更新配置字段，保留本节点的连接与流量状态
+func syncClient(e *file.SyncEvent) error {
+	if e.Del {
+		DelTunnelAndHostByClientId(e.Id, false)
+		DelClientConnect(e.Id)
+		Bridge.DelTelemetry(e.Id)
+		return file.GetDb().DelClient(e.Id)
+	}
+	c := new(file.Client)
+	if err := json.Unmarshal(e.Data, c); err != nil {
+		return err
+	}
+	if c.Flow == nil {
+		c.Flow = new(file.Flow)
+	}
+	if c.Cnf == nil {
+		c.Cnf = new(file.Config)
+	}
+	if v, err := file.GetDb().GetClient(e.Id); err == nil {
+		v.VerifyKey = c.VerifyKey
+		v.Remark = c.Remark
+		v.Status = c.Status
+		v.NoDisplay = c.NoDisplay
+		v.Flow.FlowLimit = c.Flow.FlowLimit
+		v.MaxConn = c.MaxConn
+		v.MaxTunnelNum = c.MaxTunnelNum
+		v.WebUserName = c.WebUserName
+		v.WebPassword = c.WebPassword
+		v.ConfigConnAllow = c.ConfigConnAllow
+		v.Cnf = c.Cnf
+		if v.RateLimit != c.RateLimit || v.Rate == nil {
+			if v.Rate != nil {
+				v.Rate.Stop()
+			}
+			v.RateLimit = c.RateLimit
+			v.Rate = newClientRate(c.RateLimit)
+		}
+		if !v.Status {
+			DelClientConnect(v.Id)
+		}
+	} else {
+		c.Rate = newClientRate(c.RateLimit)
+		file.GetDb().JsonDb.Clients.Store(c.Id, c)
+	}
+	file.GetDb().JsonDb.StoreClientsToJsonFile()
+	return nil
+}
+
+// newClientRate 按速率限制（KB/s）创建并启动限速器，未限制时为 16MB/s
+func newClientRate(limit int) *rate.Rate {
+	var r *rate.Rate
+	if limit > 0 {
+		r = rate.NewRate(int64(limit * 1024))
+	} else {
+		r = rate.NewRate(int64(2 << 23))
+	}
+	r.Start()
+	return r
+}
+
+// syncTask 应用隧道的变更：停止正在运行的旧隧道，替换配置后按状态重新启动
+func syncTask(e *file.SyncEvent) error {
+	if e.Del {
+		if _, err := file.GetDb().GetTask(e.Id); err != nil {
+			return nil
+		}
+		return DelTask(e.Id)
+	}
+	t := new(file.Tunnel)
+	if err := json.Unmarshal(e.Data, t); err != nil {
+		return err
+	}
+	if t.Client == nil {
+		return errors.New("the task has no client")
+	}
+	c, err := file.GetDb().GetClient(t.Client.Id)
+	if err != nil {
+		return err
+	}
+	t.Client = c
+	if t.Flow == nil {
+		t.Flow = new(file.Flow)
+	}
+	if old, err := file.GetDb().GetTask(e.Id); err == nil {
+		t.Flow.InletFlow, t.Flow.ExportFlow = old.Flow.InletFlow, old.Flow.ExportFlow
+		if v, ok := RunList.Load(e.Id); ok {
+			if svr, ok := v.(proxy.Service); ok {
+				svr.Close()
+			}
+			RunList.Delete(e.Id)
+		}
+	}
+	file.GetDb().JsonDb.Tasks.Store(t.Id, t)
+	file.GetDb().JsonDb.StoreTasksToJsonFile()
+	if t.Status {
+		return AddTask(t)
+	}
+	return nil
+}
+
+// syncHost 应用域名解析的变更，保留本节点的流量统计与证书状态
+func syncHost(e *file.SyncEvent) error {
+	if e.Del {
+		if _, err := file.GetDb().GetHostById(e.Id); err != nil {
+			return nil
+		}
+		proxy.DelHttpCacheHost(e.Id)
+		return file.GetDb().DelHost(e.Id)
+	}
+	h := new(file.Host)
+	if err := json.Unmarshal(e.Data, h); err != nil {
+		return err
+	}
+	if h.Client == nil {
+		return errors.New("the host has no client")
+	}
+	c, err := file.GetDb().GetClient(h.Client.Id)
+	if err != nil {
+		return err
+	}
+	h.Client = c
+	if h.Flow == nil {
+		h.Flow = new(file.Flow)
+	}
+	if h.Target == nil {
+		h.Target = new(file.Target)
+	}
+	if old, err := file.GetDb().GetHostById(e.Id); err == nil {
+		h.Flow.InletFlow, h.Flow.ExportFlow = old.Flow.InletFlow, old.Flow.ExportFlow
+		h.CertStatus = old.GetCertStatus()
+	}
+	file.GetDb().JsonDb.Hosts.Store(h.Id, h)
+	file.GetDb().JsonDb.StoreHostToJsonFile()
+	return nil
+}
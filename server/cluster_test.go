@@ -0,0 +1,177 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/file"
+)
+
+// startTestNodes 在本地端口上启动两个节点，返回按节点 ID 索引的集群状态
+func startTestNodes(t *testing.T, secret string, tlsConf func(id int) (*tls.Config, *tls.Config)) map[int]*cluster {
+	addrs := make(map[int]string)
+	listeners := make(map[int]net.Listener)
+	for _, id := range []int{1, 2} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		addrs[id], listeners[id] = l.Addr().String(), l
+	}
+	nodes := make(map[int]*cluster)
+	for id, l := range listeners {
+		s := &cluster{self: id, secret: secret, nodes: make(map[int]*clusterNode)}
+		for n, addr := range addrs {
+			s.nodes[n] = &clusterNode{Id: n, Addr: addr, msgs: make(chan *file.SyncEvent, 1)}
+		}
+		s.serverTls, s.clientTls = tlsConf(id)
+		go s.accept(l)
+		nodes[id] = s
+	}
+	return nodes
+}
+
+// defaultTls 未配置集群 CA 时的 TLS 配置
+func defaultTls(t *testing.T) func(id int) (*tls.Config, *tls.Config) {
+	return func(id int) (*tls.Config, *tls.Config) {
+		server, client, err := clusterTlsConfig("", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server, client
+	}
+}
+
+// checkSync 经同步连接发送心跳，校验对方节点记录了本节点的客户端
+func checkSync(t *testing.T, from, to *cluster) {
+	c, err := from.dial(from.nodes[to.self], common.CLUSTER_SYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := from.writeMsg(c, &clusterMsg{Clients: []int{100 + from.self}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50 && to.Owner(100+from.self) != from.self; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if to.Owner(100+from.self) != from.self {
+		t.Fatalf("node %d does not receive the heartbeat of node %d", to.self, from.self)
+	}
+}
+
+// TestClusterAuth 测试两个节点之间的认证：相同密钥可以同步，密钥不同或经中间人转发的连接被拒绝
+func TestClusterAuth(t *testing.T) {
+	crypt.InitTls()
+	nodes := startTestNodes(t, "secret", defaultTls(t))
+	checkSync(t, nodes[1], nodes[2])
+	checkSync(t, nodes[2], nodes[1])
+
+	other := &cluster{self: 1, secret: "other", nodes: nodes[1].nodes, clientTls: nodes[1].clientTls}
+	if c, err := other.dial(other.nodes[2], common.CLUSTER_SYNC); err == nil {
+		c.Close()
+		t.Fatal("the node with a different secret is accepted")
+	}
+
+	// 中间人分别与两端完成 TLS 握手后原样转发认证信息
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			raw, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				up, err := tls.Dial("tcp", nodes[2].nodes[2].Addr, &tls.Config{InsecureSkipVerify: true})
+				if err != nil {
+					raw.Close()
+					return
+				}
+				down := tls.Server(raw, &tls.Config{Certificates: []tls.Certificate{crypt.GetCert()}})
+				go io.Copy(up, down)
+				io.Copy(down, up)
+				down.Close()
+				up.Close()
+			}()
+		}
+	}()
+	if c, err := nodes[1].dial(&clusterNode{Id: 2, Addr: l.Addr().String()}, common.CLUSTER_SYNC); err == nil {
+		c.Close()
+		t.Fatal("the relayed authentication is accepted")
+	}
+}
+
+// writeTestCert 生成由 parent 签发的证书（parent 为 nil 时自签名），写入目录后返回证书与私钥
+func writeTestCert(t *testing.T, dir, name string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+	c, _ := x509.ParseCertificate(der)
+	return c, key
+}
+
+// TestClusterCA 测试配置集群 CA 后双向校验节点证书，持有密钥但证书不是该 CA 签发的节点被拒绝
+func TestClusterCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeTestCert(t, dir, "ca", true, nil, nil)
+	writeTestCert(t, dir, "node", false, ca, caKey)
+	writeTestCert(t, dir, "rogue", false, nil, nil)
+	load := func(name string) (*tls.Config, *tls.Config) {
+		server, client, err := clusterTlsConfig(filepath.Join(dir, "ca.crt"), filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server, client
+	}
+	nodes := startTestNodes(t, "secret", func(id int) (*tls.Config, *tls.Config) { return load("node") })
+	checkSync(t, nodes[1], nodes[2])
+
+	rogue := &cluster{self: 1, secret: "secret", nodes: nodes[1].nodes}
+	_, rogue.clientTls = load("rogue")
+	if c, err := rogue.dial(rogue.nodes[2], common.CLUSTER_SYNC); err == nil {
+		c.Close()
+		t.Fatal("the node certificate not issued by the cluster ca is accepted")
+	}
+	if _, _, err := clusterTlsConfig(filepath.Join(dir, "node.key"), filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")); err == nil {
+		t.Fatal("a ca file without certificate is accepted")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 
+	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/pmux"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
@@ -34,6 +35,7 @@ var (
 // InitConnectionService 初始化连接服务
 // 从配置文件中读取各种端口配置，并根据端口复用情况初始化端口复用器
 // 如果HTTP、HTTPS或Web管理端口与桥接端口相同，则启用端口复用功能
+// 配置了 proxy_protocol_trusted 时，各监听器解析受信任来源发送的 PROXY protocol 头
 func InitConnectionService() {
 	// 从配置文件读取各种端口配置
 	bridgePort = beego.AppConfig.String("bridge_port")
@@ -41,6 +43,12 @@ func InitConnectionService() {
 	httpPort = beego.AppConfig.String("http_proxy_port")
 	webPort = beego.AppConfig.String("web_port")
 
+	// 位于负载均衡之后时，从 PROXY protocol 头中取得真实的访问者地址
+	if err := conn.SetProxyTrusted(beego.AppConfig.String("proxy_protocol_trusted")); err != nil {
+		logs.Error(err)
+		os.Exit(0)
+	}
+
 	// 检查是否需要启用端口复用
 	// 当HTTP、HTTPS或Web管理端口与桥接端口相同时，使用端口复用器
 	if httpPort == bridgePort || httpsPort == bridgePort || webPort == bridgePort {
@@ -50,7 +58,7 @@ func InitConnectionService() {
 			os.Exit(0)
 		}
 		// 创建端口复用器实例
-		pMux = pmux.NewPortMux(port, beego.AppConfig.String("web_host"))
+		pMux = pmux.NewPortMux(port, beego.AppConfig.String("web_host"), conn.NewProxyListener)
 	}
 }
 
@@ -95,7 +103,11 @@ func GetBridgeListener(tp string) (net.Listener, error) {
 	}
 
 	// 否则创建独立的TCP监听器
-	return net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(beego.AppConfig.String("bridge_ip")), p, ""})
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(beego.AppConfig.String("bridge_ip")), p, ""})
+	if err != nil {
+		return nil, err
+	}
+	return conn.NewProxyListener(l), nil
 }
 
 // GetHttpListener 获取HTTP代理监听器
@@ -176,6 +188,10 @@ func getTcpListener(ip, p string) (net.Listener, error) {
 		ip = "0.0.0.0"
 	}
 
-	// 创建并返回TCP监听器
-	return net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(ip), port, ""})
+	// 创建并返回TCP监听器，受信任来源的连接解析 PROXY protocol 头
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(ip), port, ""})
+	if err != nil {
+		return nil, err
+	}
+	return conn.NewProxyListener(l), nil
 }
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/health"
+	"github.com/astaxie/beego/logs"
+)
+
+// 服务端健康检查：本地代理（LocalProxy）的隧道与域名解析由 nps 直接连接目标，npc 无法检查，
+// 因此由 nps 按其健康检查配置探测，与 npc 上报的结果一样以 HealthRemoveArr/TargetArr 移除与恢复目标，
+// 检查结果记录在 Bridge 中，与 npc 上报的结果一同在 web 管理中显示。
+// 检查的目标为 HealthCheckTarget（逗号分隔），为空时检查全部目标；
+// HealthMaxFail、HealthCheckTimeout、HealthCheckInterval 都为正时才检查。
+
+// localHealthCheck 每秒扫描本地代理的隧道与域名解析，到期的启动一次检查
+func localHealthCheck() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+				v := value.(*file.Tunnel)
+				if v.Client != nil && v.Target != nil && v.Target.LocalProxy && v.Status && healthDue(&v.Health, now) {
+					go checkLocalTargets(v.Client.Id, TunnelOwner(v.Id), &v.Health, v.Target, &v.RWMutex)
+				}
+				return true
+			})
+			file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+				v := value.(*file.Host)
+				if v.Client != nil && v.Target != nil && v.Target.LocalProxy && !v.IsClose && healthDue(&v.Health, now) {
+					go checkLocalTargets(v.Client.Id, HostOwner(v.Id), &v.Health, v.Target, &v.RWMutex)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// healthDue 判断是否到了下次检查的时间，到期时设置下次检查的时间
+func healthDue(h *file.Health, now time.Time) bool {
+	h.Lock()
+	defer h.Unlock()
+	if h.HealthMaxFail <= 0 || h.HealthCheckTimeout <= 0 || h.HealthCheckInterval <= 0 || now.Before(h.HealthNextTime) {
+		return false
+	}
+	h.HealthNextTime = now.Add(time.Duration(h.HealthCheckInterval) * time.Second)
+	return true
+}
+
+// TunnelOwner 返回 nps 检查隧道的本地代理目标时，检查结果在 Bridge 中所属的隧道
+func TunnelOwner(id int) string {
+	return "tunnel:" + strconv.Itoa(id)
+}
+
+// HostOwner 返回 nps 检查域名解析的本地代理目标时，检查结果在 Bridge 中所属的域名解析
+func HostOwner(id int) string {
+	return "host:" + strconv.Itoa(id)
+}
+
+// checkLocalTargets 检查一个隧道或域名解析的目标，owner 为检查结果的归属，lock 为隧道或域名解析的锁
+func checkLocalTargets(clientId int, owner string, h *file.Health, t *file.Target, lock sync.Locker) {
+	h.RLock()
+	checkTarget := h.HealthCheckTarget
+	h.RUnlock()
+	targets := file.TargetAddrs(t.TargetStr)
+	if checkTarget != "" {
+		targets = strings.Split(checkTarget, ",")
+	}
+	for _, addr := range targets {
+		latency, err := health.Probe(h, addr)
+		h.Lock()
+		change, stat := health.Update(h, addr, Bridge.GetHealthStat(clientId, owner, addr), latency, err)
+		h.Unlock()
+		Bridge.SetHealthStat(clientId, owner, stat)
+		switch change {
+		case health.ChangeRemove:
+			lock.Lock()
+			h.HealthRemove(t, addr)
+			lock.Unlock()
+			logs.Warn("local proxy target %s is removed after %d failed health checks, %s", addr, stat.Fails, stat.Error)
+		case health.ChangeRestore:
+			lock.Lock()
+			restored := h.HealthRestore(t, addr)
+			lock.Unlock()
+			if restored {
+				logs.Info("local proxy target %s is restored by the health check", addr)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME 自动证书：开启了自动证书的域名解析由 autocert 申请与续期证书，
+// HTTP-01 验证在域名解析的 HTTP 端口应答，TLS-ALPN-01 验证与证书的使用都在 HTTPS 端口，
+// 账户与证书保存在 acme_cache_dir 目录，重启后无需重新申请。
+// 证书状态由后台定时检查并记录到域名解析，申请失败时按指数退避重试。
+
+// acmeChallengePath HTTP-01 验证请求的路径前缀
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+var (
+	acmeOnce    sync.Once
+	acmeManager *autocert.Manager
+)
+
+// getAcmeManager 返回全局的证书管理器，未开启 acme_enable 或初始化失败时返回 nil
+func getAcmeManager() *autocert.Manager {
+	acmeOnce.Do(func() {
+		if b, err := beego.AppConfig.Bool("acme_enable"); err != nil || !b {
+			return
+		}
+		m, err := newAcmeManager()
+		if err != nil {
+			logs.Error("acme init error %s", err.Error())
+			return
+		}
+		acmeManager = m
+		go checkAutoCerts(m)
+	})
+	return acmeManager
+}
+
+// newAcmeManager 按配置创建证书管理器
+// acme_directory 为空时使用 Let's Encrypt，acme_ca_file 用于信任测试服务器（如 Pebble）的自签根证书
+func newAcmeManager() (*autocert.Manager, error) {
+	dir := beego.AppConfig.DefaultString("acme_cache_dir", filepath.Join("conf", "acme"))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(common.GetRunPath(), dir)
+	}
+	client := &acme.Client{DirectoryURL: beego.AppConfig.DefaultString("acme_directory", acme.LetsEncryptURL)}
+	if caFile := beego.AppConfig.String("acme_ca_file"); caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificate found in " + caFile)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(dir),
+		HostPolicy:  acmeHostPolicy,
+		RenewBefore: time.Duration(beego.AppConfig.DefaultInt("acme_renew_days", 30)) * 24 * time.Hour,
+		Client:      client,
+		Email:       beego.AppConfig.String("acme_email"),
+	}, nil
+}
+
+// acmeHostPolicy 只为开启了自动证书的域名申请证书
+func acmeHostPolicy(ctx context.Context, host string) error {
+	if findAutoCertHost(host) == nil {
+		return errors.New("the host " + host + " is not configured with auto cert")
+	}
+	return nil
+}
+
+// findAutoCertHost 查找开启了自动证书的域名解析，通配符域名无法通过 HTTP-01 与 TLS-ALPN-01 验证，不参与匹配
+func findAutoCertHost(serverName string) *file.Host {
+	var host *file.Host
+	serverName = common.GetIpByAddr(serverName)
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		v := value.(*file.Host)
+		if v.AutoCert && !v.IsClose && v.Scheme != "http" && strings.EqualFold(v.Host, serverName) {
+			host = v
+			return false
+		}
+		return true
+	})
+	return host
+}
+
+// serveAcmeChallenge 在 HTTP 端口应答 HTTP-01 验证，非验证请求返回 false
+func serveAcmeChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		return false
+	}
+	m := getAcmeManager()
+	if m == nil || findAutoCertHost(r.Host) == nil {
+		return false
+	}
+	m.HTTPHandler(nil).ServeHTTP(w, r)
+	return true
+}
+
+// acceptAutoCert 将自动证书域名的连接交给终止 TLS 的监听器，域名未开启自动证书时返回 false
+func (https *HttpsServer) acceptAutoCert(c *conn.Conn, serverName string) bool {
+	if getAcmeManager() == nil || findAutoCertHost(serverName) == nil {
+		return false
+	}
+	https.getTlsListener().acceptConn <- c
+	return true
+}
+
+// acmeRetry 证书申请失败后的重试时间
+type acmeRetry struct {
+	next    time.Time
+	backoff time.Duration
+}
+
+// checkAutoCerts 每分钟检查一次开启了自动证书的域名，缺少证书时申请，并记录证书状态
+// 证书到期前的续期由 autocert 在证书载入后自动完成
+func checkAutoCerts(m *autocert.Manager) {
+	retries := make(map[string]*acmeRetry)
+	for {
+		checkAutoCertsOnce(m, retries)
+		time.Sleep(time.Minute)
+	}
+}
+
+// checkAutoCertsOnce 检查一遍开启了自动证书的域名，retries 记录各域名申请失败后的重试时间
+func checkAutoCertsOnce(m *autocert.Manager, retries map[string]*acmeRetry) {
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		h := value.(*file.Host)
+		if !h.AutoCert || h.IsClose {
+			return true
+		}
+		if strings.Contains(h.Host, "*") {
+			h.SetCertStatus("wildcard not supported")
+			return true
+		}
+		name := strings.ToLower(h.Host)
+		r, ok := retries[name]
+		if ok && time.Now().Before(r.next) {
+			return true
+		}
+		if h.GetCertStatus() == "" {
+			h.SetCertStatus("obtaining")
+		}
+		cert, err := m.GetCertificate(acmeHello(name))
+		if err != nil {
+			if !ok {
+				r = &acmeRetry{backoff: time.Minute / 2}
+				retries[name] = r
+			}
+			r.backoff *= 2
+			if r.backoff > time.Hour {
+				r.backoff = time.Hour
+			}
+			r.next = time.Now().Add(r.backoff)
+			h.SetCertStatus("error: " + err.Error())
+			logs.Warn("obtain certificate for %s error %s, retry after %s", name, err.Error(), r.backoff)
+			return true
+		}
+		delete(retries, name)
+		if cert.Leaf != nil {
+			h.SetCertStatus("valid until " + cert.Leaf.NotAfter.Local().Format("2006-01-02 15:04:05"))
+		}
+		return true
+	})
+}
+
+// acmeHello 构造申请证书用的 ClientHello，声明支持 ECDSA 以获取 ECDSA 证书
+func acmeHello(serverName string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:        serverName,
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SupportedVersions: []uint16{tls.VersionTLS12},
+	}
+}
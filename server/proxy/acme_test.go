@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego"
+)
+
+// setTestConfig 设置测试使用的配置项，测试结束后恢复
+func setTestConfig(t *testing.T, kv map[string]string) {
+	for k, v := range kv {
+		old := beego.AppConfig.String(k)
+		beego.AppConfig.Set(k, v)
+		k := k
+		t.Cleanup(func() { beego.AppConfig.Set(k, old) })
+	}
+}
+
+// TestAutoCertStatus 测试证书申请失败时记录状态并按退避时间重试，通配符域名不申请，状态的更新与读取并发安全
+func TestAutoCertStatus(t *testing.T) {
+	var requests int32
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer directory.Close()
+	setTestConfig(t, map[string]string{"acme_directory": directory.URL, "acme_cache_dir": t.TempDir()})
+	m, err := newAcmeManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHost(t, "acme.nps.test", "127.0.0.1:1")
+	h.AutoCert = true
+	wild := newTestHost(t, "*.acme.nps.test", "127.0.0.1:1")
+	wild.AutoCert = true
+
+	// web 列表在后台检查期间读取状态
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				json.Marshal(h)
+			}
+		}
+	}()
+	retries := make(map[string]*acmeRetry)
+	checkAutoCertsOnce(m, retries)
+	close(stop)
+	wg.Wait()
+
+	if s := h.GetCertStatus(); !strings.HasPrefix(s, "error: ") {
+		t.Fatalf("status of the failed host is %q", s)
+	}
+	if s := wild.GetCertStatus(); s != "wildcard not supported" {
+		t.Fatalf("status of the wildcard host is %q", s)
+	}
+	r := retries[h.Host]
+	if r == nil || r.backoff != time.Minute || time.Until(r.next) <= 0 {
+		t.Fatalf("retry is not scheduled, %+v", r)
+	}
+	// 退避期间不再请求 ACME 服务器
+	n := atomic.LoadInt32(&requests)
+	if n == 0 {
+		t.Fatal("the acme directory is not requested")
+	}
+	checkAutoCertsOnce(m, retries)
+	if atomic.LoadInt32(&requests) != n {
+		t.Fatal("the acme directory is requested again during the backoff")
+	}
+}
+
+// TestAutoCertPebble 测试经 HTTP-01 验证从本地的 Pebble 申请证书，并在 https 端口使用该证书。
+// 需先启动 Pebble，并以环境变量指定：
+//
+//	NPS_ACME_DIRECTORY  Pebble 的 directory 地址，如 https://127.0.0.1:14000/dir
+//	NPS_ACME_CA         Pebble 的根证书（pebble.minica.pem）
+//	NPS_ACME_HOST       申请证书的域名，需解析到本机，默认 localhost
+//	NPS_ACME_HTTP_ADDR  应答 HTTP-01 验证的地址，与 Pebble 的 httpPort 一致，默认 127.0.0.1:5002
+func TestAutoCertPebble(t *testing.T) {
+	dir := os.Getenv("NPS_ACME_DIRECTORY")
+	if dir == "" {
+		t.Skip("NPS_ACME_DIRECTORY is not set")
+	}
+	name, httpAddr := os.Getenv("NPS_ACME_HOST"), os.Getenv("NPS_ACME_HTTP_ADDR")
+	if name == "" {
+		name = "localhost"
+	}
+	if httpAddr == "" {
+		httpAddr = "127.0.0.1:5002"
+	}
+	setTestConfig(t, map[string]string{"acme_enable": "true", "acme_directory": dir, "acme_ca_file": os.Getenv("NPS_ACME_CA"),
+		"acme_cache_dir": t.TempDir()})
+	m := getAcmeManager()
+	if m == nil {
+		t.Fatal("acme is not enabled")
+	}
+	h := newTestHost(t, name, "127.0.0.1:1")
+	h.AutoCert = true
+
+	l, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewHttp(nil, nil, 0, 0, false)
+	s.bridge = &localBridge{}
+	srv := s.NewServer(0, "http", false)
+	go srv.Serve(l)
+	defer srv.Close()
+
+	checkAutoCertsOnce(m, make(map[string]*acmeRetry))
+	if status := h.GetCertStatus(); !strings.HasPrefix(status, "valid until ") {
+		t.Fatalf("obtain certificate failed, status %q", status)
+	}
+	c, err := tls.Dial("tcp", startTestHttps(t), &tls.Config{ServerName: name, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if leaf := c.ConnectionState().PeerCertificates[0]; len(leaf.DNSNames) == 0 || leaf.DNSNames[0] != name {
+		t.Fatalf("the https port does not use the acme certificate, names %v", leaf.DNSNames)
+	}
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 域名解析的访问认证：设置了认证用户或 Bearer 令牌时按域名解析的配置校验，否则使用客户端的 Basic 认证。
+// 访问者 IP 在免认证列表中时直接通过；开启登录 Cookie 时，以账号或令牌认证通过后在响应中下发
+// nps_auth_<域名解析 id> Cookie，Cookie 以密钥签名并带有过期时间，有效期内的请求不再要求认证。
+// 域名解析的认证通过后，Authorization 不再转发到后端。
+
+// maxAuthVerified 缓存的已校验密码数量上限，避免每个请求都计算 bcrypt
+const maxAuthVerified = 1024
+
+// hostAuth 已解析的认证配置
+type hostAuth struct {
+	own       bool              // 是否为域名解析自己的认证
+	users     map[string]string // 用户名 -> bcrypt 哈希（客户端的 Basic 认证时为明文密码）
+	tokens    []string          // Bearer 令牌
+	bypass    []*net.IPNet      // 免认证的访问者网段
+	cookieKey []byte            // 登录 Cookie 的签名密钥
+}
+
+// authUserKey 请求上下文中以账号或令牌认证通过的用户，用于下发登录 Cookie 及重新处理请求时不再校验
+type authUserKey struct{}
+
+var (
+	compiledAuth sync.Map // 已解析的认证配置，按配置文本缓存
+	authVerified = struct {
+		sync.Mutex
+		m map[[sha256.Size]byte]bool
+	}{m: make(map[[sha256.Size]byte]bool)}
+)
+
+// authCookieName 登录 Cookie 的名称，按域名解析区分
+func authCookieName(host *file.Host) string {
+	return "nps_auth_" + strconv.Itoa(host.Id)
+}
+
+// getHostAuth 返回域名解析的认证配置，不需要认证时返回 nil
+func getHostAuth(host *file.Host) *hostAuth {
+	var u, p string
+	if !host.HasAuth() {
+		if host.Client == nil || host.Client.Cnf == nil || host.Client.Cnf.U == "" || host.Client.Cnf.P == "" {
+			return nil
+		}
+		u, p = host.Client.Cnf.U, host.Client.Cnf.P
+	}
+	key := strings.Join([]string{strconv.Itoa(host.Id), host.AuthUsers, host.AuthTokens, host.AuthBypass, u, p}, "\x00")
+	if v, ok := compiledAuth.Load(key); ok {
+		return v.(*hostAuth)
+	}
+	a := &hostAuth{own: host.HasAuth(), users: make(map[string]string)}
+	if a.own {
+		for _, line := range strings.Split(host.AuthUsers, "\n") {
+			if kv := strings.SplitN(strings.TrimSpace(line), ":", 2); len(kv) == 2 {
+				a.users[kv[0]] = kv[1]
+			}
+		}
+		a.tokens = strings.Fields(host.AuthTokens)
+	} else {
+		a.users[u] = p
+	}
+	var err error
+	if a.bypass, err = common.ParseCIDRs(host.AuthBypass); err != nil {
+		logs.Warn("host %s auth bypass is ignored, %s", host.Host, err.Error())
+	}
+	sum := sha256.Sum256([]byte(beego.AppConfig.String("auth_crypt_key") + "\x00" + key))
+	a.cookieKey = sum[:]
+	compiledAuth.Store(key, a)
+	return a
+}
+
+// checkHostAuth 校验访问者的请求，remoteAddr 为访问者连接的地址
+// 以账号或令牌认证通过时，返回的请求在上下文中带有认证的用户
+func checkHostAuth(host *file.Host, r *http.Request, remoteAddr string) (*http.Request, error) {
+	a := getHostAuth(host)
+	if a == nil {
+		return r, nil
+	}
+	if _, ok := r.Context().Value(authUserKey{}).(string); ok {
+		return r, nil
+	}
+	if ip := net.ParseIP(common.GetIpByAddr(remoteAddr)); ip != nil && common.IsIpInCIDRs(ip, a.bypass) {
+		return r, nil
+	}
+	if host.AuthCookieHours > 0 && a.checkCookie(host, r) {
+		return r, nil
+	}
+	user, ok := a.checkHeader(r.Header.Get("Authorization"))
+	if !ok {
+		if user, ok = a.checkHeader(r.Header.Get("Proxy-Authorization")); !ok {
+			return r, errors.New("auth error")
+		}
+	}
+	if a.own {
+		r.Header.Del("Authorization")
+		r.Header.Del("Proxy-Authorization")
+	}
+	return r.WithContext(context.WithValue(r.Context(), authUserKey{}, user)), nil
+}
+
+// checkHeader 校验 Basic 或 Bearer 认证头，通过时返回用户名（令牌认证时为空）
+func (a *hostAuth) checkHeader(v string) (string, bool) {
+	s := strings.SplitN(v, " ", 2)
+	if len(s) != 2 {
+		return "", false
+	}
+	switch strings.ToLower(s[0]) {
+	case "basic":
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s[1]))
+		if err != nil {
+			return "", false
+		}
+		pair := strings.SplitN(string(b), ":", 2)
+		if len(pair) != 2 {
+			return "", false
+		}
+		hash, ok := a.users[pair[0]]
+		if !ok {
+			return "", false
+		}
+		if !a.own {
+			return pair[0], subtle.ConstantTimeCompare([]byte(hash), []byte(pair[1])) == 1
+		}
+		return pair[0], verifyPassword(hash, pair[1])
+	case "bearer":
+		token := []byte(strings.TrimSpace(s[1]))
+		for _, v := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(v), token) == 1 {
+				return "", true
+			}
+		}
+	}
+	return "", false
+}
+
+// verifyPassword 以 bcrypt 校验密码，校验通过的结果按哈希与密码的摘要缓存
+func verifyPassword(hash, password string) bool {
+	sum := sha256.Sum256([]byte(hash + "\x00" + password))
+	authVerified.Lock()
+	ok := authVerified.m[sum]
+	authVerified.Unlock()
+	if ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	authVerified.Lock()
+	if len(authVerified.m) >= maxAuthVerified {
+		authVerified.m = make(map[[sha256.Size]byte]bool)
+	}
+	authVerified.m[sum] = true
+	authVerified.Unlock()
+	return true
+}
+
+// cookieSign 登录 Cookie 的签名
+func (a *hostAuth) cookieSign(payload string) string {
+	mac := hmac.New(sha256.New, a.cookieKey)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkCookie 校验登录 Cookie，Cookie 的值为 用户名（base64）.过期时间.签名
+func (a *hostAuth) checkCookie(host *file.Host, r *http.Request) bool {
+	c, err := r.Cookie(authCookieName(host))
+	if err != nil {
+		return false
+	}
+	i := strings.LastIndex(c.Value, ".")
+	if i < 0 || !hmac.Equal([]byte(a.cookieSign(c.Value[:i])), []byte(c.Value[i+1:])) {
+		return false
+	}
+	s := strings.SplitN(c.Value[:i], ".", 2)
+	if len(s) != 2 {
+		return false
+	}
+	expire, err := strconv.ParseInt(s[1], 10, 64)
+	return err == nil && time.Now().Unix() < expire
+}
+
+// setAuthCookie 以账号或令牌认证通过的请求，在响应中下发登录 Cookie，r 为访问者的请求
+func setAuthCookie(host *file.Host, r *http.Request, h http.Header) {
+	user, ok := r.Context().Value(authUserKey{}).(string)
+	if !ok || host.AuthCookieHours <= 0 {
+		return
+	}
+	a := getHostAuth(host)
+	if a == nil {
+		return
+	}
+	age := host.AuthCookieHours * 3600
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(time.Now().Unix()+int64(age), 10)
+	h.Add("Set-Cookie", (&http.Cookie{
+		Name:     authCookieName(host),
+		Value:    payload + "." + a.cookieSign(payload),
+		Path:     "/",
+		MaxAge:   age,
+		HttpOnly: true,
+		Secure:   r.URL.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	}).String())
+}
+
+// authChallenge 认证失败时的 WWW-Authenticate，只设置了令牌时要求 Bearer 认证
+func authChallenge(host *file.Host) string {
+	if host != nil && host.AuthUsers == "" && host.AuthTokens != "" {
+		return `Bearer realm="easyProxy"`
+	}
+	return `Basic realm="easyProxy"`
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 
 	"ehang.io/nps/bridge"
@@ -37,11 +38,10 @@ type NetBridge interface {
 // BaseServer 是代理服务器的基础结构体
 // 提供所有代理服务共用的核心功能：流量统计、连接管理、认证检查等
 type BaseServer struct {
-	id           int           // 服务器实例ID
-	bridge       NetBridge     // 网络桥接器，用于与客户端通信
-	task         *file.Tunnel  // 隧道配置信息
-	errorContent []byte        // 错误页面内容，用于连接失败时返回
-	sync.Mutex                 // 互斥锁，保护并发访问
+	id         int          // 服务器实例ID
+	bridge     NetBridge    // 网络桥接器，用于与客户端通信
+	task       *file.Tunnel // 隧道配置信息
+	sync.Mutex              // 互斥锁，保护并发访问
 }
 
 // NewBaseServer 创建新的基础代理服务器实例
@@ -50,10 +50,9 @@ type BaseServer struct {
 // 返回: 初始化完成的 BaseServer 实例
 func NewBaseServer(bridge *bridge.Bridge, task *file.Tunnel) *BaseServer {
 	return &BaseServer{
-		bridge:       bridge,
-		task:         task,
-		errorContent: nil,
-		Mutex:        sync.Mutex{},
+		bridge: bridge,
+		task:   task,
+		Mutex:  sync.Mutex{},
 	}
 }
 
@@ -80,14 +79,6 @@ func (s *BaseServer) FlowAddHost(host *file.Host, in, out int64) {
 	host.Flow.InletFlow += in    // 累加主机入站流量
 }
 
-// writeConnFail 向连接写入失败响应
-// 当连接建立失败时，向客户端返回错误页面
-// c: 目标连接
-func (s *BaseServer) writeConnFail(c net.Conn) {
-	c.Write([]byte(common.ConnectionFailBytes)) // 写入连接失败标志
-	c.Write(s.errorContent)                     // 写入错误页面内容
-}
-
 // auth 执行HTTP基础认证检查
 // 验证请求的用户名和密码是否匹配
 // r: HTTP请求对象
@@ -105,6 +96,50 @@ func (s *BaseServer) auth(r *http.Request, c *conn.Conn, u, p string) error {
 	return nil
 }
 
+// checkSourceAcl 按全局黑名单与隧道或域名解析的来源访问控制校验访问者
+// 在接受连接或请求时执行，拒绝的次数分别计入全局黑名单与 acl
+// acl: 隧道或域名解析的来源访问控制，为 nil 时只校验全局黑名单
+// addr: 访问者地址（ip:port）
+// 返回: 访问者被拒绝时返回错误，否则返回nil
+func checkSourceAcl(acl *file.IpAcl, addr string) error {
+	if !file.GetDb().JsonDb.Global.Check(addr) {
+		return errors.New("remote address " + addr + " is in the global blocklist")
+	}
+	if !acl.Check(addr) {
+		return errors.New("remote address " + addr + " is denied by the ip acl")
+	}
+	return nil
+}
+
+// checkSourceRate 按访问者 IP 的速率限制校验一次请求或新建连接
+// limit: 隧道或域名解析的速率限制，为 nil 时不限制
+// addr: 访问者地址（ip:port）
+// 返回: 超出限制或访问者处于封禁期间时返回错误，否则返回nil
+func checkSourceRate(limit *file.RateLimit, addr string) error {
+	if !limit.Allow(addr) {
+		return errors.New("remote address " + addr + " exceeds the rate limit")
+	}
+	return nil
+}
+
+// checkDestAcl 按隧道的目标访问控制规则校验访问者请求的目标地址
+// 用于 socks5、httpProxy 模式，在向客户端发送连接信息之前执行
+// addr: 目标地址（host:port）
+// 返回: 客户端拨号时应使用的地址（域名按 cidr 规则校验过时为校验过的 IP），目标被拒绝时返回错误
+func (s *BaseServer) checkDestAcl(addr string) (string, error) {
+	if s.task.DestAcl == nil {
+		return addr, nil
+	}
+	ok, i, dial := s.task.DestAcl.Allow(addr)
+	if !ok {
+		if i < 0 {
+			return "", errors.New("destination " + addr + " is denied by the default policy")
+		}
+		return "", errors.New("destination " + addr + " is denied by acl rule " + strconv.Itoa(i+1))
+	}
+	return dial, nil
+}
+
 // CheckFlowAndConnNum 检查客户端的流量限制和连接数限制
 // 确保客户端未超过配置的流量上限和最大连接数
 // client: 客户端配置信息
@@ -131,10 +166,14 @@ func (s *BaseServer) CheckFlowAndConnNum(client *file.Client) error {
 // f: 连接建立后的回调函数
 // flow: 流量统计对象
 // localProxy: 是否为本地代理模式
+// opts: 连接选项，隧道设置了 PROXY protocol 时自动添加（socks5 与 http 正向代理的目标不固定，不添加）
 // 返回: 处理过程中的错误
-func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string, rb []byte, tp string, f func(), flow *file.Flow, localProxy bool) error {
+func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string, rb []byte, tp string, f func(), flow *file.Flow, localProxy bool, opts ...conn.Option) error {
+	if s.task != nil && s.task.ProxyProtocol > 0 && s.task.Mode != "socks5" && s.task.Mode != "httpProxy" {
+		opts = append([]conn.Option{conn.LinkProxyProtocol(s.task.ProxyProtocol, c.Conn.LocalAddr().String())}, opts...)
+	}
 	// 创建连接信息对象，包含目标地址、加密、压缩等配置
-	link := conn.NewLink(tp, addr, client.Cnf.Crypt, client.Cnf.Compress, c.Conn.RemoteAddr().String(), localProxy)
+	link := conn.NewLink(tp, addr, client.Cnf.Crypt, client.Cnf.Compress, c.Conn.RemoteAddr().String(), localProxy, opts...)
 	
 	// 通过桥接器向客户端发送连接信息，建立代理通道
 	if target, err := s.bridge.SendLinkInfo(client.Id, link, s.task); err != nil {
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// 证书存储：TLS 终止时按 SNI 找到域名解析，再取得其证书。
+// 证书来源依次为编辑页面粘贴的 PEM、证书文件、默认证书（https_default_cert_file），
+// 证书文件每隔 certCheckInterval 检查一次修改时间，修改后重新载入，无需重启服务端。
+
+// certCheckInterval 检查证书文件是否修改的最小间隔
+const certCheckInterval = 5 * time.Second
+
+// certs 全局证书存储
+var certs = new(certStore)
+
+// certStore 已载入的证书，key 为证书文件路径或域名解析ID
+type certStore struct {
+	entries sync.Map // map[string]*certEntry
+}
+
+// certEntry 一张已载入的证书
+type certEntry struct {
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+	modTime  time.Time // 证书文件的修改时间
+	checked  time.Time // 最近一次检查证书文件的时间
+	sum      [32]byte  // 粘贴的 PEM 内容的摘要
+	sync.Mutex
+}
+
+// CertExpiry 即将过期的证书
+type CertExpiry struct {
+	Name     string // 域名或 default（默认证书）
+	NotAfter string // 到期时间
+	Days     int    // 剩余天数，已过期时为负数
+}
+
+// get 返回域名解析使用的证书，host 为 nil 时返回默认证书
+func (s *certStore) get(host *file.Host) (*tls.Certificate, error) {
+	if host != nil && host.CertContent != "" && host.KeyContent != "" {
+		return s.fromPem("host-"+strconv.Itoa(host.Id), host.CertContent, host.KeyContent)
+	}
+	if host != nil && common.FileExists(host.CertFilePath) && common.FileExists(host.KeyFilePath) {
+		return s.fromFile(host.CertFilePath, host.KeyFilePath)
+	}
+	certFile := beego.AppConfig.String("https_default_cert_file")
+	keyFile := beego.AppConfig.String("https_default_key_file")
+	if !common.FileExists(certFile) || !common.FileExists(keyFile) {
+		return nil, errors.New("the key " + keyFile + " cert " + certFile + " file is not exist")
+	}
+	return s.fromFile(certFile, keyFile)
+}
+
+// fromPem 返回粘贴的 PEM 内容对应的证书，内容修改后重新解析
+func (s *certStore) fromPem(key, certPem, keyPem string) (*tls.Certificate, error) {
+	v, _ := s.entries.LoadOrStore(key, new(certEntry))
+	e := v.(*certEntry)
+	e.Lock()
+	defer e.Unlock()
+	sum := sha256.Sum256([]byte(certPem + "\n" + keyPem))
+	if e.cert != nil && e.sum == sum {
+		return e.cert, nil
+	}
+	cert, err := parseKeyPair([]byte(certPem), []byte(keyPem))
+	if err != nil {
+		return nil, err
+	}
+	e.cert, e.sum = cert, sum
+	return cert, nil
+}
+
+// fromFile 返回证书文件对应的证书，文件修改后重新载入，载入失败时继续使用原证书
+func (s *certStore) fromFile(certFile, keyFile string) (*tls.Certificate, error) {
+	v, _ := s.entries.LoadOrStore(certFile+"|"+keyFile, &certEntry{certFile: certFile, keyFile: keyFile})
+	e := v.(*certEntry)
+	e.Lock()
+	defer e.Unlock()
+	if e.cert != nil && time.Since(e.checked) < certCheckInterval {
+		return e.cert, nil
+	}
+	e.checked = time.Now()
+	modTime, err := latestModTime(certFile, keyFile)
+	if err == nil && e.cert != nil && modTime.Equal(e.modTime) {
+		return e.cert, nil
+	}
+	var certPem, keyPem []byte
+	if err == nil {
+		if certPem, err = common.ReadAllFromFile(certFile); err == nil {
+			keyPem, err = common.ReadAllFromFile(keyFile)
+		}
+	}
+	var cert *tls.Certificate
+	if err == nil {
+		cert, err = parseKeyPair(certPem, keyPem)
+	}
+	if err != nil {
+		if e.cert != nil {
+			logs.Warn("reload certificate %s error %s, keep using the loaded one", certFile, err.Error())
+			return e.cert, nil
+		}
+		return nil, err
+	}
+	if e.cert != nil {
+		logs.Info("certificate %s is reloaded", certFile)
+	}
+	e.cert, e.modTime = cert, modTime
+	return cert, nil
+}
+
+// latestModTime 返回证书与私钥文件中较新的修改时间
+func latestModTime(files ...string) (time.Time, error) {
+	var t time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// parseKeyPair 解析 PEM 格式的证书与私钥，并解析出证书本身以便读取有效期
+func parseKeyPair(certPem, keyPem []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// CheckKeyPair 校验粘贴的 PEM 证书与私钥是否匹配
+func CheckKeyPair(certPem, keyPem string) error {
+	_, err := parseKeyPair([]byte(certPem), []byte(keyPem))
+	return err
+}
+
+// ExpiringCerts 返回 days 天内到期（含已过期）的证书，按到期时间排序
+// 只检查服务端终止 TLS 时使用的证书，自动证书由 ACME 续期，不在此列
+func ExpiringCerts(days int) []CertExpiry {
+	var list []CertExpiry
+	if b, err := beego.AppConfig.Bool("https_just_proxy"); err == nil && b {
+		return list
+	}
+	add := func(name string, host *file.Host) {
+		cert, err := certs.get(host)
+		if err != nil || cert.Leaf == nil {
+			return
+		}
+		left := time.Until(cert.Leaf.NotAfter)
+		if left > time.Duration(days)*24*time.Hour {
+			return
+		}
+		list = append(list, CertExpiry{
+			Name:     name,
+			NotAfter: cert.Leaf.NotAfter.Local().Format("2006-01-02 15:04:05"),
+			Days:     int(left.Hours() / 24),
+		})
+	}
+	add("default", nil)
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		h := value.(*file.Host)
+		if h.IsClose || h.AutoCert || h.Scheme == "http" {
+			return true
+		}
+		if (h.CertContent != "" && h.KeyContent != "") || (common.FileExists(h.CertFilePath) && common.FileExists(h.KeyFilePath)) {
+			add(h.Host, h)
+		}
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].NotAfter < list[j].NotAfter
+	})
+	return list
+}
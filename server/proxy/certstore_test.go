@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertFiles 生成证书并写入证书与私钥文件
+func writeCertFiles(t *testing.T, certFile, keyFile, name string) {
+	cert, key := testCertPem(t, name)
+	if err := ioutil.WriteFile(certFile, []byte(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// peerName 经 https 代理以 serverName 握手（为空时不携带 SNI），返回服务端证书的 CommonName
+func peerName(t *testing.T, addr, serverName string) string {
+	c, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("handshake with server name %q error %v", serverName, err)
+	}
+	defer c.Close()
+	return c.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// setModTime 修改文件的修改时间，避免同一秒内的修改无法区分
+func setModTime(t *testing.T, mt time.Time, files ...string) {
+	for _, f := range files {
+		if err := os.Chtimes(f, mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expireCheck 使证书文件在下次取得证书时重新检查修改时间
+func expireCheck(certFile, keyFile string) {
+	if v, ok := certs.entries.Load(certFile + "|" + keyFile); ok {
+		e := v.(*certEntry)
+		e.Lock()
+		e.checked = time.Time{}
+		e.Unlock()
+	}
+}
+
+// TestCertStore 测试共用的 TLS 服务按 SNI 选择粘贴的证书、证书文件与默认证书，
+// 证书文件或粘贴内容修改后重新载入，载入失败时继续使用原证书
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	defCert, defKey := filepath.Join(dir, "default.pem"), filepath.Join(dir, "default.key")
+	writeCertFiles(t, defCert, defKey, "default")
+	setTestConfig(t, map[string]string{"https_default_cert_file": defCert, "https_default_key_file": defKey})
+
+	pasted := newTestHost(t, "pem.nps.test", "127.0.0.1:1")
+	pasted.CertContent, pasted.KeyContent = testCertPem(t, "pem-v1")
+	hostCert, hostKey := filepath.Join(dir, "host.pem"), filepath.Join(dir, "host.key")
+	writeCertFiles(t, hostCert, hostKey, "file-v1")
+	fromFile := newTestHost(t, "file.nps.test", "127.0.0.1:1")
+	fromFile.CertFilePath, fromFile.KeyFilePath = hostCert, hostKey
+	newTestHost(t, "nocert.nps.test", "127.0.0.1:1")
+	addr := startTestHttps(t)
+
+	for _, c := range []struct{ serverName, cn string }{
+		{"pem.nps.test", "pem-v1"},
+		{"file.nps.test", "file-v1"},
+		{"nocert.nps.test", "default"},
+		{"", "default"},
+	} {
+		if cn := peerName(t, addr, c.serverName); cn != c.cn {
+			t.Fatalf("server name %q uses certificate %q, want %q", c.serverName, cn, c.cn)
+		}
+	}
+	if c, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "unknown.nps.test", InsecureSkipVerify: true}); err == nil {
+		c.Close()
+		t.Fatal("the handshake of an unknown server name succeeds")
+	}
+
+	// 修改粘贴的内容与证书文件后无需重启即可生效
+	pasted.CertContent, pasted.KeyContent = testCertPem(t, "pem-v2")
+	writeCertFiles(t, hostCert, hostKey, "file-v2")
+	future := time.Now().Add(time.Minute)
+	setModTime(t, future, hostCert, hostKey)
+	expireCheck(hostCert, hostKey)
+	if cn := peerName(t, addr, "pem.nps.test"); cn != "pem-v2" {
+		t.Fatalf("the pasted certificate is not reloaded, got %q", cn)
+	}
+	if cn := peerName(t, addr, "file.nps.test"); cn != "file-v2" {
+		t.Fatalf("the certificate file is not reloaded, got %q", cn)
+	}
+
+	// 证书文件损坏时继续使用已载入的证书
+	ioutil.WriteFile(hostCert, []byte("broken"), 0600)
+	setModTime(t, future.Add(time.Minute), hostCert, hostKey)
+	expireCheck(hostCert, hostKey)
+	if cn := peerName(t, addr, "file.nps.test"); cn != "file-v2" {
+		t.Fatalf("a broken certificate file replaces the loaded one, got %q", cn)
+	}
+}
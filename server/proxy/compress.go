@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"ehang.io/nps/lib/file"
+	"github.com/andybalholm/brotli"
+	"github.com/astaxie/beego"
+)
+
+// 响应压缩：域名解析开启了响应压缩时，按访问者的 Accept-Encoding 协商 br 或 gzip，
+// 压缩发往访问者的响应。只压缩 http_compress_types 列出的类型且不小于 http_compress_min_size 的响应，
+// 后端已经压缩、带有 Cache-Control: no-transform 或为 text/event-stream 的响应原样转发。
+// 压缩在缓存之后进行，缓存中保存的是未压缩的响应，命中缓存时同样按访问者协商压缩。
+
+// compressBrotliLevel 即时压缩使用的 brotli 级别，兼顾压缩率与速度
+const compressBrotliLevel = 4
+
+// compressChunkSize 每次从后端响应读取的字节数
+const compressChunkSize = 32 << 10
+
+var (
+	compressOnce    sync.Once
+	compressTypes   []string // 可压缩的 Content-Type，支持 text/* 形式
+	compressMinSize int64    // 可压缩的最小响应体字节数，长度未知的响应总是压缩
+
+	gzipWriters   = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	brotliWriters = sync.Pool{New: func() interface{} { return brotli.NewWriterLevel(nil, compressBrotliLevel) }}
+)
+
+// loadCompressConfig 读取响应压缩的配置
+func loadCompressConfig() {
+	compressOnce.Do(func() {
+		types := beego.AppConfig.DefaultString("http_compress_types", "text/*,application/json,application/javascript,application/xml,image/svg+xml")
+		for _, v := range strings.Split(types, ",") {
+			if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+				compressTypes = append(compressTypes, v)
+			}
+		}
+		compressMinSize = int64(beego.AppConfig.DefaultInt("http_compress_min_size", 1024))
+	})
+}
+
+// compressResponse 按访问者的请求压缩响应，修改响应头并以压缩后的内容替换响应体
+// r 为访问者的请求，不满足压缩条件时不做修改
+func compressResponse(host *file.Host, r *http.Request, resp *http.Response) {
+	if !host.HttpCompress || r == nil || r.Method == "HEAD" || !r.ProtoAtLeast(1, 1) {
+		return
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPartialContent {
+		return
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" {
+		return
+	}
+	if _, ok := parseCacheControl(resp.Header)["no-transform"]; ok {
+		return
+	}
+	loadCompressConfig()
+	if resp.ContentLength >= 0 && resp.ContentLength < compressMinSize {
+		return
+	}
+	if !compressibleType(resp.Header.Get("Content-Type")) {
+		return
+	}
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return
+	}
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	if !headerHasToken(resp.Header, "Vary", "Accept-Encoding") {
+		resp.Header.Add("Vary", "Accept-Encoding")
+	}
+	// 压缩后内容与原响应不再逐字节相同，强 ETag 改为弱 ETag
+	if etag := resp.Header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	resp.ContentLength = -1
+	resp.TransferEncoding = []string{"chunked"}
+	resp.Body = newCompressReader(resp.Body, encoding)
+}
+
+// compressibleType 判断 Content-Type 是否在可压缩的类型中
+func compressibleType(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil || t == "text/event-stream" {
+		return false
+	}
+	for _, v := range compressTypes {
+		if v == t || (strings.HasSuffix(v, "/*") && strings.HasPrefix(t, v[:len(v)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding 按 Accept-Encoding 的权重选择 br 或 gzip，权重相同时优先 br，都不接受时返回空
+func negotiateEncoding(accept string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		for _, f := range fields[1:] {
+			if f = strings.TrimSpace(f); strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					weight = v
+				}
+			}
+		}
+		q[name] = weight
+	}
+	best, bestQ := "", 0.0
+	for _, name := range []string{"br", "gzip"} {
+		w, ok := q[name]
+		if !ok {
+			if w, ok = q["*"]; !ok {
+				continue
+			}
+		}
+		if w > bestQ {
+			best, bestQ = name, w
+		}
+	}
+	return best
+}
+
+// headerHasToken 判断以逗号分隔的响应头中是否包含指定的值
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, line := range h[name] {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v == "*" || strings.EqualFold(v, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compressReader 读取时压缩原响应体
+type compressReader struct {
+	src      io.ReadCloser
+	encoding string
+	w        io.WriteCloser // 压缩输出写入 buf
+	buf      bytes.Buffer
+	chunk    []byte
+	done     bool
+}
+
+// newCompressReader 创建压缩读取器，压缩器从池中取得
+func newCompressReader(src io.ReadCloser, encoding string) *compressReader {
+	r := &compressReader{src: src, encoding: encoding, chunk: make([]byte, compressChunkSize)}
+	if encoding == "br" {
+		w := brotliWriters.Get().(*brotli.Writer)
+		w.Reset(&r.buf)
+		r.w = w
+	} else {
+		w := gzipWriters.Get().(*gzip.Writer)
+		w.Reset(&r.buf)
+		r.w = w
+	}
+	return r
+}
+
+// Read 返回压缩后的内容，原响应体读完后写出压缩结尾
+func (r *compressReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 && !r.done {
+		n, err := r.src.Read(r.chunk)
+		if n > 0 {
+			if _, werr := r.w.Write(r.chunk[:n]); werr != nil {
+				return 0, werr
+			}
+		}
+		if err == io.EOF {
+			if err = r.w.Close(); err != nil {
+				return 0, err
+			}
+			r.done = true
+			r.release()
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if r.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.buf.Read(p)
+}
+
+// Close 关闭原响应体
+func (r *compressReader) Close() error {
+	return r.src.Close()
+}
+
+// release 将压缩器放回池中
+func (r *compressReader) release() {
+	switch w := r.w.(type) {
+	case *brotli.Writer:
+		brotliWriters.Put(w)
+	case *gzip.Writer:
+		w.Reset(nil)
+		gzipWriters.Put(w)
+	}
+	r.w = nil
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+// 错误页面：域名解析代理无法转发请求时，以 HTML 模板渲染的页面应答访问者。
+// 全局模板为 web/static/page/error_<类型>.html，不存在时使用 web/static/page/error.html；
+// 域名解析可以设置自己的模板，所有类型共用，在模板中以 {{.Kind}} 区分。
+// 模板中可以使用的变量：.Host、.Path、.Kind、.Status、.Reason、.RequestId、.Time。
+
+// 错误页面的类型
+const (
+	pageNoHost       = "nohost"       // 没有对应的域名解析
+	pageOffline      = "offline"      // 客户端离线
+	pageUnreachable  = "unreachable"  // 内网目标无法连接
+	pageQuota        = "quota"        // 超出流量或连接数限制
+	pageMaintenance  = "maintenance"  // 域名解析处于维护状态
+	pageUnauthorized = "unauthorized" // 认证失败
+	pageForbidden    = "forbidden"    // 访问者 IP 被拒绝
+	pageRateLimit    = "ratelimit"    // 访问者超出请求速率限制
+)
+
+// errorPageKinds 各类型错误页面的状态码与原因
+var errorPageKinds = map[string]struct {
+	status int
+	reason string
+}{
+	pageNoHost:       {http.StatusNotFound, "no such host"},
+	pageOffline:      {http.StatusBadGateway, "the client is offline"},
+	pageUnreachable:  {http.StatusBadGateway, "the target is unreachable"},
+	pageQuota:        {http.StatusServiceUnavailable, "the quota is exceeded"},
+	pageMaintenance:  {http.StatusServiceUnavailable, "the site is under maintenance"},
+	pageUnauthorized: {http.StatusUnauthorized, "unauthorized"},
+	pageForbidden:    {http.StatusForbidden, "forbidden"},
+	pageRateLimit:    {http.StatusTooManyRequests, "too many requests"},
+}
+
+// defaultErrorPage 全局模板文件都不存在时使用的模板
+const defaultErrorPage = `<!DOCTYPE html><html><head><meta charset="UTF-8"><title>{{.Status}} {{.Reason}}</title></head>` +
+	`<body>{{.Status}} {{.Reason}}, request id {{.RequestId}}, power by <a href="//ehang.io/nps">nps</a></body></html>`
+
+// errorPageData 错误页面模板的变量
+type errorPageData struct {
+	Host      string
+	Path      string
+	Kind      string
+	Status    int
+	Reason    string
+	RequestId string
+	Time      string
+}
+
+var (
+	errorPagesOnce   sync.Once
+	globalErrorPages map[string]*template.Template // key 为错误页面的类型
+	hostErrorPages   hostCache                     // 域名解析的模板，模板有误时为 nil
+)
+
+// CheckErrorPage 检查域名解析错误页面模板的语法
+func CheckErrorPage(s string) error {
+	if s == "" {
+		return nil
+	}
+	t, err := template.New("error").Parse(s)
+	if err != nil {
+		return err
+	}
+	return t.Execute(new(bytes.Buffer), errorPageData{})
+}
+
+// loadErrorPages 读取全局错误页面模板
+func loadErrorPages() {
+	errorPagesOnce.Do(func() {
+		dir := filepath.Join(common.GetRunPath(), "web", "static", "page")
+		def := parseErrorPageFile(filepath.Join(dir, "error.html"))
+		if def == nil {
+			def = template.Must(template.New("error").Parse(defaultErrorPage))
+		}
+		globalErrorPages = make(map[string]*template.Template)
+		for kind := range errorPageKinds {
+			if t := parseErrorPageFile(filepath.Join(dir, "error_"+kind+".html")); t != nil {
+				globalErrorPages[kind] = t
+			} else {
+				globalErrorPages[kind] = def
+			}
+		}
+	})
+}
+
+// parseErrorPageFile 读取并解析模板文件，文件不存在或有误时返回 nil
+func parseErrorPageFile(path string) *template.Template {
+	if !common.FileExists(path) {
+		return nil
+	}
+	b, err := common.ReadAllFromFile(path)
+	if err != nil {
+		return nil
+	}
+	t, err := template.New(filepath.Base(path)).Parse(string(b))
+	if err != nil {
+		logs.Warn("error page %s is ignored, %s", path, err.Error())
+		return nil
+	}
+	return t
+}
+
+// hostErrorPage 返回域名解析自己的错误页面模板，没有或有误时返回 nil
+func hostErrorPage(host *file.Host) *template.Template {
+	if host == nil || host.ErrorPage == "" {
+		return nil
+	}
+	return hostErrorPages.load(host, host.ErrorPage, func() interface{} {
+		t, err := template.New("error").Parse(host.ErrorPage)
+		if err != nil {
+			logs.Warn("host %s error page is ignored, %s", host.Host, err.Error())
+			t = nil
+		}
+		return t
+	}).(*template.Template)
+}
+
+// errorPageResponse 渲染错误页面，host 为 nil 时（没有对应的域名解析）只使用全局模板
+// 访问者的请求带有 X-Request-Id 时沿用，否则生成新的请求 id，并通过响应头返回
+func errorPageResponse(host *file.Host, r *http.Request, kind string) *http.Response {
+	loadErrorPages()
+	info := errorPageKinds[kind]
+	data := errorPageData{
+		Host:      r.Host,
+		Path:      r.URL.Path,
+		Kind:      kind,
+		Status:    info.status,
+		Reason:    info.reason,
+		RequestId: r.Header.Get("X-Request-Id"),
+		Time:      time.Now().Format("2006-01-02 15:04:05"),
+	}
+	if data.RequestId == "" {
+		data.RequestId = crypt.GetRandomString(16)
+	}
+	var body bytes.Buffer
+	if t := hostErrorPage(host); t == nil || t.Execute(&body, data) != nil {
+		body.Reset()
+		if err := globalErrorPages[kind].Execute(&body, data); err != nil {
+			body.Reset()
+			body.WriteString(strconv.Itoa(info.status) + " " + info.reason)
+		}
+	}
+	header := http.Header{
+		"Content-Type":  {"text/html; charset=utf-8"},
+		"Cache-Control": {"no-store"},
+		"X-Request-Id":  {data.RequestId},
+	}
+	switch kind {
+	case pageUnauthorized:
+		header.Set("WWW-Authenticate", authChallenge(host))
+	case pageMaintenance:
+		header.Set("Retry-After", "120")
+	case pageRateLimit:
+		header.Set("Retry-After", "1")
+	}
+	logs.Info("host %s, url %s, remote address %s, request id %s, return error page %s", r.Host, r.URL.Path, r.RemoteAddr, data.RequestId, kind)
+	resp := ruleResponse(r, info.status, header, body.String())
+	if host != nil {
+		changeResponseHeader(host, r, resp.Header)
+	}
+	return resp
+}
+
+// writeErrorPage 以错误页面应答访问者，并要求访问者关闭连接
+func writeErrorPage(c io.Writer, host *file.Host, r *http.Request, kind string) {
+	writeCloseResponse(c, host, errorPageResponse(host, r, kind))
+}
+
+// writeCloseResponse 以响应应答访问者，并要求访问者关闭连接
+func writeCloseResponse(c io.Writer, host *file.Host, resp *http.Response) {
+	resp.Close = true
+	var b bytes.Buffer
+	resp.Write(&b)
+	if n, err := c.Write(b.Bytes()); err == nil && host != nil {
+		host.Flow.Add(0, int64(n))
+	}
+}
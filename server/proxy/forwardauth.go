@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+)
+
+// 外部认证：域名解析设置了认证服务地址时，转发每个请求之前以原请求的方法与请求头向认证服务发送子请求，
+// 并通过 X-Forwarded-Method、X-Forwarded-Proto、X-Forwarded-Host、X-Forwarded-Uri、X-Forwarded-For 告知原请求。
+// 认证服务返回 2xx 时放行，并把 AuthRespHeaders 中列出的响应头复制到发往后端的请求（认证服务没有返回的同名请求头被去掉）；
+// 其他应答（包括重定向到登录页面）原样返回访问者。
+
+// maxForwardAuthBody 返回访问者的认证服务应答的响应体上限
+const maxForwardAuthBody = 1 << 20
+
+// forwardAuthKey 请求上下文中已通过外部认证的标记，重新处理请求时不再发送子请求
+type forwardAuthKey struct{}
+
+var (
+	forwardAuthOnce   sync.Once
+	forwardAuthClient *http.Client
+)
+
+// authRespHeaders 认证通过时复制到请求的响应头名称
+func authRespHeaders(host *file.Host) []string {
+	var names []string
+	for _, v := range strings.FieldsFunc(host.AuthRespHeaders, func(r rune) bool { return r == ',' || r == '\n' || r == ' ' }) {
+		names = append(names, http.CanonicalHeaderKey(v))
+	}
+	return names
+}
+
+// getForwardAuthClient 发送子请求的客户端，不跟随重定向，超时由 forward_auth_timeout 设置（秒）
+func getForwardAuthClient() *http.Client {
+	forwardAuthOnce.Do(func() {
+		forwardAuthClient = &http.Client{
+			Timeout: time.Duration(beego.AppConfig.DefaultInt("forward_auth_timeout", 5)) * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	})
+	return forwardAuthClient
+}
+
+// checkForwardAuth 向认证服务校验访问者的请求，remoteAddr 为访问者连接的地址
+// 放行时返回带有标记的请求，并已复制认证服务的响应头；未放行时返回发给访问者的应答；认证服务无法访问时返回错误
+func checkForwardAuth(host *file.Host, r *http.Request, remoteAddr string) (*http.Request, *http.Response, error) {
+	if host.ForwardAuth == "" {
+		return r, nil, nil
+	}
+	if _, ok := r.Context().Value(forwardAuthKey{}).(bool); ok {
+		return r, nil, nil
+	}
+	req, err := http.NewRequest(r.Method, host.ForwardAuth, nil)
+	if err != nil {
+		return r, nil, err
+	}
+	req.Header = cacheHeader(r.Header)
+	req.Header.Del("Content-Length")
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", r.URL.Scheme)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", common.GetIpByAddr(remoteAddr))
+	resp, err := getForwardAuthClient().Do(req)
+	if err != nil {
+		return r, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxForwardAuthBody))
+		for _, name := range authRespHeaders(host) {
+			r.Header.Del(name)
+			for _, v := range resp.Header[name] {
+				r.Header.Add(name, v)
+			}
+		}
+		return r.WithContext(context.WithValue(r.Context(), forwardAuthKey{}, true)), nil, nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxForwardAuthBody))
+	if err != nil {
+		return r, nil, err
+	}
+	header := cacheHeader(resp.Header)
+	header.Del("Content-Length")
+	return r, ruleResponse(r, resp.StatusCode, header, string(b)), nil
+}
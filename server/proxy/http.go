@@ -8,15 +8,12 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"os"
-	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 
 	"ehang.io/nps/bridge"
-	"ehang.io/nps/lib/cache"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
@@ -27,16 +24,14 @@ import (
 // httpServer HTTP代理服务器结构体
 // 继承自BaseServer，提供HTTP和HTTPS协议的代理服务
 type httpServer struct {
-	BaseServer                    // 基础代理服务器，提供通用功能
-	httpPort      int             // HTTP服务监听端口
-	httpsPort     int             // HTTPS服务监听端口
-	httpServer    *http.Server    // HTTP服务器实例
-	httpsServer   *http.Server    // HTTPS服务器实例
-	httpsListener net.Listener    // HTTPS监听器
-	useCache      bool            // 是否启用缓存功能
-	addOrigin     bool            // 是否添加Origin头信息
-	cache         *cache.Cache    // 缓存实例，用于存储HTTP响应
-	cacheLen      int             // 缓存最大长度限制
+	BaseServer                 // 基础代理服务器，提供通用功能
+	httpPort      int          // HTTP服务监听端口
+	httpsPort     int          // HTTPS服务监听端口
+	httpServer    *http.Server // HTTP服务器实例
+	httpsServer   *http.Server // HTTPS服务器实例
+	httpsListener net.Listener // HTTPS监听器
+	addOrigin     bool         // 是否添加Origin头信息
+	visitors      sync.Map     // 访问者连接及其复用的后端连接，map[net.Conn]*h2Visitor
 }
 
 // NewHttp 创建新的HTTP代理服务器实例
@@ -44,11 +39,9 @@ type httpServer struct {
 // c: 隧道配置信息
 // httpPort: HTTP服务端口，0表示不启动HTTP服务
 // httpsPort: HTTPS服务端口，0表示不启动HTTPS服务
-// useCache: 是否启用响应缓存
-// cacheLen: 缓存大小限制
 // addOrigin: 是否在请求头中添加Origin信息
 // 返回: 初始化完成的HTTP服务器实例
-func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, useCache bool, cacheLen int, addOrigin bool) *httpServer {
+func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, addOrigin bool) *httpServer {
 	httpServer := &httpServer{
 		BaseServer: BaseServer{
 			task:   c,
@@ -57,14 +50,8 @@ func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, use
 		},
 		httpPort:  httpPort,
 		httpsPort: httpsPort,
-		useCache:  useCache,
-		cacheLen:  cacheLen,
 		addOrigin: addOrigin,
 	}
-	// 如果启用缓存，初始化缓存实例
-	if useCache {
-		httpServer.cache = cache.New(cacheLen)
-	}
 	return httpServer
 }
 
@@ -73,14 +60,15 @@ func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, use
 // 返回: 启动过程中的错误
 func (s *httpServer) Start() error {
 	var err error
-	// 读取错误页面内容，用于连接失败时显示
-	if s.errorContent, err = common.ReadAllFromFile(filepath.Join(common.GetRunPath(), "web", "static", "page", "error.html")); err != nil {
-		s.errorContent = []byte("npx 404")
-	}
-	
+	// 读取错误页面模板，用于无法转发请求时应答访问者
+	loadErrorPages()
+
+	// 开启 acme_enable 时初始化证书管理器，开始申请自动证书
+	getAcmeManager()
+
 	// 启动HTTP服务
 	if s.httpPort > 0 {
-		s.httpServer = s.NewServer(s.httpPort, "http")
+		s.httpServer = s.NewServer(s.httpPort, "http", false)
 		go func() {
 			// 获取HTTP监听器
 			l, err := connection.GetHttpListener()
@@ -99,7 +87,7 @@ func (s *httpServer) Start() error {
 	
 	// 启动HTTPS服务
 	if s.httpsPort > 0 {
-		s.httpsServer = s.NewServer(s.httpsPort, "https")
+		s.httpsServer = s.NewServer(s.httpsPort, "https", false)
 		go func() {
 			// 获取HTTPS监听器
 			s.httpsListener, err = connection.GetHttpsListener()
@@ -108,7 +96,7 @@ func (s *httpServer) Start() error {
 				os.Exit(0)
 			}
 			// 启动HTTPS服务器
-			logs.Error(NewHttpsServer(s.httpsListener, s.bridge, s.useCache, s.cacheLen).Start())
+			logs.Error(NewHttpsServer(s.httpsListener, s.bridge).Start())
 		}()
 	}
 	return nil
@@ -145,12 +133,17 @@ func (s *httpServer) handleTunneling(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// 劫持HTTP连接，获取原始TCP连接
-	c, _, err := hijacker.Hijack()
+	c, rw, err := hijacker.Hijack()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	}
-	// 处理HTTP代理请求
-	s.handleHttp(conn.NewConn(c), r)
+	// 处理HTTP代理请求，劫持时已缓冲但未解析的数据优先读取
+	hc := conn.NewConn(c)
+	if n := rw.Reader.Buffered(); n > 0 {
+		hc.Rb, _ = rw.Reader.Peek(n)
+	}
+	s.handleHttp(hc, r)
 }
 
 // handleHttp 处理HTTP代理请求的核心方法
@@ -169,14 +162,23 @@ func (s *httpServer) handleHttp(c *conn.Conn, r *http.Request) {
 		lenConn    *conn.LenConn   // 带长度统计的连接
 		isReset    bool            // 是否需要重置连接
 		wg         sync.WaitGroup  // 等待组，用于协程同步
+		upgrade    bool            // 当前请求是否为协议升级请求
+		br         = bufio.NewReader(c) // 读取访问者后续请求的缓冲
+		pending    *reqQueue       // 已转发、尚未收到响应的请求，与后端响应按顺序对应
+		cached     *http.Response  // 命中缓存时直接应答的响应
+		cr         *cacheReq       // 当前请求的缓存状态
+		ruleResp   *http.Response  // 规则要求直接应答的响应（重定向或固定应答）
+		ruleTarget string          // 规则指定的目标地址
+		ruled      bool            // 切换目标重新连接时，当前请求已按规则处理过
+		authResp   *http.Response  // 外部认证未放行时返回访问者的应答
+		limited    bool            // 当前请求超出了速率限制
+		rated      bool            // 当前请求已在读取时计入速率限制
 	)
 	
-	// 确保连接在函数结束时被正确关闭
+	// 确保连接在函数结束时被正确关闭，未能转发请求时已在出错处以错误页面应答访问者
 	defer func() {
 		if connClient != nil {
 			connClient.Close()
-		} else {
-			s.writeConnFail(c.Conn)
 		}
 		c.Close()
 	}()
@@ -191,12 +193,32 @@ reset:
 	// 根据请求的Host头查找对应的主机配置
 	if host, err = file.GetDb().GetInfoByHost(r.Host, r); err != nil {
 		logs.Notice("the url %s %s %s can't be parsed!", r.URL.Scheme, r.Host, r.RequestURI)
+		writeErrorPage(c, nil, r, pageNoHost)
+		return
+	}
+
+	// 按全局黑名单与域名解析的来源访问控制校验访问者
+	if err := checkSourceAcl(host.IpAcl, c.RemoteAddr().String()); err != nil {
+		logs.Info("host id %d, %s", host.Id, err.Error())
+		writeErrorPage(c, host, r, pageForbidden)
+		return
+	}
+
+	// 按访问者 IP 限制请求速率，同一连接上后续的请求在读取时已计入
+	if !rated {
+		limited = checkSourceRate(host.RateLimit, c.RemoteAddr().String()) != nil
+	}
+	rated = false
+	if limited {
+		logs.Info("host id %d, remote address %s exceeds the rate limit", host.Id, c.RemoteAddr().String())
+		writeErrorPage(c, host, r, pageRateLimit)
 		return
 	}
 	
 	// 检查客户端的流量限制和连接数限制
 	if err := s.CheckFlowAndConnNum(host.Client); err != nil {
 		logs.Warn("client id %d, host id %d, error %s, when https connection", host.Client.Id, host.Id, err.Error())
+		writeErrorPage(c, host, r, pageQuota)
 		return
 	}
 	
@@ -204,92 +226,204 @@ reset:
 	if !isReset {
 		defer host.Client.AddConn()
 	}
+
+	// 维护中的域名解析直接返回维护页面，不连接客户端
+	if host.Maintenance {
+		writeErrorPage(c, host, r, pageMaintenance)
+		return
+	}
 	
-	// 执行HTTP基础认证检查
-	if err = s.auth(r, c, host.Client.Cnf.U, host.Client.Cnf.P); err != nil {
-		logs.Warn("auth error", err, r.RemoteAddr)
+	// 执行访问认证：域名解析的认证，未设置时为客户端的 Basic 认证
+	if r, err = checkHostAuth(host, r, c.RemoteAddr().String()); err != nil {
+		logs.Warn("host %s, remote address %s, %s", host.Host, c.RemoteAddr().String(), err.Error())
+		writeErrorPage(c, host, r, pageUnauthorized)
+		return
+	}
+
+	// 外部认证：由认证服务决定是否放行，未放行时将认证服务的应答返回访问者
+	if authResp == nil {
+		if r, authResp, err = checkForwardAuth(host, r, c.RemoteAddr().String()); err != nil {
+			logs.Warn("host %s forward auth error %s", host.Host, err.Error())
+			writeErrorPage(c, host, r, pageUnreachable)
+			return
+		}
+	}
+	if authResp != nil {
+		changeResponseHeader(host, r, authResp.Header)
+		writeCloseResponse(c, host, authResp)
 		return
 	}
 	
-	// 获取目标服务器的随机地址（支持负载均衡）
-	if targetAddr, err = host.Target.GetRandomTarget(); err != nil {
+	// 按域名解析的规则处理请求：重写路径、重定向、固定应答或指定目标
+	if !ruled {
+		if ruleResp, ruleTarget, err = applyHostRules(host, r); err != nil {
+			logs.Warn(err.Error())
+			writeErrorPage(c, host, r, pageUnreachable)
+			return
+		}
+	}
+	ruled = false
+
+	// 重定向或固定应答时不连接后端，应答后读取访问者的下一个请求
+	if ruleResp != nil {
+		changeResponseHeader(host, r, ruleResp.Header)
+		lenConn = conn.NewLenConn(c)
+		err = ruleResp.Write(lenConn)
+		host.Flow.Add(0, int64(lenConn.Len))
+		logs.Trace("%s request, method %s, host %s, url %s, remote address %s, return by rule", r.URL.Scheme, r.Method, r.Host, r.URL.Path, c.RemoteAddr().String())
+		if err != nil || r.Close {
+			return
+		}
+		if r, err = http.ReadRequest(br); err != nil {
+			return
+		}
+		r.URL.Scheme = scheme
+		r.Method = resetReqMethod(r.Method)
+		isReset = true
+		goto reset
+	}
+
+	// 规则指定了目标时使用该目标，否则按域名解析的负载均衡策略选择目标
+	if ruleTarget != "" {
+		targetAddr = ruleTarget
+	} else if targetAddr, err = selectHostTarget(host, r, c.RemoteAddr().String()); err != nil {
 		logs.Warn(err.Error())
+		writeErrorPage(c, host, r, pageUnreachable)
 		return
 	}
 	
 	// 创建连接链路信息，包含目标地址、加密、压缩等配置
-	lk = conn.NewLink("http", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, r.RemoteAddr, host.Target.LocalProxy)
+	lk = conn.NewLink("http", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, r.RemoteAddr, host.Target.LocalProxy,
+		conn.LinkProxyProtocol(host.ProxyProtocol, c.LocalAddr().String()), conn.LinkFixedTarget())
 	
 	// 通过桥接器向客户端发送连接信息，建立代理通道
 	if target, err = s.bridge.SendLinkInfo(host.Client.Id, lk, nil); err != nil {
 		logs.Notice("connect to target %s error %s", lk.Host, err)
+		if lk.LocalProxy {
+			writeErrorPage(c, host, r, pageUnreachable)
+		} else {
+			writeErrorPage(c, host, r, pageOffline)
+		}
 		return
 	}
 	
 	// 创建带加密、压缩和限速功能的客户端连接
 	connClient = conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true)
+	// 后端连接期间计入目标的活动连接数，由响应协程在连接结束时减去
+	host.Target.ConnOpen(targetAddr)
+
+	pending = new(reqQueue)
+
+	// 协议升级请求发出后，由响应协程通过 upgraded 告知后端是否返回了 101（返回时传递空闲检测，否则为 nil）
+	var expectUpgrade int32
+	upgraded := make(chan *idleWatcher, 1)
+	respDone := make(chan struct{})
 
 	// 启动协程：从目标服务器读取响应并转发给客户端
-	go func() {
-		wg.Add(1)
+	wg.Add(1)
+	go func(connClient io.ReadWriteCloser, host *file.Host, pending *reqQueue, targetAddr string) {
 		isReset = false
 		defer connClient.Close()
+		defer host.Target.ConnClose(targetAddr)
 		defer func() {
+			close(respDone)
 			wg.Done()
 			if !isReset {
 				c.Close()
 			}
 		}()
+		rb := bufio.NewReader(connClient)
 		
 		// 持续读取目标服务器的响应
 		for {
-			if resp, err := http.ReadResponse(bufio.NewReader(connClient), r); err != nil || resp == nil || r == nil {
+			// 等后端响应到达后再取出对应的请求，请求总是在写入后端之前入队
+			if _, err := rb.Peek(1); err != nil {
+				// 后端未应答就关闭了连接（如内网目标拒绝连接），以错误页面应答尚未收到响应的请求
+				if req, _ := pending.front(); req != nil && !isReset {
+					writeErrorPage(c, host, req, pageUnreachable)
+				}
+				return
+			}
+			req, cr := pending.front()
+			if resp, err := http.ReadResponse(rb, req); err != nil || resp == nil || req == nil {
 				// 如果读取响应失败或连接断开，退出循环
 				return
+			} else if resp.StatusCode == http.StatusSwitchingProtocols {
+				// 协议升级成功：写回 101 响应后，后端到访问者的数据原样转发
+				lenConn := conn.NewLenConn(c)
+				if err := resp.Write(lenConn); err != nil {
+					return
+				}
+				host.Flow.Add(0, int64(lenConn.Len))
+				w := newIdleWatcher(upgradeIdleTimeout(), c, connClient)
+				defer w.stop()
+				if atomic.CompareAndSwapInt32(&expectUpgrade, 1, 0) {
+					upgraded <- w
+				}
+				copyUpgraded(c, rb, w, func(n int64) { host.Flow.Add(0, n) })
+				return
 			} else {
-				// 如果启用了缓存且请求的是静态资源（包含文件扩展名）
-				if s.useCache && r.URL != nil && strings.Contains(r.URL.Path, ".") {
-					// 将响应序列化为字节数组
-					b, err := httputil.DumpResponse(resp, true)
-					if err != nil {
-						return
-					}
-					// 直接写入响应到客户端
-					c.Write(b)
-					// 更新流量统计
-					host.Flow.Add(0, int64(len(b)))
-					// 将响应存储到缓存中
-					s.cache.Add(filepath.Join(host.Host, r.URL.Path), b)
-				} else {
-					// 创建带长度统计的连接包装器
-					lenConn := conn.NewLenConn(c)
-					// 将响应写入客户端连接
-					if err := resp.Write(lenConn); err != nil {
-						logs.Error(err)
-						return
-					}
-					// 更新流量统计
-					host.Flow.Add(0, int64(lenConn.Len))
+				if atomic.CompareAndSwapInt32(&expectUpgrade, 1, 0) {
+					upgraded <- nil
+				}
+				// 最终响应与最早转发的请求对应，交给缓存处理（304 时以缓存应答，可缓存时边转发边存入）
+				if resp.StatusCode >= http.StatusOK {
+					pending.pop()
+					cr.finish(resp)
+					// 域名解析开启了响应压缩时按访问者的 Accept-Encoding 压缩，流量按压缩后的字节数统计
+					compressResponse(host, req, resp)
+					// 按域名解析的响应头规则修改响应头
+					changeResponseHeader(host, req, resp.Header)
+					// cookie 策略时设置会话保持 Cookie
+					setStickyCookie(host, req, resp.Header, targetAddr)
+					// 认证通过时下发登录 Cookie
+					setAuthCookie(host, req, resp.Header)
+				}
+				// 创建带长度统计的连接包装器
+				lenConn := conn.NewLenConn(c)
+				// 将响应写入客户端连接
+				if err := resp.Write(lenConn); err != nil {
+					logs.Error(err)
+					return
 				}
+				// 更新流量统计
+				host.Flow.Add(0, int64(lenConn.Len))
 			}
 		}
-	}()
+	}(connClient, host, pending, targetAddr)
 
 	// 主循环：处理来自客户端的请求
 	for {
-		// 如果启用了缓存，检查是否有缓存的响应
-		if s.useCache {
-			if v, ok := s.cache.Get(filepath.Join(host.Host, r.URL.Path)); ok {
-				// 直接返回缓存的响应
-				n, err := c.Write(v.([]byte))
-				if err != nil {
+		// 规则要求直接应答时不再转发到后端
+		if ruleResp != nil {
+			changeResponseHeader(host, r, ruleResp.Header)
+			lenConn = conn.NewLenConn(c)
+			if err := ruleResp.Write(lenConn); err != nil {
+				break
+			}
+			logs.Trace("%s request, method %s, host %s, url %s, remote address %s, return by rule", r.URL.Scheme, r.Method, r.Host, r.URL.Path, c.RemoteAddr().String())
+			host.Flow.Add(0, int64(lenConn.Len))
+			if r.Close {
+				break
+			}
+			goto readReq
+		}
+
+		// 域名解析开启了缓存时查找缓存，命中新鲜的缓存时直接应答，不再转发到后端
+		cr = nil
+		if !isUpgrade(r) {
+			if cached, cr = beginCache(host, r); cached != nil {
+				compressResponse(host, r, cached)
+				changeResponseHeader(host, r, cached.Header)
+				lenConn = conn.NewLenConn(c)
+				if err := cached.Write(lenConn); err != nil {
 					break
 				}
 				logs.Trace("%s request, method %s, host %s, url %s, remote address %s, return cache", r.URL.Scheme, r.Method, r.Host, r.URL.Path, c.RemoteAddr().String())
 				// 更新流量统计
-				host.Flow.Add(0, int64(n))
-				// 如果连接设置为关闭或未设置，则关闭连接
-				if strings.ToLower(r.Header.Get("Connection")) == "close" || strings.ToLower(r.Header.Get("Connection")) == "" {
+				host.Flow.Add(0, int64(lenConn.Len))
+				// 访问者要求关闭连接时不再读取后续请求
+				if r.Close {
 					break
 				}
 				goto readReq
@@ -301,6 +435,11 @@ reset:
 		logs.Trace("%s request, method %s, host %s, url %s, remote address %s, target %s", r.URL.Scheme, r.Method, r.Host, r.URL.Path, c.RemoteAddr().String(), lk.Host)
 		
 		// 将修改后的请求转发给目标服务器
+		upgrade = isUpgrade(r)
+		if upgrade {
+			atomic.StoreInt32(&expectUpgrade, 1)
+		}
+		pending.push(r, cr)
 		lenConn = conn.NewLenConn(connClient)
 		if err := r.Write(lenConn); err != nil {
 			logs.Error(err)
@@ -309,10 +448,27 @@ reset:
 		// 更新出站流量统计
 		host.Flow.Add(int64(lenConn.Len), 0)
 
+		// 协议升级请求：等待后端响应，返回 101 后访问者到后端的数据原样转发，不再按 HTTP 请求解析
+		if upgrade {
+			select {
+			case w := <-upgraded:
+				if w != nil {
+					logs.Trace("%s upgrade to %s, host %s, url %s, remote address %s", r.URL.Scheme, r.Header.Get("Upgrade"), r.Host, r.URL.Path, c.RemoteAddr().String())
+					copyUpgraded(connClient, br, w, func(n int64) { host.Flow.Add(n, 0) })
+					connClient.Close()
+					c.Close()
+					wg.Wait()
+					return
+				}
+			case <-respDone:
+				return
+			}
+		}
+
 	// readReq标签：读取下一个请求
 	readReq:
 		// 从客户端连接读取下一个HTTP请求
-		if r, err = http.ReadRequest(bufio.NewReader(c)); err != nil {
+		if r, err = http.ReadRequest(br); err != nil {
 			break
 		}
 		// 保持原始协议类型
@@ -325,9 +481,40 @@ reset:
 			logs.Notice("the url %s %s %s can't be parsed!", r.URL.Scheme, r.Host, r.RequestURI)
 			break
 		} else if host != hostTmp {
-			// 如果主机配置发生变化，需要重置连接
+			// 如果主机配置发生变化，需要重置连接，由新的域名解析计入速率限制
 			host = hostTmp
 			isReset = true
+			rated = false
+			connClient.Close()
+			goto reset
+		}
+
+		// 同一连接上的每个请求都计入速率限制，超出时重新处理以返回限制的应答
+		limited, rated = checkSourceRate(host.RateLimit, c.RemoteAddr().String()) != nil, true
+		if limited {
+			isReset = true
+			connClient.Close()
+			goto reset
+		}
+
+		// 同一连接上的每个请求都要通过认证与外部认证，未通过时重新处理以返回认证失败的应答
+		if r, err = checkHostAuth(host, r, c.RemoteAddr().String()); err == nil {
+			r, authResp, err = checkForwardAuth(host, r, c.RemoteAddr().String())
+		}
+		if err != nil || authResp != nil {
+			isReset = true
+			connClient.Close()
+			goto reset
+		}
+
+		// 按规则处理请求，规则指定的目标与当前连接的目标不同时重新连接
+		if ruleResp, ruleTarget, err = applyHostRules(host, r); err != nil {
+			logs.Warn(err.Error())
+			break
+		}
+		if ruleTarget != "" && ruleTarget != lk.Host {
+			ruled = true
+			isReset = true
 			connClient.Close()
 			goto reset
 		}
@@ -336,6 +523,44 @@ reset:
 	wg.Wait()
 }
 
+// reqQueue 后端连接上已转发、尚未收到最终响应的请求
+type reqQueue struct {
+	list []pendingReq
+	sync.Mutex
+}
+
+// pendingReq 已转发的请求及其缓存状态
+type pendingReq struct {
+	r  *http.Request
+	cr *cacheReq // 未开启缓存时为 nil
+}
+
+// push 记录一个已转发的请求
+func (q *reqQueue) push(r *http.Request, cr *cacheReq) {
+	q.Lock()
+	q.list = append(q.list, pendingReq{r: r, cr: cr})
+	q.Unlock()
+}
+
+// front 返回最早转发的请求，没有时返回 nil
+func (q *reqQueue) front() (*http.Request, *cacheReq) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.list) == 0 {
+		return nil, nil
+	}
+	return q.list[0].r, q.list[0].cr
+}
+
+// pop 移除最早转发的请求，1xx 中间响应之后仍对应同一个请求，收到最终响应后才移除
+func (q *reqQueue) pop() {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.list) > 0 {
+		q.list = q.list[1:]
+	}
+}
+
 // resetReqMethod 修复HTTP请求方法
 // 处理某些情况下请求方法字符丢失的问题
 // method: 原始请求方法
@@ -353,16 +578,29 @@ func resetReqMethod(method string) string {
 // NewServer 创建HTTP服务器实例
 // port: 监听端口
 // scheme: 协议类型（http/https）
+// http2: 是否在 TLS 握手时协商 h2
 // 返回: 配置完成的HTTP服务器实例
-func (s *httpServer) NewServer(port int, scheme string) *http.Server {
-	return &http.Server{
+func (s *httpServer) NewServer(port int, scheme string, http2 bool) *http.Server {
+	srv := &http.Server{
 		Addr: ":" + strconv.Itoa(port),
-		// 设置请求处理器，将所有请求转发给隧道处理方法
+		// 设置请求处理器：ACME 验证请求直接应答，h2 请求与后端为 h2c 的请求按请求转发，其余劫持连接转发
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			r.URL.Scheme = scheme
+			if scheme == "http" && serveAcmeChallenge(w, r) {
+				return
+			}
+			if s.useHttp2(r) {
+				s.handleHttp2(w, r)
+				return
+			}
 			s.handleTunneling(w, r)
 		}),
+		ConnContext: s.connContext,
+		ConnState:   s.connState,
+	}
+	if !http2 {
 		// 禁用HTTP/2，确保与代理功能的兼容性
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 	}
+	return srv
 }
@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+	"golang.org/x/net/http2"
+)
+
+// HTTP/2 代理路径：访问者以 h2 访问（TLS 终止时协商），或域名解析开启了 h2c 连接后端时，
+// 请求不再劫持连接逐字节转发，而是经 httputil.ReverseProxy 逐个请求转发，
+// 后端连接通过 npc 的复用隧道建立，可以是 HTTP/1.1，也可以是 h2c（HTTP/2 明文，适用于 gRPC）。
+// 后端连接按访问者连接与域名解析分组复用，访问者连接关闭时一并关闭，
+// 保证 ip_limit 等按访问者地址的校验在建立后端连接时生效。
+
+// visitorKey 访问者连接在请求 context 中的 key
+type visitorKey struct{}
+
+// h2Visitor 一个访问者连接上复用的后端连接
+type h2Visitor struct {
+	remoteAddr string
+	localAddr  string
+	transports map[h2TransportKey]*h2Transport
+	sync.Mutex
+}
+
+// h2TransportKey 连接池按域名解析与目标区分
+type h2TransportKey struct {
+	hostId int
+	target string
+}
+
+// h2Transport 某个域名解析（或其规则指定的目标）的后端连接池
+type h2Transport struct {
+	host *file.Host
+	rt   http.RoundTripper
+}
+
+// rwcConn 将经过加密、压缩与限速包装的后端连接还原为 net.Conn
+type rwcConn struct {
+	net.Conn
+	rwc io.ReadWriteCloser
+}
+
+// Read 读取后端响应
+func (s *rwcConn) Read(b []byte) (int, error) {
+	return s.rwc.Read(b)
+}
+
+// Write 写入发往后端的请求
+func (s *rwcConn) Write(b []byte) (int, error) {
+	return s.rwc.Write(b)
+}
+
+// Close 关闭后端连接
+func (s *rwcConn) Close() error {
+	return s.rwc.Close()
+}
+
+// flowWriter 统计写给访问者的响应体（压缩后）字节数，计入域名解析的出站流量，与 HTTP/1.1 路径一致按访问者一侧统计
+type flowWriter struct {
+	http.ResponseWriter
+	flow *file.Flow
+}
+
+// Write 写入响应体，计入出站流量
+func (s *flowWriter) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.flow.Add(0, int64(n))
+	return n, err
+}
+
+// Flush 将已写入的响应发送给访问者
+func (s *flowWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap 返回原始的 ResponseWriter，供 http.ResponseController 使用
+func (s *flowWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// flowReader 统计从访问者读取的请求体字节数，计入域名解析的入站流量
+type flowReader struct {
+	io.ReadCloser
+	flow *file.Flow
+}
+
+// Read 读取请求体，计入入站流量
+func (s *flowReader) Read(b []byte) (int, error) {
+	n, err := s.ReadCloser.Read(b)
+	s.flow.Add(int64(n), 0)
+	return n, err
+}
+
+// connContext 为每个访问者连接创建 h2Visitor，作为 http.Server 的 ConnContext 使用
+func (s *httpServer) connContext(ctx context.Context, c net.Conn) context.Context {
+	v := &h2Visitor{remoteAddr: c.RemoteAddr().String(), localAddr: c.LocalAddr().String(), transports: make(map[h2TransportKey]*h2Transport)}
+	s.visitors.Store(c, v)
+	return context.WithValue(ctx, visitorKey{}, v)
+}
+
+// connState 访问者连接关闭或被劫持时释放其后端连接，作为 http.Server 的 ConnState 使用
+func (s *httpServer) connState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	if v, ok := s.visitors.Load(c); ok {
+		s.visitors.Delete(c)
+		v.(*h2Visitor).close()
+	}
+}
+
+// close 关闭访问者连接上的所有后端连接
+func (s *h2Visitor) close() {
+	s.Lock()
+	defer s.Unlock()
+	for key, t := range s.transports {
+		closeTransport(t.rt)
+		delete(s.transports, key)
+	}
+}
+
+// closeTransport 关闭连接池中的空闲连接
+func closeTransport(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// transport 返回访问者连接上某个域名解析到目标 targetAddr 的连接池，域名解析被修改后重新创建
+func (s *httpServer) transport(v *h2Visitor, host *file.Host, targetAddr string) http.RoundTripper {
+	key := h2TransportKey{hostId: host.Id, target: targetAddr}
+	v.Lock()
+	defer v.Unlock()
+	if t, ok := v.transports[key]; ok {
+		if t.host == host {
+			return t.rt
+		}
+		closeTransport(t.rt)
+	}
+	dial := func() (net.Conn, error) {
+		return s.dialHost(host, targetAddr, v.remoteAddr, v.localAddr)
+	}
+	var rt http.RoundTripper
+	if host.H2cTarget {
+		rt = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial()
+			},
+		}
+	} else {
+		rt = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial()
+			},
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     time.Minute,
+			DisableCompression:  true,
+		}
+	}
+	v.transports[key] = &h2Transport{host: host, rt: rt}
+	return rt
+}
+
+// dialHost 经 npc 建立到域名解析目标 targetAddr 的连接，remoteAddr 与 localAddr 为访问者连接的两端地址
+func (s *httpServer) dialHost(host *file.Host, targetAddr, remoteAddr, localAddr string) (net.Conn, error) {
+	lk := conn.NewLink("http", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, remoteAddr, host.Target.LocalProxy,
+		conn.LinkProxyProtocol(host.ProxyProtocol, localAddr), conn.LinkFixedTarget())
+	target, err := s.bridge.SendLinkInfo(host.Client.Id, lk, nil)
+	if err != nil {
+		logs.Notice("connect to target %s error %s", lk.Host, err)
+		if !lk.LocalProxy {
+			err = &clientOfflineError{err}
+		}
+		return nil, err
+	}
+	return &rwcConn{Conn: target, rwc: conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true)}, nil
+}
+
+// clientOfflineError 经 npc 建立后端连接失败，用于区分客户端离线与内网目标无法连接
+type clientOfflineError struct {
+	err error
+}
+
+func (e *clientOfflineError) Error() string {
+	return e.err.Error()
+}
+
+// isUpgrade 判断是否为 WebSocket 等协议升级请求，升级请求仍走劫持连接的 HTTP/1.1 路径
+func isUpgrade(r *http.Request) bool {
+	return r.ProtoMajor == 1 && strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// useHttp2 判断请求是否走 HTTP/2 代理路径：访问者使用 h2，或域名解析开启了 h2c 连接后端
+func (s *httpServer) useHttp2(r *http.Request) bool {
+	if r.ProtoMajor == 2 {
+		return true
+	}
+	if isUpgrade(r) {
+		return false
+	}
+	host, err := file.GetDb().GetInfoByHost(r.Host, r)
+	return err == nil && host.H2cTarget
+}
+
+// handleHttp2 以反向代理的方式逐个转发请求
+func (s *httpServer) handleHttp2(w http.ResponseWriter, r *http.Request) {
+	host, err := file.GetDb().GetInfoByHost(r.Host, r)
+	if err != nil {
+		logs.Notice("the url %s %s %s can't be parsed!", r.URL.Scheme, r.Host, r.RequestURI)
+		writeCachedResponse(w, errorPageResponse(nil, r, pageNoHost))
+		return
+	}
+	if err = checkSourceAcl(host.IpAcl, r.RemoteAddr); err != nil {
+		logs.Info("host id %d, %s", host.Id, err.Error())
+		host.Flow.Add(0, writeCachedResponse(w, errorPageResponse(host, r, pageForbidden)))
+		return
+	}
+	if err = checkSourceRate(host.RateLimit, r.RemoteAddr); err != nil {
+		logs.Info("host id %d, %s", host.Id, err.Error())
+		host.Flow.Add(0, writeCachedResponse(w, errorPageResponse(host, r, pageRateLimit)))
+		return
+	}
+	if err = s.CheckFlowAndConnNum(host.Client); err != nil {
+		logs.Warn("client id %d, host id %d, error %s, when http2 connection", host.Client.Id, host.Id, err.Error())
+		host.Flow.Add(0, writeCachedResponse(w, errorPageResponse(host, r, pageQuota)))
+		return
+	}
+	defer host.Client.AddConn()
+	if host.Maintenance {
+		host.Flow.Add(0, writeCachedResponse(w, errorPageResponse(host, r, pageMaintenance)))
+		return
+	}
+	if r, err = checkHostAuth(host, r, r.RemoteAddr); err != nil {
+		logs.Warn("host %s, remote address %s, %s", host.Host, r.RemoteAddr, err.Error())
+		host.Flow.Add(0, writeCachedResponse(w, errorPageResponse(host, r, pageUnauthorized)))
+		return
+	}
+	// 外部认证未放行时将认证服务的应答返回访问者
+	r, authResp, err := checkForwardAuth(host, r, r.RemoteAddr)
+	if err != nil {
+		logs.Warn("host %s forward auth error %s", host.Host, err.Error())
+		host.Flow.Add(0, writeCachedResponse(w, errorPageResponse(host, r, pageUnreachable)))
+		return
+	}
+	if authResp != nil {
+		changeResponseHeader(host, r, authResp.Header)
+		host.Flow.Add(0, writeCachedResponse(w, authResp))
+		return
+	}
+	v, ok := r.Context().Value(visitorKey{}).(*h2Visitor)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	remoteAddr := r.RemoteAddr
+	// 按域名解析的规则处理请求，重定向或固定应答时直接应答
+	ruleResp, ruleTarget, err := applyHostRules(host, r)
+	if err != nil {
+		logs.Warn(err.Error())
+		host.Flow.Add(0, writeCachedResponse(w, errorPageResponse(host, r, pageUnreachable)))
+		return
+	}
+	if ruleResp != nil {
+		changeResponseHeader(host, r, ruleResp.Header)
+		logs.Trace("%s request, method %s, host %s, url %s, remote address %s, return by rule", r.URL.Scheme, r.Method, r.Host, r.URL.Path, remoteAddr)
+		host.Flow.Add(0, writeCachedResponse(w, ruleResp))
+		return
+	}
+	// 域名解析开启了缓存时查找缓存，命中新鲜的缓存时直接应答
+	cached, cr := beginCache(host, r)
+	if cached != nil {
+		compressResponse(host, r, cached)
+		changeResponseHeader(host, r, cached.Header)
+		logs.Trace("%s request, method %s, host %s, url %s, remote address %s, return cache", r.URL.Scheme, r.Method, r.Host, r.URL.Path, remoteAddr)
+		host.Flow.Add(0, writeCachedResponse(w, cached))
+		return
+	}
+	// 规则指定了目标时使用该目标，否则按域名解析的负载均衡策略为每个请求选择目标，请求期间计入目标的活动连接数
+	targetAddr := ruleTarget
+	if targetAddr == "" {
+		if targetAddr, err = selectHostTarget(host, r, remoteAddr); err != nil {
+			logs.Warn(err.Error())
+			host.Flow.Add(0, writeCachedResponse(w, errorPageResponse(host, r, pageUnreachable)))
+			return
+		}
+	}
+	host.Target.ConnOpen(targetAddr)
+	defer host.Target.ConnClose(targetAddr)
+	logs.Trace("%s request, method %s, host %s, url %s, remote address %s, proto %s", r.URL.Scheme, r.Method, r.Host, r.URL.Path, remoteAddr, r.Proto)
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = req.Host
+			common.ChangeHostAndHeader(req, host.HostChange, host.HeaderChange, remoteAddr, s.addOrigin)
+		},
+		Transport:     s.transport(v, host, targetAddr),
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			cr.finish(resp)
+			compressResponse(host, r, resp)
+			changeResponseHeader(host, r, resp.Header)
+			setStickyCookie(host, r, resp.Header, targetAddr)
+			setAuthCookie(host, r, resp.Header)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			logs.Notice("http2 proxy to host %s error %s", host.Host, err.Error())
+			kind := pageUnreachable
+			var offline *clientOfflineError
+			if errors.As(err, &offline) {
+				kind = pageOffline
+			}
+			// w 为 flowWriter，已计入流量
+			writeCachedResponse(w, errorPageResponse(host, r, kind))
+		},
+	}
+	// 去掉访问者地址，由 ChangeHostAndHeader 按 http_add_origin_header 处理 X-Forwarded-For
+	req := r.WithContext(r.Context())
+	req.RemoteAddr = ""
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &flowReader{ReadCloser: req.Body, flow: host.Flow}
+	}
+	proxy.ServeHTTP(&flowWriter{ResponseWriter: w, flow: host.Flow}, req)
+}
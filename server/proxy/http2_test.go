@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/file"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// testCertPem 生成一张自签名证书，返回 PEM 格式的证书与私钥
+func testCertPem(t *testing.T, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}))
+}
+
+// startTestHttps 启动终止 TLS 的 https 代理，返回监听地址
+func startTestHttps(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewHttpsServer(l, &localBridge{})
+	go s.Start()
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+// tlsClient 经 https 代理以 serverName 访问的客户端，h2 为 true 时在握手时提供 h2
+func tlsClient(proxyAddr, serverName string, h2 bool) *http.Client {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", proxyAddr)
+		},
+		ForceAttemptHTTP2: h2,
+	}
+	return &http.Client{Transport: tr, Timeout: 5 * time.Second}
+}
+
+// TestHttp2 测试按域名解析的开关与访问者协商 h2、以 h2c 连接后端，以及请求计入域名解析的流量
+func TestHttp2(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"name":"nps","value":12345},`), 1000)
+	proto := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/json" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+			return
+		}
+		io.WriteString(w, r.Proto)
+	})
+	h1 := httptest.NewServer(proto)
+	defer h1.Close()
+	h2cBackend := httptest.NewServer(h2c.NewHandler(proto, &http2.Server{}))
+	defer h2cBackend.Close()
+
+	plain := newTestHost(t, "h1.nps.test", h1.Listener.Addr().String())
+	h2 := newTestHost(t, "h2.nps.test", h1.Listener.Addr().String())
+	h2.Http2 = true
+	grpc := newTestHost(t, "h2c.nps.test", h2cBackend.Listener.Addr().String())
+	grpc.H2cTarget = true
+	grpc.Http2 = true
+	for _, h := range []*file.Host{plain, h2, grpc} {
+		h.CertContent, h.KeyContent = testCertPem(t, h.Host)
+	}
+	httpsAddr := startTestHttps(t)
+	httpAddr := startTestProxy(t)
+
+	for _, c := range []struct {
+		name, url, visitor, backend string
+		client                      *http.Client
+	}{
+		// 未开启 HTTP/2 的域名解析即使访问者提供 h2 也以 HTTP/1.1 应答
+		{"http2 disabled", "https://h1.nps.test/", "HTTP/1.1", "HTTP/1.1", tlsClient(httpsAddr, plain.Host, true)},
+		{"http2 enabled", "https://h2.nps.test/", "HTTP/2.0", "HTTP/1.1", tlsClient(httpsAddr, h2.Host, true)},
+		{"http2 without h2 alpn", "https://h2.nps.test/", "HTTP/1.1", "HTTP/1.1", tlsClient(httpsAddr, h2.Host, false)},
+		{"h2c over h2", "https://h2c.nps.test/", "HTTP/2.0", "HTTP/2.0", tlsClient(httpsAddr, grpc.Host, true)},
+		// 访问者使用 HTTP/1.1 时同样以 h2c 连接后端
+		{"h2c over http", "http://" + httpAddr + "/", "HTTP/1.1", "HTTP/2.0", &http.Client{Timeout: 5 * time.Second}},
+	} {
+		req, _ := http.NewRequest("GET", c.url, nil)
+		if c.name == "h2c over http" {
+			req.Host = grpc.Host
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Proto != c.visitor || string(b) != c.backend {
+			t.Fatalf("%s: visitor proto %s, backend proto %s, want %s and %s", c.name, resp.Proto, b, c.visitor, c.backend)
+		}
+	}
+
+	// 流量按访问者一侧统计：请求体计入入站流量，压缩后的响应体计入出站流量
+	gz := newTestHost(t, "gz.nps.test", h1.Listener.Addr().String())
+	gz.Http2, gz.HttpCompress = true, true
+	gz.CertContent, gz.KeyContent = testCertPem(t, gz.Host)
+	resp, err := tlsClient(httpsAddr, gz.Host, true).Post("https://gz.nps.test/json", "text/plain", strings.NewReader("request body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Proto != "HTTP/2.0" || !bytes.Equal(b, body) {
+		t.Fatalf("unexpected response, proto %s, %d bytes", resp.Proto, len(b))
+	}
+	// 响应写完后才计入，稍作等待
+	time.Sleep(50 * time.Millisecond)
+	gz.Flow.RLock()
+	defer gz.Flow.RUnlock()
+	if gz.Flow.ExportFlow == 0 || gz.Flow.ExportFlow >= int64(len(body)) {
+		t.Fatalf("export flow %d should count compressed bytes of a %d bytes body", gz.Flow.ExportFlow, len(body))
+	}
+	if gz.Flow.InletFlow != int64(len("request body")) {
+		t.Fatalf("inlet flow %d should count the request body", gz.Flow.InletFlow)
+	}
+}
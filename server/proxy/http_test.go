@@ -0,0 +1,797 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"github.com/andybalholm/brotli"
+	"github.com/astaxie/beego"
+	"golang.org/x/net/websocket"
+)
+
+// localBridge 直接在本地拨号到目标，代替经 npc 建立的连接
+type localBridge struct{}
+
+func (b *localBridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (net.Conn, error) {
+	return net.Dial("tcp", link.Host)
+}
+
+// testHostId 测试中添加的域名解析与客户端的ID，避免与配置文件中的对象冲突
+var testHostId int32 = 1 << 30
+
+// initTestDb 配置文件不存在时创建空文件，以便加载配置
+func initTestDb(t *testing.T) {
+	dir := filepath.Join(common.GetRunPath(), "conf")
+	os.MkdirAll(dir, 0755)
+	for _, name := range []string{"clients.json", "tasks.json", "hosts.json"} {
+		if p := filepath.Join(dir, name); !common.FileExists(p) {
+			if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	file.GetDb()
+}
+
+// newTestHost 在内存中添加一个指向 target 的域名解析
+func newTestHost(t *testing.T, host, target string) *file.Host {
+	initTestDb(t)
+	id := int(atomic.AddInt32(&testHostId, 1))
+	h := &file.Host{
+		Id:     id,
+		Host:   host,
+		Scheme: "all",
+		Flow:   new(file.Flow),
+		Client: &file.Client{Id: id, Status: true, Cnf: new(file.Config), Flow: new(file.Flow)},
+		Target: &file.Target{TargetStr: target},
+	}
+	file.GetDb().JsonDb.Hosts.Store(h.Id, h)
+	t.Cleanup(func() { file.GetDb().JsonDb.Hosts.Delete(h.Id) })
+	return h
+}
+
+// startTestProxy 启动域名解析代理，返回监听地址
+func startTestProxy(t *testing.T) string {
+	s := NewHttp(nil, nil, 0, 0, false)
+	s.bridge = &localBridge{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := s.NewServer(0, "http", false)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// dialWebsocket 经代理以指定的 Host 建立 WebSocket 连接
+func dialWebsocket(t *testing.T, proxyAddr, host string) *websocket.Conn {
+	cfg, err := websocket.NewConfig("ws://"+host+"/echo", "http://"+host+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := websocket.NewClient(cfg, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+// echoMessages WebSocket 回显服务，按消息原样返回
+func echoMessages(ws *websocket.Conn) {
+	var msg string
+	for websocket.Message.Receive(ws, &msg) == nil {
+		if websocket.Message.Send(ws, msg) != nil {
+			return
+		}
+	}
+}
+
+// TestWebsocketEcho 测试 WebSocket 升级后按原始数据双向转发，并统计流量
+func TestWebsocketEcho(t *testing.T) {
+	echo := httptest.NewServer(websocket.Handler(echoMessages))
+	defer echo.Close()
+	h := newTestHost(t, "ws-echo.nps.test", echo.Listener.Addr().String())
+	ws := dialWebsocket(t, startTestProxy(t), h.Host)
+	defer ws.Close()
+
+	for _, msg := range []string{"hello", "GET / HTTP/1.1\r\n\r\n", string(make([]byte, 64<<10))} {
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			t.Fatal(err)
+		}
+		var reply string
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := websocket.Message.Receive(ws, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != msg {
+			t.Fatalf("echo mismatch, sent %d bytes, received %d bytes", len(msg), len(reply))
+		}
+	}
+	h.Flow.RLock()
+	defer h.Flow.RUnlock()
+	if h.Flow.InletFlow < 64<<10 || h.Flow.ExportFlow < 64<<10 {
+		t.Fatalf("flow is not counted after upgrade, inlet %d export %d", h.Flow.InletFlow, h.Flow.ExportFlow)
+	}
+}
+
+// TestWebsocketIdleTimeout 测试升级后的连接空闲超时后被关闭
+func TestWebsocketIdleTimeout(t *testing.T) {
+	beego.AppConfig.Set("http_upgrade_idle_timeout", "1")
+	defer beego.AppConfig.Set("http_upgrade_idle_timeout", "")
+	echo := httptest.NewServer(websocket.Handler(echoMessages))
+	defer echo.Close()
+	h := newTestHost(t, "ws-idle.nps.test", echo.Listener.Addr().String())
+	ws := dialWebsocket(t, startTestProxy(t), h.Host)
+	defer ws.Close()
+
+	var reply string
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.Message.Receive(ws, &reply); err == nil {
+		t.Fatal("the idle connection is not closed")
+	} else if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Fatal("the idle connection is not closed before the deadline")
+	}
+}
+
+// proxyRequest 经代理以指定的 Host 发送请求，返回状态码、响应头与响应体
+func proxyRequest(t *testing.T, client *http.Client, proxyAddr, host, method, path string, header http.Header) (int, http.Header, string) {
+	req, err := http.NewRequest(method, "http://"+proxyAddr+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header, string(b)
+}
+
+// TestHttpCache 测试按 Cache-Control 缓存、Vary 变体、条件请求重新验证、不安全方法失效、转存磁盘与清除
+func TestHttpCache(t *testing.T) {
+	var backendHits, revalidations int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backendHits, 1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("fresh " + r.URL.RawQuery))
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&revalidations, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("etag body"))
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte("lang " + r.Header.Get("Accept-Language")))
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write([]byte("nostore"))
+		default:
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write(make([]byte, 64<<10))
+		}
+	}))
+	defer backend.Close()
+	httpCacheOnce.Do(func() {})
+	dir, err := ioutil.TempDir("", "nps-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	httpCache = newRespCache(0, 100<<10, 1<<20, dir, 1<<20)
+	defer func() { httpCache = nil }()
+
+	h := newTestHost(t, "cache.nps.test", backend.Listener.Addr().String())
+	h.Cache = true
+	addr := startTestProxy(t)
+	client := &http.Client{}
+	hits := func() int32 { return atomic.LoadInt32(&backendHits) }
+
+	// 新鲜的缓存直接应答，查询参数不同的请求分别缓存
+	for i := 0; i < 3; i++ {
+		if _, header, body := proxyRequest(t, client, addr, h.Host, "GET", "/fresh?a=1", nil); body != "fresh a=1" || (i > 0 && header.Get("Age") == "") {
+			t.Fatalf("unexpected cached response %q, age %q", body, header.Get("Age"))
+		}
+	}
+	if _, _, body := proxyRequest(t, client, addr, h.Host, "GET", "/fresh?a=2", nil); body != "fresh a=2" || hits() != 2 {
+		t.Fatalf("query string is not part of the cache key, body %q, backend hits %d", body, hits())
+	}
+	if status, _, body := proxyRequest(t, client, addr, h.Host, "HEAD", "/fresh?a=1", nil); status != http.StatusOK || body != "" || hits() != 2 {
+		t.Fatalf("head request is not served from cache, status %d, backend hits %d", status, hits())
+	}
+
+	// no-cache 的响应每次使用前以 ETag 向后端确认，访问者自身的条件请求由缓存返回 304
+	for i := 0; i < 3; i++ {
+		if _, _, body := proxyRequest(t, client, addr, h.Host, "GET", "/etag", nil); body != "etag body" {
+			t.Fatalf("unexpected revalidated response %q", body)
+		}
+	}
+	if atomic.LoadInt32(&revalidations) != 2 {
+		t.Fatalf("expect 2 revalidations, got %d", revalidations)
+	}
+	if status, _, _ := proxyRequest(t, client, addr, h.Host, "GET", "/etag", http.Header{"If-None-Match": {`"v1"`}}); status != http.StatusNotModified {
+		t.Fatalf("conditional request expects 304, got %d", status)
+	}
+
+	// Vary 列出的请求头不同的请求分别缓存
+	before := hits()
+	for _, lang := range []string{"en", "zh", "en", "zh"} {
+		if _, _, body := proxyRequest(t, client, addr, h.Host, "GET", "/vary", http.Header{"Accept-Language": {lang}}); body != "lang "+lang {
+			t.Fatalf("vary variant mismatch, want %s, got %q", lang, body)
+		}
+	}
+	if hits()-before != 2 {
+		t.Fatalf("expect 2 backend hits for 2 variants, got %d", hits()-before)
+	}
+
+	// no-store 的响应不缓存，不安全的方法使缓存失效
+	before = hits()
+	proxyRequest(t, client, addr, h.Host, "GET", "/nostore", nil)
+	proxyRequest(t, client, addr, h.Host, "GET", "/nostore", nil)
+	proxyRequest(t, client, addr, h.Host, "POST", "/fresh?a=1", nil)
+	proxyRequest(t, client, addr, h.Host, "GET", "/fresh?a=1", nil)
+	if hits()-before != 4 {
+		t.Fatalf("expect 4 backend hits, got %d", hits()-before)
+	}
+
+	// 超出内存限制的缓存转存到磁盘，仍可命中
+	for _, p := range []string{"/big1", "/big2", "/big3"} {
+		proxyRequest(t, client, addr, h.Host, "GET", p, nil)
+	}
+	before = hits()
+	if _, _, body := proxyRequest(t, client, addr, h.Host, "GET", "/big1", nil); len(body) != 64<<10 || hits() != before {
+		t.Fatalf("spilled response is not served from disk, size %d", len(body))
+	}
+	stats, ok := HttpCacheStats(h.Id)
+	if !ok || stats.DiskBytes == 0 || stats.MemBytes > 100<<10 || stats.Hits == 0 || stats.Revalidated != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// 按路径清除缓存
+	if n := PurgeHttpCache(h.Id, "/big"); n != 3 {
+		t.Fatalf("expect 3 purged entries, got %d", n)
+	}
+	proxyRequest(t, client, addr, h.Host, "GET", "/big1", nil)
+	if hits() != before+1 {
+		t.Fatal("purged response is still served from cache")
+	}
+
+	// http 与 https 的请求分别缓存
+	h.CertContent, h.KeyContent = testCertPem(t, h.Host)
+	before = hits()
+	resp, err := tlsClient(startTestHttps(t), h.Host, false).Get("https://" + h.Host + "/fresh?a=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if hits() != before+1 {
+		t.Fatal("the https request is served from the cache of the http request")
+	}
+
+	// 删除域名解析时清除缓存与命中统计
+	DelHttpCacheHost(h.Id)
+	httpCache.Lock()
+	_, ok = httpCache.stats[h.Id]
+	httpCache.Unlock()
+	if stats, _ := HttpCacheStats(h.Id); ok || stats.Entries != 0 {
+		t.Fatalf("the cache of the deleted host is left, stats %+v", stats)
+	}
+}
+
+// TestHttpCompress 测试按 Accept-Encoding 协商压缩、类型与大小过滤以及按压缩后的字节数统计流量
+func TestHttpCompress(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"name":"nps","value":12345},`), 1000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(body)
+		case "/encoded":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(body)
+		default:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(body)
+		}
+	}))
+	defer backend.Close()
+
+	h := newTestHost(t, "compress.nps.test", backend.Listener.Addr().String())
+	h.HttpCompress = true
+	addr := startTestProxy(t)
+	// 关闭客户端的自动解压，以便检查原始响应
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for _, c := range []struct {
+		accept, encoding string
+	}{
+		{"gzip, deflate, br", "br"},
+		{"gzip", "gzip"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"identity", ""},
+	} {
+		_, header, got := proxyRequest(t, client, addr, h.Host, "GET", "/json", http.Header{"Accept-Encoding": {c.accept}})
+		if header.Get("Content-Encoding") != c.encoding {
+			t.Fatalf("accept %q expects encoding %q, got %q", c.accept, c.encoding, header.Get("Content-Encoding"))
+		}
+		var plain []byte
+		var err error
+		switch c.encoding {
+		case "br":
+			plain, err = ioutil.ReadAll(brotli.NewReader(bytes.NewReader([]byte(got))))
+		case "gzip":
+			var zr *gzip.Reader
+			if zr, err = gzip.NewReader(bytes.NewReader([]byte(got))); err == nil {
+				plain, err = ioutil.ReadAll(zr)
+			}
+		default:
+			plain = []byte(got)
+		}
+		if err != nil || !bytes.Equal(plain, body) {
+			t.Fatalf("encoding %q decodes to %d bytes, err %v", c.encoding, len(plain), err)
+		}
+		if c.encoding != "" && (header.Get("Vary") != "Accept-Encoding" || header.Get("ETag") != `W/"v1"`) {
+			t.Fatalf("unexpected compressed headers %v", header)
+		}
+	}
+
+	// 过小、类型不在列表中或已经压缩的响应原样转发
+	for _, p := range []string{"/small", "/image", "/encoded"} {
+		_, header, got := proxyRequest(t, client, addr, h.Host, "GET", p, http.Header{"Accept-Encoding": {"br"}})
+		if enc := header.Get("Content-Encoding"); (p == "/encoded") != (enc == "gzip") || enc == "br" || (p != "/small" && len(got) != len(body)) {
+			t.Fatalf("%s should not be compressed, encoding %q, size %d", p, enc, len(got))
+		}
+	}
+
+	// 流量按发往访问者的压缩后字节数统计，响应写完后才计入，稍作等待
+	exportFlow := func() int64 {
+		h.Flow.RLock()
+		defer h.Flow.RUnlock()
+		return h.Flow.ExportFlow
+	}
+	time.Sleep(50 * time.Millisecond)
+	before := exportFlow()
+	proxyRequest(t, client, addr, h.Host, "GET", "/json", http.Header{"Accept-Encoding": {"gzip"}})
+	time.Sleep(50 * time.Millisecond)
+	if out := exportFlow() - before; out == 0 || out >= int64(len(body)) {
+		t.Fatalf("export flow %d should count compressed bytes of a %d bytes body", out, len(body))
+	}
+}
+
+// TestHostRules 测试按顺序匹配的规则：重写路径、重定向、固定应答与指定目标，同一访问者连接上切换目标
+func TestHostRules(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.RequestURI()))
+		}))
+	}
+	a, b := newBackend("a"), newBackend("b")
+	defer a.Close()
+	defer b.Close()
+	addrB := b.Listener.Addr().String()
+
+	h := newTestHost(t, "rules.nps.test", a.Listener.Addr().String()+"\n"+addrB)
+	h.Rules = "# 注释\n" +
+		"path=^/old/(.*) redirect=301:https://new.nps.test/$1\n" +
+		"path=^/api/(.*) method=GET header=X-Env:^dev$ rewrite=/v2/$1?from=api target=" + addrB + "\n" +
+		"path=^/beta/ cookie=beta:^1$ target=" + addrB + "\n" +
+		"query=ping respond=200:pong with spaces\n"
+	addr := startTestProxy(t)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	for _, c := range []struct {
+		path   string
+		header http.Header
+		status int
+		body   string
+	}{
+		{"/?ping", nil, http.StatusOK, "pong with spaces"},
+		{"/api/users?x=1", http.Header{"X-Env": {"dev"}}, http.StatusOK, "b /v2/users?from=api"},
+		{"/beta/index", http.Header{"Cookie": {"beta=1"}}, http.StatusOK, "b /beta/index"},
+		{"/api/users", http.Header{"X-Env": {"dev"}}, http.StatusOK, "b /v2/users?from=api"},
+		{"/old/a/b", nil, http.StatusMovedPermanently, ""},
+		{"/?ping=1", nil, http.StatusOK, "pong with spaces"},
+	} {
+		status, header, body := proxyRequest(t, client, addr, h.Host, "GET", c.path, c.header)
+		if status != c.status || body != c.body {
+			t.Fatalf("%s expects %d %q, got %d %q", c.path, c.status, c.body, status, body)
+		}
+		if status == http.StatusMovedPermanently && header.Get("Location") != "https://new.nps.test/a/b" {
+			t.Fatalf("unexpected redirect location %q", header.Get("Location"))
+		}
+	}
+
+	// 条件不满足时按负载均衡转发，路径不变
+	for i := 0; i < 2; i++ {
+		if _, _, body := proxyRequest(t, client, addr, h.Host, "GET", "/api/users", nil); body != "a /api/users" && body != "b /api/users" {
+			t.Fatalf("unmatched request is rewritten, got %q", body)
+		}
+	}
+
+	// 修改规则后替换已解析的规则，删除域名解析时清除
+	h.Rules = "query=ping respond=200:changed"
+	if _, _, body := proxyRequest(t, client, addr, h.Host, "GET", "/?ping", nil); body != "changed" {
+		t.Fatalf("changed rules are not applied, got %q", body)
+	}
+	DelHttpCacheHost(h.Id)
+	if _, ok := compiledRules.m.Load(h.Id); ok {
+		t.Fatal("rules of the deleted host are kept")
+	}
+
+	// 规则语法错误
+	for _, s := range []string{"path=^/a", "path=( target=x", "redirect=200:/x", "target=y respond=200:x", "foo=bar rewrite=/x",
+		"redirect=300:/x", "redirect=304:/x", "redirect=305:/x", "redirect=306:/x", "redirect=3010:/x", "respond=20:x", "respond=12:30", "respond=99999999999999999999:x"} {
+		if CheckHostRules(s) == nil {
+			t.Fatalf("rule %q should be invalid", s)
+		}
+	}
+	for _, s := range []string{"redirect=/x", "redirect=308:/x", "respond=pong", "respond=200:12:30", "respond=404:"} {
+		if err := CheckHostRules(s); err != nil {
+			t.Fatalf("rule %q should be valid, %v", s, err)
+		}
+	}
+}
+
+// TestResponseHeader 测试响应头的设置、添加、删除与预设，以及 CORS 预检请求的应答
+func TestResponseHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Add", "backend")
+		w.Write([]byte(r.Method))
+	}))
+	defer backend.Close()
+
+	h := newTestHost(t, "header.nps.test", backend.Listener.Addr().String())
+	h.RespHeaderChange = "@hsts\n@csp\n@xfo DENY\n@cors https://a.nps.test, https://b.nps.test\n+X-Add: nps\n-Server\nX-Custom: a:b"
+	addr := startTestProxy(t)
+	client := &http.Client{}
+
+	_, header, _ := proxyRequest(t, client, addr, h.Host, "GET", "/", http.Header{"Origin": {"https://b.nps.test"}})
+	for name, want := range map[string]string{
+		"Content-Security-Policy":          "default-src 'self'",
+		"X-Frame-Options":                  "DENY",
+		"Access-Control-Allow-Origin":      "https://b.nps.test",
+		"Access-Control-Allow-Credentials": "true",
+		"Vary":                             "Origin",
+		"X-Custom":                         "a:b",
+		"Server":                           "",
+		"Strict-Transport-Security":        "",
+	} {
+		if header.Get(name) != want {
+			t.Fatalf("header %s expects %q, got %q", name, want, header.Get(name))
+		}
+	}
+	if v := header["X-Add"]; len(v) != 2 || v[0] != "backend" || v[1] != "nps" {
+		t.Fatalf("unexpected added header %v", v)
+	}
+
+	// 允许来源的预检请求由 nps 直接应答，其他来源转发到后端且不带 CORS 响应头
+	preflight := http.Header{"Access-Control-Request-Method": {"PUT"}, "Access-Control-Request-Headers": {"X-Token"}}
+	preflight.Set("Origin", "https://a.nps.test")
+	status, header, body := proxyRequest(t, client, addr, h.Host, "OPTIONS", "/", preflight)
+	if status != http.StatusNoContent || body != "" || header.Get("Access-Control-Allow-Origin") != "https://a.nps.test" || header.Get("Access-Control-Allow-Headers") != "X-Token" {
+		t.Fatalf("unexpected preflight response %d %q %v", status, body, header)
+	}
+	preflight.Set("Origin", "https://evil.nps.test")
+	if status, header, body = proxyRequest(t, client, addr, h.Host, "OPTIONS", "/", preflight); body != "OPTIONS" || header.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("preflight from a disallowed origin expects the backend response, got %d %q %v", status, body, header)
+	}
+
+	if CheckResponseHeader("@unknown") == nil || CheckResponseHeader("no colon") == nil {
+		t.Fatal("invalid response header rules are accepted")
+	}
+}
+
+// TestErrorPages 测试各类错误页面的状态码、域名解析自己的模板与请求 id
+func TestErrorPages(t *testing.T) {
+	// 接受连接后不应答直接关闭，模拟内网目标拒绝连接
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	h := newTestHost(t, "error.nps.test", l.Addr().String())
+	h.ErrorPage = `{{.Kind}} {{.Status}} {{.RequestId}} {{.Host}}`
+	addr := startTestProxy(t)
+	client := &http.Client{}
+	check := func(host string, header http.Header, status int, body string) http.Header {
+		t.Helper()
+		got, respHeader, b := proxyRequest(t, client, addr, host, "GET", "/", header)
+		if got != status || b != body {
+			t.Fatalf("host %s expects %d %q, got %d %q", host, status, body, got, b)
+		}
+		return respHeader
+	}
+
+	check(h.Host, http.Header{"X-Request-Id": {"r1"}}, http.StatusBadGateway, "unreachable 502 r1 error.nps.test")
+	h.Target = &file.Target{TargetStr: closed.Addr().String()}
+	check(h.Host, http.Header{"X-Request-Id": {"r2"}}, http.StatusBadGateway, "offline 502 r2 error.nps.test")
+	h.Maintenance = true
+	if header := check(h.Host, http.Header{"X-Request-Id": {"r3"}}, http.StatusServiceUnavailable, "maintenance 503 r3 error.nps.test"); header.Get("Retry-After") == "" {
+		t.Fatal("maintenance page expects a Retry-After header")
+	}
+	h.Maintenance = false
+	h.Client.Cnf = &file.Config{U: "u", P: "p"}
+	if header := check(h.Host, http.Header{"X-Request-Id": {"r4"}}, http.StatusUnauthorized, "unauthorized 401 r4 error.nps.test"); header.Get("WWW-Authenticate") == "" {
+		t.Fatal("unauthorized page expects a WWW-Authenticate header")
+	}
+	h.Client.Flow = &file.Flow{FlowLimit: 1, ExportFlow: 2 << 20}
+	check(h.Host, http.Header{"X-Request-Id": {"r5"}}, http.StatusServiceUnavailable, "quota 503 r5 error.nps.test")
+	h.Client.Flow = new(file.Flow)
+	if h.RateLimit, err = file.NewRateLimit(1, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	proxyRequest(t, client, addr, h.Host, "GET", "/", nil)
+	if header := check(h.Host, http.Header{"X-Request-Id": {"r6"}}, http.StatusTooManyRequests, "ratelimit 429 r6 error.nps.test"); header.Get("Retry-After") == "" {
+		t.Fatal("rate limit page expects a Retry-After header")
+	}
+	h.RateLimit = nil
+
+	// 没有对应的域名解析时使用全局页面，生成请求 id
+	status, header, _ := proxyRequest(t, client, addr, "none.nps.test", "GET", "/", nil)
+	if status != http.StatusNotFound || len(header.Get("X-Request-Id")) != 16 {
+		t.Fatalf("unknown host expects 404 with a request id, got %d %v", status, header)
+	}
+}
+
+// TestLoadBalance 测试加权轮询、按来源 IP 哈希、Cookie 会话保持与目标的活动连接数
+func TestLoadBalance(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	a, b := newBackend("a"), newBackend("b")
+	addrA, addrB := a.Listener.Addr().String(), b.Listener.Addr().String()
+	h := newTestHost(t, "lb.nps.test", addrA+" weight=3\n"+addrB)
+	addr := startTestProxy(t)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	count := func(n int, header http.Header) map[string]int {
+		t.Helper()
+		got := map[string]int{}
+		for i := 0; i < n; i++ {
+			_, _, body := proxyRequest(t, client, addr, h.Host, "GET", "/", header)
+			got[body]++
+		}
+		return got
+	}
+
+	if got := count(8, nil); got["a"] != 6 || got["b"] != 2 {
+		t.Fatalf("weighted round robin expects a:6 b:2, got %v", got)
+	}
+	h.Target.LbStrategy = file.LbIpHash
+	if got := count(4, nil); len(got) != 1 {
+		t.Fatalf("ip_hash expects one target for one visitor, got %v", got)
+	}
+
+	// cookie：首次访问设置会话保持 Cookie，之后的请求固定到同一目标且不再设置
+	h.Target.LbStrategy = file.LbCookie
+	_, header, first := proxyRequest(t, client, addr, h.Host, "GET", "/", nil)
+	cookie := header.Get("Set-Cookie")
+	if !strings.HasPrefix(cookie, stickyCookieName(h)+"=") {
+		t.Fatalf("cookie strategy expects a sticky cookie, got %q", cookie)
+	}
+	sticky := http.Header{"Cookie": {strings.Split(cookie, ";")[0]}}
+	for i := 0; i < 4; i++ {
+		if _, header, body := proxyRequest(t, client, addr, h.Host, "GET", "/", sticky); body != first || header.Get("Set-Cookie") != "" {
+			t.Fatalf("sticky request expects %s without a new cookie, got %s %q", first, body, header.Get("Set-Cookie"))
+		}
+	}
+	// Cookie 指向的目标不可用时重新选择并更新 Cookie
+	h.Target.TargetArr = []string{addrB}
+	if _, header, body := proxyRequest(t, client, addr, h.Host, "GET", "/", http.Header{"Cookie": {stickyCookieName(h) + "=" + file.StickyId(addrA)}}); body != "b" || header.Get("Set-Cookie") == "" {
+		t.Fatalf("offline sticky target expects b with a new cookie, got %s %q", body, header.Get("Set-Cookie"))
+	}
+	h.Target.TargetArr = nil
+
+	// 与后端保持连接期间计入目标的活动连接数，连接关闭后减去
+	conns := func() int64 {
+		var n int64
+		for _, v := range h.Target.Stats() {
+			n += v.Conn
+		}
+		return n
+	}
+	keepAlive := &http.Transport{}
+	proxyRequest(t, &http.Client{Transport: keepAlive}, addr, h.Host, "GET", "/", nil)
+	if n := conns(); n != 1 {
+		t.Fatalf("keep-alive connection expects 1 active connection, got %d", n)
+	}
+	// 后端连接在访问者与后端都关闭后结束
+	keepAlive.CloseIdleConnections()
+	a.CloseClientConnections()
+	b.CloseClientConnections()
+	for i := 0; i < 50 && conns() != 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := conns(); n != 0 {
+		t.Fatalf("closed connection expects 0 active connections, got %d", n)
+	}
+}
+
+// TestHostAuth 测试域名解析的 Basic 与 Bearer 认证、登录 Cookie、免认证 IP 以及同一连接上的每个请求都要认证
+func TestHostAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("auth:" + r.Header.Get("Authorization")))
+	}))
+	defer backend.Close()
+	h := newTestHost(t, "auth.nps.test", backend.Listener.Addr().String())
+	if err := h.SetAuth("admin:secret\ndev:654321", "tok1", "", 1); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(strings.Split(h.AuthUsers, "\n")[0], "admin:$2") {
+		t.Fatalf("auth users expect bcrypt hashes, got %q", h.AuthUsers)
+	}
+	addr := startTestProxy(t)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	basic := func(user, pass string) http.Header {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(user, pass)
+		return req.Header
+	}
+	check := func(header http.Header, status int) http.Header {
+		t.Helper()
+		got, respHeader, body := proxyRequest(t, client, addr, h.Host, "GET", "/", header)
+		if got != status {
+			t.Fatalf("expects %d, got %d %q", status, got, body)
+		}
+		if status == http.StatusOK && body != "auth:" {
+			t.Fatalf("the authorization header should not be forwarded, got %q", body)
+		}
+		return respHeader
+	}
+
+	if header := check(nil, http.StatusUnauthorized); !strings.HasPrefix(header.Get("WWW-Authenticate"), "Basic") {
+		t.Fatalf("expects a Basic challenge, got %q", header.Get("WWW-Authenticate"))
+	}
+	check(basic("admin", "wrong"), http.StatusUnauthorized)
+	check(http.Header{"Authorization": {"Bearer tok2"}}, http.StatusUnauthorized)
+	check(http.Header{"Authorization": {"Bearer tok1"}}, http.StatusOK)
+
+	// 认证通过后下发登录 Cookie，带有 Cookie 的请求不再要求认证，篡改的 Cookie 无效
+	cookie := check(basic("dev", "654321"), http.StatusOK).Get("Set-Cookie")
+	if !strings.HasPrefix(cookie, authCookieName(h)+"=") || !strings.Contains(cookie, "HttpOnly") {
+		t.Fatalf("expects a login cookie, got %q", cookie)
+	}
+	value := strings.Split(cookie, ";")[0]
+	if header := check(http.Header{"Cookie": {value}}, http.StatusOK); header.Get("Set-Cookie") != "" {
+		t.Fatalf("cookie request expects no new cookie, got %q", header.Get("Set-Cookie"))
+	}
+	tampered := value[:len(value)-1] + "0"
+	if tampered == value {
+		tampered = value[:len(value)-1] + "1"
+	}
+	check(http.Header{"Cookie": {tampered}}, http.StatusUnauthorized)
+
+	// 同一连接上后续未认证的请求返回认证失败
+	keepAlive := &http.Client{}
+	if status, _, _ := proxyRequest(t, keepAlive, addr, h.Host, "GET", "/", basic("admin", "secret")); status != http.StatusOK {
+		t.Fatalf("keep-alive request expects 200, got %d", status)
+	}
+	if status, _, _ := proxyRequest(t, keepAlive, addr, h.Host, "GET", "/", nil); status != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated request on the same connection expects 401, got %d", status)
+	}
+
+	// 只设置了令牌时要求 Bearer 认证，免认证 IP 直接通过
+	if err := h.SetAuth("", "tok1", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if header := check(nil, http.StatusUnauthorized); !strings.HasPrefix(header.Get("WWW-Authenticate"), "Bearer") {
+		t.Fatalf("expects a Bearer challenge, got %q", header.Get("WWW-Authenticate"))
+	}
+	if err := h.SetAuth("", "tok1", "127.0.0.0/8", 0); err != nil {
+		t.Fatal(err)
+	}
+	check(nil, http.StatusOK)
+}
+
+// TestForwardAuth 测试外部认证：放行时复制认证服务的响应头，未放行时返回认证服务的应答，认证服务无法访问时返回错误页面
+func TestForwardAuth(t *testing.T) {
+	var lastMethod, lastUri atomic.Value
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastMethod.Store(r.Method)
+		lastUri.Store(r.Header.Get("X-Forwarded-Uri"))
+		switch {
+		case strings.HasPrefix(r.Header.Get("X-Forwarded-Uri"), "/public"):
+			w.WriteHeader(http.StatusNoContent)
+		case strings.Contains(r.Header.Get("Cookie"), "sso=ok"):
+			w.Header().Set("X-User", "alice")
+			w.Write([]byte("ok"))
+		default:
+			http.Redirect(w, r, "https://sso.nps.test/login", http.StatusFound)
+		}
+	}))
+	defer auth.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " user:" + r.Header.Get("X-User")))
+	}))
+	defer backend.Close()
+	h := newTestHost(t, "fauth.nps.test", backend.Listener.Addr().String())
+	h.ForwardAuth = auth.URL + "/verify"
+	h.AuthRespHeaders = "x-user"
+	addr := startTestProxy(t)
+	client := &http.Client{
+		Transport:     &http.Transport{DisableKeepAlives: true},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	check := func(client *http.Client, method, path string, header http.Header, status int, body string) http.Header {
+		t.Helper()
+		got, respHeader, b := proxyRequest(t, client, addr, h.Host, method, path, header)
+		if got != status || (body != "" && b != body) {
+			t.Fatalf("%s %s expects %d %q, got %d %q", method, path, status, body, got, b)
+		}
+		return respHeader
+	}
+
+	if header := check(client, "GET", "/", nil, http.StatusFound, ""); header.Get("Location") != "https://sso.nps.test/login" {
+		t.Fatalf("expects the redirect to the login page, got %v", header)
+	}
+	// 放行时认证服务的响应头替换访问者伪造的同名请求头
+	check(client, "POST", "/a?b=1", http.Header{"Cookie": {"sso=ok"}, "X-User": {"mallory"}}, http.StatusOK, "POST user:alice")
+	if lastMethod.Load() != "POST" || lastUri.Load() != "/a?b=1" {
+		t.Fatalf("subrequest expects the original method and uri, got %v %v", lastMethod.Load(), lastUri.Load())
+	}
+	check(client, "GET", "/public/x", http.Header{"X-User": {"mallory"}}, http.StatusOK, "GET user:")
+
+	// 同一连接上后续未通过的请求返回认证服务的应答
+	keepAlive := &http.Client{CheckRedirect: client.CheckRedirect}
+	check(keepAlive, "GET", "/", http.Header{"Cookie": {"sso=ok"}}, http.StatusOK, "GET user:alice")
+	check(keepAlive, "GET", "/", nil, http.StatusFound, "")
+
+	auth.Close()
+	check(client, "GET", "/", http.Header{"Cookie": {"sso=ok"}}, http.StatusBadGateway, "")
+}
@@ -0,0 +1,787 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// HTTP 响应缓存：开启 http_cache 后，域名解析开启了缓存时按共享缓存的规则（RFC 9111）缓存后端响应。
+// 缓存键为域名与完整的请求 URI（含查询参数），同一 URI 按响应 Vary 列出的请求头区分变体；
+// 新鲜期依次取 s-maxage、max-age、Expires，均未设置时按 Last-Modified 估算（距今时长的 1/10，最长一天）；
+// 过期的缓存带有 ETag 或 Last-Modified 时向后端发起条件请求，后端返回 304 后更新新鲜期并继续使用。
+// 内存中的缓存按总字节数淘汰，配置了 http_cache_disk_dir 时先转存到磁盘，磁盘也超出限制后删除。
+
+// cacheHeuristicMax 按 Last-Modified 估算的新鲜期上限
+const cacheHeuristicMax = 24 * time.Hour
+
+// cacheFileExt 转存到磁盘的缓存文件扩展名，启动时清理该目录中遗留的缓存文件
+const cacheFileExt = ".cache"
+
+var (
+	httpCacheOnce sync.Once
+	httpCache     *respCache
+)
+
+// getHttpCache 返回全局的响应缓存，未开启 http_cache 时返回 nil
+func getHttpCache() *respCache {
+	httpCacheOnce.Do(func() {
+		if b, err := beego.AppConfig.Bool("http_cache"); err != nil || !b {
+			return
+		}
+		dir := beego.AppConfig.String("http_cache_disk_dir")
+		if dir != "" && !filepath.IsAbs(dir) {
+			dir = filepath.Join(common.GetRunPath(), dir)
+		}
+		httpCache = newRespCache(
+			beego.AppConfig.DefaultInt("http_cache_length", 0),
+			int64(beego.AppConfig.DefaultInt("http_cache_mem_size", 64))<<20,
+			int64(beego.AppConfig.DefaultInt("http_cache_object_size", 8))<<20,
+			dir,
+			int64(beego.AppConfig.DefaultInt("http_cache_disk_size", 1024))<<20,
+		)
+	})
+	return httpCache
+}
+
+// respCache 响应缓存
+type respCache struct {
+	maxEntries int                   // 缓存条数上限，0 为不限制
+	maxMem     int64                 // 内存中缓存的字节数上限
+	maxObject  int64                 // 单个响应体的字节数上限，超出的响应不缓存
+	diskDir    string                // 转存目录，为空时不转存
+	maxDisk    int64                 // 磁盘上缓存的字节数上限
+	items      map[string]*cacheItem // key 为缓存键
+	mem        *list.List            // 内存中的缓存，表头为最近使用
+	disk       *list.List            // 转存到磁盘的缓存，表头为最近使用
+	memBytes   int64                 // 内存中缓存的字节数
+	diskBytes  int64                 // 磁盘上缓存的字节数
+	stats      map[int]*CacheStats   // 各域名解析的命中统计，key 为域名解析ID
+	sync.Mutex
+}
+
+// cacheItem 同一缓存键下的所有变体
+type cacheItem struct {
+	vary     []string               // 响应 Vary 列出的请求头，已规范化并排序
+	variants map[string]*cacheEntry // key 为这些请求头的取值
+}
+
+// cacheEntry 一个缓存的响应
+type cacheEntry struct {
+	item     *cacheItem
+	key      string        // 缓存键
+	variant  string        // 变体键
+	hostId   int           // 域名解析ID
+	path     string        // 请求路径，用于按路径清除
+	status   int           // 状态码
+	header   http.Header   // 响应头，更新时整体替换，不原地修改
+	body     []byte        // 响应体，转存到磁盘后为 nil
+	file     string        // 转存到磁盘的文件
+	size     int64         // 占用的字节数
+	received time.Time     // 收到响应的时间
+	age      time.Duration // 收到响应时已有的年龄
+	lifetime time.Duration // 新鲜期
+	shared   bool          // 携带 Authorization 的请求能否使用
+	elem     *list.Element
+}
+
+// CacheStats 缓存统计
+type CacheStats struct {
+	HostId      int   // 域名解析ID，汇总时为 0
+	Hits        int64 // 直接以缓存应答的请求数
+	Revalidated int64 // 后端返回 304 后以缓存应答的请求数
+	Misses      int64 // 转发到后端的请求数
+	Entries     int   // 缓存条数
+	MemBytes    int64 // 内存中缓存的字节数
+	DiskBytes   int64 // 磁盘上缓存的字节数
+}
+
+// newRespCache 创建响应缓存，清理转存目录中遗留的缓存文件
+func newRespCache(maxEntries int, maxMem, maxObject int64, diskDir string, maxDisk int64) *respCache {
+	c := &respCache{
+		maxEntries: maxEntries,
+		maxMem:     maxMem,
+		maxObject:  maxObject,
+		diskDir:    diskDir,
+		maxDisk:    maxDisk,
+		items:      make(map[string]*cacheItem),
+		mem:        list.New(),
+		disk:       list.New(),
+		stats:      make(map[int]*CacheStats),
+	}
+	if diskDir != "" {
+		if err := os.MkdirAll(diskDir, 0700); err != nil {
+			logs.Error("http cache disk dir %s error %s, disk spill is disabled", diskDir, err.Error())
+			c.diskDir = ""
+		} else if names, err := filepath.Glob(filepath.Join(diskDir, "*"+cacheFileExt)); err == nil {
+			for _, name := range names {
+				os.Remove(name)
+			}
+		}
+	}
+	return c
+}
+
+// cacheReq 一个已转发到后端的请求的缓存状态，收到响应后交给 finish 处理
+type cacheReq struct {
+	cache   *respCache
+	host    *file.Host
+	key     string
+	method  string
+	header  http.Header // 访问者的原始请求头
+	path    string
+	sent    time.Time   // 转发请求的时间
+	stale   *cacheEntry // 正在重新验证的过期缓存
+	noStore bool        // 访问者要求不缓存
+}
+
+// cacheKey 返回请求的缓存键
+// 包含协议，避免 http 与 https 共用缓存（如 http 跳转 https 的 301 被 https 访问者命中后循环跳转）
+func cacheKey(r *http.Request) string {
+	return r.URL.Scheme + "://" + strings.ToLower(r.Host) + r.URL.RequestURI()
+}
+
+// beginCache 在转发请求前查找缓存
+// 命中新鲜的缓存时返回可直接应答的响应；缓存过期且可以重新验证时为请求加上条件头。
+// 返回的 cacheReq 在收到后端响应后交给 finish，域名解析未开启缓存时为 nil
+func beginCache(host *file.Host, r *http.Request) (*http.Response, *cacheReq) {
+	c := getHttpCache()
+	if c == nil || !host.Cache {
+		return nil, nil
+	}
+	cr := &cacheReq{cache: c, host: host, key: cacheKey(r), method: r.Method, path: r.URL.Path, sent: time.Now()}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return nil, cr
+	}
+	cr.header = r.Header.Clone()
+	reqCc := parseCacheControl(r.Header)
+	if _, ok := reqCc["no-store"]; ok || r.Header.Get("Range") != "" {
+		cr.noStore = true
+		c.count(host.Id, func(s *CacheStats) { s.Misses++ })
+		return nil, cr
+	}
+	e := c.get(cr.key, r.Header, authByClient(host, r.Header))
+	if e == nil {
+		c.count(host.Id, func(s *CacheStats) { s.Misses++ })
+		return nil, cr
+	}
+	_, noCache := reqCc["no-cache"]
+	maxAge, limited := ccSeconds(reqCc, "max-age")
+	noCache = noCache || strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache")
+	now := time.Now()
+	if !noCache && e.fresh(now) && (!limited || e.currentAge(now) <= maxAge) {
+		c.count(host.Id, func(s *CacheStats) { s.Hits++ })
+		return e.response(r, now), nil
+	}
+	etag, lastModified := e.header.Get("ETag"), e.header.Get("Last-Modified")
+	if (etag == "" && lastModified == "") || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		c.count(host.Id, func(s *CacheStats) { s.Misses++ })
+		return nil, cr
+	}
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		r.Header.Set("If-Modified-Since", lastModified)
+	}
+	cr.stale = e
+	return nil, cr
+}
+
+// finish 处理后端响应：重新验证返回 304 时以缓存应答，可缓存的响应在响应体读完后存入缓存
+func (cr *cacheReq) finish(resp *http.Response) {
+	if cr == nil {
+		return
+	}
+	c := cr.cache
+	if cr.method != "GET" && cr.method != "HEAD" {
+		// 不安全的方法可能修改了资源，后端处理成功后使缓存失效
+		if resp.StatusCode < 400 {
+			c.purgeKey(cr.key)
+		}
+		return
+	}
+	now := time.Now()
+	if cr.stale != nil {
+		if resp.StatusCode == http.StatusNotModified {
+			c.count(cr.host.Id, func(s *CacheStats) { s.Revalidated++ })
+			e := c.refresh(cr, resp.Header, now)
+			// 以访问者的原始请求头判断条件请求，转发的请求中已加入了缓存的条件头
+			cached := e.response(&http.Request{Method: cr.method, Header: cr.header, Close: resp.Request != nil && resp.Request.Close}, now)
+			resp.Status, resp.StatusCode, resp.Header = cached.Status, cached.StatusCode, cached.Header
+			resp.Body, resp.ContentLength, resp.TransferEncoding = cached.Body, cached.ContentLength, nil
+			return
+		}
+		c.count(cr.host.Id, func(s *CacheStats) { s.Misses++ })
+	}
+	e := cr.storable(resp, now)
+	if e == nil || (resp.ContentLength > c.maxObject) {
+		return
+	}
+	resp.Body = &cacheBody{ReadCloser: resp.Body, cr: cr, entry: e}
+}
+
+// storable 判断响应能否缓存，可以时返回尚未填入响应体的缓存
+func (cr *cacheReq) storable(resp *http.Response, now time.Time) *cacheEntry {
+	if cr.noStore || cr.method != "GET" || resp.Body == nil {
+		return nil
+	}
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return nil
+	}
+	if _, ok := cc["private"]; ok {
+		return nil
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	vary := varyHeaders(resp.Header)
+	if len(vary) == 1 && vary[0] == "*" {
+		return nil
+	}
+	_, public := cc["public"]
+	_, mustRevalidate := cc["must-revalidate"]
+	_, sMaxAge := cc["s-maxage"]
+	shared := public || mustRevalidate || sMaxAge
+	if authByClient(cr.host, cr.header) && !shared {
+		return nil
+	}
+	date := now
+	if t, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		date = t
+	}
+	lifetime, explicit := freshnessLifetime(resp.StatusCode, resp.Header, cc, date)
+	switch resp.StatusCode {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+	case 302, 307:
+		if !explicit {
+			return nil
+		}
+	default:
+		return nil
+	}
+	if _, ok := cc["no-cache"]; ok {
+		lifetime = 0
+	}
+	if lifetime <= 0 {
+		if resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "" {
+			return nil
+		}
+		lifetime = 0
+	}
+	return &cacheEntry{
+		key:      cr.key,
+		variant:  variantKey(vary, cr.header),
+		hostId:   cr.host.Id,
+		path:     cr.path,
+		status:   resp.StatusCode,
+		header:   cacheHeader(resp.Header),
+		received: now,
+		age:      initialAge(resp.Header, date, cr.sent, now),
+		lifetime: lifetime,
+		shared:   shared,
+		item:     &cacheItem{vary: vary},
+	}
+}
+
+// cacheBody 转发响应体的同时收集内容，完整读完后存入缓存
+type cacheBody struct {
+	io.ReadCloser
+	cr     *cacheReq
+	entry  *cacheEntry
+	buf    bytes.Buffer
+	failed bool // 响应体超出大小限制
+	done   bool
+}
+
+// Read 读取响应体，读到结尾时存入缓存
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.failed {
+		if int64(b.buf.Len()+n) > b.cr.cache.maxObject {
+			b.failed = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.failed && !b.done {
+		b.done = true
+		b.entry.body = b.buf.Bytes()
+		b.cr.cache.store(b.entry)
+	}
+	return n, err
+}
+
+// get 查找与请求头匹配的缓存，返回的缓存已载入响应体，只读使用
+func (c *respCache) get(key string, h http.Header, auth bool) *cacheEntry {
+	c.Lock()
+	defer c.Unlock()
+	item, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	e, ok := item.variants[variantKey(item.vary, h)]
+	if !ok || (auth && !e.shared) {
+		return nil
+	}
+	cp := *e
+	if e.file != "" {
+		b, err := ioutil.ReadFile(e.file)
+		if err != nil {
+			logs.Warn("read http cache file %s error %s", e.file, err.Error())
+			c.remove(e)
+			return nil
+		}
+		cp.body = b
+		c.disk.MoveToFront(e.elem)
+	} else {
+		c.mem.MoveToFront(e.elem)
+	}
+	return &cp
+}
+
+// store 存入缓存，替换同一变体的旧缓存，Vary 改变时清除该缓存键的所有变体
+func (c *respCache) store(e *cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+	vary := e.item.vary
+	if item, ok := c.items[e.key]; ok {
+		if !equalStrings(item.vary, vary) {
+			for _, v := range item.variants {
+				c.remove(v)
+			}
+		} else if old, ok := item.variants[e.variant]; ok {
+			c.remove(old)
+		}
+	}
+	item, ok := c.items[e.key]
+	if !ok {
+		item = &cacheItem{vary: vary, variants: make(map[string]*cacheEntry)}
+		c.items[e.key] = item
+	}
+	e.item = item
+	e.size = int64(len(e.body)) + headerSize(e.header)
+	item.variants[e.variant] = e
+	e.elem = c.mem.PushFront(e)
+	c.memBytes += e.size
+	c.evict()
+}
+
+// refresh 后端返回 304 后以其响应头更新缓存的响应头与新鲜期，返回更新后的缓存
+func (c *respCache) refresh(cr *cacheReq, h http.Header, now time.Time) *cacheEntry {
+	c.Lock()
+	defer c.Unlock()
+	stale := cr.stale
+	header := stale.header.Clone()
+	for k, v := range cacheHeader(h) {
+		if k != "Content-Length" && k != "Content-Type" {
+			header[k] = v
+		}
+	}
+	date := now
+	if t, err := http.ParseTime(header.Get("Date")); err == nil {
+		date = t
+	}
+	cc := parseCacheControl(header)
+	lifetime, _ := freshnessLifetime(stale.status, header, cc, date)
+	if _, ok := cc["no-cache"]; ok || lifetime < 0 {
+		lifetime = 0
+	}
+	cp := *stale
+	cp.header, cp.received, cp.lifetime = header, now, lifetime
+	cp.age = initialAge(h, date, cr.sent, now)
+	if item, ok := c.items[stale.key]; ok {
+		if e, ok := item.variants[stale.variant]; ok {
+			e.header, e.received, e.age, e.lifetime = cp.header, cp.received, cp.age, cp.lifetime
+		}
+	}
+	return &cp
+}
+
+// evict 淘汰最久未使用的缓存，内存超出限制时先转存到磁盘
+func (c *respCache) evict() {
+	for c.maxEntries > 0 && c.mem.Len()+c.disk.Len() > c.maxEntries {
+		l := c.disk
+		if l.Len() == 0 {
+			l = c.mem
+		}
+		c.remove(l.Back().Value.(*cacheEntry))
+	}
+	for c.memBytes > c.maxMem && c.mem.Len() > 0 {
+		e := c.mem.Back().Value.(*cacheEntry)
+		if c.diskDir == "" || e.size > c.maxDisk {
+			c.remove(e)
+			continue
+		}
+		if err := c.spill(e); err != nil {
+			logs.Warn("spill http cache to disk error %s", err.Error())
+			c.remove(e)
+		}
+	}
+	for c.diskBytes > c.maxDisk && c.disk.Len() > 0 {
+		c.remove(c.disk.Back().Value.(*cacheEntry))
+	}
+}
+
+// spill 将内存中的缓存转存到磁盘
+func (c *respCache) spill(e *cacheEntry) error {
+	sum := sha256.Sum256([]byte(e.key + "\n" + e.variant))
+	name := filepath.Join(c.diskDir, hex.EncodeToString(sum[:])+cacheFileExt)
+	if err := ioutil.WriteFile(name, e.body, 0600); err != nil {
+		return err
+	}
+	c.mem.Remove(e.elem)
+	c.memBytes -= e.size
+	e.body, e.file = nil, name
+	e.elem = c.disk.PushFront(e)
+	c.diskBytes += e.size
+	return nil
+}
+
+// remove 删除一个缓存
+func (c *respCache) remove(e *cacheEntry) {
+	if e.file != "" {
+		c.disk.Remove(e.elem)
+		c.diskBytes -= e.size
+		os.Remove(e.file)
+	} else {
+		c.mem.Remove(e.elem)
+		c.memBytes -= e.size
+	}
+	delete(e.item.variants, e.variant)
+	if len(e.item.variants) == 0 && c.items[e.key] == e.item {
+		delete(c.items, e.key)
+	}
+}
+
+// purgeKey 删除缓存键的所有变体
+func (c *respCache) purgeKey(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if item, ok := c.items[key]; ok {
+		for _, e := range item.variants {
+			c.remove(e)
+		}
+	}
+}
+
+// count 更新域名解析的命中统计
+func (c *respCache) count(hostId int, f func(s *CacheStats)) {
+	c.Lock()
+	defer c.Unlock()
+	s, ok := c.stats[hostId]
+	if !ok {
+		s = &CacheStats{HostId: hostId}
+		c.stats[hostId] = s
+	}
+	f(s)
+}
+
+// fresh 判断缓存是否仍在新鲜期内
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return e.currentAge(now) < e.lifetime
+}
+
+// currentAge 返回缓存当前的年龄
+func (e *cacheEntry) currentAge(now time.Time) time.Duration {
+	return e.age + now.Sub(e.received)
+}
+
+// response 以缓存构造应答，访问者的条件请求匹配时返回 304，HEAD 请求不带响应体
+func (e *cacheEntry) response(r *http.Request, now time.Time) *http.Response {
+	h := e.header.Clone()
+	h.Set("Age", strconv.FormatInt(int64(e.currentAge(now)/time.Second), 10))
+	status, body := e.status, e.body
+	if r != nil && notModified(r.Header, h) {
+		status, body = http.StatusNotModified, nil
+		h.Del("Content-Length")
+	} else {
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	resp := &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Request:       r,
+		ContentLength: int64(len(body)),
+		Body:          http.NoBody,
+	}
+	if r != nil {
+		resp.Close = r.Close
+	}
+	if len(body) > 0 && (r == nil || r.Method != "HEAD") {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return resp
+}
+
+// notModified 判断访问者的条件请求是否与缓存的响应匹配
+func notModified(reqHeader, h http.Header) bool {
+	if inm := reqHeader.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(reqHeader.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// writeCachedResponse 在 HTTP/2 代理路径上以缓存应答，返回写出的响应体字节数
+func writeCachedResponse(w http.ResponseWriter, resp *http.Response) int64 {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	n, _ := io.Copy(w, resp.Body)
+	return n
+}
+
+// parseCacheControl 解析 Cache-Control 头，指令名转为小写
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, line := range h["Cache-Control"] {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				name, value = part[:i], strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return cc
+}
+
+// ccSeconds 返回以秒为单位的 Cache-Control 指令，指令不存在或取值无效时返回 false
+func ccSeconds(cc map[string]string, name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshnessLifetime 计算响应的新鲜期，explicit 表示由响应头明确指定
+func freshnessLifetime(status int, h http.Header, cc map[string]string, date time.Time) (lifetime time.Duration, explicit bool) {
+	if d, ok := ccSeconds(cc, "s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := ccSeconds(cc, "max-age"); ok {
+		return d, true
+	}
+	if v := h.Get("Expires"); v != "" {
+		t, err := http.ParseTime(v)
+		if err != nil {
+			return 0, true
+		}
+		return t.Sub(date), true
+	}
+	if status != 200 && status != 203 && status != 204 && status != 300 && status != 301 && status != 308 && status != 404 && status != 405 && status != 410 && status != 414 && status != 501 {
+		return 0, false
+	}
+	if lm, err := http.ParseTime(h.Get("Last-Modified")); err == nil && date.After(lm) {
+		if lifetime = date.Sub(lm) / 10; lifetime > cacheHeuristicMax {
+			lifetime = cacheHeuristicMax
+		}
+	}
+	return lifetime, false
+}
+
+// initialAge 计算收到响应时其已有的年龄，计入 Age 头与请求往返的耗时
+func initialAge(h http.Header, date, sent, received time.Time) time.Duration {
+	apparent := received.Sub(date)
+	if apparent < 0 {
+		apparent = 0
+	}
+	var age time.Duration
+	if n, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && n > 0 {
+		age = time.Duration(n) * time.Second
+	}
+	if corrected := age + received.Sub(sent); corrected > apparent {
+		return corrected
+	}
+	return apparent
+}
+
+// varyHeaders 返回响应 Vary 列出的请求头，已规范化、去重并排序
+func varyHeaders(h http.Header) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, line := range h["Vary"] {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name == "*" {
+				return []string{"*"}
+			} else if name != "" && !seen[http.CanonicalHeaderKey(name)] {
+				seen[http.CanonicalHeaderKey(name)] = true
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// variantKey 返回请求在 Vary 列出的请求头上的取值
+func variantKey(vary []string, h http.Header) string {
+	var b strings.Builder
+	for _, name := range vary {
+		b.WriteString(name + ":" + strings.Join(h[name], ",") + "\n")
+	}
+	return b.String()
+}
+
+// cacheHeader 复制需要缓存的响应头，去掉逐跳头
+func cacheHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			out.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Age"} {
+		out.Del(name)
+	}
+	return out
+}
+
+// headerSize 估算响应头占用的字节数
+func headerSize(h http.Header) int64 {
+	var n int64
+	for k, v := range h {
+		for _, s := range v {
+			n += int64(len(k) + len(s) + 4)
+		}
+	}
+	return n
+}
+
+// authByClient 判断请求是否携带了发往后端的认证信息，客户端配置了 Basic 认证时 Authorization 由服务端校验，不算在内
+// 域名解析的认证通过后 Authorization 已被去掉，仍带有的是发往后端的
+func authByClient(host *file.Host, h http.Header) bool {
+	if h.Get("Authorization") == "" {
+		return false
+	}
+	return host.HasAuth() || host.Client == nil || host.Client.Cnf == nil || host.Client.Cnf.U == "" || host.Client.Cnf.P == ""
+}
+
+// equalStrings 判断两个字符串切片是否相同
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PurgeHttpCache 清除缓存，hostId 为 0 时清除所有域名解析的缓存，path 不为空时只清除以其开头的路径，返回清除的条数
+func PurgeHttpCache(hostId int, path string) int {
+	c := getHttpCache()
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	var list []*cacheEntry
+	for _, item := range c.items {
+		for _, e := range item.variants {
+			if (hostId == 0 || e.hostId == hostId) && strings.HasPrefix(e.path, path) {
+				list = append(list, e)
+			}
+		}
+	}
+	for _, e := range list {
+		c.remove(e)
+	}
+	return len(list)
+}
+
+// DelHttpCacheHost 删除域名解析时清除其缓存与命中统计，以及已解析的规则、响应头规则与错误页面
+func DelHttpCacheHost(hostId int) {
+	compiledRules.delete(hostId)
+	compiledRespHeaders.delete(hostId)
+	hostErrorPages.delete(hostId)
+	c := getHttpCache()
+	if c == nil {
+		return
+	}
+	PurgeHttpCache(hostId, "")
+	c.Lock()
+	delete(c.stats, hostId)
+	c.Unlock()
+}
+
+// HttpCacheStats 返回缓存统计，hostId 为 0 时返回所有域名解析的汇总，未开启 http_cache 时返回 false
+func HttpCacheStats(hostId int) (CacheStats, bool) {
+	c := getHttpCache()
+	if c == nil {
+		return CacheStats{}, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	stats := CacheStats{HostId: hostId}
+	for id, s := range c.stats {
+		if hostId == 0 || id == hostId {
+			stats.Hits += s.Hits
+			stats.Revalidated += s.Revalidated
+			stats.Misses += s.Misses
+		}
+	}
+	for _, item := range c.items {
+		for _, e := range item.variants {
+			if hostId != 0 && e.hostId != hostId {
+				continue
+			}
+			stats.Entries++
+			if e.file != "" {
+				stats.DiskBytes += e.size
+			} else {
+				stats.MemBytes += e.size
+			}
+		}
+	}
+	return stats, true
+}
@@ -1,12 +1,13 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"sync"
 
-	"ehang.io/nps/lib/cache"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/crypt"
@@ -14,29 +15,25 @@ import (
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
 )
 
 // HttpsServer HTTPS代理服务器结构体
 // 继承自httpServer，提供HTTPS代理功能
 type HttpsServer struct {
 	httpServer
-	listener         net.Listener        // 网络监听器
-	httpsListenerMap sync.Map            // 存储不同域名的HTTPS监听器映射表
+	listener    net.Listener   // 网络监听器
+	tlsListener *HttpsListener // 终止 TLS 的监听器，所有域名共用，按 SNI 选择证书
+	tlsOnce     sync.Once      // 保证终止 TLS 的服务只启动一次
 }
 
 // NewHttpsServer 创建新的HTTPS服务器实例
 // 参数:
 //   - l: 网络监听器
 //   - bridge: 网络桥接接口
-//   - useCache: 是否使用缓存
-//   - cacheLen: 缓存长度
-func NewHttpsServer(l net.Listener, bridge NetBridge, useCache bool, cacheLen int) *HttpsServer {
+func NewHttpsServer(l net.Listener, bridge NetBridge) *HttpsServer {
 	https := &HttpsServer{listener: l}
 	https.bridge = bridge
-	https.useCache = useCache
-	if useCache {
-		https.cache = cache.New(cacheLen)
-	}
 	return https
 }
 
@@ -50,55 +47,9 @@ func (https *HttpsServer) Start() error {
 			https.handleHttps(c)
 		})
 	} else {
-		// SSL证书模式：使用SSL证书进行HTTPS服务
-		// 启动默认监听器
-		certFile := beego.AppConfig.String("https_default_cert_file")
-		keyFile := beego.AppConfig.String("https_default_key_file")
-		if common.FileExists(certFile) && common.FileExists(keyFile) {
-			l := NewHttpsListener(https.listener)
-			https.NewHttps(l, certFile, keyFile)
-			https.httpsListenerMap.Store("default", l)
-		}
-		// 接受连接并处理SNI（服务器名称指示）
+		// SSL证书模式：所有连接交给同一个 TLS 服务，握手时按 SNI 从证书存储中取得证书
 		conn.Accept(https.listener, func(c net.Conn) {
-			serverName, rb := GetServerNameFromClientHello(c)
-			// 如果客户端Hello消息不包含SNI，使用默认SSL证书
-			if serverName == "" {
-				serverName = "default"
-			}
-			var l *HttpsListener
-			if v, ok := https.httpsListenerMap.Load(serverName); ok {
-				// 如果已存在该域名的监听器，直接使用
-				l = v.(*HttpsListener)
-			} else {
-				// 创建新的HTTPS请求来查询主机信息
-				r := buildHttpsRequest(serverName)
-				if host, err := file.GetDb().GetInfoByHost(serverName, r); err != nil {
-					c.Close()
-					logs.Notice("the url %s can't be parsed!,remote addr %s", serverName, c.RemoteAddr().String())
-					return
-				} else {
-					if !common.FileExists(host.CertFilePath) || !common.FileExists(host.KeyFilePath) {
-						// 如果主机证书文件或密钥文件未设置，使用默认文件
-						if v, ok := https.httpsListenerMap.Load("default"); ok {
-							l = v.(*HttpsListener)
-						} else {
-							c.Close()
-							logs.Error("the key %s cert %s file is not exist", host.KeyFilePath, host.CertFilePath)
-							return
-						}
-					} else {
-						// 创建新的HTTPS监听器并启动SSL服务
-						l = NewHttpsListener(https.listener)
-						https.NewHttps(l, host.CertFilePath, host.KeyFilePath)
-						https.httpsListenerMap.Store(serverName, l)
-					}
-				}
-			}
-			// 将连接包装并发送到对应的监听器
-			acceptConn := conn.NewConn(c)
-			acceptConn.Rb = rb
-			l.acceptConn <- acceptConn
+			https.getTlsListener().acceptConn <- conn.NewConn(c)
 		})
 	}
 	return nil
@@ -109,21 +60,59 @@ func (https *HttpsServer) Close() error {
 	return https.listener.Close()
 }
 
-// NewHttps 根据证书和密钥文件创建新的HTTPS服务器
-// 参数:
-//   - l: 网络监听器
-//   - certFile: 证书文件路径
-//   - keyFile: 密钥文件路径
-func (https *HttpsServer) NewHttps(l net.Listener, certFile string, keyFile string) {
-	go func() {
-		logs.Error(https.NewServer(0, "https").ServeTLS(l, certFile, keyFile))
-	}()
+// getTlsListener 返回终止 TLS 的监听器，首次调用时启动 TLS 服务
+// 证书与 ALPN 协议在握手时按域名解析确定，证书文件修改后无需重启即可生效
+func (https *HttpsServer) getTlsListener() *HttpsListener {
+	https.tlsOnce.Do(func() {
+		https.tlsListener = NewHttpsListener(https.listener)
+		srv := https.NewServer(0, "https", true)
+		go func() {
+			logs.Error(srv.Serve(tls.NewListener(https.tlsListener, &tls.Config{GetConfigForClient: https.getConfigForClient})))
+		}()
+	})
+	return https.tlsListener
+}
+
+// getConfigForClient 按 SNI 查找域名解析，返回本次握手使用的证书与 ALPN 协议
+// 未携带 SNI 时使用默认证书，开启 HTTP/2 的域名协商 h2，开启自动证书的域名使用 ACME 证书
+func (https *HttpsServer) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	var host *file.Host
+	if hello.ServerName != "" {
+		var err error
+		if host, err = file.GetDb().GetInfoByHost(hello.ServerName, buildHttpsRequest(hello.ServerName)); err != nil {
+			logs.Notice("the url %s can't be parsed!,remote addr %s", hello.ServerName, hello.Conn.RemoteAddr().String())
+			return nil, err
+		}
+	}
+	config := &tls.Config{NextProtos: []string{"http/1.1"}}
+	if host != nil && host.Http2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if m := getAcmeManager(); m != nil && findAutoCertHost(hello.ServerName) != nil {
+		// acme-tls/1 只在验证服务器单独请求时选中
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+		config.GetCertificate = m.GetCertificate
+		return config, nil
+	}
+	cert, err := certs.get(host)
+	if err != nil {
+		logs.Error(err)
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{*cert}
+	return config, nil
 }
 
 // handleHttps 处理纯代理模式的HTTPS连接
 // 从客户端Hello消息中提取主机名，然后代理到目标服务器
 func (https *HttpsServer) handleHttps(c net.Conn) {
 	hostName, rb := GetServerNameFromClientHello(c)
+	// 开启自动证书的域名在服务端终止 TLS
+	acceptConn := conn.NewConn(c)
+	acceptConn.Rb = rb
+	if https.acceptAutoCert(acceptConn, hostName) {
+		return
+	}
 	var targetAddr string
 	r := buildHttpsRequest(hostName)
 	var host *file.Host
@@ -135,6 +124,19 @@ func (https *HttpsServer) handleHttps(c net.Conn) {
 		logs.Notice("the url %s can't be parsed!", hostName)
 		return
 	}
+
+	// 按全局黑名单与域名解析的来源访问控制校验访问者
+	if err = checkSourceAcl(host.IpAcl, c.RemoteAddr().String()); err != nil {
+		logs.Info("host id %d, %s", host.Id, err.Error())
+		c.Close()
+		return
+	}
+	// 直接转发时无法读取请求，按新建连接计入速率限制
+	if err = checkSourceRate(host.RateLimit, c.RemoteAddr().String()); err != nil {
+		logs.Info("host id %d, %s", host.Id, err.Error())
+		c.Close()
+		return
+	}
 	
 	// 检查客户端流量和连接数限制
 	if err := https.CheckFlowAndConnNum(host.Client); err != nil {
@@ -144,20 +146,30 @@ func (https *HttpsServer) handleHttps(c net.Conn) {
 	}
 	defer host.Client.AddConn()
 	
-	// 进行身份验证
-	if err = https.auth(r, conn.NewConn(c), host.Client.Cnf.U, host.Client.Cnf.P); err != nil {
-		logs.Warn("auth error", err, r.RemoteAddr)
+	// 进行身份验证：TLS 不终止时无法读取认证头，设置了认证的域名解析只允许免认证的访问者
+	if _, err = checkHostAuth(host, r, c.RemoteAddr().String()); err != nil {
+		logs.Warn("host %s, remote address %s, %s", host.Host, c.RemoteAddr().String(), err.Error())
+		c.Close()
+		return
+	}
+	// 外部认证需要读取请求，TLS 不终止时不允许访问
+	if host.ForwardAuth != "" {
+		logs.Warn("host %s, remote address %s, forward auth requires the tls to be terminated", host.Host, c.RemoteAddr().String())
+		c.Close()
 		return
 	}
 	
-	// 获取随机目标地址
-	if targetAddr, err = host.Target.GetRandomTarget(); err != nil {
+	// 按域名解析的负载均衡策略选择目标地址（TLS 不终止时无法使用 Cookie 保持会话）
+	if targetAddr, err = host.Target.SelectTarget(common.GetIpByAddr(c.RemoteAddr().String()), ""); err != nil {
 		logs.Warn(err.Error())
 	}
+	host.Target.ConnOpen(targetAddr)
+	defer host.Target.ConnClose(targetAddr)
 	
 	logs.Trace("new https connection,clientId %d,host %s,remote address %s", host.Client.Id, r.Host, c.RemoteAddr().String())
 	// 处理客户端连接，建立代理
-	https.DealClient(conn.NewConn(c), host.Client, targetAddr, rb, common.CONN_TCP, nil, host.Flow, host.Target.LocalProxy)
+	https.DealClient(conn.NewConn(c), host.Client, targetAddr, rb, common.CONN_TCP, nil, host.Flow, host.Target.LocalProxy,
+		conn.LinkProxyProtocol(host.ProxyProtocol, c.LocalAddr().String()), conn.LinkFixedTarget())
 }
 
 // HttpsListener HTTPS监听器结构体
@@ -193,20 +205,30 @@ func (httpsListener *HttpsListener) Addr() net.Addr {
 }
 
 // GetServerNameFromClientHello 从客户端Hello消息中获取服务器名称
-// 通过读取TLS握手数据来提取SNI（服务器名称指示）
+// 通过读取TLS握手数据来提取SNI（服务器名称指示），按记录头中的长度读取完整的握手记录，
+// ClientHello 分多个 TCP 分段到达时也能取得
 // 返回值:
 //   - string: 服务器名称
 //   - []byte: 原始客户端Hello数据
 func GetServerNameFromClientHello(c net.Conn) (string, []byte) {
 	buf := make([]byte, 4096)
-	data := make([]byte, 4096)
 	n, err := c.Read(buf)
 	if err != nil {
 		return "", nil
 	}
+	// 0x16 为握手记录，记录长度不超过 16KB
+	if n >= 5 && buf[0] == 0x16 {
+		if size := 5 + (int(buf[3])<<8 | int(buf[4])); size <= 5+1<<14 && size > n {
+			full := make([]byte, size)
+			copy(full, buf[:n])
+			m, _ := io.ReadFull(c, full[n:])
+			buf, n = full, n+m
+		}
+	}
 	if n < 42 {
-		return "", nil
+		return "", buf[:n]
 	}
+	data := make([]byte, n)
 	copy(data, buf[:n])
 	clientHello := new(crypt.ClientHelloMsg)
 	clientHello.Unmarshal(data[5:n])
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+)
+
+// 域名解析的负载均衡：ip_hash 按访问者连接的地址选择目标，
+// cookie 策略以 nps_lb_<域名解析 id> Cookie 保存访问者的目标标识，Cookie 指向的目标不可用时重新选择并更新 Cookie。
+
+// stickyCookieName 会话保持 Cookie 的名称，按域名解析区分，同一域名下不同路由的会话互不影响
+func stickyCookieName(host *file.Host) string {
+	return "nps_lb_" + strconv.Itoa(host.Id)
+}
+
+// selectHostTarget 按域名解析的负载均衡策略为访问者的请求选择目标，remoteAddr 为访问者连接的地址
+func selectHostTarget(host *file.Host, r *http.Request, remoteAddr string) (string, error) {
+	var sticky string
+	if host.Target.LbStrategy == file.LbCookie {
+		if c, err := r.Cookie(stickyCookieName(host)); err == nil {
+			sticky = c.Value
+		}
+	}
+	return host.Target.SelectTarget(common.GetIpByAddr(remoteAddr), sticky)
+}
+
+// setStickyCookie cookie 策略下访问者的会话未指向实际转发的目标时，在响应中设置会话保持 Cookie
+// r 为访问者的请求，targetAddr 为实际转发的目标
+func setStickyCookie(host *file.Host, r *http.Request, h http.Header, targetAddr string) {
+	if host.Target.LbStrategy != file.LbCookie || targetAddr == "" {
+		return
+	}
+	id := file.StickyId(targetAddr)
+	if c, err := r.Cookie(stickyCookieName(host)); err == nil && c.Value == id {
+		return
+	}
+	h.Add("Set-Cookie", (&http.Cookie{Name: stickyCookieName(host), Value: id, Path: "/", HttpOnly: true}).String())
+}
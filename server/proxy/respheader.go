@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+// 响应头修改：域名解析的响应头规则每行一条，在响应发往访问者之前按顺序执行：
+//   Name: value   设置响应头，替换后端返回的同名响应头
+//   +Name: value  添加响应头，保留后端返回的同名响应头
+//   -Name         删除响应头
+// 以 @ 开头的行为预设，可以带一个参数覆盖默认值：
+//   @hsts [max-age=31536000; includeSubDomains]  只在 https 访问时添加 Strict-Transport-Security
+//   @csp [default-src 'self']                     Content-Security-Policy
+//   @xfo [SAMEORIGIN]                             X-Frame-Options
+//   @cors [来源 ...]                              CORS，不带参数时允许任意来源，
+//                                                 带参数时只允许列出的来源并允许携带凭据，预检请求由 nps 直接应答
+
+const (
+	defaultHsts = "max-age=31536000; includeSubDomains"
+	defaultCsp  = "default-src 'self'"
+	defaultXfo  = "SAMEORIGIN"
+)
+
+// respHeaderRules 已解析的响应头规则
+type respHeaderRules struct {
+	rules []headerRule
+	hsts  string   // 为空时不添加
+	cors  []string // 为 nil 时未开启 CORS，含 * 时允许任意来源
+}
+
+// headerRule 一条响应头修改
+type headerRule struct {
+	op    byte // '=' 设置，'+' 添加，'-' 删除
+	name  string
+	value string
+}
+
+// compiledRespHeaders 已解析的响应头规则
+var compiledRespHeaders hostCache
+
+// CheckResponseHeader 检查响应头规则的语法，返回第一个错误
+func CheckResponseHeader(s string) error {
+	_, err := parseRespHeaders(s)
+	return err
+}
+
+// parseRespHeaders 解析多行响应头规则
+func parseRespHeaders(s string) (*respHeaderRules, error) {
+	rs := new(respHeaderRules)
+	for i, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := rs.parseLine(line); err != nil {
+			return nil, fmt.Errorf("response header line %d: %s", i+1, err.Error())
+		}
+	}
+	return rs, nil
+}
+
+// parseLine 解析一行响应头规则
+func (rs *respHeaderRules) parseLine(line string) error {
+	switch line[0] {
+	case '@':
+		name, arg := line[1:], ""
+		if i := strings.IndexAny(name, " \t"); i >= 0 {
+			name, arg = name[:i], strings.TrimSpace(name[i+1:])
+		}
+		switch strings.ToLower(name) {
+		case "hsts":
+			rs.hsts = defaultString(arg, defaultHsts)
+		case "csp":
+			rs.rules = append(rs.rules, headerRule{op: '=', name: "Content-Security-Policy", value: defaultString(arg, defaultCsp)})
+		case "xfo":
+			rs.rules = append(rs.rules, headerRule{op: '=', name: "X-Frame-Options", value: defaultString(arg, defaultXfo)})
+		case "cors":
+			rs.cors = strings.FieldsFunc(arg, func(r rune) bool { return r == ' ' || r == ',' || r == '\t' })
+			if len(rs.cors) == 0 {
+				rs.cors = []string{"*"}
+			}
+		default:
+			return fmt.Errorf("unknown preset %s", name)
+		}
+		return nil
+	case '-':
+		if name := strings.TrimSpace(line[1:]); name != "" {
+			rs.rules = append(rs.rules, headerRule{op: '-', name: name})
+			return nil
+		}
+		return errors.New("header name is empty")
+	}
+	op := byte('=')
+	if line[0] == '+' {
+		op, line = '+', line[1:]
+	}
+	kv := strings.SplitN(line, ":", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+		return fmt.Errorf("%s is not in name: value form", line)
+	}
+	rs.rules = append(rs.rules, headerRule{op: op, name: strings.TrimSpace(kv[0]), value: strings.TrimSpace(kv[1])})
+	return nil
+}
+
+// defaultString 参数为空时返回默认值
+func defaultString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// getRespHeaders 返回域名解析已解析的响应头规则，没有规则或规则有误时返回 nil
+func getRespHeaders(host *file.Host) *respHeaderRules {
+	if host.RespHeaderChange == "" {
+		return nil
+	}
+	return compiledRespHeaders.load(host, host.RespHeaderChange, func() interface{} {
+		rs, err := parseRespHeaders(host.RespHeaderChange)
+		if err != nil {
+			logs.Warn("host %s response header rules are ignored, %s", host.Host, err.Error())
+		}
+		return rs
+	}).(*respHeaderRules)
+}
+
+// changeResponseHeader 按域名解析的规则修改发往访问者的响应头，r 为访问者的请求
+func changeResponseHeader(host *file.Host, r *http.Request, h http.Header) {
+	rs := getRespHeaders(host)
+	if rs == nil {
+		return
+	}
+	if rs.hsts != "" && r.URL.Scheme == "https" {
+		h.Set("Strict-Transport-Security", rs.hsts)
+	}
+	if origin := rs.allowOrigin(r); origin != "" {
+		h.Set("Access-Control-Allow-Origin", origin)
+		if origin != "*" {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+	if rs.cors != nil && rs.cors[0] != "*" && !headerHasToken(h, "Vary", "Origin") {
+		h.Add("Vary", "Origin")
+	}
+	for _, v := range rs.rules {
+		switch v.op {
+		case '=':
+			h.Set(v.name, v.value)
+		case '+':
+			h.Add(v.name, v.value)
+		case '-':
+			h.Del(v.name)
+		}
+	}
+}
+
+// allowOrigin 返回允许的 CORS 来源，请求不带 Origin 或来源不被允许时返回空
+func (rs *respHeaderRules) allowOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if rs.cors == nil || origin == "" {
+		return ""
+	}
+	for _, v := range rs.cors {
+		if v == "*" {
+			return "*"
+		}
+		if strings.EqualFold(v, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// corsPreflight 开启了 CORS 的域名解析直接应答允许来源的预检请求，不是预检请求时返回 nil
+func corsPreflight(host *file.Host, r *http.Request) *http.Response {
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return nil
+	}
+	rs := getRespHeaders(host)
+	if rs == nil || rs.allowOrigin(r) == "" {
+		return nil
+	}
+	header := http.Header{
+		"Access-Control-Allow-Methods": {"GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"},
+		"Access-Control-Max-Age":       {"86400"},
+	}
+	if v := r.Header.Get("Access-Control-Request-Headers"); v != "" {
+		header.Set("Access-Control-Allow-Headers", v)
+	}
+	return ruleResponse(r, http.StatusNoContent, header, "")
+}
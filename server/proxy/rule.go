@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+// 域名解析规则：每行一条，按顺序匹配，第一条匹配的规则生效。
+// 一条规则由空格分隔的若干 key=value 组成，条件全部满足时执行动作：
+//   条件 path=正则（匹配请求路径）、method=GET,POST、header=名称[:正则]、query=名称[:正则]、cookie=名称[:正则]
+//   动作 rewrite=新路径、redirect=[301:]地址、target=内网目标、respond=[状态码:]内容
+// rewrite 与 redirect 中可以用 $1 等引用 path 正则的分组，rewrite 可与 target 同时使用，
+// respond 必须写在最后，其后的内容（含空格）都作为响应体。以 # 开头的行为注释。
+// 例如：
+//   path=^/api/(.*) method=GET,POST rewrite=/v2/$1
+//   path=^/old/(.*) redirect=301:https://new.example.com/$1
+//   path=^/static/ target=127.0.0.1:8081
+//   path=^/ping$ respond=200:pong
+
+// hostRule 域名解析的一条规则
+type hostRule struct {
+	path         *regexp.Regexp
+	methods      []string
+	headers      []ruleMatch
+	queries      []ruleMatch
+	cookies      []ruleMatch
+	rewrite      string
+	target       string
+	redirect     string
+	redirectCode int // 重定向的状态码，为 0 时不重定向
+	respond      string
+	respondCode  int // 固定应答的状态码，为 0 时不应答
+}
+
+// ruleMatch 对请求头、查询参数或 Cookie 的匹配，value 为空时只要求存在
+type ruleMatch struct {
+	name  string
+	value *regexp.Regexp
+}
+
+// compiledRules 已解析的规则
+var compiledRules hostCache
+
+// hostCache 按域名解析 id 缓存由其配置文本解析的结果，文本修改后重新解析并替换，
+// 删除域名解析时由 DelHttpCacheHost 清除，缓存的条数不超过域名解析的个数
+type hostCache struct {
+	m sync.Map // map[int]*hostCached
+}
+
+// hostCached 一个域名解析的解析结果及解析时的文本
+type hostCached struct {
+	text  string
+	value interface{}
+}
+
+// load 返回域名解析的配置文本 text 的解析结果，未缓存或文本已修改时调用 parse 解析
+func (c *hostCache) load(host *file.Host, text string, parse func() interface{}) interface{} {
+	if v, ok := c.m.Load(host.Id); ok && v.(*hostCached).text == text {
+		return v.(*hostCached).value
+	}
+	value := parse()
+	c.m.Store(host.Id, &hostCached{text: text, value: value})
+	return value
+}
+
+// delete 清除域名解析的解析结果
+func (c *hostCache) delete(hostId int) {
+	c.m.Delete(hostId)
+}
+
+// CheckHostRules 检查域名解析规则的语法，返回第一个错误
+func CheckHostRules(s string) error {
+	_, err := parseHostRules(s)
+	return err
+}
+
+// parseHostRules 解析多行规则文本
+func parseHostRules(s string) ([]*hostRule, error) {
+	var rules []*hostRule
+	for i, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseHostRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("rule line %d: %s", i+1, err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseHostRule 解析一行规则
+func parseHostRule(line string) (*hostRule, error) {
+	rule := new(hostRule)
+	for line != "" {
+		var item string
+		if strings.HasPrefix(line, "respond=") {
+			item, line = line, ""
+		} else if i := strings.IndexAny(line, " \t"); i >= 0 {
+			item, line = line[:i], strings.TrimSpace(line[i+1:])
+		} else {
+			item, line = line, ""
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("%s is not in key=value form", item)
+		}
+		var err error
+		switch kv[0] {
+		case "path":
+			rule.path, err = regexp.Compile(kv[1])
+		case "method":
+			for _, m := range strings.Split(kv[1], ",") {
+				rule.methods = append(rule.methods, strings.ToUpper(strings.TrimSpace(m)))
+			}
+		case "header", "query", "cookie":
+			var m ruleMatch
+			if m, err = parseRuleMatch(kv[1]); err != nil {
+				break
+			}
+			switch kv[0] {
+			case "header":
+				m.name = http.CanonicalHeaderKey(m.name)
+				rule.headers = append(rule.headers, m)
+			case "query":
+				rule.queries = append(rule.queries, m)
+			default:
+				rule.cookies = append(rule.cookies, m)
+			}
+		case "rewrite":
+			if !strings.HasPrefix(kv[1], "/") {
+				err = errors.New("rewrite path must start with /")
+			}
+			rule.rewrite = kv[1]
+		case "target":
+			rule.target = kv[1]
+		case "redirect":
+			rule.redirectCode, rule.redirect = splitRuleStatus(kv[1], http.StatusFound)
+			if !isRedirectCode(rule.redirectCode) || rule.redirect == "" {
+				err = errors.New("redirect status must be 301, 302, 303, 307 or 308")
+			}
+		case "respond":
+			rule.respondCode, rule.respond = splitRuleStatus(kv[1], http.StatusOK)
+			if rule.respondCode < 200 || rule.respondCode > 599 {
+				err = errors.New("respond status must be between 200 and 599")
+			}
+		default:
+			err = fmt.Errorf("unknown key %s", kv[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case rule.redirectCode == 0 && rule.respondCode == 0 && rule.rewrite == "" && rule.target == "":
+		return nil, errors.New("rule has no action")
+	case rule.redirectCode != 0 && (rule.respondCode != 0 || rule.rewrite != "" || rule.target != ""),
+		rule.respondCode != 0 && (rule.rewrite != "" || rule.target != ""):
+		return nil, errors.New("redirect and respond can not be combined with other actions")
+	}
+	return rule, nil
+}
+
+// parseRuleMatch 解析 名称[:正则] 形式的匹配条件
+func parseRuleMatch(s string) (m ruleMatch, err error) {
+	kv := strings.SplitN(s, ":", 2)
+	m.name = kv[0]
+	if len(kv) == 2 {
+		m.value, err = regexp.Compile(kv[1])
+	}
+	return
+}
+
+// splitRuleStatus 拆分 状态码:内容 形式的值，值不以 数字: 开头时使用默认值
+func splitRuleStatus(s string, def int) (int, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == 0 || i == len(s) || s[i] != ':' {
+		return def, s
+	}
+	code, err := strconv.Atoi(s[:i])
+	if err != nil {
+		code = -1
+	}
+	return code, s[i+1:]
+}
+
+// isRedirectCode 判断是否为规则允许的重定向状态码
+func isRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// getHostRules 返回域名解析已解析的规则，规则有误时忽略并记录日志
+func getHostRules(host *file.Host) []*hostRule {
+	if host.Rules == "" {
+		return nil
+	}
+	return compiledRules.load(host, host.Rules, func() interface{} {
+		rules, err := parseHostRules(host.Rules)
+		if err != nil {
+			logs.Warn("host %s rules are ignored, %s", host.Host, err.Error())
+		}
+		return rules
+	}).([]*hostRule)
+}
+
+// match 判断请求是否满足规则的全部条件，满足时返回 path 正则的分组（未设置 path 时为空切片）
+func (rule *hostRule) match(r *http.Request) []string {
+	groups := []string{}
+	if rule.path != nil {
+		if groups = rule.path.FindStringSubmatch(r.URL.Path); groups == nil {
+			return nil
+		}
+	}
+	if len(rule.methods) > 0 {
+		found := false
+		for _, m := range rule.methods {
+			if m == r.Method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	for _, m := range rule.headers {
+		if !m.matchValues(r.Header[m.name]) {
+			return nil
+		}
+	}
+	if len(rule.queries) > 0 {
+		query := r.URL.Query()
+		for _, m := range rule.queries {
+			if !m.matchValues(query[m.name]) {
+				return nil
+			}
+		}
+	}
+	for _, m := range rule.cookies {
+		var values []string
+		if c, err := r.Cookie(m.name); err == nil {
+			values = append(values, c.Value)
+		}
+		if !m.matchValues(values) {
+			return nil
+		}
+	}
+	return groups
+}
+
+// matchValues 判断取得的值中是否有满足条件的
+func (m ruleMatch) matchValues(values []string) bool {
+	if m.value == nil {
+		return len(values) > 0
+	}
+	for _, v := range values {
+		if m.value.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandRule 以 path 正则的分组替换 $1 等引用
+func expandRule(s string, groups []string) string {
+	return os.Expand(s, func(name string) string {
+		if i, err := strconv.Atoi(name); err == nil {
+			if i < len(groups) {
+				return groups[i]
+			}
+			return ""
+		}
+		return "$" + name
+	})
+}
+
+// applyHostRules 按顺序匹配域名解析的规则
+// 重写路径时直接修改请求；重定向或固定应答时返回应答的响应；指定目标时返回目标地址，目标不在当前可用的目标中时返回错误
+// 开启了 CORS 的域名解析在匹配规则前直接应答预检请求
+func applyHostRules(host *file.Host, r *http.Request) (*http.Response, string, error) {
+	if resp := corsPreflight(host, r); resp != nil {
+		return resp, "", nil
+	}
+	for _, rule := range getHostRules(host) {
+		groups := rule.match(r)
+		if groups == nil {
+			continue
+		}
+		switch {
+		case rule.redirectCode != 0:
+			return ruleResponse(r, rule.redirectCode, http.Header{"Location": {expandRule(rule.redirect, groups)}}, ""), "", nil
+		case rule.respondCode != 0:
+			return ruleResponse(r, rule.respondCode, http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, rule.respond), "", nil
+		}
+		if rule.rewrite != "" {
+			rewritePath(r, expandRule(rule.rewrite, groups))
+		}
+		if rule.target != "" && !host.Target.HasTarget(rule.target) {
+			return nil, "", fmt.Errorf("the target %s of host %s is offline", rule.target, host.Host)
+		}
+		return nil, rule.target, nil
+	}
+	return nil, "", nil
+}
+
+// rewritePath 重写请求路径，新路径中带有查询参数时替换原有的查询参数
+func rewritePath(r *http.Request, path string) {
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, r.URL.RawQuery = path[:i], path[i+1:]
+	}
+	r.URL.Path = path
+	r.URL.RawPath = ""
+	r.RequestURI = r.URL.RequestURI()
+}
+
+// ruleResponse 构造重定向或固定应答的响应
+func ruleResponse(r *http.Request, code int, header http.Header, body string) *http.Response {
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+		Close:         r.Close,
+	}
+}
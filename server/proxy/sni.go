@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+// tls-sni 隧道：多个 tls-sni 隧道可以共用同一个监听地址，连接建立后读取 TLS ClientHello 中的 SNI，
+// 按各隧道配置的域名规则选出隧道，不终止 TLS，将原始数据（含已读取的 ClientHello）转发到该隧道的客户端与目标，
+// 适用于 MQTT over TLS、IMAPS 等非 HTTP 的 TLS 协议在同一端口上按域名区分用户。
+
+// sniReadTimeout 读取 ClientHello 的超时时间
+const sniReadTimeout = 10 * time.Second
+
+// sniGroups 各监听地址上的 tls-sni 隧道，key 为监听地址
+var sniGroups = struct {
+	m map[string]*sniGroup
+	sync.Mutex
+}{m: make(map[string]*sniGroup)}
+
+// sniGroup 共用同一监听地址的 tls-sni 隧道
+type sniGroup struct {
+	listener net.Listener
+	servers  map[int]*TlsSniServer // key 为隧道ID
+	sync.RWMutex
+}
+
+// TlsSniServer tls-sni 隧道
+type TlsSniServer struct {
+	BaseServer
+	addr string // 监听地址
+}
+
+// NewTlsSniServer 创建 tls-sni 隧道
+func NewTlsSniServer(bridge NetBridge, task *file.Tunnel) *TlsSniServer {
+	s := new(TlsSniServer)
+	s.bridge = bridge
+	s.task = task
+	s.addr = task.ServerIp + ":" + strconv.Itoa(task.Port)
+	return s
+}
+
+// SniPortAvailable 判断 tls-sni 隧道能否使用该端口：端口空闲，或已被其他 tls-sni 隧道监听
+func SniPortAvailable(serverIp string, port int) bool {
+	sniGroups.Lock()
+	defer sniGroups.Unlock()
+	if _, ok := sniGroups.m[serverIp+":"+strconv.Itoa(port)]; ok {
+		return true
+	}
+	return common.TestTcpPort(port)
+}
+
+// Start 加入监听地址对应的隧道组，第一个隧道负责监听端口
+func (s *TlsSniServer) Start() error {
+	sniGroups.Lock()
+	defer sniGroups.Unlock()
+	g, ok := sniGroups.m[s.addr]
+	if !ok {
+		l, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			return err
+		}
+		l = conn.NewProxyListener(l)
+		g = &sniGroup{listener: l, servers: make(map[int]*TlsSniServer)}
+		sniGroups.m[s.addr] = g
+		go conn.Accept(l, g.handle)
+	}
+	g.Lock()
+	g.servers[s.task.Id] = s
+	g.Unlock()
+	return nil
+}
+
+// Close 退出隧道组，最后一个隧道退出时关闭监听
+func (s *TlsSniServer) Close() error {
+	sniGroups.Lock()
+	defer sniGroups.Unlock()
+	g, ok := sniGroups.m[s.addr]
+	if !ok {
+		return nil
+	}
+	g.Lock()
+	if g.servers[s.task.Id] == s {
+		delete(g.servers, s.task.Id)
+	}
+	empty := len(g.servers) == 0
+	g.Unlock()
+	if !empty {
+		return nil
+	}
+	delete(sniGroups.m, s.addr)
+	return g.listener.Close()
+}
+
+// handle 读取 SNI 并交给匹配的隧道处理
+func (g *sniGroup) handle(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(sniReadTimeout))
+	serverName, rb := GetServerNameFromClientHello(c)
+	c.SetReadDeadline(time.Time{})
+	s := g.match(serverName)
+	if s == nil {
+		logs.Notice("no tls-sni tunnel on %s matches server name %s, remote address %s", g.listener.Addr().String(), serverName, c.RemoteAddr().String())
+		c.Close()
+		return
+	}
+	if err := checkSourceAcl(s.task.IpAcl, c.RemoteAddr().String()); err != nil {
+		logs.Info("task id %d, %s", s.task.Id, err.Error())
+		c.Close()
+		return
+	}
+	if err := checkSourceRate(s.task.RateLimit, c.RemoteAddr().String()); err != nil {
+		logs.Info("task id %d, %s", s.task.Id, err.Error())
+		c.Close()
+		return
+	}
+	if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
+		logs.Warn("client id %d, task id %d,error %s, when tls-sni connection", s.task.Client.Id, s.task.Id, err.Error())
+		c.Close()
+		return
+	}
+	defer s.task.Client.AddConn()
+	targetAddr, err := s.task.Target.SelectTarget(common.GetIpByAddr(c.RemoteAddr().String()), "")
+	if err != nil {
+		logs.Warn("tls-sni port %d ,client id %d,task id %d connect error %s", s.task.Port, s.task.Client.Id, s.task.Id, err.Error())
+		c.Close()
+		return
+	}
+	logs.Trace("new tls-sni connection,server name %s,client %d,remote address %s", serverName, s.task.Client.Id, c.RemoteAddr())
+	s.task.Target.ConnOpen(targetAddr)
+	defer s.task.Target.ConnClose(targetAddr)
+	s.DealClient(conn.NewConn(c), s.task.Client, targetAddr, rb, common.CONN_TCP, nil, s.task.Flow, s.task.Target.LocalProxy, conn.LinkFixedTarget())
+}
+
+// match 选出域名规则与 SNI 匹配且最精确的隧道
+func (g *sniGroup) match(serverName string) *TlsSniServer {
+	g.RLock()
+	defer g.RUnlock()
+	var best *TlsSniServer
+	bestScore := -1
+	for _, s := range g.servers {
+		if score := matchSniHost(s.task.SniHost, serverName); score > bestScore || (score == bestScore && best != nil && s.task.Id < best.task.Id) {
+			best, bestScore = s, score
+		}
+	}
+	if bestScore < 0 {
+		return nil
+	}
+	return best
+}
+
+// matchSniHost 按域名规则匹配 SNI，返回匹配的精确程度，不匹配时返回 -1
+// 规则以逗号或换行分隔：example.com 精确匹配，*.example.com 匹配其任意子域名，* 匹配所有连接（含未携带 SNI 的连接）
+func matchSniHost(rules, serverName string) int {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	score := -1
+	for _, rule := range strings.FieldsFunc(strings.ToLower(rules), func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		rule = strings.TrimSpace(rule)
+		switch {
+		case rule == "":
+		case rule == "*":
+			if score < 0 {
+				score = 0
+			}
+		case strings.HasPrefix(rule, "*."):
+			if serverName != "" && strings.HasSuffix(serverName, rule[1:]) && len(rule) > score {
+				score = len(rule)
+			}
+		case rule == serverName:
+			return 1 << 16
+		}
+	}
+	return score
+}
+
+// CheckSniHost 校验 tls-sni 隧道的域名规则
+func CheckSniHost(rules string) error {
+	for _, rule := range strings.FieldsFunc(rules, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		rule = strings.TrimSpace(rule)
+		if rule == "" || rule == "*" {
+			continue
+		}
+		if strings.Contains(strings.TrimPrefix(rule, "*."), "*") || strings.ContainsAny(rule, " :/") {
+			return errors.New("invalid server name rule " + rule)
+		}
+	}
+	if strings.TrimSpace(strings.NewReplacer(",", "", "\n", "", "\r", "").Replace(rules)) == "" {
+		return errors.New("the server name rule is empty")
+	}
+	return nil
+}
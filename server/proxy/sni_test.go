@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/file"
+)
+
+// TestMatchSniHost 测试域名规则的匹配与精确程度
+func TestMatchSniHost(t *testing.T) {
+	for _, c := range []struct {
+		rules, serverName string
+		score             int
+	}{
+		{"a.example.com", "a.example.com", 1 << 16},
+		{"A.Example.com", "a.example.COM.", 1 << 16},
+		{"a.example.com", "b.example.com", -1},
+		{"*.example.com", "a.example.com", len("*.example.com")},
+		{"*.example.com", "a.b.example.com", len("*.example.com")},
+		{"*.example.com", "example.com", -1},
+		{"*.example.com", "", -1},
+		{"*", "a.example.com", 0},
+		{"*", "", 0},
+		{"*, *.example.com", "a.example.com", len("*.example.com")},
+		{"*.com\n*.example.com", "a.example.com", len("*.example.com")},
+		{"*.example.com,a.example.com", "a.example.com", 1 << 16},
+		{" , \r\n", "a.example.com", -1},
+	} {
+		if score := matchSniHost(c.rules, c.serverName); score != c.score {
+			t.Fatalf("rules %q, server name %q, score %d, want %d", c.rules, c.serverName, score, c.score)
+		}
+	}
+}
+
+// TestCheckSniHost 测试域名规则的校验
+func TestCheckSniHost(t *testing.T) {
+	for _, c := range []struct {
+		rules string
+		ok    bool
+	}{
+		{"a.example.com", true},
+		{"*.example.com,\n*", true},
+		{"", false},
+		{" ,\n", false},
+		{"a.*.example.com", false},
+		{"example.com:443", false},
+		{"a b", false},
+	} {
+		if err := CheckSniHost(c.rules); (err == nil) != c.ok {
+			t.Fatalf("rules %q, error %v", c.rules, err)
+		}
+	}
+}
+
+// newSniTask 创建一个 tls-sni 隧道，将域名规则匹配的连接转发到 target
+func newSniTask(id, port int, sniHost, target string) *file.Tunnel {
+	return &file.Tunnel{
+		Id:       id,
+		Mode:     "tls-sni",
+		ServerIp: "127.0.0.1",
+		Port:     port,
+		SniHost:  sniHost,
+		Flow:     new(file.Flow),
+		Client:   &file.Client{Id: id, Status: true, Cnf: new(file.Config), Flow: new(file.Flow)},
+		Target:   &file.Target{TargetStr: target},
+	}
+}
+
+// sniGet 以 serverName 经 tls-sni 端口发送请求，返回响应体
+func sniGet(addr, serverName string) (string, error) {
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, a string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		},
+		DisableKeepAlives: true,
+	}}
+	resp, err := client.Get("https://" + serverName + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
+// TestTlsSniPortSharing 测试多个 tls-sni 隧道共用一个端口，按 SNI 选择最精确的隧道，最后一个隧道关闭时释放端口
+func TestTlsSniPortSharing(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+	}
+	initTestDb(t)
+	exact, wildcard := newBackend("exact"), newBackend("wildcard")
+	defer exact.Close()
+	defer wildcard.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	addr := l.Addr().String()
+
+	a := NewTlsSniServer(&localBridge{}, newSniTask(1<<30+101, port, "a.nps.test", exact.Listener.Addr().String()))
+	b := NewTlsSniServer(&localBridge{}, newSniTask(1<<30+102, port, "*.nps.test", wildcard.Listener.Addr().String()))
+	for _, s := range []*TlsSniServer{a, b} {
+		if !SniPortAvailable("127.0.0.1", port) {
+			t.Fatal("the port is not available for tls-sni tunnels")
+		}
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer a.Close()
+	defer b.Close()
+
+	for _, c := range []struct{ serverName, body string }{
+		{"a.nps.test", "exact"},
+		{"b.nps.test", "wildcard"},
+		{"x.a.nps.test", "wildcard"},
+		{"other.test", ""},
+	} {
+		body, err := sniGet(addr, c.serverName)
+		if c.body == "" && err == nil {
+			t.Fatalf("server name %s matches no tunnel but gets %q", c.serverName, body)
+		}
+		if c.body != "" && (err != nil || body != c.body) {
+			t.Fatalf("server name %s gets %q, error %v, want %q", c.serverName, body, err, c.body)
+		}
+	}
+
+	// 关闭一个隧道后端口仍由其余隧道使用
+	a.Close()
+	if body, err := sniGet(addr, "a.nps.test"); err != nil || body != "wildcard" {
+		t.Fatalf("after closing the exact tunnel, gets %q, error %v", body, err)
+	}
+	b.Close()
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("the port is not released after all tunnels are closed")
+	}
+}
@@ -3,11 +3,13 @@
 package proxy
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
 	"net"
 	"strconv"
+	"time"
 
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
@@ -186,6 +188,15 @@ func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8) {
 	// 构造目标地址
 	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
 	
+	// 按隧道的目标访问控制规则校验目标地址
+	dialAddr, err := s.checkDestAcl(addr)
+	if err != nil {
+		logs.Warn("socks5 tunnel %d from %s: %s", s.task.Id, c.RemoteAddr().String(), err.Error())
+		s.sendReply(c, notAllowed)
+		c.Close()
+		return
+	}
+
 	// 确定连接类型
 	var ltype string
 	if command == associateMethod {
@@ -197,7 +208,7 @@ func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8) {
 	// 处理客户端连接，建立隧道
 	s.DealClient(conn.NewConn(c), s.task.Client, addr, nil, ltype, func() {
 		s.sendReply(c, succeeded) // 连接成功后发送成功响应
-	}, s.task.Flow, s.task.Target.LocalProxy)
+	}, s.task.Flow, s.task.Target.LocalProxy, conn.LinkDialAddr(dialAddr))
 	return
 }
 
@@ -280,7 +291,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 	// 读取端口信息
 	var port uint16
 	binary.Read(c, binary.BigEndian, &port)
-	logs.Warn(host, string(port))
+	logs.Warn(host, strconv.Itoa(int(port)))
 	
 	// 创建本地UDP监听地址
 	replyAddr, err := net.ResolveUDPAddr("udp", s.task.ServerIp+":0")
@@ -316,6 +327,8 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 		b := common.BufPoolUdp.Get().([]byte)
 		defer common.BufPoolUdp.Put(b)
 		defer c.Close()
+		// 本次关联中各目的地址校验后的拨号地址，为空表示被拒绝
+		checked := common.NewVerdictCache()
 
 		for {
 			// 从UDP监听端口读取数据
@@ -328,6 +341,37 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 			if clientAddr == nil {
 				clientAddr = laddr
 			}
+			// 按隧道的目标访问控制规则校验数据包的目的地址，被拒绝的数据包直接丢弃
+			if s.task.DestAcl != nil {
+				dgram, err := common.ReadUDPDatagram(bytes.NewReader(b[:n]))
+				if err != nil {
+					continue
+				}
+				dst := dgram.Header.Addr.String()
+				dial, ok := checked.Get(dst, time.Now())
+				if !ok {
+					if dial, err = s.checkDestAcl(dst); err != nil {
+						logs.Warn("socks5 udp tunnel %d from %s: %s", s.task.Id, laddr.String(), err.Error())
+					}
+					checked.Set(dst, dial, time.Now())
+				}
+				if dial == "" {
+					continue
+				}
+				// 域名按 cidr 规则校验过时改写为校验过的 IP，避免客户端重新解析
+				if dial != dst {
+					host, _, _ := net.SplitHostPort(dial)
+					dgram.Header.Addr = &common.Addr{Type: ipV6, Host: host, Port: dgram.Header.Addr.Port}
+					if net.ParseIP(host).To4() != nil {
+						dgram.Header.Addr.Type = ipV4
+					}
+					if err := dgram.Write(target); err != nil {
+						logs.Error("write data to client error", err.Error())
+						return
+					}
+					continue
+				}
+			}
 			// 转发数据到客户端
 			if _, err := target.Write(b[:n]); err != nil {
 				logs.Error("write data to client error", err.Error())
@@ -501,6 +545,17 @@ func (s *Sock5ModeServer) Auth(c net.Conn) error {
 //   error - 启动错误信息，nil表示启动成功
 func (s *Sock5ModeServer) Start() error {
 	return conn.NewTcpListenerAndProcess(s.task.ServerIp+":"+strconv.Itoa(s.task.Port), func(c net.Conn) {
+		// 按全局黑名单与隧道的来源访问控制校验访问者
+		if err := checkSourceAcl(s.task.IpAcl, c.RemoteAddr().String()); err != nil {
+			logs.Info("task id %d, %s", s.task.Id, err.Error())
+			c.Close()
+			return
+		}
+		if err := checkSourceRate(s.task.RateLimit, c.RemoteAddr().String()); err != nil {
+			logs.Info("task id %d, %s", s.task.Id, err.Error())
+			c.Close()
+			return
+		}
 		// 检查客户端流量和连接数限制
 		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
 			logs.Warn("client id %d, task id %d, error %s, when socks5 connection", s.task.Client.Id, s.task.Id, err.Error())
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/file"
+)
+
+// newAclTask 创建一个带目标访问控制的隧道：允许 127.0.0.1，拒绝 nps.test 及其子域名，其余按默认策略拒绝
+func newAclTask(t *testing.T, mode string) *file.Tunnel {
+	acl, err := file.NewDestAcl("allow cidr 127.0.0.1\ndeny domain nps.test", file.AclDeny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &file.Tunnel{
+		Mode:    mode,
+		Flow:    new(file.Flow),
+		Client:  &file.Client{Id: 1 << 30, Status: true, Cnf: new(file.Config), Flow: new(file.Flow)},
+		Target:  new(file.Target),
+		DestAcl: acl,
+	}
+}
+
+// serveTest 在本地端口上接受连接并交给 handle 处理，返回监听地址
+func serveTest(t *testing.T, handle func(c net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// checkAclHits 校验每条规则与默认策略的命中次数，并校验序列化后的计数一致
+func checkAclHits(t *testing.T, acl *file.DestAcl, hits []int64, defaultHits int64) {
+	b, err := json.Marshal(acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v file.DestAcl
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range hits {
+		if i >= len(v.Hits) || v.Hits[i] != n {
+			t.Fatalf("rule hits are %v, want %v", v.Hits, hits)
+		}
+	}
+	if v.DefaultHits != defaultHits {
+		t.Fatalf("default hits are %d, want %d", v.DefaultHits, defaultHits)
+	}
+}
+
+// socks5Connect 经 socks5 代理以域名形式请求连接 host:port，返回应答中的 REP
+func socks5Connect(t *testing.T, proxyAddr, host string, port int) (net.Conn, byte) {
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte{5, 1, 0})
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil || buf[1] != 0 {
+		t.Fatalf("negotiation failed, reply %v, error %v", buf[:2], err)
+	}
+	req := append([]byte{5, connectMethod, 0, domainName, byte(len(host))}, host...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	c.Write(req)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	return c, buf[1]
+}
+
+// TestSocks5DestAcl 测试 socks5 按目标访问控制放行或以 notAllowed 应答拒绝，并累计命中次数
+func TestSocks5DestAcl(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	task := newAclTask(t, "socks5")
+	s := NewSock5ModeServer(&localBridge{}, task)
+	addr := serveTest(t, s.handleConn)
+
+	for _, c := range []struct {
+		host string
+		port int
+		rep  byte
+	}{
+		{"127.0.0.1", p, succeeded},
+		{"www.nps.test", 80, notAllowed},
+		{"192.0.2.1", 80, notAllowed},
+	} {
+		conn, rep := socks5Connect(t, addr, c.host, c.port)
+		if rep != c.rep {
+			conn.Close()
+			t.Fatalf("connect %s:%d, reply %d, want %d", c.host, c.port, rep, c.rep)
+		}
+		if rep == succeeded {
+			io.WriteString(conn, "GET / HTTP/1.1\r\nHost: echo\r\nConnection: close\r\n\r\n")
+			if b, _ := io.ReadAll(conn); !strings.HasSuffix(string(b), "ok") {
+				t.Fatalf("unexpected response through the tunnel: %q", b)
+			}
+		}
+		conn.Close()
+	}
+	checkAclHits(t, task.DestAcl, []int64{1, 1}, 1)
+}
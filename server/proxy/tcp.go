@@ -51,6 +51,18 @@ func (s *TunnelModeServer) Start() error {
 	
 	// 创建TCP监听器并处理连接
 	return conn.NewTcpListenerAndProcess(listenAddr, func(c net.Conn) {
+		// 按全局黑名单与隧道的来源访问控制校验访问者
+		if err := checkSourceAcl(s.task.IpAcl, c.RemoteAddr().String()); err != nil {
+			logs.Info("task id %d, %s", s.task.Id, err.Error())
+			c.Close()
+			return
+		}
+		if err := checkSourceRate(s.task.RateLimit, c.RemoteAddr().String()); err != nil {
+			logs.Info("task id %d, %s", s.task.Id, err.Error())
+			c.Close()
+			return
+		}
+
 		// 检查客户端的流量限制和连接数限制
 		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
 			logs.Warn("client id %d, task id %d,error %s, when tcp connection", s.task.Client.Id, s.task.Id, err.Error())
@@ -165,8 +177,8 @@ type process func(c *conn.Conn, s *TunnelModeServer) error
 //   s: 隧道模式服务器实例
 // 返回值: 处理过程中的错误信息，成功则返回nil
 func ProcessTunnel(c *conn.Conn, s *TunnelModeServer) error {
-	// 从目标配置中随机选择一个目标地址（支持负载均衡）
-	targetAddr, err := s.task.Target.GetRandomTarget()
+	// 按隧道的负载均衡策略选择目标地址
+	targetAddr, err := s.task.Target.SelectTarget(common.GetIpByAddr(c.RemoteAddr().String()), "")
 	if err != nil {
 		c.Close() // 获取目标地址失败，关闭连接
 		logs.Warn("tcp port %d ,client id %d,task id %d connect error %s", s.task.Port, s.task.Client.Id, s.task.Id, err.Error())
@@ -175,7 +187,10 @@ func ProcessTunnel(c *conn.Conn, s *TunnelModeServer) error {
 	
 	// 处理客户端连接，建立到目标服务器的隧道
 	// 参数说明：连接对象、客户端信息、目标地址、读取缓冲区、连接类型、额外数据、流量控制、本地代理设置
-	return s.DealClient(c, s.task.Client, targetAddr, nil, common.CONN_TCP, nil, s.task.Flow, s.task.Target.LocalProxy)
+	// 连接期间计入目标的活动连接数，供 least_conn 策略与 web 管理显示
+	s.task.Target.ConnOpen(targetAddr)
+	defer s.task.Target.ConnClose(targetAddr)
+	return s.DealClient(c, s.task.Client, targetAddr, nil, common.CONN_TCP, nil, s.task.Flow, s.task.Target.LocalProxy, conn.LinkFixedTarget())
 }
 
 // ProcessHttp HTTP代理处理函数
@@ -194,6 +209,20 @@ func ProcessHttp(c *conn.Conn, s *TunnelModeServer) error {
 		return err
 	}
 	
+	// 进行身份验证（如果配置了用户名和密码），需在 CONNECT 响应之前完成
+	if err := s.auth(r, c, s.task.Client.Cnf.U, s.task.Client.Cnf.P); err != nil {
+		return err // 身份验证失败
+	}
+
+	// 按隧道的目标访问控制规则校验目标地址，拒绝时返回403
+	dialAddr, err := s.checkDestAcl(addr)
+	if err != nil {
+		logs.Warn("http proxy tunnel %d from %s: %s", s.task.Id, c.RemoteAddr().String(), err.Error())
+		c.Write([]byte(common.ForbiddenBytes))
+		c.Close()
+		return err
+	}
+
 	// 处理HTTPS代理（HTTP CONNECT方法）
 	if r.Method == "CONNECT" {
 		// 发送连接建立成功响应
@@ -201,12 +230,7 @@ func ProcessHttp(c *conn.Conn, s *TunnelModeServer) error {
 		rb = nil // CONNECT方法不需要转发请求体
 	}
 	
-	// 进行身份验证（如果配置了用户名和密码）
-	if err := s.auth(r, c, s.task.Client.Cnf.U, s.task.Client.Cnf.P); err != nil {
-		return err // 身份验证失败
-	}
-	
 	// 处理客户端连接，建立到目标服务器的代理隧道
 	// 参数说明：连接对象、客户端信息、目标地址、请求缓冲区、连接类型、额外数据、流量控制、本地代理设置
-	return s.DealClient(c, s.task.Client, addr, rb, common.CONN_TCP, nil, s.task.Flow, s.task.Target.LocalProxy)
+	return s.DealClient(c, s.task.Client, addr, rb, common.CONN_TCP, nil, s.task.Flow, s.task.Target.LocalProxy, conn.LinkDialAddr(dialAddr))
 }
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/conn"
+)
+
+// TestHttpProxyDestAcl 测试 httpProxy 按目标访问控制放行普通请求与 CONNECT，拒绝时返回 403
+func TestHttpProxyDestAcl(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer echo.Close()
+
+	task := newAclTask(t, "httpProxy")
+	s := NewTunnelModeServer(ProcessHttp, &localBridge{}, task)
+	addr := serveTest(t, func(c net.Conn) { ProcessHttp(conn.NewConn(c), s) })
+
+	// 代理在连接建立时按第一个请求选择目标，每个请求使用新的连接
+	proxyUrl, _ := url.Parse("http://" + addr)
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+	for _, c := range []struct {
+		url    string
+		status int
+	}{
+		{echo.URL, http.StatusOK},
+		{"http://www.nps.test/", http.StatusForbidden},
+		{"http://192.0.2.1/", http.StatusForbidden},
+	} {
+		resp, err := client.Get(c.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Fatalf("get %s, status %d, want %d", c.url, resp.StatusCode, c.status)
+		}
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "CONNECT www.nps.test:443 HTTP/1.1\r\nHost: www.nps.test:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("connect is not denied, status %d", resp.StatusCode)
+	}
+	checkAclHits(t, task.DestAcl, []int64{1, 2}, 1)
+}
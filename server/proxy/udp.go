@@ -60,12 +60,21 @@ func (s *UdpModeServer) process(addr *net.UDPAddr, data []byte) {
 			s.task.Flow.Add(int64(len(data)), 0)
 		}
 	} else {
+		if err := checkSourceAcl(s.task.IpAcl, addr.String()); err != nil {
+			logs.Info("task id %d, %s", s.task.Id, err.Error())
+			return
+		}
+		if err := checkSourceRate(s.task.RateLimit, addr.String()); err != nil {
+			logs.Info("task id %d, %s", s.task.Id, err.Error())
+			return
+		}
 		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
 			logs.Warn("client id %d, task id %d,error %s, when udp connection", s.task.Client.Id, s.task.Id, err.Error())
 			return
 		}
 		defer s.task.Client.AddConn()
-		link := conn.NewLink(common.CONN_UDP, s.task.Target.TargetStr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, addr.String(), s.task.Target.LocalProxy)
+		link := conn.NewLink(common.CONN_UDP, s.task.Target.TargetStr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, addr.String(), s.task.Target.LocalProxy,
+			conn.LinkProxyProtocol(s.task.ProxyProtocol, s.listener.LocalAddr().String()), conn.LinkFixedTarget())
 		if clientConn, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task); err != nil {
 			return
 		} else {
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/astaxie/beego"
+)
+
+// 协议升级（WebSocket 等）的处理：请求带 Connection: Upgrade 且后端返回 101 后，
+// 该连接不再按 HTTP 报文解析，改为双向原样转发，流量计入域名解析，空闲超时后关闭。
+
+// upgradeIdleTimeout 读取 http_upgrade_idle_timeout（秒），未配置时为 10 分钟，0 表示不限制
+func upgradeIdleTimeout() time.Duration {
+	return time.Duration(beego.AppConfig.DefaultInt("http_upgrade_idle_timeout", 600)) * time.Second
+}
+
+// idleWatcher 在双向转发空闲超过 timeout 时关闭两端连接
+type idleWatcher struct {
+	last    int64 // 最近一次有数据的时间（UnixNano）
+	timeout time.Duration
+	closers []io.Closer
+	done    chan struct{}
+	once    sync.Once
+}
+
+// newIdleWatcher 创建并启动空闲检测，timeout 不大于 0 时不检测
+func newIdleWatcher(timeout time.Duration, closers ...io.Closer) *idleWatcher {
+	w := &idleWatcher{last: time.Now().UnixNano(), timeout: timeout, closers: closers, done: make(chan struct{})}
+	if timeout > 0 {
+		go w.watch()
+	}
+	return w
+}
+
+// watch 定时检查空闲时间
+func (w *idleWatcher) watch() {
+	interval := w.timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&w.last))) > w.timeout {
+				for _, c := range w.closers {
+					c.Close()
+				}
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// touch 记录一次数据传输
+func (w *idleWatcher) touch() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+// stop 停止空闲检测
+func (w *idleWatcher) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+// copyUpgraded 将 src 原样转发到 dst，每次写入后通过 count 统计流量，直到任一端出错
+func copyUpgraded(dst io.Writer, src io.Reader, w *idleWatcher, count func(n int64)) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			w.touch()
+			if _, e := dst.Write(buf[:n]); e != nil {
+				return e
+			}
+			count(int64(n))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
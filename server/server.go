@@ -21,6 +21,7 @@ import (
 
 	"ehang.io/nps/bridge"     // 桥接层，处理服务端与客户端通信
 	"ehang.io/nps/lib/common" // 通用工具函数
+	"ehang.io/nps/lib/conn"   // 连接与链路选项
 	"ehang.io/nps/lib/file"   // 文件操作和数据结构
 
 	// 邮件服务
@@ -97,6 +98,7 @@ func DealBridgeTask() {
 			if v, ok := file.GetDb().JsonDb.Clients.Load(id); ok {
 				if v.(*file.Client).NoStore {
 					file.GetDb().DelClient(id)
+					Bridge.DelTelemetry(id)
 				}
 			}
 		case tunnel := <-Bridge.OpenTask:
@@ -109,7 +111,7 @@ func DealBridgeTask() {
 			if t := file.GetDb().GetTaskByMd5Password(s.Password); t != nil {
 				if t.Status {
 					// 任务状态为开启，创建基础服务器处理连接
-					go proxy.NewBaseServer(Bridge, t).DealClient(s.Conn, t.Client, t.Target.TargetStr, nil, common.CONN_TCP, nil, t.Flow, t.Target.LocalProxy)
+					go proxy.NewBaseServer(Bridge, t).DealClient(s.Conn, t.Client, t.Target.TargetStr, nil, common.CONN_TCP, nil, t.Flow, t.Target.LocalProxy, conn.LinkFixedTarget())
 				} else {
 					// 任务状态为关闭，拒绝连接
 					s.Conn.Close()
@@ -134,6 +136,9 @@ func StartNewServer(bridgePort int, cnf *file.Tunnel, bridgeType string, bridgeD
 	// 创建桥接对象
 	Bridge = bridge.NewTunnel(bridgePort, bridgeType, common.GetBoolByStr(beego.AppConfig.String("ip_limit")), RunList, bridgeDisconnect)
 
+	// 按配置开启集群模式（需在启动任务之前，以便同步配置与按节点分配ID）
+	StartCluster()
+
 	// 启动桥接服务
 	go func() {
 		if err := Bridge.StartTunnel(); err != nil {
@@ -155,6 +160,11 @@ func StartNewServer(bridgePort int, cnf *file.Tunnel, bridgeType string, bridgeD
 	// 启动客户端流量处理协程
 	go dealClientFlow()
 
+	// 允许本地代理时，由服务端检查本地代理目标的健康状态
+	if beego.AppConfig.DefaultBool("allow_local_proxy", false) {
+		go localHealthCheck()
+	}
+
 	// 根据配置创建并启动对应的服务模式
 	if svr := NewMode(Bridge, cnf); svr != nil {
 		if err := svr.Start(); err != nil {
@@ -205,6 +215,9 @@ func NewMode(Bridge *bridge.Bridge, c *file.Tunnel) proxy.Service {
 	case "udp":
 		// UDP代理模式
 		service = proxy.NewUdpModeServer(Bridge, c)
+	case "tls-sni":
+		// 按 SNI 转发 TLS 连接，同一端口可由多个隧道共用
+		service = proxy.NewTlsSniServer(Bridge, c)
 	case "webServer":
 		// Web服务器模式
 		InitFromCsv() // 初始化所有任务
@@ -219,10 +232,8 @@ func NewMode(Bridge *bridge.Bridge, c *file.Tunnel) proxy.Service {
 		// HTTP主机服务器模式
 		httpPort, _ := beego.AppConfig.Int("http_proxy_port")          // HTTP代理端口
 		httpsPort, _ := beego.AppConfig.Int("https_proxy_port")        // HTTPS代理端口
-		useCache, _ := beego.AppConfig.Bool("http_cache")              // 是否使用缓存
-		cacheLen, _ := beego.AppConfig.Int("http_cache_length")        // 缓存长度
 		addOrigin, _ := beego.AppConfig.Bool("http_add_origin_header") // 是否添加Origin头
-		service = proxy.NewHttp(Bridge, c, httpPort, httpsPort, useCache, cacheLen, addOrigin)
+		service = proxy.NewHttp(Bridge, c, httpPort, httpsPort, addOrigin)
 	}
 	return service
 }
@@ -336,6 +347,18 @@ func DelTask(id int) error {
 	return file.GetDb().DelTask(id) // 从数据库删除任务
 }
 
+// TargetStats 返回目标的负载均衡状态，并附上最近一次主动健康检查的结果
+// owner 为隧道或域名解析（见 TunnelOwner、HostOwner），nps 未检查其目标时使用客户端上报的结果
+func TargetStats(clientId int, owner string, t *file.Target) []file.TargetStat {
+	stats := t.Stats()
+	for i := range stats {
+		if stats[i].Health = Bridge.GetHealthStat(clientId, owner, stats[i].Addr); stats[i].Health == nil {
+			stats[i].Health = Bridge.GetHealthStat(clientId, "", stats[i].Addr)
+		}
+	}
+	return stats
+}
+
 // GetTunnel 分页获取隧道列表
 // 参数：
 //   - start: 起始位置
@@ -411,6 +434,39 @@ func GetClientList(start, length int, search, sort, order string, clientId int)
 	return
 }
 
+// GetClientTelemetry 获取客户端上报的链路质量历史
+// 参数：
+//   - id: 客户端ID
+//
+// 返回：
+//   - 按时间先后排列的遥测样本，客户端从未上报时为空
+func GetClientTelemetry(id int) []*file.Telemetry {
+	return Bridge.GetTelemetry(id)
+}
+
+// SendClientCommand 向客户端下发管理命令并等待执行结果
+// 参数：
+//   - id: 客户端ID
+//   - name: 命令名称（version、config、log、restart、reload、test）
+//   - args: 命令参数
+//   - timeout: 超时时间（秒）
+//
+// 返回：
+//   - 命令记录（包含请求ID、状态与结果）与错误信息
+func SendClientCommand(id int, name, args string, timeout int) (*bridge.CommandRecord, error) {
+	return Bridge.SendCommand(id, name, args, timeout)
+}
+
+// GetClientCommands 获取下发给客户端的管理命令记录
+// 参数：
+//   - id: 客户端ID
+//
+// 返回：
+//   - 按下发先后排列的命令记录
+func GetClientCommands(id int) []bridge.CommandRecord {
+	return Bridge.GetCommands(id)
+}
+
 // dealClientData 处理客户端数据
 // 更新客户端连接状态、版本信息和流量统计
 func dealClientData() {
@@ -424,6 +480,17 @@ func dealClientData() {
 		} else {
 			v.IsConnect = false
 		}
+		v.ClusterNode = 0
+		if Cluster != nil && !v.IsConnect {
+			if v.ClusterNode = Cluster.Owner(v.Id); v.ClusterNode > 0 {
+				v.IsConnect = true // 客户端连接在集群中的其他节点
+			}
+		}
+		v.Telemetry = Bridge.GetLastTelemetry(v.Id) // 最近一次链路质量上报
+		if num, last, ok := Bridge.GetTargetDeny(v.Id); ok {
+			v.TargetDenyNum = num // 客户端本地白名单拒绝的连接
+			v.TargetDenyLast = time.Unix(last.Time, 0).Format("2006-01-02 15:04:05") + " " + last.ConnType + " " + last.Host + ": " + last.Reason
+		}
 
 		// 重置流量统计
 		v.Flow.InletFlow = 0
@@ -489,6 +556,7 @@ func DelTunnelAndHostByClientId(clientId int, justDelNoStore bool) {
 	})
 	for _, id := range ids {
 		file.GetDb().DelHost(id) // 删除主机配置
+		proxy.DelHttpCacheHost(id)
 	}
 }
 
@@ -572,6 +640,14 @@ func GetDashboardData() map[string]interface{} {
 	data["p2pPort"] = beego.AppConfig.String("p2p_port")
 	data["logLevel"] = beego.AppConfig.String("log_level")
 
+	// 即将过期的证书
+	data["certWarnings"] = proxy.ExpiringCerts(beego.AppConfig.DefaultInt("cert_expire_warn_days", 14))
+
+	// 响应缓存统计
+	if stats, ok := proxy.HttpCacheStats(0); ok {
+		data["httpCache"] = stats
+	}
+
 	// 统计TCP连接数
 	tcpCount := 0
 	file.GetDb().JsonDb.Clients.Range(func(key, value interface{}) bool {
@@ -62,8 +62,10 @@ func TestServerPort(p int, m string) (b bool) {
 			return false
 		}
 	}
-	// 根据协议类型进行相应的端口测试
-	if m == "udp" {
+	// 根据协议类型进行相应的端口测试，tls-sni 隧道可以共用端口，占用情况在启动时检查
+	if m == "tls-sni" {
+		b = true
+	} else if m == "udp" {
 		// 测试UDP端口是否可用
 		b = common.TestUdpPort(p)
 	} else {
@@ -84,6 +84,8 @@ func (s *BaseController) Prepare() {
 		s.Data["isAdmin"] = true
 	}
 	s.Data["https_just_proxy"], _ = beego.AppConfig.Bool("https_just_proxy")
+	s.Data["acme_enable"], _ = beego.AppConfig.Bool("acme_enable")
+	s.Data["http_cache"], _ = beego.AppConfig.Bool("http_cache")
 	s.Data["allow_user_login"], _ = beego.AppConfig.Bool("allow_user_login")
 	s.Data["allow_flow_limit"], _ = beego.AppConfig.Bool("allow_flow_limit")
 	s.Data["allow_rate_limit"], _ = beego.AppConfig.Bool("allow_rate_limit")
@@ -322,6 +324,10 @@ func (s *BaseController) CheckUserAuth() {
 		}
 	}
 	if s.controllerName == "index" {
+		if s.actionName == "global" || s.actionName == "banlist" || s.actionName == "unban" {
+			s.StopRun()
+			return
+		}
 		if id := s.GetIntNoErr("id"); id != 0 {
 			belong := false
 			if strings.Contains(s.actionName, "h") {
@@ -145,6 +145,82 @@ func (s *ClientController) GetClient() {
 	}
 }
 
+// Telemetry 客户端链路质量详情
+// GET请求：显示客户端链路质量详情页面（RTT、丢包率、复用流、资源占用等历史）
+// POST请求：返回客户端上报的链路质量历史JSON数据
+//
+// 请求参数：
+// - id: 客户端ID
+func (s *ClientController) Telemetry() {
+	id := s.GetIntNoErr("id")
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "client"
+		if c, err := file.GetDb().GetClient(id); err != nil {
+			s.error()
+			return
+		} else {
+			s.Data["c"] = c
+		}
+		s.SetInfo("telemetry")
+		s.display("client/telemetry")
+		return
+	}
+	data := make(map[string]interface{})
+	if _, err := file.GetDb().GetClient(id); err != nil {
+		data["code"] = 0 // 客户端不存在
+	} else {
+		data["code"] = 1
+		data["data"] = server.GetClientTelemetry(id) // 按时间先后排列的遥测样本
+	}
+	s.Data["json"] = data
+	s.ServeJSON()
+}
+
+// Command 客户端管理命令
+// GET请求：显示客户端管理命令页面
+// POST请求：向在线客户端下发管理命令并等待执行结果，返回命令记录
+//
+// POST请求参数：
+// - id: 客户端ID
+// - cmd: 命令名称，version/config/log/restart/reload/test
+// - args: 命令参数，log为行数，test为目标地址(host:port或http(s) URL)
+// - timeout: 超时时间，单位秒，空则为10秒
+func (s *ClientController) Command() {
+	id := s.GetIntNoErr("id")
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "client"
+		if c, err := file.GetDb().GetClient(id); err != nil {
+			s.error()
+			return
+		} else {
+			s.Data["c"] = c
+		}
+		s.SetInfo("command")
+		s.display("client/command")
+		return
+	}
+	data := make(map[string]interface{})
+	if record, err := server.SendClientCommand(id, s.getEscapeString("cmd"), s.GetString("args"), s.GetIntNoErr("timeout", 10)); err != nil {
+		data["code"] = 0
+		data["msg"] = err.Error()
+	} else {
+		data["code"] = 1
+		data["data"] = record
+	}
+	s.Data["json"] = data
+	s.ServeJSON()
+}
+
+// CommandList 获取客户端管理命令记录
+// POST请求：返回下发给客户端的管理命令及执行结果列表
+//
+// POST请求参数：
+// - id: 客户端ID
+func (s *ClientController) CommandList() {
+	list := server.GetClientCommands(s.GetIntNoErr("id"))
+	s.AjaxTable(list, len(list), len(list), nil)
+}
+
 // Edit 编辑客户端
 // GET请求：显示编辑客户端的表单页面，预填充现有数据
 // POST请求：处理编辑客户端的表单提交，更新客户端配置
@@ -286,6 +362,7 @@ func (s *ClientController) Del() {
 	
 	// 断开客户端的所有连接
 	server.DelClientConnect(id)
+	server.Bridge.DelTelemetry(id)
 	
 	s.AjaxOk("delete success")
 }
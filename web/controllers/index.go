@@ -3,8 +3,13 @@
 package controllers
 
 import (
+	"strings"
+
+	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/health"
 	"ehang.io/nps/server"
+	"ehang.io/nps/server/proxy"
 	"ehang.io/nps/server/tool"
 
 	"github.com/astaxie/beego"
@@ -70,6 +75,15 @@ func (s *IndexController) Http() {
 	s.display("index/list")
 }
 
+// TlsSni 显示 tls-sni 隧道管理页面
+// 列出所有按 SNI 转发 TLS 连接的隧道配置
+// URL: GET /index/tlssni
+func (s *IndexController) TlsSni() {
+	s.SetInfo("tls-sni")
+	s.SetType("tls-sni")
+	s.display("index/list")
+}
+
 // File 显示文件服务器管理页面
 // 列出所有文件服务器类型的隧道配置
 // URL: GET /index/file
@@ -123,7 +137,7 @@ func (s *IndexController) All() {
 // URL: POST /index/gettunnel
 // 参数:
 //   - client_id: 穿透隧道的客户端id
-//   - type: 类型tcp udp httpProx socks5 secret p2p
+//   - type: 类型tcp udp httpProx socks5 secret p2p tls-sni
 //   - search: 搜索
 //   - offset: 分页(第几页)
 //   - limit: 条数(分页显示的条数)
@@ -132,7 +146,13 @@ func (s *IndexController) GetTunnel() {
 	taskType := s.getEscapeString("type")
 	clientId := s.GetIntNoErr("client_id")
 	list, cnt := server.GetTunnel(start, length, taskType, clientId, s.getEscapeString("search"))
-	s.AjaxTable(list, cnt, cnt, nil)
+	stats := make(map[int][]file.TargetStat)
+	for _, t := range list {
+		if t.Target != nil && t.Client != nil {
+			stats[t.Id] = server.TargetStats(t.Client.Id, server.TunnelOwner(t.Id), t.Target)
+		}
+	}
+	s.AjaxTable(list, cnt, cnt, map[string]interface{}{"target_stats": stats})
 }
 
 // Add 添加新隧道
@@ -140,11 +160,22 @@ func (s *IndexController) GetTunnel() {
 // POST请求：处理隧道创建逻辑，包括端口检测、客户端验证、隧道数量限制等
 // URL: GET/POST /index/add
 // POST参数:
-//   - type: 类型tcp udp httpProx socks5 secret p2p
+//   - type: 类型tcp udp httpProx socks5 secret p2p tls-sni
 //   - remark: 备注
 //   - port: 服务端端口
-//   - target: 目标(ip:端口)
+//   - target: 目标(ip:端口)，每行一个，可带 weight=N
+//   - lb_strategy: 负载均衡策略 round_robin least_conn ip_hash
 //   - client_id: 客户端id
+//   - dest_acl: 目标访问控制规则，每行一条（socks5、httpProxy）
+//   - dest_acl_default: 未命中规则时的默认策略 allow 或 deny
+//   - sni_host: tls-sni 模式按 SNI 匹配的域名规则，多个以逗号分隔
+//   - ip_allow: 允许的访问者 IP 或 CIDR，逗号或换行分隔，为空时不限制
+//   - ip_deny: 拒绝的访问者 IP 或 CIDR，逗号或换行分隔
+//   - ip_rate: 每个访问者 IP 每秒允许的新建连接数，为 0 时不限制
+//   - ip_burst: 允许的突发连接数，为 0 时与 ip_rate 相同
+//   - ip_ban: 持续超出限制的访问者被封禁的秒数，为 0 时不封禁
+//   - proxy_protocol: npc 连接目标后发送的 PROXY protocol 版本 1 或 2，0 为不发送
+//   - health_check_type、health_check_interval 等: 本地代理时由 nps 执行的健康检查配置
 func (s *IndexController) Add() {
 	if s.Ctx.Request.Method == "GET" {
 		s.Data["type"] = s.getEscapeString("type")
@@ -156,19 +187,46 @@ func (s *IndexController) Add() {
 			Port:      s.GetIntNoErr("port"),
 			ServerIp:  s.getEscapeString("server_ip"),
 			Mode:      s.getEscapeString("type"),
-			Target:    &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: s.GetBoolNoErr("local_proxy")},
+			Target:    &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: s.GetBoolNoErr("local_proxy"), LbStrategy: s.getEscapeString("lb_strategy")},
 			Id:        int(file.GetDb().JsonDb.GetTaskId()),
 			Status:    true,
 			Remark:    s.getEscapeString("remark"),
 			Password:  s.getEscapeString("password"),
 			LocalPath: s.getEscapeString("local_path"),
 			StripPre:  s.getEscapeString("strip_pre"),
+			SniHost:   s.getEscapeString("sni_host"),
 			Flow:      &file.Flow{},
 		}
-		if !tool.TestServerPort(t.Port, t.Mode) {
+		if !tool.TestServerPort(t.Port, t.Mode) || (t.Mode == "tls-sni" && !proxy.SniPortAvailable(t.ServerIp, t.Port)) {
 			s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
 		}
+		if t.Mode == "tls-sni" {
+			if err := proxy.CheckSniHost(t.SniHost); err != nil {
+				s.AjaxErr(err.Error())
+			}
+		}
+		if err := file.CheckTargetStr(t.Target.TargetStr); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if err := file.CheckLbStrategy(t.Target.LbStrategy); err != nil {
+			s.AjaxErr(err.Error())
+		}
 		var err error
+		if t.DestAcl, err = s.getDestAcl(t.Mode); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if t.IpAcl, err = s.getIpAcl(nil); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if t.RateLimit, err = s.getRateLimit(nil); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if t.ProxyProtocol = s.GetIntNoErr("proxy_protocol"); conn.CheckProxyProtocol(t.ProxyProtocol) != nil {
+			s.AjaxErr(conn.CheckProxyProtocol(t.ProxyProtocol).Error())
+		}
+		if err = s.setHealth(&t.Health, t.Target); err != nil {
+			s.AjaxErr(err.Error())
+		}
 		if t.Client, err = file.GetDb().GetClient(s.GetIntNoErr("client_id")); err != nil {
 			s.AjaxErr(err.Error())
 		}
@@ -210,12 +268,23 @@ func (s *IndexController) GetOneTunnel() {
 // POST请求：处理隧道更新逻辑，包括端口变更检测、配置更新、服务重启等
 // URL: GET/POST /index/edit
 // POST参数:
-//   - type: 类型tcp udp httpProx socks5 secret p2p
+//   - type: 类型tcp udp httpProx socks5 secret p2p tls-sni
 //   - remark: 备注
 //   - port: 服务端端口
-//   - target: 目标(ip:端口)
+//   - target: 目标(ip:端口)，每行一个，可带 weight=N
+//   - lb_strategy: 负载均衡策略 round_robin least_conn ip_hash
 //   - client_id: 客户端id
 //   - id: 隧道id
+//   - dest_acl: 目标访问控制规则，每行一条（socks5、httpProxy）
+//   - dest_acl_default: 未命中规则时的默认策略 allow 或 deny
+//   - sni_host: tls-sni 模式按 SNI 匹配的域名规则，多个以逗号分隔
+//   - ip_allow: 允许的访问者 IP 或 CIDR，逗号或换行分隔，为空时不限制
+//   - ip_deny: 拒绝的访问者 IP 或 CIDR，逗号或换行分隔
+//   - ip_rate: 每个访问者 IP 每秒允许的新建连接数，为 0 时不限制
+//   - ip_burst: 允许的突发连接数，为 0 时与 ip_rate 相同
+//   - ip_ban: 持续超出限制的访问者被封禁的秒数，为 0 时不封禁
+//   - proxy_protocol: npc 连接目标后发送的 PROXY protocol 版本 1 或 2，0 为不发送
+//   - health_check_type、health_check_interval 等: 本地代理时由 nps 执行的健康检查配置
 func (s *IndexController) Edit() {
 	id := s.GetIntNoErr("id")
 	if s.Ctx.Request.Method == "GET" {
@@ -236,8 +305,22 @@ func (s *IndexController) Edit() {
 			} else {
 				t.Client = client
 			}
+			if s.getEscapeString("type") == "tls-sni" {
+				if err := proxy.CheckSniHost(s.getEscapeString("sni_host")); err != nil {
+					s.AjaxErr(err.Error())
+					return
+				}
+			}
+			if err := file.CheckTargetStr(s.getEscapeString("target")); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
+			if err := file.CheckLbStrategy(s.getEscapeString("lb_strategy")); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
 			if s.GetIntNoErr("port") != t.Port {
-				if !tool.TestServerPort(s.GetIntNoErr("port"), t.Mode) {
+				if !tool.TestServerPort(s.GetIntNoErr("port"), t.Mode) || (s.getEscapeString("type") == "tls-sni" && !proxy.SniPortAvailable(s.getEscapeString("server_ip"), s.GetIntNoErr("port"))) {
 					s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
 					return
 				}
@@ -245,13 +328,43 @@ func (s *IndexController) Edit() {
 			}
 			t.ServerIp = s.getEscapeString("server_ip")
 			t.Mode = s.getEscapeString("type")
-			t.Target = &file.Target{TargetStr: s.getEscapeString("target")}
+			t.Target = &file.Target{TargetStr: s.getEscapeString("target"), LbStrategy: s.getEscapeString("lb_strategy")}
 			t.Password = s.getEscapeString("password")
 			t.Id = id
 			t.LocalPath = s.getEscapeString("local_path")
 			t.StripPre = s.getEscapeString("strip_pre")
+			t.SniHost = s.getEscapeString("sni_host")
 			t.Remark = s.getEscapeString("remark")
 			t.Target.LocalProxy = s.GetBoolNoErr("local_proxy")
+			if err := s.setHealth(&t.Health, t.Target); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
+			if acl, err := s.getDestAcl(t.Mode); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			} else if acl == nil || t.DestAcl == nil || acl.Rules != t.DestAcl.Rules {
+				t.DestAcl = acl
+			} else {
+				t.DestAcl.SetDefault(acl.Default) // 规则未变化时保留命中计数
+			}
+			if acl, err := s.getIpAcl(t.IpAcl); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			} else {
+				t.IpAcl = acl
+			}
+			if limit, err := s.getRateLimit(t.RateLimit); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			} else {
+				t.RateLimit = limit
+			}
+			if err := conn.CheckProxyProtocol(s.GetIntNoErr("proxy_protocol")); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
+			t.ProxyProtocol = s.GetIntNoErr("proxy_protocol")
 			file.GetDb().UpdateTask(t)
 			server.StopServer(t.Id)
 			server.StartTask(t.Id)
@@ -260,6 +373,83 @@ func (s *IndexController) Edit() {
 	}
 }
 
+// getDestAcl 从表单解析目标访问控制规则，仅 socks5、httpProxy 模式有效
+// 未填写规则且默认策略为允许时返回nil
+func (s *IndexController) getDestAcl(mode string) (*file.DestAcl, error) {
+	if mode != "socks5" && mode != "httpProxy" {
+		return nil, nil
+	}
+	rules, def := s.GetString("dest_acl"), s.getEscapeString("dest_acl_default")
+	if strings.TrimSpace(rules) == "" && def != file.AclDeny {
+		return nil, nil
+	}
+	return file.NewDestAcl(rules, def)
+}
+
+// getIpAcl 从表单解析访问者来源 IP 的允许与拒绝列表，都未填写时返回nil
+// 列表与 old 相同时返回 old，保留拒绝计数
+func (s *IndexController) getIpAcl(old *file.IpAcl) (*file.IpAcl, error) {
+	acl, err := file.NewIpAcl(s.GetString("ip_allow"), s.GetString("ip_deny"))
+	if err != nil {
+		return nil, err
+	}
+	if acl != nil && old != nil && acl.Allow == old.Allow && acl.Deny == old.Deny {
+		return old, nil
+	}
+	return acl, nil
+}
+
+// getRateLimit 从表单解析按访问者 IP 的速率限制，未设置速率时返回nil
+// 配置与 old 相同时返回 old，保留计数与封禁状态
+func (s *IndexController) getRateLimit(old *file.RateLimit) (*file.RateLimit, error) {
+	rate, burst, ban := s.GetIntNoErr("ip_rate"), s.GetIntNoErr("ip_burst"), s.GetIntNoErr("ip_ban")
+	if old.Same(rate, burst, ban) {
+		return old, nil
+	}
+	return file.NewRateLimit(rate, burst, ban)
+}
+
+// setHealth 从表单解析由 nps 检查本地代理目标的健康检查配置，并清除原有的检查状态
+func (s *IndexController) setHealth(h *file.Health, t *file.Target) error {
+	n := &file.Health{
+		HealthCheckType:       s.getEscapeString("health_check_type"),
+		HealthCheckTimeout:    s.GetIntNoErr("health_check_timeout"),
+		HealthMaxFail:         s.GetIntNoErr("health_check_max_failed"),
+		HealthCheckInterval:   s.GetIntNoErr("health_check_interval"),
+		HttpHealthUrl:         s.GetString("health_http_url"),
+		HealthCheckStatus:     s.getEscapeString("health_check_status"),
+		HealthCheckHeader:     s.GetString("health_check_header"),
+		HealthCheckBody:       s.GetString("health_check_body"),
+		HealthCheckBodyRegex:  s.GetString("health_check_body_regex"),
+		HealthCheckSkipVerify: s.GetBoolNoErr("health_check_skip_verify"),
+		HealthCheckSni:        s.getEscapeString("health_check_sni"),
+		HealthCheckSend:       s.GetString("health_check_send"),
+		HealthCheckDnsName:    s.getEscapeString("health_check_dns_name"),
+		HealthCheckTarget:     s.getEscapeString("health_check_target"),
+	}
+	if err := health.CheckHealth(n); err != nil {
+		return err
+	}
+	h.Lock()
+	h.HealthCheckType = n.HealthCheckType
+	h.HealthCheckTimeout = n.HealthCheckTimeout
+	h.HealthMaxFail = n.HealthMaxFail
+	h.HealthCheckInterval = n.HealthCheckInterval
+	h.HttpHealthUrl = n.HttpHealthUrl
+	h.HealthCheckStatus = n.HealthCheckStatus
+	h.HealthCheckHeader = n.HealthCheckHeader
+	h.HealthCheckBody = n.HealthCheckBody
+	h.HealthCheckBodyRegex = n.HealthCheckBodyRegex
+	h.HealthCheckSkipVerify = n.HealthCheckSkipVerify
+	h.HealthCheckSni = n.HealthCheckSni
+	h.HealthCheckSend = n.HealthCheckSend
+	h.HealthCheckDnsName = n.HealthCheckDnsName
+	h.HealthCheckTarget = n.HealthCheckTarget
+	h.ResetHealth(t)
+	h.Unlock()
+	return nil
+}
+
 // Stop 停止指定隧道服务
 // 根据隧道ID停止对应的隧道服务，但保留配置信息
 // URL: POST /index/stop
@@ -317,7 +507,11 @@ func (s *IndexController) HostList() {
 		start, length := s.GetAjaxParams()
 		clientId := s.GetIntNoErr("client_id")
 		list, cnt := file.GetDb().GetHost(start, length, clientId, s.getEscapeString("search"))
-		s.AjaxTable(list, cnt, cnt, nil)
+		stats := make(map[int][]file.TargetStat)
+		for _, h := range list {
+			stats[h.Id] = server.TargetStats(h.Client.Id, server.HostOwner(h.Id), h.Target)
+		}
+		s.AjaxTable(list, cnt, cnt, map[string]interface{}{"target_stats": stats})
 	}
 }
 
@@ -351,9 +545,97 @@ func (s *IndexController) DelHost() {
 	if err := file.GetDb().DelHost(id); err != nil {
 		s.AjaxErr("delete error")
 	}
+	proxy.DelHttpCacheHost(id)
 	s.AjaxOk("delete success")
 }
 
+// PurgeCache 清除域名解析的响应缓存
+// URL: POST /index/purgecache
+// 参数:
+//   - id: 域名解析id，为 0 或不填时清除所有域名解析的缓存
+//   - path: 只清除以此开头的请求路径，不填时清除全部
+func (s *IndexController) PurgeCache() {
+	id := s.GetIntNoErr("id")
+	if id == 0 && s.Data["isAdmin"] != true {
+		s.AjaxErr("purge error, the host id is required")
+	}
+	if id != 0 {
+		if _, err := file.GetDb().GetHostById(id); err != nil {
+			s.AjaxErr("the host can not be found")
+		}
+	}
+	proxy.PurgeHttpCache(id, s.GetString("path"))
+	s.AjaxOk("purge success")
+}
+
+// CacheStats 获取响应缓存的命中统计（AJAX接口）
+// 未开启 http_cache 时 code 为 0，普通用户只能查询自己的域名解析
+// URL: POST /index/cachestats
+// 参数:
+//   - id: 域名解析id，为 0 或不填时返回所有域名解析的汇总
+func (s *IndexController) CacheStats() {
+	data := make(map[string]interface{})
+	id := s.GetIntNoErr("id")
+	if id == 0 && s.Data["isAdmin"] != true {
+		data["code"] = 0
+	} else if stats, ok := proxy.HttpCacheStats(id); ok {
+		data["data"] = stats
+		data["code"] = 1
+	} else {
+		data["code"] = 0
+	}
+	s.Data["json"] = data
+	s.ServeJSON()
+}
+
+// Global 全局配置，仅管理员可用
+// GET请求：显示全局黑名单及其拒绝次数，以及因超出速率限制被封禁的访问者
+// POST请求：保存全局黑名单，对所有隧道与域名解析立即生效
+// URL: GET/POST /index/global
+// POST参数:
+//   - blocklist: 全局黑名单，访问者 IP 或 CIDR，逗号或换行分隔
+func (s *IndexController) Global() {
+	if s.Data["isAdmin"] != true {
+		s.StopRun()
+	}
+	g := file.GetDb().JsonDb.Global
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["blocklist"] = g.BlockList
+		s.Data["deny_hits"] = g.DenyHits()
+		s.Data["banned"] = file.GetDb().GetBannedList()
+		s.SetInfo("global")
+		s.display("index/global")
+	} else {
+		if err := g.SetBlockList(s.GetString("blocklist")); err != nil {
+			s.AjaxErr("modified error, " + err.Error())
+		}
+		file.GetDb().JsonDb.StoreGlobalToJsonFile()
+		s.AjaxOk("modified success")
+	}
+}
+
+// BanList 获取因超出速率限制被封禁的访问者（AJAX接口），仅管理员可用
+// URL: POST /index/banlist
+func (s *IndexController) BanList() {
+	if s.Data["isAdmin"] != true {
+		s.StopRun()
+	}
+	s.Data["json"] = map[string]interface{}{"code": 1, "data": file.GetDb().GetBannedList()}
+	s.ServeJSON()
+}
+
+// Unban 解除访问者的封禁，仅管理员可用
+// URL: POST /index/unban
+// 参数:
+//   - ip: 访问者 IP，不填时解除全部封禁
+func (s *IndexController) Unban() {
+	if s.Data["isAdmin"] != true {
+		s.StopRun()
+	}
+	file.GetDb().Unban(strings.TrimSpace(s.GetString("ip")))
+	s.AjaxOk("unban success")
+}
+
 // AddHost 添加新主机配置
 // GET请求：显示添加主机的表单页面
 // POST请求：处理主机创建逻辑，包括主机域名、目标地址、SSL证书等配置
@@ -364,9 +646,34 @@ func (s *IndexController) DelHost() {
 //   - scheme: 协议类型(三种 all http https)
 //   - location: url路由 空则为不限制
 //   - client_id: 客户端id
-//   - target: 内网目标(ip:端口)
+//   - target: 内网目标(ip:端口)，每行一个，可带 weight=N
+//   - lb_strategy: 负载均衡策略 round_robin least_conn ip_hash cookie
 //   - header: request header 请求头
 //   - hostchange: request host 请求主机
+//   - cert_content: 粘贴的 PEM 证书，优先于证书文件
+//   - key_content: 粘贴的 PEM 私钥
+//   - http2: 是否与访问者协商 HTTP/2
+//   - h2c_target: 是否以 h2c 连接后端
+//   - auto_cert: 是否通过 ACME 自动申请证书
+//   - cache: 是否缓存后端响应（需开启 http_cache）
+//   - http_compress: 是否以 gzip/brotli 压缩响应
+//   - rules: 路由规则，每行一条
+//   - resp_header: 响应头修改规则，每行一条
+//   - maintenance: 是否处于维护状态
+//   - error_page: 自定义错误页面（HTML 模板）
+//   - health_check_type、health_check_interval 等: 本地代理时由 nps 执行的健康检查配置
+//   - auth_users: 认证用户，每行一个 用户名:密码，密码以 bcrypt 哈希保存
+//   - auth_tokens: Bearer 认证令牌，每行一个
+//   - auth_bypass: 免认证的访问者 IP 或 CIDR
+//   - auth_cookie_hours: 登录 Cookie 的有效小时数，为 0 时不下发
+//   - forward_auth: 外部认证服务的地址
+//   - auth_resp_headers: 外部认证通过时复制到请求的认证服务响应头，逗号分隔
+//   - ip_allow: 允许的访问者 IP 或 CIDR，逗号或换行分隔，为空时不限制
+//   - ip_deny: 拒绝的访问者 IP 或 CIDR，逗号或换行分隔
+//   - ip_rate: 每个访问者 IP 每秒允许的请求数，为 0 时不限制
+//   - ip_burst: 允许的突发请求数，为 0 时与 ip_rate 相同
+//   - ip_ban: 持续超出限制的访问者被封禁的秒数，为 0 时不封禁
+//   - proxy_protocol: npc 连接目标后发送的 PROXY protocol 版本 1 或 2，0 为不发送
 func (s *IndexController) AddHost() {
 	if s.Ctx.Request.Method == "GET" {
 		s.Data["client_id"] = s.getEscapeString("client_id")
@@ -375,19 +682,70 @@ func (s *IndexController) AddHost() {
 		s.display("index/hadd")
 	} else {
 		h := &file.Host{
-			Id:           int(file.GetDb().JsonDb.GetHostId()),
-			Host:         s.getEscapeString("host"),
-			Target:       &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: s.GetBoolNoErr("local_proxy")},
-			HeaderChange: s.getEscapeString("header"),
-			HostChange:   s.getEscapeString("hostchange"),
-			Remark:       s.getEscapeString("remark"),
-			Location:     s.getEscapeString("location"),
-			Flow:         &file.Flow{},
-			Scheme:       s.getEscapeString("scheme"),
-			KeyFilePath:  s.getEscapeString("key_file_path"),
-			CertFilePath: s.getEscapeString("cert_file_path"),
+			Id:               int(file.GetDb().JsonDb.GetHostId()),
+			Host:             s.getEscapeString("host"),
+			Target:           &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: s.GetBoolNoErr("local_proxy"), LbStrategy: s.getEscapeString("lb_strategy")},
+			HeaderChange:     s.getEscapeString("header"),
+			HostChange:       s.getEscapeString("hostchange"),
+			Remark:           s.getEscapeString("remark"),
+			Location:         s.getEscapeString("location"),
+			Flow:             &file.Flow{},
+			Scheme:           s.getEscapeString("scheme"),
+			KeyFilePath:      s.getEscapeString("key_file_path"),
+			CertFilePath:     s.getEscapeString("cert_file_path"),
+			Http2:            s.GetBoolNoErr("http2"),
+			H2cTarget:        s.GetBoolNoErr("h2c_target"),
+			AutoCert:         s.GetBoolNoErr("auto_cert"),
+			Cache:            s.GetBoolNoErr("cache"),
+			HttpCompress:     s.GetBoolNoErr("http_compress"),
+			Rules:            strings.TrimSpace(s.GetString("rules")),
+			RespHeaderChange: strings.TrimSpace(s.GetString("resp_header")),
+			Maintenance:      s.GetBoolNoErr("maintenance"),
+			ErrorPage:        strings.TrimSpace(s.GetString("error_page")),
+			ForwardAuth:      strings.TrimSpace(s.GetString("forward_auth")),
+			AuthRespHeaders:  strings.TrimSpace(s.GetString("auth_resp_headers")),
+			CertContent:      strings.TrimSpace(s.GetString("cert_content")),
+			KeyContent:       strings.TrimSpace(s.GetString("key_content")),
+		}
+		if h.CertContent != "" || h.KeyContent != "" {
+			if err := proxy.CheckKeyPair(h.CertContent, h.KeyContent); err != nil {
+				s.AjaxErr("add fail, the certificate is invalid " + err.Error())
+			}
+		}
+		if err := file.CheckTargetStr(h.Target.TargetStr); err != nil {
+			s.AjaxErr("add fail, " + err.Error())
+		}
+		if err := file.CheckLbStrategy(h.Target.LbStrategy); err != nil {
+			s.AjaxErr("add fail, " + err.Error())
+		}
+		if err := proxy.CheckHostRules(h.Rules); err != nil {
+			s.AjaxErr("add fail, " + err.Error())
+		}
+		if err := proxy.CheckResponseHeader(h.RespHeaderChange); err != nil {
+			s.AjaxErr("add fail, " + err.Error())
+		}
+		if err := proxy.CheckErrorPage(h.ErrorPage); err != nil {
+			s.AjaxErr("add fail, the error page is invalid " + err.Error())
+		}
+		if err := file.CheckForwardAuth(h.ForwardAuth, h.AuthRespHeaders, beego.AppConfig.String("forward_auth_allow"), s.Data["isAdmin"] == true); err != nil {
+			s.AjaxErr("add fail, " + err.Error())
+		}
+		if err := s.setHealth(&h.Health, h.Target); err != nil {
+			s.AjaxErr("add fail, " + err.Error())
+		}
+		if err := h.SetAuth(s.GetString("auth_users"), s.GetString("auth_tokens"), s.GetString("auth_bypass"), s.GetIntNoErr("auth_cookie_hours")); err != nil {
+			s.AjaxErr("add fail, " + err.Error())
 		}
 		var err error
+		if h.IpAcl, err = s.getIpAcl(nil); err != nil {
+			s.AjaxErr("add fail, " + err.Error())
+		}
+		if h.RateLimit, err = s.getRateLimit(nil); err != nil {
+			s.AjaxErr("add fail, " + err.Error())
+		}
+		if h.ProxyProtocol = s.GetIntNoErr("proxy_protocol"); conn.CheckProxyProtocol(h.ProxyProtocol) != nil {
+			s.AjaxErr("add fail, " + conn.CheckProxyProtocol(h.ProxyProtocol).Error())
+		}
 		if h.Client, err = file.GetDb().GetClient(s.GetIntNoErr("client_id")); err != nil {
 			s.AjaxErr("add error the client can not be found")
 		}
@@ -408,9 +766,34 @@ func (s *IndexController) AddHost() {
 //   - scheme: 协议类型(三种 all http https)
 //   - location: url路由 空则为不限制
 //   - client_id: 客户端id
-//   - target: 内网目标(ip:端口)
+//   - target: 内网目标(ip:端口)，每行一个，可带 weight=N
+//   - lb_strategy: 负载均衡策略 round_robin least_conn ip_hash cookie
 //   - header: request header 请求头
 //   - hostchange: request host 请求主机
+//   - cert_content: 粘贴的 PEM 证书，优先于证书文件
+//   - key_content: 粘贴的 PEM 私钥
+//   - http2: 是否与访问者协商 HTTP/2
+//   - h2c_target: 是否以 h2c 连接后端
+//   - auto_cert: 是否通过 ACME 自动申请证书
+//   - cache: 是否缓存后端响应（需开启 http_cache）
+//   - http_compress: 是否以 gzip/brotli 压缩响应
+//   - rules: 路由规则，每行一条
+//   - resp_header: 响应头修改规则，每行一条
+//   - maintenance: 是否处于维护状态
+//   - error_page: 自定义错误页面（HTML 模板）
+//   - health_check_type、health_check_interval 等: 本地代理时由 nps 执行的健康检查配置
+//   - auth_users: 认证用户，每行一个 用户名:密码，已是 bcrypt 哈希的保持不变
+//   - auth_tokens: Bearer 认证令牌，每行一个
+//   - auth_bypass: 免认证的访问者 IP 或 CIDR
+//   - auth_cookie_hours: 登录 Cookie 的有效小时数，为 0 时不下发
+//   - forward_auth: 外部认证服务的地址
+//   - auth_resp_headers: 外部认证通过时复制到请求的认证服务响应头，逗号分隔
+//   - ip_allow: 允许的访问者 IP 或 CIDR，逗号或换行分隔，为空时不限制
+//   - ip_deny: 拒绝的访问者 IP 或 CIDR，逗号或换行分隔
+//   - ip_rate: 每个访问者 IP 每秒允许的请求数，为 0 时不限制
+//   - ip_burst: 允许的突发请求数，为 0 时与 ip_rate 相同
+//   - ip_ban: 持续超出限制的访问者被封禁的秒数，为 0 时不封禁
+//   - proxy_protocol: npc 连接目标后发送的 PROXY protocol 版本 1 或 2，0 为不发送
 //   - id: 需要修改的域名解析id
 func (s *IndexController) EditHost() {
 	id := s.GetIntNoErr("id")
@@ -427,6 +810,50 @@ func (s *IndexController) EditHost() {
 		if h, err := file.GetDb().GetHostById(id); err != nil {
 			s.error()
 		} else {
+			certContent := strings.TrimSpace(s.GetString("cert_content"))
+			keyContent := strings.TrimSpace(s.GetString("key_content"))
+			if certContent != "" || keyContent != "" {
+				if err := proxy.CheckKeyPair(certContent, keyContent); err != nil {
+					s.AjaxErr("modified error, the certificate is invalid " + err.Error())
+				}
+			}
+			if err := file.CheckTargetStr(s.getEscapeString("target")); err != nil {
+				s.AjaxErr("modified error, " + err.Error())
+			}
+			if err := file.CheckLbStrategy(s.getEscapeString("lb_strategy")); err != nil {
+				s.AjaxErr("modified error, " + err.Error())
+			}
+			rules := strings.TrimSpace(s.GetString("rules"))
+			if err := proxy.CheckHostRules(rules); err != nil {
+				s.AjaxErr("modified error, " + err.Error())
+			}
+			respHeader := strings.TrimSpace(s.GetString("resp_header"))
+			if err := proxy.CheckResponseHeader(respHeader); err != nil {
+				s.AjaxErr("modified error, " + err.Error())
+			}
+			errorPage := strings.TrimSpace(s.GetString("error_page"))
+			if err := proxy.CheckErrorPage(errorPage); err != nil {
+				s.AjaxErr("modified error, the error page is invalid " + err.Error())
+			}
+			forwardAuth := strings.TrimSpace(s.GetString("forward_auth"))
+			authRespHeaders := strings.TrimSpace(s.GetString("auth_resp_headers"))
+			//an unchanged url set by an admin is kept when a user edits the host
+			admin := s.Data["isAdmin"] == true || forwardAuth == h.ForwardAuth
+			if err := file.CheckForwardAuth(forwardAuth, authRespHeaders, beego.AppConfig.String("forward_auth_allow"), admin); err != nil {
+				s.AjaxErr("modified error, " + err.Error())
+			}
+			ipAcl, err := s.getIpAcl(h.IpAcl)
+			if err != nil {
+				s.AjaxErr("modified error, " + err.Error())
+			}
+			rateLimit, err := s.getRateLimit(h.RateLimit)
+			if err != nil {
+				s.AjaxErr("modified error, " + err.Error())
+			}
+			proxyProtocol := s.GetIntNoErr("proxy_protocol")
+			if err := conn.CheckProxyProtocol(proxyProtocol); err != nil {
+				s.AjaxErr("modified error, " + err.Error())
+			}
 			if h.Host != s.getEscapeString("host") {
 				tmpHost := new(file.Host)
 				tmpHost.Host = s.getEscapeString("host")
@@ -443,7 +870,7 @@ func (s *IndexController) EditHost() {
 				h.Client = client
 			}
 			h.Host = s.getEscapeString("host")
-			h.Target = &file.Target{TargetStr: s.getEscapeString("target")}
+			h.Target = &file.Target{TargetStr: s.getEscapeString("target"), LbStrategy: s.getEscapeString("lb_strategy")}
 			h.HeaderChange = s.getEscapeString("header")
 			h.HostChange = s.getEscapeString("hostchange")
 			h.Remark = s.getEscapeString("remark")
@@ -452,7 +879,31 @@ func (s *IndexController) EditHost() {
 			h.KeyFilePath = s.getEscapeString("key_file_path")
 			h.CertFilePath = s.getEscapeString("cert_file_path")
 			h.Target.LocalProxy = s.GetBoolNoErr("local_proxy")
+			if err := s.setHealth(&h.Health, h.Target); err != nil {
+				s.AjaxErr("modified error, " + err.Error())
+			}
+			if err := h.SetAuth(s.GetString("auth_users"), s.GetString("auth_tokens"), s.GetString("auth_bypass"), s.GetIntNoErr("auth_cookie_hours")); err != nil {
+				s.AjaxErr("modified error, " + err.Error())
+			}
+			h.Http2 = s.GetBoolNoErr("http2")
+			h.H2cTarget = s.GetBoolNoErr("h2c_target")
+			h.AutoCert = s.GetBoolNoErr("auto_cert")
+			h.Cache = s.GetBoolNoErr("cache")
+			h.HttpCompress = s.GetBoolNoErr("http_compress")
+			h.Rules = rules
+			h.RespHeaderChange = respHeader
+			h.Maintenance = s.GetBoolNoErr("maintenance")
+			h.ErrorPage = errorPage
+			h.ForwardAuth = forwardAuth
+			h.AuthRespHeaders = authRespHeaders
+			h.IpAcl = ipAcl
+			h.RateLimit = rateLimit
+			h.ProxyProtocol = proxyProtocol
+			h.CertContent = certContent
+			h.KeyContent = keyContent
 			file.GetDb().JsonDb.StoreHostToJsonFile()
+			// 目标或域名可能已修改，清除原有的缓存
+			proxy.PurgeHttpCache(h.Id, "")
 		}
 		s.AjaxOk("modified success")
 	}
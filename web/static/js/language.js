@@ -243,7 +243,7 @@ function langreply(langstr) {
 
 /**
  * 通用表单提交函数，支持多语言确认对话框
- * @param {string} action - 操作类型：'start'|'stop'|'delete'|'add'|'edit'
+ * @param {string} action - 操作类型：'start'|'stop'|'delete'|'purgecache'|'unban'|'add'|'edit'
  * @param {string} url - 提交的URL地址
  * @param {Array} postdata - 表单数据数组
  */
@@ -254,6 +254,8 @@ function submitform(action, url, postdata) {
         case 'start':
         case 'stop':
         case 'delete':
+        case 'purgecache':
+        case 'unban':
             // 危险操作需要用户确认
             var langobj = languages['content']['confirm'][action];
             // 获取确认消息的多语言版本